@@ -11,25 +11,45 @@ import (
 )
 
 var cliUsage = `
-Usage: %s [--inject|--proxy|--webhook]
+Usage: %s [--inject|--explain|--proxy|--webhook|--combined|--wait-for-proxy|--routes|--print-ca|--print-webhook-config]
   --inject   Inject MCA sidecar into Pod manifest (stdin/stdout)
+             --output=json|yaml overrides the output format (default: same as input)
+             --minimal-diff keeps the layout, comments and unknown fields of YAML input
+  --explain  Show the JSON patch, merge patch and final Pod for a Pod manifest (stdin/stdout)
   --proxy    Start MCA proxy server
   --webhook  Start MCA webhook server
+  --combined Start MCA webhook and proxy servers in a single process
+  --wait-for-proxy  Wait until the MCA proxy listens (legacy sidecar postStart hook)
+  --routes   Print the proxy's cluster routing table, without credentials
+  --print-ca Print the webhook's CA certificate as PEM (loaded when managed externally)
+  --print-webhook-config  Print the MutatingWebhookConfiguration matching the webhook's settings
 `
 
 func main() {
 	var (
-		injectFlag  = flag.Bool("inject", false, "Inject MCA sidecar into Pod manifest")
-		proxyFlag   = flag.Bool("proxy", false, "Start MCA proxy server")
-		webhookFlag = flag.Bool("webhook", false, "Start MCA webhook server")
+		injectFlag   = flag.Bool("inject", false, "Inject MCA sidecar into Pod manifest")
+		explainFlag  = flag.Bool("explain", false, "Explain MCA injection into Pod manifest")
+		proxyFlag    = flag.Bool("proxy", false, "Start MCA proxy server")
+		webhookFlag  = flag.Bool("webhook", false, "Start MCA webhook server")
+		combinedFlag = flag.Bool("combined", false, "Start MCA webhook and proxy servers in a single process")
+		waitFlag     = flag.Bool("wait-for-proxy", false, "Wait until the MCA proxy listens")
+		routesFlag   = flag.Bool("routes", false, "Print the proxy's cluster routing table")
+		printCAFlag  = flag.Bool("print-ca", false, "Print the webhook's CA certificate as PEM")
+		printConfig  = flag.Bool("print-webhook-config", false, "Print the MutatingWebhookConfiguration matching the webhook's settings")
+		outputFlag   = flag.String("output", inject.OutputAuto, "Output format for --inject: json or yaml (default: same as input)")
+		minimalFlag  = flag.Bool("minimal-diff", false, "Keep the layout of YAML input for --inject, changing only injected fields")
 	)
 	flag.Parse()
 
 	switch {
 	case *injectFlag:
-		if err := runInject(); err != nil {
+		if err := runInject(*outputFlag, *minimalFlag); err != nil {
 			log.Fatalf("Injection failed: %v", err)
 		}
+	case *explainFlag:
+		if err := runExplain(); err != nil {
+			log.Fatalf("Explain failed: %v", err)
+		}
 	case *proxyFlag:
 		if err := runProxy(); err != nil {
 			log.Fatalf("Proxy server failed: %v", err)
@@ -38,19 +58,48 @@ func main() {
 		if err := runWebhook(); err != nil {
 			log.Fatalf("Webhook server failed: %v", err)
 		}
+	case *combinedFlag:
+		if err := runCombined(); err != nil {
+			log.Fatalf("Combined server failed: %v", err)
+		}
+	case *waitFlag:
+		if err := runWaitForProxy(); err != nil {
+			log.Fatalf("Waiting for proxy failed: %v", err)
+		}
+	case *routesFlag:
+		if err := runRoutes(); err != nil {
+			log.Fatalf("Printing routes failed: %v", err)
+		}
+	case *printCAFlag:
+		if err := runPrintCA(); err != nil {
+			log.Fatalf("Printing CA failed: %v", err)
+		}
+	case *printConfig:
+		if err := runPrintWebhookConfig(); err != nil {
+			log.Fatalf("Printing webhook configuration failed: %v", err)
+		}
 	default:
 		fmt.Fprint(os.Stderr, fmt.Sprintf(cliUsage, os.Args[0]))
 		os.Exit(1)
 	}
 }
 
-func runInject() error {
+func runInject(format string, minimalDiff bool) error {
+	if minimalDiff && format != inject.OutputAuto {
+		return fmt.Errorf("--minimal-diff cannot be combined with --output")
+	}
+
 	input, err := os.ReadFile("/dev/stdin")
 	if err != nil {
 		return fmt.Errorf("failed to read stdin: %w", err)
 	}
 
-	output, err := inject.ViaCLI(input)
+	var output []byte
+	if minimalDiff {
+		output, err = inject.ViaCLIMinimalDiff(input)
+	} else {
+		output, err = inject.ViaCLIFormat(input, format)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to inject MCA: %w", err)
 	}
@@ -62,6 +111,24 @@ func runInject() error {
 	return nil
 }
 
+func runExplain() error {
+	input, err := os.ReadFile("/dev/stdin")
+	if err != nil {
+		return fmt.Errorf("failed to read stdin: %w", err)
+	}
+
+	output, err := inject.ViaExplain(input)
+	if err != nil {
+		return fmt.Errorf("failed to explain MCA injection: %w", err)
+	}
+
+	if _, err := os.Stdout.Write(output); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	return nil
+}
+
 func runProxy() error {
 	return serve.StartProxy()
 }
@@ -69,3 +136,23 @@ func runProxy() error {
 func runWebhook() error {
 	return serve.StartWebhook()
 }
+
+func runCombined() error {
+	return serve.StartCombined()
+}
+
+func runWaitForProxy() error {
+	return serve.WaitForProxy()
+}
+
+func runRoutes() error {
+	return serve.PrintRoutes(os.Stdout)
+}
+
+func runPrintCA() error {
+	return serve.PrintCA(os.Stdout)
+}
+
+func runPrintWebhookConfig() error {
+	return serve.PrintWebhookConfig(os.Stdout)
+}
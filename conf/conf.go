@@ -0,0 +1,177 @@
+package conf
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Version is the MCA build version, set at build time via -ldflags.
+var Version = "dev"
+
+// Policies for requests naming a cluster that is not in the proxy's cluster map.
+const (
+	// UnknownClusterStrict rejects the request with an error response.
+	UnknownClusterStrict = "strict"
+	// UnknownClusterFallback routes the request to the in-cluster API server.
+	UnknownClusterFallback = "fallback"
+)
+
+// Modes for the User-Agent forwarded by the proxy.
+const (
+	// UserAgentAppend prefixes the client's User-Agent with the MCA identifier.
+	UserAgentAppend = "append"
+	// UserAgentSet replaces the client's User-Agent with the MCA identifier.
+	UserAgentSet = "set"
+	// UserAgentOff forwards the client's User-Agent unchanged.
+	UserAgentOff = "off"
+)
+
+// Kinds of startup probe injected on the proxy container.
+const (
+	// StartupProbeTCP probes the proxy's health listener with a TCP connect.
+	StartupProbeTCP = "tcp"
+	// StartupProbeHTTP probes the health listener's /healthz endpoint over plain HTTP.
+	StartupProbeHTTP = "http"
+)
+
+// Modes for running the injected proxy.
+const (
+	// SidecarModeNative injects the proxy as a native sidecar init container.
+	SidecarModeNative = "native"
+	// SidecarModeLegacy injects the proxy as a regular container, for clusters without
+	// native sidecar support.
+	SidecarModeLegacy = "legacy"
+)
+
+// Policies for rewriting the service account mount and API env of regular init containers.
+const (
+	// InitContainersProxyOnly rewrites only init containers that start after the proxy.
+	InitContainersProxyOnly = "proxy-only"
+	// InitContainersAll rewrites every init container.
+	InitContainersAll = "all"
+	// InitContainersNone leaves init containers untouched.
+	InitContainersNone = "none"
+)
+
+// Policies for containers that already set a non-loopback KUBERNETES_SERVICE_HOST.
+const (
+	// ServiceHostConflictOverwrite redirects the container to the proxy regardless.
+	ServiceHostConflictOverwrite = "overwrite"
+	// ServiceHostConflictWarn logs a warning and leaves the container untouched.
+	ServiceHostConflictWarn = "warn"
+	// ServiceHostConflictDeny fails the injection.
+	ServiceHostConflictDeny = "deny"
+)
+
+// Policies for pods using the default service account, or none.
+const (
+	// ServiceAccountAny injects such pods.
+	ServiceAccountAny = "any"
+	// ServiceAccountWarn logs a warning and injects such pods.
+	ServiceAccountWarn = "warn"
+	// ServiceAccountRequire fails the injection of such pods.
+	ServiceAccountRequire = "require"
+)
+
+// Forms in which the proxy logs request URLs.
+const (
+	// LogURLsPath logs the path without the query.
+	LogURLsPath = "path"
+	// LogURLsFull logs the path with the query.
+	LogURLsFull = "full"
+	// LogURLsSanitized logs the path without the query, with resource names redacted.
+	LogURLsSanitized = "sanitized"
+)
+
+// Answers of the proxy to plain HTTP requests on its HTTPS port.
+const (
+	// PlainHTTPHint answers with a 400 Status telling the client to use HTTPS.
+	PlainHTTPHint = "hint"
+	// PlainHTTPRedirect answers with a 308 redirect to the HTTPS URL.
+	PlainHTTPRedirect = "redirect"
+	// PlainHTTPOff leaves the Go default of a bare 400 response.
+	PlainHTTPOff = "off"
+)
+
+// Handling of requests to the API root, "/".
+const (
+	// RootPathForward forwards the request to the API server, which lists its API paths.
+	RootPathForward = "forward"
+	// RootPathInfo answers with an informational Status instead.
+	RootPathInfo = "info"
+)
+
+// Handling of a conf.ProxyImage with a floating tag, ":latest" or none, at webhook startup.
+const (
+	// FloatingTagIgnore accepts the image silently.
+	FloatingTagIgnore = "ignore"
+	// FloatingTagWarn logs a warning that rollouts are not reproducible.
+	FloatingTagWarn = "warn"
+	// FloatingTagReject refuses to start the webhook.
+	FloatingTagReject = "reject"
+)
+
+// Log levels.
+const (
+	// LogLevelInfo logs what MCA does.
+	LogLevelInfo = "info"
+	// LogLevelDebug also logs details for diagnosing failures, such as the webhook's patches.
+	LogLevelDebug = "debug"
+)
+
+// ProxyRunAsUserAuto leaves the UID and GID of the injected proxy to the namespace's
+// security constraints, such as an OpenShift MustRunAsRange SCC.
+const ProxyRunAsUserAuto = "auto"
+
+// TLS renegotiation support of the proxy and webhook servers.
+const (
+	// TLSRenegotiationNever refuses renegotiation.
+	TLSRenegotiationNever = "never"
+	// TLSRenegotiationOnce allows a single renegotiation per connection.
+	TLSRenegotiationOnce = "once"
+	// TLSRenegotiationFreely allows repeated renegotiation.
+	TLSRenegotiationFreely = "freely"
+)
+
+// ProxyResourceProfiles maps proxy resource profile names to the resources applied to the
+// injected proxy container.
+var ProxyResourceProfiles = map[string]corev1.ResourceRequirements{
+	"small": {
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("10m"),
+			corev1.ResourceMemory: resource.MustParse("32Mi"),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceMemory: resource.MustParse("64Mi"),
+		},
+	},
+	"medium": {
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("50m"),
+			corev1.ResourceMemory: resource.MustParse("64Mi"),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceMemory: resource.MustParse("128Mi"),
+		},
+	},
+	"large": {
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("100m"),
+			corev1.ResourceMemory: resource.MustParse("128Mi"),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceMemory: resource.MustParse("256Mi"),
+		},
+	},
+}
+
+// Cluster is an API server the proxy routes to besides the in-cluster one, keyed by its
+// name in conf.Clusters.
+type Cluster struct {
+	// Host is the API server URL, e.g. https://10.0.0.1:6443.
+	Host string `json:"host"`
+	// TokenPath is a file holding the bearer token, re-read as it rotates. Optional.
+	TokenPath string `json:"tokenPath,omitempty"`
+	// CAPath is a file holding the API server CA bundle; the system roots are used when empty.
+	CAPath string `json:"caPath,omitempty"`
+}
@@ -6,8 +6,10 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/spf13/afero"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -22,6 +24,184 @@ var (
 	WebhookName = "mca-webhook"
 
 	PodNamespace = "default"
+
+	PodName = ""
+
+	ClusterHeader = "X-MCA-Cluster"
+
+	UnknownClusterPolicy = UnknownClusterStrict
+
+	UpstreamMaxRetries = 2
+
+	UpstreamRetryMaxWait = 5 * time.Second
+
+	UpstreamDialTimeout = 30 * time.Second
+
+	UpstreamTLSHandshakeTimeout = 10 * time.Second
+
+	UpstreamReconnectAttempts = 3
+
+	UpstreamReconnectWait = 500 * time.Millisecond
+
+	ProxyExtraSANs []string
+
+	ExcludedNamespaces []string
+
+	IncludedNamespaces []string
+
+	ProxyImageConfigMap = ""
+
+	ProxyLocalPaths []string
+
+	WebhookLeaderElection = false
+
+	WebhookCertSecret = "mca-webhook-tls"
+
+	ProxyDefaultProfile = "small"
+
+	ProxyMethodPolicy map[string][]string
+
+	ProxyMethodPolicyErr error
+
+	PodSecurityLevel = ""
+
+	PodSecurityEnforce = false
+
+	ProxyUserAgent = UserAgentAppend
+
+	ProxyRequireLoopback = false
+
+	NamespaceConfigMap = ""
+
+	ProxyStartupProbe = ""
+
+	ProxyListenAddress = "127.0.0.1:6443"
+
+	InitContainersPolicy = InitContainersProxyOnly
+
+	InitContainersSkip = 0
+
+	CAMaxPathLenZero = true
+
+	CAKeyUsage []string
+
+	CertKeySize = 2048
+
+	UpstreamAnnotation = false
+
+	PodOptInOverridesNamespace = false
+
+	ServiceHostConflictPolicy = ServiceHostConflictOverwrite
+
+	ServiceAccountPolicy = ServiceAccountAny
+
+	ProxyInsertAfter = ""
+
+	PatchTestOps = false
+
+	CACertFileMode    os.FileMode = 0644
+	NamespaceFileMode os.FileMode = 0644
+	TokenFileMode     os.FileMode = 0644
+
+	WebhookMaxInFlight = 0
+
+	ProxyStripResponseHeaders []string
+
+	ProxySidecarMode = SidecarModeNative
+
+	ConfigHashAnnotation = "mca.marxus.io/config-hash"
+
+	ProxyBufferSize = 0
+
+	ProxyFlushInterval time.Duration = 0
+
+	ProxyLogURLs = LogURLsPath
+
+	PodInfoPath = ""
+
+	ProxyPlainHTTP = PlainHTTPHint
+
+	ProxyContainerName = "mca-proxy"
+
+	ProxyRBACPreflight = false
+
+	ProxyHopByHopHeaders []string
+
+	MaxClusters = 100
+
+	ProxyRootPath = RootPathForward
+
+	WebhookFailurePolicy = "Fail"
+
+	WebhookServicePort = 443
+
+	TLSSessionTicketsDisabled = true
+
+	ProxyRunAsUser = "999"
+
+	SAFileWriteAttempts = 3
+
+	SAFileWriteBackoff = 100 * time.Millisecond
+
+	ProxyClientCAPath = ""
+
+	ClientCertClusters map[string]string
+
+	ClientCertClustersErr error
+
+	SummaryAnnotation = ""
+
+	ProxyImageFloatingTag = FloatingTagWarn
+
+	ProxyImagePinDigest = false
+
+	ProxyDrainTimeout = 30 * time.Second
+
+	WebhookDrainTimeout = 5 * time.Second
+
+	LogLevel = LogLevelInfo
+
+	WebhookEphemeralContainers = false
+
+	ProxyDiscoveryCacheTTL time.Duration
+
+	TLSRenegotiation = TLSRenegotiationNever
+
+	WebhookPatchCABundle = true
+
+	NamespaceSelector = ""
+
+	ProxyHealthAddress = ""
+
+	NamespaceAnnotations []string
+
+	ProxyRequestFraction = 0.0
+
+	ProxyRequestMin corev1.ResourceList
+
+	ProxyRequestMax corev1.ResourceList
+
+	NodeCapacityHint corev1.ResourceList
+
+	WebhookMutatePath = "/mutate"
+
+	WebhookListenAddress = ":8443"
+
+	ProxyStartupFence = false
+
+	EnvSizeWarnBytes = 32768
+
+	VerifyCertChain = true
+
+	WebhookUpdateOptOut = false
+
+	Clusters map[string]Cluster
+
+	ClustersErr error
+
+	ServiceAccountVolumeMedium = ""
+
+	ServiceAccountVolumeSizeLimit = ""
 )
 
 func initDevelop() {
@@ -0,0 +1,119 @@
+//go:build release
+
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func getenv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func getenvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %d: %v", key, value, fallback, err)
+		return fallback
+	}
+	return parsed
+}
+
+func getenvFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %g: %v", key, value, fallback, err)
+		return fallback
+	}
+	return parsed
+}
+
+func getenvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %t: %v", key, value, fallback, err)
+		return fallback
+	}
+	return parsed
+}
+
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %s: %v", key, value, fallback, err)
+		return fallback
+	}
+	return parsed
+}
+
+func getenvFileMode(key string, fallback os.FileMode) os.FileMode {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.ParseUint(value, 8, 9)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %#o: %v", key, value, fallback, err)
+		return fallback
+	}
+	return os.FileMode(parsed)
+}
+
+func getenvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getenvJSON parses the JSON value of key. Unlike the other helpers it returns an invalid value's
+// error instead of falling back, for settings that must not be silently dropped.
+func getenvJSON[T any](key string) (T, error) {
+	var parsed T
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return parsed, nil
+	}
+	if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+		var zero T
+		return zero, fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return parsed, nil
+}
+
+// getenvJSONOrZero is like getenvJSON but logs an invalid value and ignores it.
+func getenvJSONOrZero[T any](key string) T {
+	parsed, err := getenvJSON[T](key)
+	if err != nil {
+		log.Printf("%v, ignoring", err)
+	}
+	return parsed
+}
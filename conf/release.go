@@ -4,8 +4,10 @@ package conf
 
 import (
 	"os"
+	"time"
 
 	"github.com/spf13/afero"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/rest"
 )
 
@@ -18,3 +20,177 @@ var ProxyImage = os.Getenv("MCA_PROXY_IMAGE")
 var WebhookName = os.Getenv("MCA_WEBHOOK_NAME")
 
 var PodNamespace = os.Getenv("NAMESPACE")
+
+var PodName = os.Getenv("POD_NAME")
+
+var ClusterHeader = getenv("MCA_CLUSTER_HEADER", "X-MCA-Cluster")
+
+var UnknownClusterPolicy = getenv("MCA_UNKNOWN_CLUSTER_POLICY", UnknownClusterStrict)
+
+var UpstreamMaxRetries = getenvInt("MCA_UPSTREAM_MAX_RETRIES", 2)
+
+var UpstreamRetryMaxWait = getenvDuration("MCA_UPSTREAM_RETRY_MAX_WAIT", 5*time.Second)
+
+var ProxyExtraSANs = getenvList("MCA_PROXY_EXTRA_SANS")
+
+var ExcludedNamespaces = getenvList("MCA_EXCLUDED_NAMESPACES")
+
+var IncludedNamespaces = getenvList("MCA_INCLUDED_NAMESPACES")
+
+var ProxyImageConfigMap = os.Getenv("MCA_PROXY_IMAGE_CONFIGMAP")
+
+var ProxyLocalPaths = getenvList("MCA_PROXY_LOCAL_PATHS")
+
+var WebhookLeaderElection = getenvBool("MCA_WEBHOOK_LEADER_ELECTION", false)
+
+var WebhookCertSecret = getenv("MCA_WEBHOOK_CERT_SECRET", WebhookName+"-tls")
+
+var ProxyDefaultProfile = getenv("MCA_PROXY_DEFAULT_PROFILE", "small")
+
+var ProxyMethodPolicy, ProxyMethodPolicyErr = getenvJSON[map[string][]string]("MCA_PROXY_METHOD_POLICY")
+
+var PodSecurityLevel = os.Getenv("MCA_POD_SECURITY_LEVEL")
+
+var PodSecurityEnforce = getenvBool("MCA_POD_SECURITY_ENFORCE", false)
+
+var ProxyUserAgent = getenv("MCA_PROXY_USER_AGENT", UserAgentAppend)
+
+var ProxyRequireLoopback = getenvBool("MCA_PROXY_REQUIRE_LOOPBACK", false)
+
+var NamespaceConfigMap = os.Getenv("MCA_NAMESPACE_CONFIGMAP")
+
+var ProxyStartupProbe = os.Getenv("MCA_PROXY_STARTUP_PROBE")
+
+var ProxyListenAddress = getenv("MCA_PROXY_LISTEN_ADDRESS", "127.0.0.1:6443")
+
+var InitContainersPolicy = getenv("MCA_INIT_CONTAINERS_POLICY", InitContainersProxyOnly)
+
+var CAMaxPathLenZero = getenvBool("MCA_CA_MAX_PATH_LEN_ZERO", true)
+
+var CAKeyUsage = getenvList("MCA_CA_KEY_USAGE")
+
+var ServiceHostConflictPolicy = getenv("MCA_SERVICE_HOST_CONFLICT_POLICY", ServiceHostConflictOverwrite)
+
+var ProxyInsertAfter = os.Getenv("MCA_PROXY_INSERT_AFTER")
+
+var PatchTestOps = getenvBool("MCA_PATCH_TEST_OPS", false)
+
+var CACertFileMode = getenvFileMode("MCA_CA_CERT_FILE_MODE", 0644)
+
+var NamespaceFileMode = getenvFileMode("MCA_NAMESPACE_FILE_MODE", 0644)
+
+var TokenFileMode = getenvFileMode("MCA_TOKEN_FILE_MODE", 0644)
+
+var WebhookMaxInFlight = getenvInt("MCA_WEBHOOK_MAX_IN_FLIGHT", 0)
+
+var UpstreamDialTimeout = getenvDuration("MCA_UPSTREAM_DIAL_TIMEOUT", 30*time.Second)
+
+var UpstreamTLSHandshakeTimeout = getenvDuration("MCA_UPSTREAM_TLS_HANDSHAKE_TIMEOUT", 10*time.Second)
+
+var ProxyStripResponseHeaders = getenvList("MCA_PROXY_STRIP_RESPONSE_HEADERS")
+
+var ProxySidecarMode = getenv("MCA_PROXY_SIDECAR_MODE", SidecarModeNative)
+
+var ConfigHashAnnotation = getenv("MCA_CONFIG_HASH_ANNOTATION", "mca.marxus.io/config-hash")
+
+var WebhookPatchCABundle = getenvBool("MCA_WEBHOOK_PATCH_CA_BUNDLE", true)
+
+var NamespaceSelector = getenv("MCA_NAMESPACE_SELECTOR", "")
+
+var ProxyHealthAddress = getenv("MCA_PROXY_HEALTH_ADDRESS", "")
+
+var NamespaceAnnotations = getenvList("MCA_NAMESPACE_ANNOTATIONS")
+
+var ProxyRequestFraction = getenvFloat("MCA_PROXY_REQUEST_FRACTION", 0)
+
+var ProxyRequestMin = getenvJSONOrZero[corev1.ResourceList]("MCA_PROXY_REQUEST_MIN")
+
+var ProxyRequestMax = getenvJSONOrZero[corev1.ResourceList]("MCA_PROXY_REQUEST_MAX")
+
+var NodeCapacityHint = getenvJSONOrZero[corev1.ResourceList]("MCA_NODE_CAPACITY_HINT")
+
+var WebhookMutatePath = getenv("MCA_WEBHOOK_MUTATE_PATH", "/mutate")
+
+var WebhookListenAddress = getenv("MCA_WEBHOOK_LISTEN_ADDRESS", ":8443")
+
+var ProxyStartupFence = getenvBool("MCA_PROXY_STARTUP_FENCE", false)
+
+var EnvSizeWarnBytes = getenvInt("MCA_ENV_SIZE_WARN_BYTES", 32768)
+
+var VerifyCertChain = getenvBool("MCA_VERIFY_CERT_CHAIN", true)
+
+var WebhookUpdateOptOut = getenvBool("MCA_WEBHOOK_UPDATE_OPT_OUT", false)
+
+var Clusters, ClustersErr = getenvJSON[map[string]Cluster]("MCA_CLUSTERS")
+
+var ServiceAccountVolumeMedium = getenv("MCA_SA_VOLUME_MEDIUM", "")
+
+var ServiceAccountVolumeSizeLimit = getenv("MCA_SA_VOLUME_SIZE_LIMIT", "")
+
+var UpstreamReconnectAttempts = getenvInt("MCA_UPSTREAM_RECONNECT_ATTEMPTS", 3)
+
+var UpstreamReconnectWait = getenvDuration("MCA_UPSTREAM_RECONNECT_WAIT", 500*time.Millisecond)
+
+var InitContainersSkip = getenvInt("MCA_INIT_CONTAINERS_SKIP", 0)
+
+var CertKeySize = getenvInt("MCA_CERT_KEY_SIZE", 2048)
+
+var UpstreamAnnotation = getenvBool("MCA_UPSTREAM_ANNOTATION", false)
+
+var PodOptInOverridesNamespace = getenvBool("MCA_POD_OPT_IN_OVERRIDES_NAMESPACE", false)
+
+var ServiceAccountPolicy = getenv("MCA_SERVICE_ACCOUNT_POLICY", ServiceAccountAny)
+
+var ProxyBufferSize = getenvInt("MCA_PROXY_BUFFER_SIZE", 0)
+
+var ProxyFlushInterval = getenvDuration("MCA_PROXY_FLUSH_INTERVAL", 0)
+
+var ProxyLogURLs = getenv("MCA_PROXY_LOG_URLS", LogURLsPath)
+
+var PodInfoPath = getenv("MCA_POD_INFO_PATH", "")
+
+var ProxyPlainHTTP = getenv("MCA_PROXY_PLAIN_HTTP", PlainHTTPHint)
+
+var ProxyContainerName = getenv("MCA_PROXY_CONTAINER_NAME", "mca-proxy")
+
+var ProxyRBACPreflight = getenvBool("MCA_PROXY_RBAC_PREFLIGHT", false)
+
+var ProxyHopByHopHeaders = getenvList("MCA_PROXY_HOP_BY_HOP_HEADERS")
+
+var MaxClusters = getenvInt("MCA_MAX_CLUSTERS", 100)
+
+var ProxyRootPath = getenv("MCA_PROXY_ROOT_PATH", RootPathForward)
+
+var WebhookFailurePolicy = getenv("MCA_WEBHOOK_FAILURE_POLICY", "Fail")
+
+var WebhookServicePort = getenvInt("MCA_WEBHOOK_SERVICE_PORT", 443)
+
+var TLSSessionTicketsDisabled = getenvBool("MCA_TLS_SESSION_TICKETS_DISABLED", true)
+
+var TLSRenegotiation = getenv("MCA_TLS_RENEGOTIATION", TLSRenegotiationNever)
+
+var ProxyRunAsUser = getenv("MCA_PROXY_RUN_AS_USER", "999")
+
+var SAFileWriteAttempts = getenvInt("MCA_SA_FILE_WRITE_ATTEMPTS", 3)
+
+var SAFileWriteBackoff = getenvDuration("MCA_SA_FILE_WRITE_BACKOFF", 100*time.Millisecond)
+
+var ProxyClientCAPath = getenv("MCA_PROXY_CLIENT_CA_PATH", "")
+
+var ClientCertClusters, ClientCertClustersErr = getenvJSON[map[string]string]("MCA_CLIENT_CERT_CLUSTERS")
+
+var SummaryAnnotation = getenv("MCA_SUMMARY_ANNOTATION", "")
+
+var ProxyImageFloatingTag = getenv("MCA_PROXY_IMAGE_FLOATING_TAG", FloatingTagWarn)
+
+var ProxyImagePinDigest = getenvBool("MCA_PROXY_IMAGE_PIN_DIGEST", false)
+
+var ProxyDrainTimeout = getenvDuration("MCA_PROXY_DRAIN_TIMEOUT", 30*time.Second)
+
+var WebhookDrainTimeout = getenvDuration("MCA_WEBHOOK_DRAIN_TIMEOUT", 5*time.Second)
+
+var LogLevel = getenv("MCA_LOG_LEVEL", LogLevelInfo)
+
+var WebhookEphemeralContainers = getenvBool("MCA_WEBHOOK_EPHEMERAL_CONTAINERS", false)
+
+var ProxyDiscoveryCacheTTL = getenvDuration("MCA_PROXY_DISCOVERY_CACHE_TTL", 0)
@@ -0,0 +1,152 @@
+// Package testutil provides test helpers shared across packages.
+package testutil
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// UpstreamOptions configures the responses of an [Upstream]. The zero value answers every
+// request with 200 and an empty body.
+type UpstreamOptions struct {
+	// Status is the response status, 200 when zero.
+	Status int
+	// Header is added to every response.
+	Header http.Header
+	// Body is the response body, written after Stream.
+	Body string
+	// Stream is written chunk by chunk, flushing after each and waiting Interval in between.
+	Stream   []string
+	Interval time.Duration
+	// Hold keeps the response open after it was written until the client goes away, as a
+	// watch does.
+	Hold bool
+	// Upgrade is the protocol accepted on upgrade requests. An upgraded connection echoes back
+	// everything it reads.
+	Upgrade string
+}
+
+// Request is a request received by an [Upstream].
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// Upstream is a fake upstream server that records the requests it receives and answers them
+// as configured by its [UpstreamOptions].
+type Upstream struct {
+	server *httptest.Server
+	opts   UpstreamOptions
+
+	mu       sync.Mutex
+	requests []Request
+}
+
+// NewUpstream starts an Upstream answering as configured by opts. It is closed when t ends.
+func NewUpstream(t testing.TB, opts UpstreamOptions) *Upstream {
+	t.Helper()
+
+	upstream := &Upstream{opts: opts}
+	upstream.server = httptest.NewServer(http.HandlerFunc(upstream.serveHTTP))
+	t.Cleanup(upstream.server.Close)
+	return upstream
+}
+
+// URL returns the base URL of the upstream.
+func (u *Upstream) URL() *url.URL {
+	upstreamURL, _ := url.Parse(u.server.URL)
+	return upstreamURL
+}
+
+// Close shuts the upstream down, closing its connections.
+func (u *Upstream) Close() {
+	u.server.Close()
+}
+
+// Requests returns the requests received so far, in order.
+func (u *Upstream) Requests() []Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]Request(nil), u.requests...)
+}
+
+// LastRequest returns the most recent request received, or the zero Request if none was.
+func (u *Upstream) LastRequest() Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.requests) == 0 {
+		return Request{}
+	}
+	return u.requests[len(u.requests)-1]
+}
+
+func (u *Upstream) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	u.mu.Lock()
+	u.requests = append(u.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	u.mu.Unlock()
+
+	if u.opts.Upgrade != "" && strings.EqualFold(r.Header.Get("Upgrade"), u.opts.Upgrade) {
+		u.serveUpgrade(w)
+		return
+	}
+
+	for name, values := range u.opts.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(max(u.opts.Status, http.StatusOK))
+
+	for i, chunk := range u.opts.Stream {
+		if i > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(u.opts.Interval):
+			}
+		}
+		io.WriteString(w, chunk)
+		w.(http.Flusher).Flush()
+	}
+	io.WriteString(w, u.opts.Body)
+
+	if u.opts.Hold {
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+}
+
+// serveUpgrade switches the connection to the upgrade protocol and echoes it back.
+func (u *Upstream) serveUpgrade(w http.ResponseWriter) {
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buf.WriteString("Connection: Upgrade\r\n")
+	buf.WriteString("Upgrade: " + u.opts.Upgrade + "\r\n\r\n")
+	if err := buf.Flush(); err != nil {
+		return
+	}
+
+	io.Copy(conn, buf.Reader)
+}
@@ -0,0 +1,120 @@
+// Fake upstream tests.
+package testutil
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstream_RecordsRequestsAndAnswers(t *testing.T) {
+	upstream := NewUpstream(t, UpstreamOptions{
+		Status: http.StatusCreated,
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   `{"kind":"Pod"}`,
+	})
+
+	req, err := http.NewRequest(http.MethodPost, upstream.URL().String()+"/api/v1/namespaces/default/pods?dryRun=All", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	req.Header.Set("X-Custom", "value")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	assert.Equal(t, `{"kind":"Pod"}`, string(body))
+
+	require.Len(t, upstream.Requests(), 1)
+	received := upstream.LastRequest()
+	assert.Equal(t, http.MethodPost, received.Method)
+	assert.Equal(t, "/api/v1/namespaces/default/pods", received.Path)
+	assert.Equal(t, "All", received.Query.Get("dryRun"))
+	assert.Equal(t, "value", received.Header.Get("X-Custom"))
+	assert.Equal(t, `{}`, string(received.Body))
+}
+
+func TestUpstream_Stream(t *testing.T) {
+	upstream := NewUpstream(t, UpstreamOptions{
+		Stream:   []string{"first\n", "second\n"},
+		Interval: 200 * time.Millisecond,
+	})
+
+	start := time.Now()
+	res, err := http.Get(upstream.URL().String() + "/api/v1/pods?watch=true")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	reader := bufio.NewReader(res.Body)
+
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", line)
+	assert.Less(t, time.Since(start), 200*time.Millisecond, "first chunk is flushed before the next is written")
+
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "second\n", line)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	_, err = reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestUpstream_StreamHold(t *testing.T) {
+	upstream := NewUpstream(t, UpstreamOptions{Stream: []string{"event\n"}, Hold: true})
+
+	res, err := http.Get(upstream.URL().String() + "/api/v1/pods?watch=true")
+	require.NoError(t, err)
+	reader := bufio.NewReader(res.Body)
+
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event\n", line)
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := reader.ReadString('\n')
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		t.Fatalf("held stream ended: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	res.Body.Close()
+	<-read
+}
+
+func TestUpstream_Upgrade(t *testing.T) {
+	upstream := NewUpstream(t, UpstreamOptions{Upgrade: "SPDY/3.1"})
+
+	conn, err := net.Dial("tcp", upstream.URL().Host)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "POST /api/v1/namespaces/default/pods/web/exec HTTP/1.1\r\nHost: upstream\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\n\r\n")
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, "SPDY/3.1", res.Header.Get("Upgrade"))
+
+	_, err = io.WriteString(conn, "ping")
+	require.NoError(t, err)
+	echoed := make([]byte, 4)
+	_, err = io.ReadFull(reader, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(echoed))
+}
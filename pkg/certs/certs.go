@@ -4,19 +4,69 @@
 package certs
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"net"
+	"slices"
 	"time"
 )
 
-func generateCA() (*rsa.PrivateKey, *x509.Certificate, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+// CAOptions controls the constraints of the generated CA certificate.
+type CAOptions struct {
+	// MaxPathLenZero restricts the CA to signing leaf certificates only.
+	MaxPathLenZero bool
+	// KeyUsage is the CA key usage. It must include [x509.KeyUsageCertSign].
+	KeyUsage x509.KeyUsage
+	// KeySize is the RSA key size in bits of the CA and of the certificates it issues. It must
+	// be one of [KeySizes], or zero for [DefaultKeySize].
+	KeySize int
+}
+
+// DefaultKeySize is the RSA key size used when none is set.
+const DefaultKeySize = 2048
+
+// KeySizes are the supported RSA key sizes. Larger keys are rejected, since generating them
+// would slow down every proxy startup.
+var KeySizes = []int{2048, 3072, 4096}
+
+// ValidateKeySize returns an error if size is not one of [KeySizes].
+func ValidateKeySize(size int) error {
+	if !slices.Contains(KeySizes, size) {
+		return fmt.Errorf("unsupported key size %d, must be one of %v", size, KeySizes)
+	}
+	return nil
+}
+
+// DefaultCAOptions returns the CA options used by [GenerateCAAndTLSCert]. MCA's CA only
+// ever signs a single leaf certificate, so the path length is constrained to zero.
+func DefaultCAOptions() CAOptions {
+	return CAOptions{
+		MaxPathLenZero: true,
+		KeyUsage:       x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+}
+
+func generateCA(opts CAOptions) (*rsa.PrivateKey, *x509.Certificate, error) {
+	if opts.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, nil, errors.New("CA key usage must include cert sign")
+	}
+	keySize := opts.KeySize
+	if keySize == 0 {
+		keySize = DefaultKeySize
+	}
+	if err := ValidateKeySize(keySize); err != nil {
+		return nil, nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -29,9 +79,10 @@ func generateCA() (*rsa.PrivateKey, *x509.Certificate, error) {
 		},
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		KeyUsage:              opts.KeyUsage,
 		BasicConstraintsValid: true,
 		IsCA:                  true,
+		MaxPathLenZero:        opts.MaxPathLenZero,
 	}
 
 	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
@@ -49,25 +100,75 @@ func generateCA() (*rsa.PrivateKey, *x509.Certificate, error) {
 
 // GenerateCAAndTLSCert generates a self-signed CA certificate and a TLS server certificate.
 // The server certificate is signed by the CA and includes the specified DNS names and IP addresses.
+// Its CommonName is the first DNS name, as with [GenerateTLSCert].
+// The CA is generated with [DefaultCAOptions].
 //
 // Returns the TLS certificate for use in servers, the CA certificate in PEM format for distribution,
 // and an error if certificate generation fails.
 func GenerateCAAndTLSCert(dnsNames []string, ipAddresses []net.IP) (tls.Certificate, []byte, error) {
-	caKey, caCert, err := generateCA()
+	return GenerateCAAndTLSCertWithOptions(dnsNames, ipAddresses, DefaultCAOptions())
+}
+
+// GenerateCAAndTLSCertWithOptions is like [GenerateCAAndTLSCert] but generates the CA with caOpts.
+//
+// Returns an error if caOpts are invalid or certificate generation fails.
+func GenerateCAAndTLSCertWithOptions(dnsNames []string, ipAddresses []net.IP, caOpts CAOptions) (tls.Certificate, []byte, error) {
+	caKey, caCert, err := generateCA(caOpts)
 	if err != nil {
 		return tls.Certificate{}, nil, err
 	}
 
-	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	tlsCert, err := GenerateTLSCert(caCert, caKey, dnsNames, ipAddresses)
 	if err != nil {
 		return tls.Certificate{}, nil, err
 	}
 
+	caCertPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+
+	return tlsCert, caCertPEM, nil
+}
+
+// GenerateCA generates a self-signed CA certificate and key with opts, for issuing serving
+// certificates with [GenerateTLSCert].
+//
+// Returns an error if opts are invalid or certificate generation fails.
+func GenerateCA(opts CAOptions) (*x509.Certificate, crypto.Signer, error) {
+	caKey, caCert, err := generateCA(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return caCert, caKey, nil
+}
+
+// GenerateTLSCert generates a TLS server certificate for the specified DNS names and IP
+// addresses, signed by an existing CA. It lets a caller re-issue the serving certificate
+// without minting a new CA, so clients trusting the CA keep working.
+//
+// The CommonName is the first DNS name, or "localhost" when there is none, for clients that
+// still check the CommonName rather than the SANs. The key has the size of the CA's key.
+//
+// Returns an error if certificate generation fails.
+func GenerateTLSCert(caCert *x509.Certificate, caKey crypto.Signer, dnsNames []string, ipAddresses []net.IP) (tls.Certificate, error) {
+	keySize := DefaultKeySize
+	if caPublicKey, ok := caKey.Public().(*rsa.PublicKey); ok && ValidateKeySize(caPublicKey.N.BitLen()) == nil {
+		keySize = caPublicKey.N.BitLen()
+	}
+
+	serverKey, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
 	serverTemplate := &x509.Certificate{
-		SerialNumber: big.NewInt(2),
+		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: []string{"MCA"},
-			CommonName:   "localhost",
+			CommonName:   commonName(dnsNames),
 		},
 		NotBefore:   time.Now(),
 		NotAfter:    time.Now().Add(365 * 24 * time.Hour),
@@ -79,17 +180,96 @@ func GenerateCAAndTLSCert(dnsNames []string, ipAddresses []net.IP) (tls.Certific
 
 	serverCertDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, caCert, &serverKey.PublicKey, caKey)
 	if err != nil {
-		return tls.Certificate{}, nil, err
+		return tls.Certificate{}, err
 	}
 
 	serverCertPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCertDER})
 	serverKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(serverKey)})
-	caCertPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
 
-	tlsCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	return tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+}
+
+func commonName(dnsNames []string) string {
+	if len(dnsNames) == 0 {
+		return "localhost"
+	}
+	return dnsNames[0]
+}
+
+// EncodeTLSCertPEM returns the PEM-encoded leaf certificate and private key of tlsCert,
+// suitable for persisting and later loading with [tls.X509KeyPair].
+//
+// Returns an error if tlsCert has no certificate or its private key is not an RSA key.
+func EncodeTLSCertPEM(tlsCert tls.Certificate) ([]byte, []byte, error) {
+	if len(tlsCert.Certificate) == 0 {
+		return nil, nil, errors.New("certificate is empty")
+	}
+
+	key, ok := tlsCert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("private key is not an RSA key")
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsCert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return certPEM, keyPEM, nil
+}
+
+// SANs returns the DNS names and IP addresses carried by the leaf certificate of tlsCert.
+//
+// Returns an error if tlsCert has no certificate or the leaf cannot be parsed.
+func SANs(tlsCert tls.Certificate) ([]string, []net.IP, error) {
+	if len(tlsCert.Certificate) == 0 {
+		return nil, nil, errors.New("certificate is empty")
+	}
+
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
 	if err != nil {
-		return tls.Certificate{}, nil, err
+		return nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
 	}
 
-	return tlsCert, caCertPEM, nil
+	return leaf.DNSNames, leaf.IPAddresses, nil
+}
+
+// VerifyChain checks that the leaf certificate of tlsCert chains to a CA certificate in
+// caCertPEM for server authentication, with any further certificates of tlsCert used as
+// intermediates. It catches a serving certificate paired with the wrong CA before clients do.
+//
+// Returns an error naming the leaf and the CA if the chain does not verify, or if either
+// cannot be parsed.
+func VerifyChain(tlsCert tls.Certificate, caCertPEM []byte) error {
+	if len(tlsCert.Certificate) == 0 {
+		return errors.New("certificate is empty")
+	}
+
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, certDER := range tlsCert.Certificate[1:] {
+		cert, err := x509.ParseCertificate(certDER)
+		if err != nil {
+			return fmt.Errorf("failed to parse intermediate certificate: %w", err)
+		}
+		intermediates.AddCert(cert)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caCertPEM) {
+		return errors.New("no CA certificate found in PEM")
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate %q issued by %q does not chain to the CA: %w",
+			leaf.Subject.CommonName, leaf.Issuer.CommonName, err)
+	}
+	return nil
 }
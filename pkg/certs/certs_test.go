@@ -2,9 +2,11 @@
 package certs
 
 import (
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 	"net"
 	"testing"
 	"time"
@@ -47,6 +49,28 @@ func TestGenerateCAAndTLSCert_CACertificateValid(t *testing.T) {
 	assert.Equal(t, expectedKeyUsage, caCert.KeyUsage&expectedKeyUsage, "CA certificate has incorrect key usage")
 }
 
+func TestGenerateCAAndTLSCert_CommonName(t *testing.T) {
+	tests := []struct {
+		name     string
+		dnsNames []string
+		wantCN   string
+	}{
+		{name: "first DNS name", dnsNames: []string{"mca-webhook.mca.svc", "localhost"}, wantCN: "mca-webhook.mca.svc"},
+		{name: "no DNS names", dnsNames: nil, wantCN: "localhost"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsCert, _, err := GenerateCAAndTLSCert(tt.dnsNames, []net.IP{net.IPv4(127, 0, 0, 1)})
+			require.NoError(t, err)
+
+			serverCert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCN, serverCert.Subject.CommonName)
+		})
+	}
+}
+
 func TestGenerateCAAndTLSCert_ServerCertificateValid(t *testing.T) {
 	dnsNames := []string{"localhost", "example.com"}
 	ipAddresses := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
@@ -203,3 +227,260 @@ func TestGenerateCAAndTLSCert_SerialNumbers(t *testing.T) {
 
 	assert.NotEqual(t, caCert.SerialNumber, serverCert.SerialNumber, "CA and server certificates should have different serial numbers")
 }
+
+func TestEncodeTLSCertPEM(t *testing.T) {
+	tlsCert, _, err := GenerateCAAndTLSCert([]string{"localhost"}, nil)
+	require.NoError(t, err)
+
+	certPEM, keyPEM, err := EncodeTLSCertPEM(tlsCert)
+	require.NoError(t, err)
+
+	loaded, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	assert.Equal(t, tlsCert.Certificate[0], loaded.Certificate[0])
+}
+
+func TestEncodeTLSCertPEM_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		tlsCert tls.Certificate
+		errMsg  string
+	}{
+		{
+			name:    "empty certificate",
+			tlsCert: tls.Certificate{},
+			errMsg:  "certificate is empty",
+		},
+		{
+			name:    "non-RSA private key",
+			tlsCert: tls.Certificate{Certificate: [][]byte{{1}}, PrivateKey: "not-a-key"},
+			errMsg:  "private key is not an RSA key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := EncodeTLSCertPEM(tt.tlsCert)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestSANs(t *testing.T) {
+	dnsNames := []string{"localhost", "mca-webhook.default.svc"}
+	ipAddresses := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+	tlsCert, _, err := GenerateCAAndTLSCert(dnsNames, ipAddresses)
+	require.NoError(t, err)
+
+	gotDNSNames, gotIPAddresses, err := SANs(tlsCert)
+	require.NoError(t, err)
+
+	assert.Equal(t, dnsNames, gotDNSNames)
+	require.Len(t, gotIPAddresses, len(ipAddresses))
+	for i, expected := range ipAddresses {
+		assert.True(t, gotIPAddresses[i].Equal(expected))
+	}
+}
+
+func TestSANs_Errors(t *testing.T) {
+	_, _, err := SANs(tls.Certificate{})
+	assert.EqualError(t, err, "certificate is empty")
+
+	_, _, err = SANs(tls.Certificate{Certificate: [][]byte{{1, 2, 3}}})
+	assert.ErrorContains(t, err, "failed to parse certificate")
+}
+
+func TestGenerateCAAndTLSCertWithOptions(t *testing.T) {
+	tests := []struct {
+		name               string
+		opts               CAOptions
+		wantMaxPathLenZero bool
+		wantMaxPathLen     int
+	}{
+		{
+			name:               "default options constrain path length to zero",
+			opts:               DefaultCAOptions(),
+			wantMaxPathLenZero: true,
+			wantMaxPathLen:     0,
+		},
+		{
+			name:               "unconstrained path length",
+			opts:               CAOptions{KeyUsage: x509.KeyUsageCertSign},
+			wantMaxPathLenZero: false,
+			wantMaxPathLen:     -1,
+		},
+		{
+			name: "custom key usage",
+			opts: CAOptions{
+				MaxPathLenZero: true,
+				KeyUsage:       x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			},
+			wantMaxPathLenZero: true,
+			wantMaxPathLen:     0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsCert, caCertPEM, err := GenerateCAAndTLSCertWithOptions([]string{"localhost"}, nil, tt.opts)
+			require.NoError(t, err)
+
+			block, _ := pem.Decode(caCertPEM)
+			require.NotNil(t, block)
+			caCert, err := x509.ParseCertificate(block.Bytes)
+			require.NoError(t, err)
+
+			assert.True(t, caCert.IsCA)
+			assert.Equal(t, tt.opts.KeyUsage, caCert.KeyUsage)
+			assert.Equal(t, tt.wantMaxPathLenZero, caCert.MaxPathLenZero)
+			assert.Equal(t, tt.wantMaxPathLen, caCert.MaxPathLen)
+
+			serverCert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+			require.NoError(t, err)
+			require.NoError(t, serverCert.CheckSignatureFrom(caCert))
+		})
+	}
+}
+
+func TestGenerateCAAndTLSCertWithOptions_RequiresCertSign(t *testing.T) {
+	_, _, err := GenerateCAAndTLSCertWithOptions(nil, nil, CAOptions{KeyUsage: x509.KeyUsageDigitalSignature})
+	assert.EqualError(t, err, "CA key usage must include cert sign")
+}
+
+func TestGenerateTLSCert_ReusesCA(t *testing.T) {
+	caCert, caKey, err := GenerateCA(DefaultCAOptions())
+	require.NoError(t, err)
+
+	first, err := GenerateTLSCert(caCert, caKey, []string{"localhost"}, nil)
+	require.NoError(t, err)
+	second, err := GenerateTLSCert(caCert, caKey, []string{"localhost", "mca.example"}, nil)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	var serials []string
+	for _, tlsCert := range []tls.Certificate{first, second} {
+		leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+		require.NoError(t, err)
+
+		_, err = leaf.Verify(x509.VerifyOptions{
+			Roots:     roots,
+			DNSName:   "localhost",
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		require.NoError(t, err)
+		serials = append(serials, leaf.SerialNumber.String())
+	}
+
+	assert.NotEqual(t, serials[0], serials[1], "leaf certificates from the same CA should have distinct serial numbers")
+}
+
+func TestGenerateCA_InvalidOptions(t *testing.T) {
+	_, _, err := GenerateCA(CAOptions{})
+	assert.EqualError(t, err, "CA key usage must include cert sign")
+}
+
+func TestGenerateCAAndTLSCertWithOptions_KeySize(t *testing.T) {
+	tests := []struct {
+		name     string
+		keySize  int
+		wantBits int
+		wantErr  string
+	}{
+		{name: "default", keySize: 0, wantBits: 2048},
+		{name: "2048", keySize: 2048, wantBits: 2048},
+		{name: "3072", keySize: 3072, wantBits: 3072},
+		{name: "4096", keySize: 4096, wantBits: 4096},
+		{name: "too small", keySize: 1024, wantErr: "unsupported key size 1024, must be one of [2048 3072 4096]"},
+		{name: "too large", keySize: 8192, wantErr: "unsupported key size 8192, must be one of [2048 3072 4096]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultCAOptions()
+			opts.KeySize = tt.keySize
+
+			tlsCert, caCertPEM, err := GenerateCAAndTLSCertWithOptions([]string{"localhost"}, nil, opts)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			block, _ := pem.Decode(caCertPEM)
+			require.NotNil(t, block)
+			caCert, err := x509.ParseCertificate(block.Bytes)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantBits, caCert.PublicKey.(*rsa.PublicKey).N.BitLen())
+
+			leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantBits, leaf.PublicKey.(*rsa.PublicKey).N.BitLen())
+		})
+	}
+}
+
+func BenchmarkGenerateCAAndTLSCert(b *testing.B) {
+	for _, keySize := range KeySizes {
+		b.Run(fmt.Sprintf("rsa%d", keySize), func(b *testing.B) {
+			opts := DefaultCAOptions()
+			opts.KeySize = keySize
+			for b.Loop() {
+				if _, _, err := GenerateCAAndTLSCertWithOptions([]string{"localhost"}, []net.IP{net.IPv4(127, 0, 0, 1)}, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	tlsCert, caCertPEM, err := GenerateCAAndTLSCert([]string{"localhost"}, nil)
+	require.NoError(t, err)
+	_, otherCACertPEM, err := GenerateCAAndTLSCert([]string{"localhost"}, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		tlsCert   tls.Certificate
+		caCertPEM []byte
+		wantErr   string
+	}{
+		{
+			name:      "matching pair",
+			tlsCert:   tlsCert,
+			caCertPEM: caCertPEM,
+		},
+		{
+			name:      "mismatched CA",
+			tlsCert:   tlsCert,
+			caCertPEM: otherCACertPEM,
+			wantErr:   `certificate "localhost" issued by "MCA CA" does not chain to the CA: x509: certificate signed by unknown authority`,
+		},
+		{
+			name:      "no CA certificate",
+			tlsCert:   tlsCert,
+			caCertPEM: []byte("not a certificate"),
+			wantErr:   "no CA certificate found in PEM",
+		},
+		{
+			name:      "empty certificate",
+			caCertPEM: caCertPEM,
+			wantErr:   "certificate is empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyChain(tt.tlsCert, tt.caCertPEM)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package certs
+
+import (
+	"crypto/tls"
+
+	"github.com/marxus/k8s-mca/conf"
+)
+
+// ServerTLSConfig returns the TLS configuration serving tlsCert, with session tickets and
+// renegotiation set from conf.TLSSessionTicketsDisabled and conf.TLSRenegotiation. Both are
+// off by default, as some compliance profiles require.
+//
+// Go TLS servers never accept renegotiation, so conf.TLSRenegotiation only takes effect where
+// the configuration is reused for a client.
+func ServerTLSConfig(tlsCert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates:           []tls.Certificate{tlsCert},
+		SessionTicketsDisabled: conf.TLSSessionTicketsDisabled,
+		Renegotiation:          renegotiation(conf.TLSRenegotiation),
+	}
+}
+
+// renegotiation returns the renegotiation support named by mode, refusing it for unknown modes.
+func renegotiation(mode string) tls.RenegotiationSupport {
+	switch mode {
+	case conf.TLSRenegotiationOnce:
+		return tls.RenegotiateOnceAsClient
+	case conf.TLSRenegotiationFreely:
+		return tls.RenegotiateFreelyAsClient
+	default:
+		return tls.RenegotiateNever
+	}
+}
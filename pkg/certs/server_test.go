@@ -0,0 +1,60 @@
+// Package certs tests the serving TLS configuration built from conf.
+package certs
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerTLSConfig(t *testing.T) {
+	tests := []struct {
+		name                   string
+		sessionTicketsDisabled bool
+		renegotiation          string
+		wantRenegotiation      tls.RenegotiationSupport
+	}{
+		{
+			name:                   "secure defaults",
+			sessionTicketsDisabled: true,
+			renegotiation:          conf.TLSRenegotiationNever,
+			wantRenegotiation:      tls.RenegotiateNever,
+		},
+		{
+			name:              "session tickets and single renegotiation",
+			renegotiation:     conf.TLSRenegotiationOnce,
+			wantRenegotiation: tls.RenegotiateOnceAsClient,
+		},
+		{
+			name:                   "free renegotiation",
+			sessionTicketsDisabled: true,
+			renegotiation:          conf.TLSRenegotiationFreely,
+			wantRenegotiation:      tls.RenegotiateFreelyAsClient,
+		},
+		{
+			name:                   "unknown renegotiation is refused",
+			sessionTicketsDisabled: true,
+			renegotiation:          "sometimes",
+			wantRenegotiation:      tls.RenegotiateNever,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalTickets, originalRenegotiation := conf.TLSSessionTicketsDisabled, conf.TLSRenegotiation
+			conf.TLSSessionTicketsDisabled, conf.TLSRenegotiation = tt.sessionTicketsDisabled, tt.renegotiation
+			defer func() {
+				conf.TLSSessionTicketsDisabled, conf.TLSRenegotiation = originalTickets, originalRenegotiation
+			}()
+
+			tlsCert := tls.Certificate{Certificate: [][]byte{[]byte("leaf")}}
+			config := ServerTLSConfig(tlsCert)
+
+			assert.Equal(t, []tls.Certificate{tlsCert}, config.Certificates)
+			assert.Equal(t, tt.sessionTicketsDisabled, config.SessionTicketsDisabled)
+			assert.Equal(t, tt.wantRenegotiation, config.Renegotiation)
+		})
+	}
+}
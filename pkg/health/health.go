@@ -0,0 +1,93 @@
+// Package health provides JSON health reporting broken down by subsystem.
+// Each subsystem is a named check; the overall status is healthy only when every check passes,
+// so probes can keep relying on the HTTP status code while operators read the detailed body.
+package health
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Statuses reported for subsystems and overall health.
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+)
+
+// Check reports the health of a single subsystem, returning nil when it is healthy.
+type Check func() error
+
+// SubsystemStatus is the health of a single subsystem.
+type SubsystemStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the JSON body served by [Handler].
+type Report struct {
+	Status     string                     `json:"status"`
+	Subsystems map[string]SubsystemStatus `json:"subsystems"`
+}
+
+// Evaluate runs every check and returns the resulting report.
+func Evaluate(checks map[string]Check) Report {
+	report := Report{
+		Status:     StatusOK,
+		Subsystems: make(map[string]SubsystemStatus, len(checks)),
+	}
+
+	for name, check := range checks {
+		if err := check(); err != nil {
+			report.Subsystems[name] = SubsystemStatus{Status: StatusFailing, Error: err.Error()}
+			report.Status = StatusFailing
+			continue
+		}
+		report.Subsystems[name] = SubsystemStatus{Status: StatusOK}
+	}
+
+	return report
+}
+
+// Handler serves the [Report] for checks as JSON, with 200 when healthy and 503 otherwise.
+// checks is called on every request so subsystems may change over the server's lifetime.
+func Handler(checks func() map[string]Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := Evaluate(checks())
+
+		statusCode := http.StatusOK
+		if report.Status != StatusOK {
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// CertCheck returns a check that fails when tlsCert has no certificate or its leaf has expired.
+func CertCheck(tlsCert tls.Certificate) Check {
+	return func() error {
+		if len(tlsCert.Certificate) == 0 {
+			return errors.New("no certificate loaded")
+		}
+
+		leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate: %w", err)
+		}
+
+		if now := time.Now(); now.After(leaf.NotAfter) {
+			return fmt.Errorf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+		} else if now.Before(leaf.NotBefore) {
+			return fmt.Errorf("certificate not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+		}
+
+		return nil
+	}
+}
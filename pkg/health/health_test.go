@@ -0,0 +1,130 @@
+// Package health tests subsystem health evaluation and reporting.
+package health
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		checks     map[string]Check
+		wantCode   int
+		wantReport Report
+	}{
+		{
+			name: "all subsystems healthy",
+			checks: map[string]Check{
+				"cert":     func() error { return nil },
+				"upstream": func() error { return nil },
+			},
+			wantCode: http.StatusOK,
+			wantReport: Report{
+				Status: StatusOK,
+				Subsystems: map[string]SubsystemStatus{
+					"cert":     {Status: StatusOK},
+					"upstream": {Status: StatusOK},
+				},
+			},
+		},
+		{
+			name: "one subsystem failing",
+			checks: map[string]Check{
+				"cert":     func() error { return nil },
+				"upstream": func() error { return errors.New("connection refused") },
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantReport: Report{
+				Status: StatusFailing,
+				Subsystems: map[string]SubsystemStatus{
+					"cert":     {Status: StatusOK},
+					"upstream": {Status: StatusFailing, Error: "connection refused"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			Handler(func() map[string]Check { return tt.checks }).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			assert.Equal(t, tt.wantCode, recorder.Code)
+			assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+			var report Report
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+			assert.Equal(t, tt.wantReport, report)
+		})
+	}
+}
+
+func TestCertCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		cert    tls.Certificate
+		wantErr string
+	}{
+		{
+			name: "valid certificate",
+			cert: testCert(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)),
+		},
+		{
+			name:    "no certificate",
+			cert:    tls.Certificate{},
+			wantErr: "no certificate loaded",
+		},
+		{
+			name:    "expired certificate",
+			cert:    testCert(t, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)),
+			wantErr: "certificate expired at",
+		},
+		{
+			name:    "unparsable certificate",
+			cert:    tls.Certificate{Certificate: [][]byte{{1, 2, 3}}},
+			wantErr: "failed to parse certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CertCheck(tt.cert)()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func testCert(t *testing.T, notBefore, notAfter time.Time) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: key}
+}
@@ -0,0 +1,57 @@
+package inject
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/marxus/k8s-mca/conf"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// stampConfigHash sets the conf.ConfigHashAnnotation annotation to the hash of the injection
+// config proxyContainer was built with. It is only stamped when the proxy is newly injected,
+// so a pod keeps the hash of the config its existing proxy came from.
+func stampConfigHash(pod *corev1.Pod, proxyContainer corev1.Container) error {
+	if conf.ConfigHashAnnotation == "" {
+		return nil
+	}
+
+	hash, err := configHash(proxyContainer)
+	if err != nil {
+		return fmt.Errorf("failed to hash MCA config: %w", err)
+	}
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[conf.ConfigHashAnnotation] = hash
+	return nil
+}
+
+// configHash returns a short hash of the settings of proxyContainer that come from the
+// injection config, together with the sidecar mode and the startup fence.
+func configHash(proxyContainer corev1.Container) (string, error) {
+	data, err := json.Marshal(struct {
+		Image           string                      `json:"image"`
+		Resources       corev1.ResourceRequirements `json:"resources"`
+		SecurityContext *corev1.SecurityContext     `json:"securityContext"`
+		StartupProbe    *corev1.Probe               `json:"startupProbe"`
+		SidecarMode     string                      `json:"sidecarMode"`
+		Lifecycle       *corev1.Lifecycle           `json:"lifecycle,omitempty"`
+	}{
+		Image:           proxyContainer.Image,
+		Resources:       proxyContainer.Resources,
+		SecurityContext: proxyContainer.SecurityContext,
+		StartupProbe:    proxyContainer.StartupProbe,
+		SidecarMode:     conf.ProxySidecarMode,
+		Lifecycle:       proxyContainer.Lifecycle,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8]), nil
+}
@@ -0,0 +1,96 @@
+package inject
+
+import (
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestInjectProxy_ConfigHash(t *testing.T) {
+	newPod := func(annotations map[string]string) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+			},
+		}
+	}
+	hashOf := func(t *testing.T, pod corev1.Pod) string {
+		mutatedPod, err := injectProxy(pod)
+		require.NoError(t, err)
+		hash := mutatedPod.Annotations[conf.ConfigHashAnnotation]
+		require.NotEmpty(t, hash)
+		return hash
+	}
+
+	baseline := hashOf(t, newPod(nil))
+	assert.Equal(t, baseline, hashOf(t, newPod(nil)), "hash is stable for the same config")
+	assert.Equal(t, baseline, hashOf(t, newPod(map[string]string{"team": "a"})), "hash ignores unrelated annotations")
+
+	tests := []struct {
+		name   string
+		pod    corev1.Pod
+		modify func()
+	}{
+		{
+			name: "image",
+			pod:  newPod(map[string]string{AnnotationProxyImage: "mca:v2"}),
+		},
+		{
+			name: "resources",
+			pod:  newPod(map[string]string{AnnotationProxyProfile: "large"}),
+		},
+		{
+			name:   "startup probe",
+			pod:    newPod(nil),
+			modify: func() { conf.ProxyStartupProbe = conf.StartupProbeTCP },
+		},
+		{
+			name:   "sidecar mode",
+			pod:    newPod(nil),
+			modify: func() { conf.ProxySidecarMode = conf.SidecarModeLegacy },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("changes with "+tt.name, func(t *testing.T) {
+			originalProbe, originalMode := conf.ProxyStartupProbe, conf.ProxySidecarMode
+			defer func() { conf.ProxyStartupProbe, conf.ProxySidecarMode = originalProbe, originalMode }()
+			if tt.modify != nil {
+				tt.modify()
+			}
+
+			assert.NotEqual(t, baseline, hashOf(t, tt.pod))
+		})
+	}
+}
+
+func TestInjectProxy_ConfigHashKeptForExistingProxy(t *testing.T) {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{conf.ConfigHashAnnotation: "stale"}},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "mca-proxy", Image: "mca:v1"}},
+			Containers:     []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+
+	mutatedPod, err := injectProxy(pod)
+	require.NoError(t, err)
+	assert.Equal(t, "stale", mutatedPod.Annotations[conf.ConfigHashAnnotation])
+}
+
+func TestInjectProxy_ConfigHashDisabled(t *testing.T) {
+	originalAnnotation := conf.ConfigHashAnnotation
+	conf.ConfigHashAnnotation = ""
+	defer func() { conf.ConfigHashAnnotation = originalAnnotation }()
+
+	mutatedPod, err := injectProxy(corev1.Pod{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, mutatedPod.Annotations)
+}
@@ -0,0 +1,55 @@
+package inject
+
+import (
+	"fmt"
+
+	"github.com/marxus/k8s-mca/conf"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// EnvSizeWarnings returns a warning for each container of mutated whose env grew with
+// injection and now exceeds conf.EnvSizeWarnBytes. Env size is estimated as the bytes of the
+// "NAME=value" entries a process would receive; values resolved from references and envFrom
+// sources cannot be measured at admission and are not counted.
+func EnvSizeWarnings(original, mutated corev1.Pod) []string {
+	if conf.EnvSizeWarnBytes <= 0 {
+		return nil
+	}
+
+	originalSizes := map[string]int{}
+	for _, container := range allContainers(&original) {
+		originalSizes[container.Name] = envSize(container.Env)
+	}
+
+	var warnings []string
+	for _, container := range allContainers(&mutated) {
+		size := envSize(container.Env)
+		if size <= conf.EnvSizeWarnBytes || size <= originalSizes[container.Name] {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("container %q env is %d bytes with MCA additions, over the %d byte threshold",
+			container.Name, size, conf.EnvSizeWarnBytes))
+	}
+	return warnings
+}
+
+// allContainers returns the init and regular containers of pod, without copying them.
+func allContainers(pod *corev1.Pod) []*corev1.Container {
+	containers := make([]*corev1.Container, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	for i := range pod.Spec.InitContainers {
+		containers = append(containers, &pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		containers = append(containers, &pod.Spec.Containers[i])
+	}
+	return containers
+}
+
+// envSize returns the size of env as "NAME=value\x00" entries.
+func envSize(env []corev1.EnvVar) int {
+	size := 0
+	for _, envVar := range env {
+		size += len(envVar.Name) + len(envVar.Value) + 2
+	}
+	return size
+}
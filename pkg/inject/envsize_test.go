@@ -0,0 +1,70 @@
+package inject
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestEnvSizeWarnings(t *testing.T) {
+	largeEnv := []corev1.EnvVar{{Name: "BLOB", Value: strings.Repeat("x", 1000)}}
+
+	tests := []struct {
+		name         string
+		threshold    int
+		env          []corev1.EnvVar
+		wantWarnings []string
+	}{
+		{
+			name:      "under threshold",
+			threshold: 2000,
+			env:       largeEnv,
+		},
+		{
+			name:      "pushed over threshold by injection",
+			threshold: 1010,
+			env:       largeEnv,
+			wantWarnings: []string{
+				`container "app" env is 1069 bytes with MCA additions, over the 1010 byte threshold`,
+			},
+		},
+		{
+			name:      "disabled",
+			threshold: 0,
+			env:       largeEnv,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalThreshold := conf.EnvSizeWarnBytes
+			conf.EnvSizeWarnBytes = tt.threshold
+			defer func() { conf.EnvSizeWarnBytes = originalThreshold }()
+
+			pod := corev1.Pod{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx", Env: tt.env}}},
+			}
+			mutated, err := injectProxy(pod)
+			assert.NoError(t, err)
+
+			assert.Equal(t, tt.wantWarnings, EnvSizeWarnings(pod, mutated))
+		})
+	}
+}
+
+func TestEnvSizeWarnings_IgnoresContainersNotGrown(t *testing.T) {
+	originalThreshold := conf.EnvSizeWarnBytes
+	conf.EnvSizeWarnBytes = 10
+	defer func() { conf.EnvSizeWarnBytes = originalThreshold }()
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Env: []corev1.EnvVar{{Name: "BLOB", Value: strings.Repeat("x", 100)}}},
+		}},
+	}
+
+	assert.Empty(t, EnvSizeWarnings(pod, pod))
+}
@@ -0,0 +1,64 @@
+package inject
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+// Section headers delimiting the output of [ViaExplain].
+const (
+	ExplainJSONPatchHeader  = "--- JSON patch ---"
+	ExplainMergePatchHeader = "--- strategic merge patch ---"
+	ExplainFinalPodHeader   = "--- final pod ---"
+)
+
+// ViaExplain injects the MCA proxy container into a pod from YAML input and describes the
+// mutation for debugging: the JSON patch the webhook would send, the equivalent strategic
+// merge patch, and the final pod as YAML, each under its own section header.
+//
+// Returns an error if unmarshaling fails, injection fails, or patch generation fails.
+func ViaExplain(podYAML []byte) ([]byte, error) {
+	var pod corev1.Pod
+	if err := yaml.Unmarshal(podYAML, &pod); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pod: %w", err)
+	}
+
+	mutatedPod, err := injectProxy(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonPatch, err := JSONPatch(pod, mutatedPod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate JSON patch: %w", err)
+	}
+
+	originalJSON, err := json.Marshal(&pod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pod: %w", err)
+	}
+	mutatedJSON, err := json.Marshal(&mutatedPod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pod: %w", err)
+	}
+	mergePatch, err := strategicpatch.CreateTwoWayMergePatch(originalJSON, mutatedJSON, corev1.Pod{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate strategic merge patch: %w", err)
+	}
+
+	mutatedPodYAML, err := yaml.Marshal(&mutatedPod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pod: %w", err)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%s\n%s\n", ExplainJSONPatchHeader, jsonPatch)
+	fmt.Fprintf(&out, "%s\n%s\n", ExplainMergePatchHeader, mergePatch)
+	fmt.Fprintf(&out, "%s\n%s", ExplainFinalPodHeader, mutatedPodYAML)
+	return out.Bytes(), nil
+}
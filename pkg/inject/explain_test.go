@@ -0,0 +1,84 @@
+package inject
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+func TestViaExplain(t *testing.T) {
+	podYAML := []byte(`
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test-pod
+spec:
+  initContainers:
+    - name: init-db
+      image: postgres:init
+  containers:
+    - name: app
+      image: nginx
+`)
+
+	out, err := ViaExplain(podYAML)
+	require.NoError(t, err)
+
+	jsonPatchStart := bytes.Index(out, []byte(ExplainJSONPatchHeader))
+	mergePatchStart := bytes.Index(out, []byte(ExplainMergePatchHeader))
+	finalPodStart := bytes.Index(out, []byte(ExplainFinalPodHeader))
+	require.Equal(t, 0, jsonPatchStart)
+	require.Greater(t, mergePatchStart, jsonPatchStart)
+	require.Greater(t, finalPodStart, mergePatchStart)
+
+	jsonPatch := out[jsonPatchStart+len(ExplainJSONPatchHeader) : mergePatchStart]
+	mergePatch := out[mergePatchStart+len(ExplainMergePatchHeader) : finalPodStart]
+	finalPodYAML := out[finalPodStart+len(ExplainFinalPodHeader):]
+
+	var finalPod corev1.Pod
+	require.NoError(t, yaml.Unmarshal(finalPodYAML, &finalPod))
+	require.Len(t, finalPod.Spec.InitContainers, 2)
+	assert.Equal(t, "mca-proxy", finalPod.Spec.InitContainers[0].Name)
+
+	originalJSON, err := yaml.YAMLToJSON(podYAML)
+	require.NoError(t, err)
+	finalJSON, err := json.Marshal(&finalPod)
+	require.NoError(t, err)
+
+	t.Run("JSON patch yields final pod", func(t *testing.T) {
+		patch, err := jsonpatch.DecodePatch(bytes.TrimSpace(jsonPatch))
+		require.NoError(t, err)
+		patchedJSON, err := patch.Apply(originalJSON)
+		require.NoError(t, err)
+
+		assertSamePod(t, finalJSON, patchedJSON)
+	})
+
+	t.Run("strategic merge patch yields final pod", func(t *testing.T) {
+		patchedJSON, err := strategicpatch.StrategicMergePatch(originalJSON, bytes.TrimSpace(mergePatch), corev1.Pod{})
+		require.NoError(t, err)
+
+		assertSamePod(t, finalJSON, patchedJSON)
+	})
+}
+
+func TestViaExplain_InvalidYAML(t *testing.T) {
+	_, err := ViaExplain([]byte("invalid: yaml: content: ["))
+	assert.ErrorContains(t, err, "failed to unmarshal pod")
+}
+
+func assertSamePod(t *testing.T, wantJSON, gotJSON []byte) {
+	t.Helper()
+
+	var want, got corev1.Pod
+	require.NoError(t, json.Unmarshal(wantJSON, &want))
+	require.NoError(t, json.Unmarshal(gotJSON, &got))
+	assert.Equal(t, want, got)
+}
@@ -4,132 +4,629 @@
 package inject
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/marxus/k8s-mca/conf"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/yaml"
 )
 
+// Pod annotations recognized during injection.
+const (
+	// AnnotationInject opts a pod out of injection when set to "false".
+	AnnotationInject = "mca.marxus.io/inject"
+	// AnnotationProxyProfile selects a resource profile from conf.ProxyResourceProfiles for the proxy.
+	AnnotationProxyProfile = "mca.marxus.io/proxy-profile"
+	// AnnotationProxyImage overrides the proxy image for the pod.
+	AnnotationProxyImage = "mca.marxus.io/proxy-image"
+	// AnnotationProxyAfter inserts the proxy right after the named init container, e.g. a mesh sidecar.
+	AnnotationProxyAfter = "mca.marxus.io/proxy-after"
+	// AnnotationProxyArgs replaces the proxy args with a comma-separated list; --proxy is always kept.
+	AnnotationProxyArgs = "mca.marxus.io/proxy-args"
+	// AnnotationUpstream records the in-cluster API server the injected proxy targets, when known.
+	AnnotationUpstream = "mca.marxus.io/upstream"
+	// AnnotationForceReinject rebuilds an existing proxy container from the current config when
+	// set to "true", instead of keeping it as is.
+	AnnotationForceReinject = "mca.marxus.io/force-reinject"
+)
+
+// proxyPort is the port the injected proxy serves the Kubernetes API on.
+const proxyPort = 6443
+
+// proxyHealthPort is the port the injected proxy answers startup probes on.
+const proxyHealthPort = 6444
+
 var proxyContainerYAML = `
 name: mca-proxy
 restartPolicy: Always
 imagePullPolicy: Always # TODO: remove this in the end
-securityContext: { runAsNonRoot: true, runAsUser: 999 }
+securityContext:
+  runAsNonRoot: true
+  allowPrivilegeEscalation: false
+  capabilities: { drop: [ALL] }
+  seccompProfile: { type: RuntimeDefault }
 args: [--proxy]
 env:
   - name: NAMESPACE
     valueFrom: { fieldRef: { fieldPath: metadata.namespace } }
+  - name: POD_NAME
+    valueFrom: { fieldRef: { fieldPath: metadata.name } }
 volumeMounts:
   - name: kube-api-access-mca-sa
     mountPath: /var/run/secrets/kubernetes.io/mca-serviceaccount
 `
 
-// ViaCLI injects the MCA proxy container into a pod from YAML input.
-// It unmarshals the pod YAML, injects the proxy, and returns the mutated pod as YAML.
+// proxyContainerTemplate parses proxyContainerYAML once; callers must copy the result.
+var proxyContainerTemplate = sync.OnceValues(func() (*corev1.Container, error) {
+	var container corev1.Container
+	if err := yaml.Unmarshal([]byte(proxyContainerYAML), &container); err != nil {
+		return nil, err
+	}
+	return &container, nil
+})
+
+// setProxyRunAsUser sets the UID of the proxy container from conf.ProxyRunAsUser, leaving
+// it unset in conf.ProxyRunAsUserAuto mode. runAsNonRoot stays set either way.
+func setProxyRunAsUser(proxyContainer *corev1.Container) error {
+	if conf.ProxyRunAsUser == conf.ProxyRunAsUserAuto {
+		proxyContainer.SecurityContext.RunAsUser = nil
+		proxyContainer.SecurityContext.RunAsGroup = nil
+		return nil
+	}
+	uid, err := strconv.ParseInt(conf.ProxyRunAsUser, 10, 64)
+	if err != nil || uid <= 0 {
+		return fmt.Errorf("invalid proxy runAsUser %q, must be a non-root UID or %q", conf.ProxyRunAsUser, conf.ProxyRunAsUserAuto)
+	}
+	proxyContainer.SecurityContext.RunAsUser = &uid
+	return nil
+}
+
+// apiEnvVars are the env vars pointing a container at the proxy, in the order they are added.
+var apiEnvVars = [...]corev1.EnvVar{
+	{Name: "KUBERNETES_SERVICE_HOST", Value: "127.0.0.1"},
+	{Name: "KUBERNETES_SERVICE_PORT", Value: strconv.Itoa(proxyPort)},
+}
+
+// serviceAccountMount replaces the service account mount of redirected containers.
+var serviceAccountMount = corev1.VolumeMount{
+	Name:      "kube-api-access-mca-sa",
+	MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+	ReadOnly:  true,
+}
+
+var proxyImageOverride atomic.Pointer[string]
+
+// SetProxyImage overrides conf.ProxyImage for subsequent injections.
+// Passing an empty image restores conf.ProxyImage. It is safe for concurrent use.
+func SetProxyImage(image string) {
+	proxyImageOverride.Store(&image)
+}
+
+// ProxyImage returns the image used for newly injected proxy containers.
+func ProxyImage() string {
+	if image := proxyImageOverride.Load(); image != nil && *image != "" {
+		return *image
+	}
+	return conf.ProxyImage
+}
+
+var upstream atomic.Pointer[string]
+
+// SetUpstream sets the API server recorded in AnnotationUpstream on subsequently injected
+// pods. Passing an empty host stops recording it. It is safe for concurrent use.
+func SetUpstream(host string) {
+	upstream.Store(&host)
+}
+
+func stampUpstream(pod *corev1.Pod) {
+	host := upstream.Load()
+	if host == nil || *host == "" {
+		return
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[AnnotationUpstream] = *host
+}
+
+// Output formats accepted by [ViaCLIFormat].
+const (
+	// OutputAuto emits the format the pod was read in.
+	OutputAuto = ""
+	// OutputJSON emits the pod as indented JSON.
+	OutputJSON = "json"
+	// OutputYAML emits the pod as YAML.
+	OutputYAML = "yaml"
+)
+
+// ViaCLI injects the MCA proxy container into a pod from YAML or JSON input.
+// It unmarshals the pod, injects the proxy, and returns the mutated pod in the input's format.
+// Pods in namespaces skipped by [NamespaceSkipReason] are returned unchanged with a logged
+// notice; a pod without a namespace is treated as being in "default".
 //
 // Returns an error if unmarshaling fails, injection fails, or marshaling fails.
 func ViaCLI(podYAML []byte) ([]byte, error) {
+	return ViaCLIFormat(podYAML, OutputAuto)
+}
+
+// ViaCLIFormat is like [ViaCLI] but emits the pod in format, one of [OutputAuto],
+// [OutputJSON] or [OutputYAML].
+//
+// Returns an error if format is unsupported, unmarshaling fails, injection fails, or marshaling fails.
+func ViaCLIFormat(podYAML []byte, format string) ([]byte, error) {
+	inputFormat := detectFormat(podYAML)
+	switch format {
+	case OutputAuto:
+		format = inputFormat
+	case OutputJSON, OutputYAML:
+	default:
+		return nil, fmt.Errorf("unsupported output format %q", format)
+	}
+
 	var pod corev1.Pod
 	if err := yaml.Unmarshal(podYAML, &pod); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal pod: %w", err)
 	}
 
+	namespace := pod.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	if reason := NamespaceSkipReason(namespace); reason != "" {
+		log.Printf("Skipped MCA injection: %s", reason)
+		if format == inputFormat {
+			return podYAML, nil
+		}
+		return marshalPod(&pod, format)
+	}
+
 	mutatedPod, err := injectProxy(pod)
 	if err != nil {
 		return nil, err
 	}
 
-	mutatedPodYAML, err := yaml.Marshal(&mutatedPod)
+	return marshalPod(&mutatedPod, format)
+}
+
+// detectFormat returns [OutputJSON] for input that is a JSON object and [OutputYAML] otherwise.
+func detectFormat(input []byte) string {
+	if bytes.HasPrefix(bytes.TrimSpace(input), []byte("{")) {
+		return OutputJSON
+	}
+	return OutputYAML
+}
+
+func marshalPod(pod *corev1.Pod, format string) ([]byte, error) {
+	if format == OutputJSON {
+		podJSON, err := json.MarshalIndent(pod, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal pod: %w", err)
+		}
+		return append(podJSON, '\n'), nil
+	}
+
+	podYAML, err := yaml.Marshal(pod)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal pod: %w", err)
 	}
+	return podYAML, nil
+}
+
+// Decision is whether [ViaWebhookResult] changed a pod.
+type Decision string
+
+// Decisions of [ViaWebhookResult].
+const (
+	// DecisionInjected means the pod was mutated to use the proxy.
+	DecisionInjected Decision = "Injected"
+	// DecisionSkipped means the pod was left unchanged.
+	DecisionSkipped Decision = "Skipped"
+)
 
-	return mutatedPodYAML, nil
+// WebhookResult is the outcome of injecting a pod from a webhook admission request.
+type WebhookResult struct {
+	// Pod is the mutated pod, equal to the input when the decision is [DecisionSkipped].
+	Pod corev1.Pod
+	// Decision is whether the pod was changed.
+	Decision Decision
+	// Reason explains the decision.
+	Reason string
+	// Warnings are meant for the client, such as env size warnings.
+	Warnings []string
 }
 
 // ViaWebhook injects the MCA proxy container into a pod from a webhook admission request.
 // It injects the proxy sidecar and configures containers to use the local proxy endpoint.
 //
-// Returns the mutated pod and an error if injection fails.
+// Returns the mutated pod and an error if injection fails. See [ViaWebhookResult] for the
+// decision and warnings behind the mutation.
 func ViaWebhook(pod corev1.Pod) (corev1.Pod, error) {
-	return injectProxy(pod)
+	result, err := ViaWebhookResult(pod)
+	if err != nil {
+		return corev1.Pod{}, err
+	}
+	return result.Pod, nil
+}
+
+// ViaWebhookResult injects the MCA proxy container into a pod like [ViaWebhook], and reports
+// whether the pod was changed, why, and the warnings to return to the client. A pod that
+// already runs an up-to-date proxy is skipped.
+//
+// Returns an error if injection fails.
+func ViaWebhookResult(pod corev1.Pod) (WebhookResult, error) {
+	mutatedPod, warnings, err := injectProxyWithWarnings(pod)
+	if err != nil {
+		return WebhookResult{}, err
+	}
+	if equality.Semantic.DeepEqual(pod, mutatedPod) {
+		return WebhookResult{
+			Pod:      mutatedPod,
+			Decision: DecisionSkipped,
+			Reason:   "pod already uses the MCA proxy",
+		}, nil
+	}
+	return WebhookResult{
+		Pod:      mutatedPod,
+		Decision: DecisionInjected,
+		Reason:   "MCA proxy injected",
+		Warnings: warnings,
+	}, nil
 }
 
 func injectProxy(pod corev1.Pod) (corev1.Pod, error) {
-	var proxyContainer corev1.Container
-	var filteredInitContainers []corev1.Container
-	for _, container := range pod.Spec.InitContainers {
-		if container.Name == "mca-proxy" {
-			proxyContainer = container
-		} else {
-			filteredInitContainers = append(filteredInitContainers, container)
-		}
+	pod, _, err := injectProxyWithWarnings(pod)
+	return pod, err
+}
+
+// injectProxyWithWarnings injects the proxy into pod and also returns, after logging them, the
+// warnings about the node capacity hint and container env sizes it raised.
+func injectProxyWithWarnings(pod corev1.Pod) (corev1.Pod, []string, error) {
+	if err := checkServiceAccount(pod); err != nil {
+		return corev1.Pod{}, nil, err
+	}
+
+	original := pod
+	pod = *pod.DeepCopy()
+
+	proxyContainer, inContainers := findProxyContainer(pod)
+	if proxyContainer.Name != "" && pod.Annotations[AnnotationForceReinject] == "true" {
+		log.Printf("Forcing re-injection of %s via %s annotation", conf.ProxyContainerName, AnnotationForceReinject)
+		proxyContainer = corev1.Container{}
 	}
+	filteredInitContainers := withoutProxy(pod.Spec.InitContainers)
+	filteredContainers := withoutProxy(pod.Spec.Containers)
 
+	resolved := resolveSettings(pod.Namespace, pod.Annotations)
 	if proxyContainer.Image == "" {
-		if err := yaml.Unmarshal([]byte(proxyContainerYAML), &proxyContainer); err != nil {
-			return corev1.Pod{}, fmt.Errorf("failed to create MCA container: %w", err)
+		template, err := proxyContainerTemplate()
+		if err != nil {
+			return corev1.Pod{}, nil, fmt.Errorf("failed to create MCA container: %w", err)
+		}
+		proxyContainer = *template.DeepCopy()
+		proxyContainer.Name = conf.ProxyContainerName
+		if err := setProxyRunAsUser(&proxyContainer); err != nil {
+			return corev1.Pod{}, nil, err
+		}
+		proxyContainer.Image = resolved.proxyImage
+		if resolved.proxyArgs != nil {
+			proxyContainer.Args = resolved.proxyArgs
+		}
+		proxyContainer.Resources = proxyResources(resolved.proxyProfile)
+		scaleProxyRequests(&proxyContainer.Resources, filteredContainers)
+		addStartupProbe(&proxyContainer)
+		addPodInfoMount(&proxyContainer)
+		inContainers = conf.ProxySidecarMode == conf.SidecarModeLegacy
+		if inContainers {
+			proxyContainer.RestartPolicy = nil
+			addStartupFence(&proxyContainer)
+		}
+		if err := stampConfigHash(&pod, proxyContainer); err != nil {
+			return corev1.Pod{}, nil, err
+		}
+		if err := stampSummary(&pod, proxyContainer, resolved.proxyProfile); err != nil {
+			return corev1.Pod{}, nil, err
 		}
-		proxyContainer.Image = conf.ProxyImage
 	}
 
-	pod.Spec.InitContainers = append([]corev1.Container{proxyContainer}, filteredInitContainers...)
+	// A legacy sidecar starts after every init container, so none of them can reach it.
+	proxyIndex := len(filteredInitContainers)
+	if inContainers {
+		pod.Spec.InitContainers = filteredInitContainers
+		pod.Spec.Containers = append([]corev1.Container{proxyContainer}, filteredContainers...)
+	} else {
+		// The skipped init containers run before anything else, the proxy included.
+		proxyIndex = max(proxyInsertIndex(filteredInitContainers, resolved.proxyAfter), skippedInitContainers(filteredInitContainers))
+		pod.Spec.InitContainers = slices.Insert(filteredInitContainers, proxyIndex, proxyContainer)
+	}
 
-	for i := range filteredInitContainers {
-		container := &filteredInitContainers[i]
-		addVolumeMount(container)
-		addEnvVars(container)
+	for _, i := range initContainersToRewrite(pod.Spec.InitContainers, proxyIndex) {
+		if err := redirectContainer(&pod.Spec.InitContainers[i]); err != nil {
+			return corev1.Pod{}, nil, err
+		}
 	}
 
 	for i := range pod.Spec.Containers {
-		container := &pod.Spec.Containers[i]
-		addVolumeMount(container)
-		addEnvVars(container)
+		if pod.Spec.Containers[i].Name == conf.ProxyContainerName {
+			continue
+		}
+		if err := redirectContainer(&pod.Spec.Containers[i]); err != nil {
+			return corev1.Pod{}, nil, err
+		}
 	}
 
 	addRequiredVolume(&pod)
+	addPodInfoVolume(&pod)
+	copyNamespaceAnnotations(&pod)
+	stampUpstream(&pod)
+
+	if err := applyTransformers(&pod); err != nil {
+		return corev1.Pod{}, nil, err
+	}
 
+	warnings := append(capacityWarnings(original, pod), EnvSizeWarnings(original, pod)...)
+	for _, warning := range warnings {
+		log.Printf("Warning: %s", warning)
+	}
+
+	if err := checkPodSecurity(original, pod); err != nil {
+		return corev1.Pod{}, nil, err
+	}
+
+	return pod, warnings, nil
+}
+
+// Injected reports whether pod carries a proxy container, named conf.ProxyContainerName.
+func Injected(pod corev1.Pod) bool {
+	proxyContainer, _ := findProxyContainer(pod)
+	return proxyContainer.Name != ""
+}
+
+// findProxyContainer returns an existing conf.ProxyContainerName container from either the
+// init containers or, for a legacy sidecar, the regular containers, and whether it was found
+// in the latter.
+func findProxyContainer(pod corev1.Pod) (corev1.Container, bool) {
+	for _, container := range pod.Spec.InitContainers {
+		if container.Name == conf.ProxyContainerName {
+			return container, false
+		}
+	}
+	for _, container := range pod.Spec.Containers {
+		if container.Name == conf.ProxyContainerName {
+			return container, true
+		}
+	}
+	return corev1.Container{}, false
+}
+
+func withoutProxy(containers []corev1.Container) []corev1.Container {
+	var filtered []corev1.Container
+	for _, container := range containers {
+		if container.Name != conf.ProxyContainerName {
+			filtered = append(filtered, container)
+		}
+	}
+	return filtered
+}
+
+// proxyInsertIndex returns the init container index the proxy is inserted at: right after
+// the init container named after, or first when after is empty or not found.
+func proxyInsertIndex(initContainers []corev1.Container, after string) int {
+	if after == "" {
+		return 0
+	}
+	for i, container := range initContainers {
+		if container.Name == after {
+			return i + 1
+		}
+	}
+	log.Printf("Warning: init container %q not found, inserting proxy first", after)
+	return 0
+}
+
+// skippedInitContainers returns how many leading init containers conf.InitContainersSkip
+// leaves untouched, at most all of them.
+func skippedInitContainers(initContainers []corev1.Container) int {
+	return min(max(conf.InitContainersSkip, 0), len(initContainers))
+}
+
+// initContainersToRewrite returns the indexes of the init containers whose service account
+// mount and API env are rewritten under conf.InitContainersPolicy. The proxy at proxyIndex and
+// the first conf.InitContainersSkip init containers are never included. Init containers
+// starting before the proxy would find nothing listening on loopback, so the default policy
+// only rewrites those after it.
+func initContainersToRewrite(initContainers []corev1.Container, proxyIndex int) []int {
+	start := proxyIndex + 1
+	switch conf.InitContainersPolicy {
+	case conf.InitContainersNone:
+		return nil
+	case conf.InitContainersAll:
+		start = 0
+	case conf.InitContainersProxyOnly:
+	default:
+		log.Printf("Warning: unknown init containers policy %q, using %q", conf.InitContainersPolicy, conf.InitContainersProxyOnly)
+	}
+	start = max(start, skippedInitContainers(initContainers))
+
+	var indexes []int
+	for i := start; i < len(initContainers); i++ {
+		if i != proxyIndex {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func proxyResources(profile string) corev1.ResourceRequirements {
+	resources, ok := conf.ProxyResourceProfiles[profile]
+	if !ok {
+		log.Printf("Warning: unknown proxy profile %q, using default profile %q", profile, conf.ProxyDefaultProfile)
+		resources = conf.ProxyResourceProfiles[conf.ProxyDefaultProfile]
+	}
+
+	return *resources.DeepCopy()
+}
+
+// addStartupProbe adds the conf.ProxyStartupProbe startup probe to the proxy container, so
+// app containers are not started before the proxy listens. Kubelet probes the pod IP, so the
+// probe targets the proxy's plain health listener on all interfaces, while the API listener,
+// which attaches the pod's credentials, stays on loopback.
+func addStartupProbe(container *corev1.Container) {
+	var handler corev1.ProbeHandler
+	switch conf.ProxyStartupProbe {
+	case "":
+		return
+	case conf.StartupProbeTCP:
+		handler.TCPSocket = &corev1.TCPSocketAction{Port: intstr.FromInt32(proxyHealthPort)}
+	case conf.StartupProbeHTTP:
+		handler.HTTPGet = &corev1.HTTPGetAction{
+			Path:   "/healthz",
+			Port:   intstr.FromInt32(proxyHealthPort),
+			Scheme: corev1.URISchemeHTTP,
+		}
+	default:
+		log.Printf("Warning: unknown proxy startup probe %q, not adding a startup probe", conf.ProxyStartupProbe)
+		return
+	}
+
+	container.StartupProbe = &corev1.Probe{
+		ProbeHandler:     handler,
+		PeriodSeconds:    1,
+		FailureThreshold: 30,
+	}
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "MCA_PROXY_HEALTH_ADDRESS",
+		Value: fmt.Sprintf(":%d", proxyHealthPort),
+	})
+}
+
+// addStartupFence adds a postStart hook that blocks until the proxy listens when
+// conf.ProxyStartupFence is set. Kubelet starts regular containers in order and waits for
+// each postStart hook, so with the legacy sidecar first the app containers start after the
+// proxy. An init container cannot serve as the fence: it would wait for a container that only
+// starts once every init container has completed.
+func addStartupFence(container *corev1.Container) {
+	if !conf.ProxyStartupFence {
+		return
+	}
+
+	container.Lifecycle = &corev1.Lifecycle{
+		PostStart: &corev1.LifecycleHandler{
+			Exec: &corev1.ExecAction{Command: []string{"./mca", "--wait-for-proxy"}},
+		},
+	}
+}
+
+// checkServiceAccount handles a pod using the default service account, or none, according to
+// conf.ServiceAccountPolicy. The proxied calls run as that account, which often lacks RBAC.
+func checkServiceAccount(pod corev1.Pod) error {
+	if pod.Spec.ServiceAccountName != "" && pod.Spec.ServiceAccountName != "default" {
+		return nil
+	}
+
+	switch conf.ServiceAccountPolicy {
+	case conf.ServiceAccountAny:
+	case conf.ServiceAccountRequire:
+		return errors.New("pod uses the default service account, set an explicit serviceAccountName")
+	case conf.ServiceAccountWarn:
+		log.Printf("Warning: pod %s/%s uses the default service account, which may lack the RBAC its API calls need", pod.Namespace, pod.Name)
+	default:
+		log.Printf("Warning: unknown service account policy %q, using %q", conf.ServiceAccountPolicy, conf.ServiceAccountAny)
+	}
+	return nil
+}
+
+// RedirectEphemeralContainers points the ephemeral containers of an injected pod, such as
+// those added by kubectl debug, at the proxy like its other containers. Pods without a proxy
+// are returned unchanged. Containers already redirected are left as they are.
+//
+// Returns an error if an ephemeral container conflicts with conf.ServiceHostConflictPolicy.
+func RedirectEphemeralContainers(pod corev1.Pod) (corev1.Pod, error) {
+	if !Injected(pod) {
+		return pod, nil
+	}
+
+	pod = *pod.DeepCopy()
+	for i := range pod.Spec.EphemeralContainers {
+		common := &pod.Spec.EphemeralContainers[i].EphemeralContainerCommon
+		container := corev1.Container{Name: common.Name, Env: common.Env, VolumeMounts: common.VolumeMounts}
+		if err := redirectContainer(&container); err != nil {
+			return corev1.Pod{}, err
+		}
+		common.Env, common.VolumeMounts = container.Env, container.VolumeMounts
+	}
 	return pod, nil
 }
 
-func addVolumeMount(container *corev1.Container) {
-	mount := corev1.VolumeMount{
-		Name:      "kube-api-access-mca-sa",
-		MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
-		ReadOnly:  true,
+// redirectContainer points a container at the proxy. A container that already sets a
+// non-loopback KUBERNETES_SERVICE_HOST is handled according to conf.ServiceHostConflictPolicy.
+func redirectContainer(container *corev1.Container) error {
+	if host, ok := conflictingServiceHost(container); ok {
+		switch conf.ServiceHostConflictPolicy {
+		case conf.ServiceHostConflictDeny:
+			return fmt.Errorf("container %q sets KUBERNETES_SERVICE_HOST to %q", container.Name, host)
+		case conf.ServiceHostConflictWarn:
+			log.Printf("Warning: container %q sets KUBERNETES_SERVICE_HOST to %q, not redirecting it to the proxy", container.Name, host)
+			return nil
+		}
 	}
 
+	addVolumeMount(container)
+	addEnvVars(container)
+	return nil
+}
+
+func conflictingServiceHost(container *corev1.Container) (string, bool) {
+	for _, env := range container.Env {
+		if env.Name != "KUBERNETES_SERVICE_HOST" {
+			continue
+		}
+		switch env.Value {
+		case "", "127.0.0.1", "::1", "localhost":
+			return "", false
+		}
+		return env.Value, true
+	}
+	return "", false
+}
+
+func addVolumeMount(container *corev1.Container) {
 	for i := range container.VolumeMounts {
-		if container.VolumeMounts[i].MountPath == mount.MountPath {
-			container.VolumeMounts[i] = mount
+		if container.VolumeMounts[i].MountPath == serviceAccountMount.MountPath {
+			container.VolumeMounts[i] = serviceAccountMount
 			return
 		}
 	}
-	container.VolumeMounts = append(container.VolumeMounts, mount)
+	container.VolumeMounts = append(container.VolumeMounts, serviceAccountMount)
 }
 
+// addEnvVars sets apiEnvVars in container, overwriting the first existing entry of each and
+// appending the rest, in a single pass over the container's env.
 func addEnvVars(container *corev1.Container) {
-	envVars := map[string]string{
-		"KUBERNETES_SERVICE_HOST": "127.0.0.1",
-		"KUBERNETES_SERVICE_PORT": "6443",
-	}
-
-	for envName, envValue := range envVars {
-		found := false
-		for i := range container.Env {
-			env := &container.Env[i]
-			if env.Name == envName {
-				env.Value = envValue
-				found = true
-				break
+	var found [len(apiEnvVars)]bool
+	for i := range container.Env {
+		env := &container.Env[i]
+		for j, apiEnv := range apiEnvVars {
+			if env.Name == apiEnv.Name && !found[j] {
+				env.Value = apiEnv.Value
+				found[j] = true
 			}
 		}
-		if !found {
-			container.Env = append(container.Env, corev1.EnvVar{
-				Name:  envName,
-				Value: envValue,
-			})
+	}
+
+	for j, apiEnv := range apiEnvVars {
+		if !found[j] {
+			container.Env = append(container.Env, apiEnv)
 		}
 	}
 }
@@ -143,6 +640,30 @@ func addRequiredVolume(pod *corev1.Pod) {
 
 	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
 		Name:         "kube-api-access-mca-sa",
-		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		VolumeSource: corev1.VolumeSource{EmptyDir: serviceAccountVolumeSource()},
 	})
 }
+
+// serviceAccountVolumeSource returns the emptyDir of the service account volume with the
+// medium and size limit from conf. Invalid settings are logged and left unset.
+func serviceAccountVolumeSource() *corev1.EmptyDirVolumeSource {
+	emptyDir := &corev1.EmptyDirVolumeSource{}
+
+	switch medium := corev1.StorageMedium(conf.ServiceAccountVolumeMedium); medium {
+	case corev1.StorageMediumDefault, corev1.StorageMediumMemory:
+		emptyDir.Medium = medium
+	default:
+		log.Printf("Warning: unknown service account volume medium %q, using the node default", medium)
+	}
+
+	if conf.ServiceAccountVolumeSizeLimit != "" {
+		sizeLimit, err := resource.ParseQuantity(conf.ServiceAccountVolumeSizeLimit)
+		if err != nil {
+			log.Printf("Warning: invalid service account volume size limit %q, not limiting: %v", conf.ServiceAccountVolumeSizeLimit, err)
+		} else {
+			emptyDir.SizeLimit = &sizeLimit
+		}
+	}
+
+	return emptyDir
+}
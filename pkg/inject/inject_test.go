@@ -2,13 +2,17 @@
 package inject
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/marxus/k8s-mca/conf"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/yaml"
 )
 
@@ -72,6 +76,54 @@ spec:
 	}
 }
 
+func TestViaCLIFormat(t *testing.T) {
+	podYAML := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test-pod
+spec:
+  containers:
+    - name: app
+      image: nginx
+`
+	podJSON := `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"test-pod"},"spec":{"containers":[{"name":"app","image":"nginx"}]}}`
+
+	tests := []struct {
+		name     string
+		input    string
+		format   string
+		wantJSON bool
+	}{
+		{name: "YAML input emits YAML", input: podYAML, format: OutputAuto},
+		{name: "JSON input emits JSON", input: "\n  " + podJSON, format: OutputAuto, wantJSON: true},
+		{name: "JSON output overrides YAML input", input: podYAML, format: OutputJSON, wantJSON: true},
+		{name: "YAML output overrides JSON input", input: podJSON, format: OutputYAML},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := ViaCLIFormat([]byte(tt.input), tt.format)
+			require.NoError(t, err)
+
+			var pod corev1.Pod
+			if tt.wantJSON {
+				require.NoError(t, json.Unmarshal(output, &pod))
+			} else {
+				assert.False(t, json.Valid(output), "output should be YAML, not JSON")
+				require.NoError(t, yaml.Unmarshal(output, &pod))
+			}
+			require.Len(t, pod.Spec.InitContainers, 1)
+			assert.Equal(t, "mca-proxy", pod.Spec.InitContainers[0].Name)
+		})
+	}
+}
+
+func TestViaCLIFormat_UnsupportedFormat(t *testing.T) {
+	_, err := ViaCLIFormat([]byte("kind: Pod"), "xml")
+	assert.EqualError(t, err, `unsupported output format "xml"`)
+}
+
 func TestViaWebhook_BasicPod(t *testing.T) {
 	pod := corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -126,6 +178,23 @@ func TestInjectProxy_AddsProxyInitContainer(t *testing.T) {
 	assert.True(t, *proxyContainer.SecurityContext.RunAsNonRoot)
 }
 
+func TestInjectProxy_AddsDownwardAPIEnvToProxy(t *testing.T) {
+	result, err := injectProxy(corev1.Pod{})
+	require.NoError(t, err)
+
+	fieldPaths := make(map[string]string)
+	for _, env := range result.Spec.InitContainers[0].Env {
+		require.NotNil(t, env.ValueFrom)
+		require.NotNil(t, env.ValueFrom.FieldRef)
+		fieldPaths[env.Name] = env.ValueFrom.FieldRef.FieldPath
+	}
+
+	assert.Equal(t, map[string]string{
+		"NAMESPACE": "metadata.namespace",
+		"POD_NAME":  "metadata.name",
+	}, fieldPaths)
+}
+
 func TestInjectProxy_PreservesExistingProxyContainer(t *testing.T) {
 	existingProxy := corev1.Container{
 		Name:  "mca-proxy",
@@ -570,3 +639,857 @@ func TestInjectProxy_MultipleContainersWithMixedVolumeMounts(t *testing.T) {
 	assert.Equal(t, "kube-api-access-mca-sa", result.Spec.Containers[2].VolumeMounts[0].Name)
 	assert.Len(t, result.Spec.Containers[2].Env, 2)
 }
+
+func TestSetProxyImage(t *testing.T) {
+	defer SetProxyImage("")
+
+	SetProxyImage("mca:override")
+	result, err := injectProxy(corev1.Pod{})
+	require.NoError(t, err)
+	assert.Equal(t, "mca:override", result.Spec.InitContainers[0].Image)
+
+	SetProxyImage("")
+	result, err = injectProxy(corev1.Pod{})
+	require.NoError(t, err)
+	assert.Equal(t, conf.ProxyImage, result.Spec.InitContainers[0].Image)
+}
+
+func TestInjectProxy_ProxyResourceProfile(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantProfile string
+	}{
+		{
+			name:        "uses default profile without annotation",
+			wantProfile: conf.ProxyDefaultProfile,
+		},
+		{
+			name:        "uses small profile",
+			annotations: map[string]string{AnnotationProxyProfile: "small"},
+			wantProfile: "small",
+		},
+		{
+			name:        "uses medium profile",
+			annotations: map[string]string{AnnotationProxyProfile: "medium"},
+			wantProfile: "medium",
+		},
+		{
+			name:        "uses large profile",
+			annotations: map[string]string{AnnotationProxyProfile: "large"},
+			wantProfile: "large",
+		},
+		{
+			name:        "falls back to default for unknown profile",
+			annotations: map[string]string{AnnotationProxyProfile: "huge"},
+			wantProfile: conf.ProxyDefaultProfile,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations},
+			}
+
+			result, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			assert.Equal(t, conf.ProxyResourceProfiles[tt.wantProfile], result.Spec.InitContainers[0].Resources)
+		})
+	}
+}
+
+func TestInjectProxy_StartupProbe(t *testing.T) {
+	tests := []struct {
+		name      string
+		probe     string
+		wantProbe *corev1.Probe
+	}{
+		{
+			name:  "no probe by default",
+			probe: "",
+		},
+		{
+			name:  "tcp probe on health port",
+			probe: conf.StartupProbeTCP,
+			wantProbe: &corev1.Probe{
+				ProbeHandler: corev1.ProbeHandler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(6444)},
+				},
+				PeriodSeconds:    1,
+				FailureThreshold: 30,
+			},
+		},
+		{
+			name:  "http probe on health port",
+			probe: conf.StartupProbeHTTP,
+			wantProbe: &corev1.Probe{
+				ProbeHandler: corev1.ProbeHandler{
+					HTTPGet: &corev1.HTTPGetAction{
+						Path:   "/healthz",
+						Port:   intstr.FromInt32(6444),
+						Scheme: corev1.URISchemeHTTP,
+					},
+				},
+				PeriodSeconds:    1,
+				FailureThreshold: 30,
+			},
+		},
+		{
+			name:  "unknown probe is ignored",
+			probe: "exec",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalProbe := conf.ProxyStartupProbe
+			conf.ProxyStartupProbe = tt.probe
+			defer func() { conf.ProxyStartupProbe = originalProbe }()
+
+			result, err := injectProxy(corev1.Pod{})
+			require.NoError(t, err)
+
+			proxyContainer := result.Spec.InitContainers[0]
+			assert.Equal(t, tt.wantProbe, proxyContainer.StartupProbe)
+
+			healthEnv := corev1.EnvVar{Name: "MCA_PROXY_HEALTH_ADDRESS", Value: ":6444"}
+			if tt.wantProbe != nil {
+				assert.Contains(t, proxyContainer.Env, healthEnv)
+			} else {
+				assert.NotContains(t, proxyContainer.Env, healthEnv)
+			}
+			for _, env := range proxyContainer.Env {
+				assert.NotEqual(t, "MCA_PROXY_LISTEN_ADDRESS", env.Name, "API listener must stay on loopback")
+			}
+		})
+	}
+}
+
+func TestInjectProxy_InitContainersPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		wantRewrite bool
+	}{
+		{name: "proxy-only rewrites init containers after the proxy", policy: conf.InitContainersProxyOnly, wantRewrite: true},
+		{name: "all rewrites every init container", policy: conf.InitContainersAll, wantRewrite: true},
+		{name: "none leaves init containers untouched", policy: conf.InitContainersNone, wantRewrite: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalPolicy := conf.InitContainersPolicy
+			conf.InitContainersPolicy = tt.policy
+			defer func() { conf.InitContainersPolicy = originalPolicy }()
+
+			pod := corev1.Pod{
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{{Name: "init-db", Image: "postgres:init"}},
+					Containers:     []corev1.Container{{Name: "app", Image: "nginx"}},
+				},
+			}
+
+			result, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			require.Len(t, result.Spec.InitContainers, 2)
+			initContainer := result.Spec.InitContainers[1]
+			if tt.wantRewrite {
+				assert.Len(t, initContainer.Env, 2)
+				assert.Len(t, initContainer.VolumeMounts, 1)
+			} else {
+				assert.Empty(t, initContainer.Env)
+				assert.Empty(t, initContainer.VolumeMounts)
+			}
+
+			assert.Len(t, result.Spec.Containers[0].Env, 2)
+		})
+	}
+}
+
+func TestInitContainersToRewrite(t *testing.T) {
+	initContainers := []corev1.Container{{Name: "init-a"}, {Name: "mca-proxy"}, {Name: "init-b"}, {Name: "init-c"}}
+
+	tests := []struct {
+		name   string
+		policy string
+		want   []int
+	}{
+		{name: "proxy-only skips init containers before the proxy", policy: conf.InitContainersProxyOnly, want: []int{2, 3}},
+		{name: "all includes init containers before the proxy", policy: conf.InitContainersAll, want: []int{0, 2, 3}},
+		{name: "none includes nothing", policy: conf.InitContainersNone, want: nil},
+		{name: "unknown policy falls back to proxy-only", policy: "some", want: []int{2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalPolicy := conf.InitContainersPolicy
+			conf.InitContainersPolicy = tt.policy
+			defer func() { conf.InitContainersPolicy = originalPolicy }()
+
+			assert.Equal(t, tt.want, initContainersToRewrite(initContainers, 1))
+		})
+	}
+}
+
+func TestInjectProxy_InitContainersSkip(t *testing.T) {
+	tests := []struct {
+		name        string
+		skip        int
+		policy      string
+		insertAfter string
+		wantOrder   []string
+		wantRewrite []string
+	}{
+		{
+			name:        "skips the first init container",
+			skip:        1,
+			policy:      conf.InitContainersProxyOnly,
+			wantOrder:   []string{"vault-init", "mca-proxy", "init-db", "init-cache"},
+			wantRewrite: []string{"init-db", "init-cache"},
+		},
+		{
+			name:        "skips even under the all policy",
+			skip:        2,
+			policy:      conf.InitContainersAll,
+			wantOrder:   []string{"vault-init", "init-db", "mca-proxy", "init-cache"},
+			wantRewrite: []string{"init-cache"},
+		},
+		{
+			name:        "insert after a later init container wins",
+			skip:        1,
+			policy:      conf.InitContainersProxyOnly,
+			insertAfter: "init-db",
+			wantOrder:   []string{"vault-init", "init-db", "mca-proxy", "init-cache"},
+			wantRewrite: []string{"init-cache"},
+		},
+		{
+			name:      "skipping more than there are leaves all untouched",
+			skip:      5,
+			policy:    conf.InitContainersAll,
+			wantOrder: []string{"vault-init", "init-db", "init-cache", "mca-proxy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalSkip, originalPolicy, originalInsertAfter := conf.InitContainersSkip, conf.InitContainersPolicy, conf.ProxyInsertAfter
+			defer func() {
+				conf.InitContainersSkip, conf.InitContainersPolicy, conf.ProxyInsertAfter = originalSkip, originalPolicy, originalInsertAfter
+			}()
+			conf.InitContainersSkip, conf.InitContainersPolicy, conf.ProxyInsertAfter = tt.skip, tt.policy, tt.insertAfter
+
+			pod := corev1.Pod{
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{
+						{Name: "vault-init", Image: "vault"},
+						{Name: "init-db", Image: "postgres:init"},
+						{Name: "init-cache", Image: "redis:init"},
+					},
+					Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+				},
+			}
+
+			result, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			var order, rewritten []string
+			for _, container := range result.Spec.InitContainers {
+				order = append(order, container.Name)
+				if container.Name == "mca-proxy" {
+					continue
+				}
+				if len(container.VolumeMounts) > 0 {
+					assert.Len(t, container.Env, 2, container.Name)
+					rewritten = append(rewritten, container.Name)
+				} else {
+					assert.Empty(t, container.Env, container.Name)
+				}
+			}
+			assert.Equal(t, tt.wantOrder, order)
+			assert.Equal(t, tt.wantRewrite, rewritten)
+		})
+	}
+}
+
+func TestInjectProxy_ServiceHostConflictPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		host     string
+		wantHost string
+		wantErr  string
+	}{
+		{
+			name:     "overwrite redirects conflicting host",
+			policy:   conf.ServiceHostConflictOverwrite,
+			host:     "10.0.0.1",
+			wantHost: "127.0.0.1",
+		},
+		{
+			name:     "warn keeps conflicting host",
+			policy:   conf.ServiceHostConflictWarn,
+			host:     "10.0.0.1",
+			wantHost: "10.0.0.1",
+		},
+		{
+			name:    "deny rejects conflicting host",
+			policy:  conf.ServiceHostConflictDeny,
+			host:    "10.0.0.1",
+			wantErr: `container "app" sets KUBERNETES_SERVICE_HOST to "10.0.0.1"`,
+		},
+		{
+			name:     "deny allows loopback host",
+			policy:   conf.ServiceHostConflictDeny,
+			host:     "localhost",
+			wantHost: "127.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalPolicy := conf.ServiceHostConflictPolicy
+			conf.ServiceHostConflictPolicy = tt.policy
+			defer func() { conf.ServiceHostConflictPolicy = originalPolicy }()
+
+			pod := corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "app",
+						Image: "nginx",
+						Env:   []corev1.EnvVar{{Name: "KUBERNETES_SERVICE_HOST", Value: tt.host}},
+					}},
+				},
+			}
+
+			result, err := injectProxy(pod)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			container := result.Spec.Containers[0]
+			assert.Contains(t, container.Env, corev1.EnvVar{Name: "KUBERNETES_SERVICE_HOST", Value: tt.wantHost})
+			if tt.wantHost != "127.0.0.1" {
+				assert.Empty(t, container.VolumeMounts)
+			}
+		})
+	}
+}
+
+func TestInjectProxy_InsertPosition(t *testing.T) {
+	tests := []struct {
+		name        string
+		insertAfter string
+		annotations map[string]string
+		wantOrder   []string
+	}{
+		{
+			name:      "first by default",
+			wantOrder: []string{"mca-proxy", "istio-proxy", "init-db"},
+		},
+		{
+			name:        "after configured container",
+			insertAfter: "istio-proxy",
+			wantOrder:   []string{"istio-proxy", "mca-proxy", "init-db"},
+		},
+		{
+			name:        "after last container",
+			insertAfter: "init-db",
+			wantOrder:   []string{"istio-proxy", "init-db", "mca-proxy"},
+		},
+		{
+			name:        "first when configured container is missing",
+			insertAfter: "linkerd-proxy",
+			wantOrder:   []string{"mca-proxy", "istio-proxy", "init-db"},
+		},
+		{
+			name:        "annotation overrides configuration",
+			insertAfter: "init-db",
+			annotations: map[string]string{AnnotationProxyAfter: "istio-proxy"},
+			wantOrder:   []string{"istio-proxy", "mca-proxy", "init-db"},
+		},
+		{
+			name:        "empty annotation inserts first",
+			insertAfter: "istio-proxy",
+			annotations: map[string]string{AnnotationProxyAfter: ""},
+			wantOrder:   []string{"mca-proxy", "istio-proxy", "init-db"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalInsertAfter := conf.ProxyInsertAfter
+			conf.ProxyInsertAfter = tt.insertAfter
+			defer func() { conf.ProxyInsertAfter = originalInsertAfter }()
+
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{
+						{Name: "istio-proxy", Image: "istio/proxyv2"},
+						{Name: "init-db", Image: "postgres:init"},
+					},
+					Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+				},
+			}
+
+			result, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			var order []string
+			for _, container := range result.Spec.InitContainers {
+				order = append(order, container.Name)
+			}
+			assert.Equal(t, tt.wantOrder, order)
+		})
+	}
+}
+
+func TestInjectProxy_ServiceAccountPolicy(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         string
+		serviceAccount string
+		wantErr        string
+	}{
+		{name: "any injects default service account", policy: conf.ServiceAccountAny, serviceAccount: "default"},
+		{name: "warn injects default service account", policy: conf.ServiceAccountWarn, serviceAccount: "default"},
+		{
+			name:           "require denies default service account",
+			policy:         conf.ServiceAccountRequire,
+			serviceAccount: "default",
+			wantErr:        "pod uses the default service account, set an explicit serviceAccountName",
+		},
+		{
+			name:    "require denies missing service account",
+			policy:  conf.ServiceAccountRequire,
+			wantErr: "pod uses the default service account, set an explicit serviceAccountName",
+		},
+		{name: "require injects explicit service account", policy: conf.ServiceAccountRequire, serviceAccount: "reporter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalPolicy := conf.ServiceAccountPolicy
+			conf.ServiceAccountPolicy = tt.policy
+			defer func() { conf.ServiceAccountPolicy = originalPolicy }()
+
+			pod := corev1.Pod{
+				Spec: corev1.PodSpec{
+					ServiceAccountName: tt.serviceAccount,
+					Containers:         []corev1.Container{{Name: "app", Image: "nginx"}},
+				},
+			}
+
+			result, err := injectProxy(pod)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, Injected(result))
+		})
+	}
+}
+
+func TestInjectProxy_ProxyOnlySkipsInitContainersBeforeProxy(t *testing.T) {
+	originalInsertAfter := conf.ProxyInsertAfter
+	conf.ProxyInsertAfter = "istio-proxy"
+	defer func() { conf.ProxyInsertAfter = originalInsertAfter }()
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Name: "istio-proxy", Image: "istio/proxyv2"},
+				{Name: "init-db", Image: "postgres:init"},
+			},
+			Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+
+	result, err := injectProxy(pod)
+	require.NoError(t, err)
+
+	require.Len(t, result.Spec.InitContainers, 3)
+	assert.Empty(t, result.Spec.InitContainers[0].Env)
+	assert.Len(t, result.Spec.InitContainers[2].Env, 2)
+}
+
+func TestInjectProxy_LegacySidecarMode(t *testing.T) {
+	originalMode := conf.ProxySidecarMode
+	conf.ProxySidecarMode = conf.SidecarModeLegacy
+	defer func() { conf.ProxySidecarMode = originalMode }()
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init-db", Image: "postgres:init"}},
+			Containers:     []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+
+	result, err := injectProxy(pod)
+	require.NoError(t, err)
+
+	require.Len(t, result.Spec.InitContainers, 1)
+	assert.Equal(t, "init-db", result.Spec.InitContainers[0].Name)
+	assert.Empty(t, result.Spec.InitContainers[0].Env, "init containers run before a legacy sidecar")
+
+	require.Len(t, result.Spec.Containers, 2)
+	proxyContainer := result.Spec.Containers[0]
+	assert.Equal(t, "mca-proxy", proxyContainer.Name)
+	assert.Nil(t, proxyContainer.RestartPolicy)
+	assert.Len(t, proxyContainer.VolumeMounts, 1)
+	assert.Equal(t, "/var/run/secrets/kubernetes.io/mca-serviceaccount", proxyContainer.VolumeMounts[0].MountPath)
+	assert.Len(t, result.Spec.Containers[1].Env, 2)
+}
+
+func TestInjectProxy_PreservesExistingProxyInContainers(t *testing.T) {
+	for _, mode := range []string{conf.SidecarModeNative, conf.SidecarModeLegacy} {
+		t.Run(mode, func(t *testing.T) {
+			originalMode := conf.ProxySidecarMode
+			conf.ProxySidecarMode = mode
+			defer func() { conf.ProxySidecarMode = originalMode }()
+
+			pod := corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "app", Image: "nginx"},
+						{Name: "mca-proxy", Image: "custom-proxy:v2", Args: []string{"--custom-arg"}},
+					},
+				},
+			}
+
+			result, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			assert.Empty(t, result.Spec.InitContainers)
+			require.Len(t, result.Spec.Containers, 2)
+			assert.Equal(t, "mca-proxy", result.Spec.Containers[0].Name)
+			assert.Equal(t, "custom-proxy:v2", result.Spec.Containers[0].Image)
+			assert.Equal(t, []string{"--custom-arg"}, result.Spec.Containers[0].Args)
+			assert.Empty(t, result.Spec.Containers[0].Env)
+			assert.Equal(t, "app", result.Spec.Containers[1].Name)
+			assert.Len(t, result.Spec.Containers[1].Env, 2)
+
+			again, err := injectProxy(result)
+			require.NoError(t, err)
+			assert.Equal(t, result.Spec, again.Spec)
+		})
+	}
+}
+
+func TestInjectProxy_StartupFence(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		fence     bool
+		wantFence bool
+	}{
+		{name: "adds fence in legacy mode", mode: conf.SidecarModeLegacy, fence: true, wantFence: true},
+		{name: "no fence when disabled", mode: conf.SidecarModeLegacy},
+		{name: "no fence for native sidecar", mode: conf.SidecarModeNative, fence: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalMode, originalFence := conf.ProxySidecarMode, conf.ProxyStartupFence
+			conf.ProxySidecarMode, conf.ProxyStartupFence = tt.mode, tt.fence
+			defer func() { conf.ProxySidecarMode, conf.ProxyStartupFence = originalMode, originalFence }()
+
+			pod := corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+				},
+			}
+
+			result, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			proxyContainer, _ := findProxyContainer(result)
+			if !tt.wantFence {
+				assert.Nil(t, proxyContainer.Lifecycle)
+				return
+			}
+			assert.Empty(t, result.Spec.InitContainers)
+			assert.Equal(t, "mca-proxy", result.Spec.Containers[0].Name)
+			require.NotNil(t, proxyContainer.Lifecycle)
+			require.NotNil(t, proxyContainer.Lifecycle.PostStart)
+			assert.Equal(t, []string{"./mca", "--wait-for-proxy"}, proxyContainer.Lifecycle.PostStart.Exec.Command)
+		})
+	}
+}
+
+func TestInjectProxy_ServiceAccountVolumeSource(t *testing.T) {
+	tests := []struct {
+		name          string
+		medium        string
+		sizeLimit     string
+		wantMedium    corev1.StorageMedium
+		wantSizeLimit string
+	}{
+		{name: "node default without settings"},
+		{name: "memory medium with size limit", medium: "Memory", sizeLimit: "1Mi", wantMedium: corev1.StorageMediumMemory, wantSizeLimit: "1Mi"},
+		{name: "size limit only", sizeLimit: "512Ki", wantSizeLimit: "512Ki"},
+		{name: "ignores unknown medium", medium: "Tape"},
+		{name: "ignores invalid size limit", medium: "Memory", sizeLimit: "lots", wantMedium: corev1.StorageMediumMemory},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalMedium, originalSizeLimit := conf.ServiceAccountVolumeMedium, conf.ServiceAccountVolumeSizeLimit
+			conf.ServiceAccountVolumeMedium, conf.ServiceAccountVolumeSizeLimit = tt.medium, tt.sizeLimit
+			defer func() {
+				conf.ServiceAccountVolumeMedium, conf.ServiceAccountVolumeSizeLimit = originalMedium, originalSizeLimit
+			}()
+
+			pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}}}
+			result, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			require.Len(t, result.Spec.Volumes, 1)
+			emptyDir := result.Spec.Volumes[0].EmptyDir
+			require.NotNil(t, emptyDir)
+			assert.Equal(t, tt.wantMedium, emptyDir.Medium)
+			if tt.wantSizeLimit == "" {
+				assert.Nil(t, emptyDir.SizeLimit)
+			} else {
+				require.NotNil(t, emptyDir.SizeLimit)
+				assert.Equal(t, tt.wantSizeLimit, emptyDir.SizeLimit.String())
+			}
+
+			again, err := injectProxy(result)
+			require.NoError(t, err)
+			assert.Equal(t, result.Spec.Volumes, again.Spec.Volumes, "the volume is not added twice")
+		})
+	}
+}
+
+func TestInjectProxy_ProxyContainerName(t *testing.T) {
+	originalName := conf.ProxyContainerName
+	conf.ProxyContainerName = "mca-proxy-tenant-a"
+	defer func() { conf.ProxyContainerName = originalName }()
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+
+	result, err := injectProxy(pod)
+	require.NoError(t, err)
+
+	require.Len(t, result.Spec.InitContainers, 1)
+	assert.Equal(t, "mca-proxy-tenant-a", result.Spec.InitContainers[0].Name)
+	assert.True(t, Injected(result))
+
+	again, err := injectProxy(result)
+	require.NoError(t, err)
+	assert.Equal(t, result.Spec, again.Spec, "the custom-named proxy is detected and kept")
+
+	t.Run("another instance's proxy is not detected", func(t *testing.T) {
+		other := corev1.Pod{
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "mca-proxy", Image: "mca:other"}},
+				Containers:     []corev1.Container{{Name: "app", Image: "nginx"}},
+			},
+		}
+		assert.False(t, Injected(other))
+
+		result, err := injectProxy(other)
+		require.NoError(t, err)
+
+		require.Len(t, result.Spec.InitContainers, 2)
+		assert.Equal(t, "mca-proxy-tenant-a", result.Spec.InitContainers[0].Name)
+		assert.Equal(t, "mca-proxy", result.Spec.InitContainers[1].Name)
+	})
+
+	t.Run("existing custom-named proxy is preserved", func(t *testing.T) {
+		existing := corev1.Pod{
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "mca-proxy-tenant-a", Image: "custom-proxy:v2"}},
+				Containers:     []corev1.Container{{Name: "app", Image: "nginx"}},
+			},
+		}
+
+		result, err := injectProxy(existing)
+		require.NoError(t, err)
+
+		require.Len(t, result.Spec.InitContainers, 1)
+		assert.Equal(t, "custom-proxy:v2", result.Spec.InitContainers[0].Image)
+	})
+}
+
+func TestInjectProxy_RunAsUser(t *testing.T) {
+	tests := []struct {
+		name      string
+		runAsUser string
+		wantUID   *int64
+		wantErr   string
+	}{
+		{name: "default UID", runAsUser: "999", wantUID: ptr.To(int64(999))},
+		{name: "custom UID", runAsUser: "1000680000", wantUID: ptr.To(int64(1000680000))},
+		{name: "auto leaves the UID to the SCC", runAsUser: conf.ProxyRunAsUserAuto},
+		{name: "root is rejected", runAsUser: "0", wantErr: `invalid proxy runAsUser "0"`},
+		{name: "garbage is rejected", runAsUser: "nobody", wantErr: `invalid proxy runAsUser "nobody"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalRunAsUser := conf.ProxyRunAsUser
+			conf.ProxyRunAsUser = tt.runAsUser
+			defer func() { conf.ProxyRunAsUser = originalRunAsUser }()
+
+			pod := corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+				},
+			}
+
+			result, err := injectProxy(pod)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			securityContext := result.Spec.InitContainers[0].SecurityContext
+			require.NotNil(t, securityContext)
+			assert.Equal(t, tt.wantUID, securityContext.RunAsUser)
+			assert.Nil(t, securityContext.RunAsGroup)
+			assert.Equal(t, ptr.To(true), securityContext.RunAsNonRoot)
+		})
+	}
+}
+
+func TestViaWebhookResult(t *testing.T) {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+
+	injected, err := ViaWebhookResult(pod)
+	require.NoError(t, err)
+	assert.Equal(t, DecisionInjected, injected.Decision)
+	assert.Equal(t, "MCA proxy injected", injected.Reason)
+	assert.True(t, Injected(injected.Pod))
+	assert.Empty(t, injected.Warnings)
+
+	skipped, err := ViaWebhookResult(injected.Pod)
+	require.NoError(t, err)
+	assert.Equal(t, DecisionSkipped, skipped.Decision)
+	assert.Equal(t, "pod already uses the MCA proxy", skipped.Reason)
+	assert.Equal(t, injected.Pod, skipped.Pod)
+
+	t.Run("carries env size warnings", func(t *testing.T) {
+		originalWarnBytes := conf.EnvSizeWarnBytes
+		conf.EnvSizeWarnBytes = 1
+		defer func() { conf.EnvSizeWarnBytes = originalWarnBytes }()
+
+		result, err := ViaWebhookResult(pod)
+		require.NoError(t, err)
+		assert.Equal(t, DecisionInjected, result.Decision)
+		assert.Equal(t, EnvSizeWarnings(pod, result.Pod), result.Warnings)
+		assert.NotEmpty(t, result.Warnings)
+	})
+
+	t.Run("carries node capacity warnings", func(t *testing.T) {
+		originalHint := conf.NodeCapacityHint
+		conf.NodeCapacityHint = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+		defer func() { conf.NodeCapacityHint = originalHint }()
+
+		busyPod := *pod.DeepCopy()
+		busyPod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("995m")}
+
+		result, err := ViaWebhookResult(busyPod)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"pod cpu request of 1005m with the proxy exceeds the node capacity hint of 1"}, result.Warnings)
+	})
+
+	t.Run("wrapper returns the mutated pod", func(t *testing.T) {
+		mutatedPod, err := ViaWebhook(pod)
+		require.NoError(t, err)
+		assert.Equal(t, injected.Pod, mutatedPod)
+	})
+}
+
+func TestInjectProxy_ForceReinject(t *testing.T) {
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+
+	originalImage := conf.ProxyImage
+	defer func() { conf.ProxyImage = originalImage }()
+
+	conf.ProxyImage = "mca:v1"
+	marked, err := injectProxy(pod)
+	require.NoError(t, err)
+	conf.ProxyImage = "mca:v2"
+	oldHash := marked.Annotations[conf.ConfigHashAnnotation]
+	require.NotEmpty(t, oldHash)
+
+	kept, err := injectProxy(marked)
+	require.NoError(t, err)
+	assert.Equal(t, "mca:v1", kept.Spec.InitContainers[0].Image, "the marked proxy is kept without the annotation")
+	assert.Equal(t, oldHash, kept.Annotations[conf.ConfigHashAnnotation])
+
+	marked.Annotations[AnnotationForceReinject] = "true"
+	forced, err := injectProxy(marked)
+	require.NoError(t, err)
+
+	require.Len(t, forced.Spec.InitContainers, 1)
+	assert.Equal(t, "mca:v2", forced.Spec.InitContainers[0].Image)
+	assert.NotEqual(t, oldHash, forced.Annotations[conf.ConfigHashAnnotation], "the config hash is updated")
+	assert.Len(t, forced.Spec.Containers, 1)
+}
+
+func TestRedirectEphemeralContainers(t *testing.T) {
+	debugger := corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+		Name:  "debugger",
+		Image: "busybox",
+		Env:   []corev1.EnvVar{{Name: "TERM", Value: "xterm"}},
+	}}
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+
+	t.Run("pod without proxy is unchanged", func(t *testing.T) {
+		plain := *pod.DeepCopy()
+		plain.Spec.EphemeralContainers = []corev1.EphemeralContainer{debugger}
+
+		result, err := RedirectEphemeralContainers(plain)
+		require.NoError(t, err)
+		assert.Equal(t, plain, result)
+	})
+
+	t.Run("injected pod redirects its ephemeral containers", func(t *testing.T) {
+		injected, err := injectProxy(pod)
+		require.NoError(t, err)
+		injected.Spec.EphemeralContainers = []corev1.EphemeralContainer{debugger}
+
+		result, err := RedirectEphemeralContainers(injected)
+		require.NoError(t, err)
+
+		redirected := result.Spec.EphemeralContainers[0]
+		assert.Equal(t, []corev1.EnvVar{
+			{Name: "TERM", Value: "xterm"},
+			{Name: "KUBERNETES_SERVICE_HOST", Value: "127.0.0.1"},
+			{Name: "KUBERNETES_SERVICE_PORT", Value: "6443"},
+		}, redirected.Env)
+		assert.Equal(t, []corev1.VolumeMount{serviceAccountMount}, redirected.VolumeMounts)
+		assert.Empty(t, injected.Spec.EphemeralContainers[0].VolumeMounts, "the input pod is not modified")
+
+		again, err := RedirectEphemeralContainers(result)
+		require.NoError(t, err)
+		assert.Equal(t, result, again)
+	})
+}
@@ -0,0 +1,86 @@
+// Injection tests and benchmarks for pods with many containers.
+package inject
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// manyContainersPod returns a pod with n containers in a mix of states: some already set the
+// API env or mount a service account directory, and all carry env and mounts of their own.
+func manyContainersPod(n int) corev1.Pod {
+	pod := corev1.Pod{}
+	for i := range n {
+		container := corev1.Container{
+			Name:  fmt.Sprintf("app-%d", i),
+			Image: "nginx",
+			Env: []corev1.EnvVar{
+				{Name: "APP_INDEX", Value: fmt.Sprint(i)},
+				{Name: "LOG_LEVEL", Value: "info"},
+			},
+			VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+		}
+		switch i % 3 {
+		case 1:
+			container.Env = append(container.Env, corev1.EnvVar{Name: "KUBERNETES_SERVICE_PORT", Value: "443"})
+		case 2:
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      "kube-api-access-abcde",
+				MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+				ReadOnly:  true,
+			})
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, container)
+	}
+	return pod
+}
+
+func TestInjectProxy_ManyContainers(t *testing.T) {
+	pod := manyContainersPod(50)
+
+	result, err := injectProxy(pod)
+	require.NoError(t, err)
+	require.Len(t, result.Spec.Containers, 50)
+
+	for i, container := range result.Spec.Containers {
+		original := pod.Spec.Containers[i]
+		assert.Equal(t, original.Name, container.Name)
+
+		assert.Equal(t, original.Env[:2], container.Env[:2], container.Name)
+		var host, port []string
+		for _, env := range container.Env {
+			switch env.Name {
+			case "KUBERNETES_SERVICE_HOST":
+				host = append(host, env.Value)
+			case "KUBERNETES_SERVICE_PORT":
+				port = append(port, env.Value)
+			}
+		}
+		assert.Equal(t, []string{"127.0.0.1"}, host, container.Name)
+		assert.Equal(t, []string{"6443"}, port, container.Name)
+
+		assert.Equal(t, original.VolumeMounts[0], container.VolumeMounts[0], container.Name)
+		require.Len(t, container.VolumeMounts, 2, container.Name)
+		assert.Equal(t, corev1.VolumeMount{
+			Name:      "kube-api-access-mca-sa",
+			MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+			ReadOnly:  true,
+		}, container.VolumeMounts[1], container.Name)
+	}
+
+	assert.Len(t, pod.Spec.Containers[0].Env, 2, "the input pod is not modified")
+}
+
+func BenchmarkInjectProxy_ManyContainers(b *testing.B) {
+	pod := manyContainersPod(50)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := injectProxy(pod); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
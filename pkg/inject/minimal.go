@@ -0,0 +1,231 @@
+package inject
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+
+	goyaml "go.yaml.in/yaml/v3"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// ViaCLIMinimalDiff is like [ViaCLI] but, for YAML input, applies the injection to the input
+// document instead of re-marshaling the pod: fields injection leaves untouched keep their
+// input representation, ordering and comments, and fields unknown to the Pod schema are kept.
+// Lists of named items, such as containers and volumes, are matched by name. JSON input,
+// which has no layout worth keeping, is handled as by [ViaCLI].
+//
+// Returns an error if unmarshaling fails, injection fails, or marshaling fails.
+func ViaCLIMinimalDiff(podYAML []byte) ([]byte, error) {
+	if detectFormat(podYAML) == OutputJSON {
+		return ViaCLI(podYAML)
+	}
+
+	var document goyaml.Node
+	if err := goyaml.Unmarshal(podYAML, &document); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pod: %w", err)
+	}
+	if document.Kind != goyaml.DocumentNode || len(document.Content) != 1 {
+		return nil, fmt.Errorf("failed to unmarshal pod: expected a single YAML document")
+	}
+
+	var pod corev1.Pod
+	if err := yaml.Unmarshal(podYAML, &pod); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pod: %w", err)
+	}
+
+	namespace := pod.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	if reason := NamespaceSkipReason(namespace); reason != "" {
+		log.Printf("Skipped MCA injection: %s", reason)
+		return podYAML, nil
+	}
+
+	mutatedPod, err := injectProxy(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := toGeneric(&pod)
+	if err != nil {
+		return nil, err
+	}
+	after, err := toGeneric(&mutatedPod)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mergeNode(document.Content[0], before, after); err != nil {
+		return nil, fmt.Errorf("failed to apply injection to pod: %w", err)
+	}
+
+	var buf bytes.Buffer
+	encoder := goyaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, fmt.Errorf("failed to marshal pod: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to marshal pod: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// toGeneric converts pod to the generic form of its JSON encoding.
+func toGeneric(pod *corev1.Pod) (interface{}, error) {
+	data, err := json.Marshal(pod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pod: %w", err)
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pod: %w", err)
+	}
+	return generic, nil
+}
+
+// mergeNode updates node, which decodes to before, so that it decodes to after, leaving the
+// parts where before and after agree untouched.
+func mergeNode(node *goyaml.Node, before, after interface{}) error {
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+
+	beforeMap, beforeIsMap := before.(map[string]interface{})
+	afterMap, afterIsMap := after.(map[string]interface{})
+	if node.Kind == goyaml.MappingNode && beforeIsMap && afterIsMap {
+		return mergeMapping(node, beforeMap, afterMap)
+	}
+
+	beforeList, beforeIsList := before.([]interface{})
+	afterList, afterIsList := after.([]interface{})
+	if node.Kind == goyaml.SequenceNode && beforeIsList && afterIsList {
+		return mergeSequence(node, beforeList, afterList)
+	}
+
+	return replaceNode(node, after)
+}
+
+func mergeMapping(node *goyaml.Node, before, after map[string]interface{}) error {
+	seen := map[string]bool{}
+	var content []*goyaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		seen[key.Value] = true
+
+		afterValue, inAfter := after[key.Value]
+		if !inAfter {
+			// Dropped by injection, or unknown to the Pod schema and kept as is.
+			if _, inBefore := before[key.Value]; inBefore {
+				continue
+			}
+		} else if err := mergeNode(value, before[key.Value], afterValue); err != nil {
+			return err
+		}
+		content = append(content, key, value)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(after)) {
+		if seen[key] || reflect.DeepEqual(before[key], after[key]) {
+			continue
+		}
+		value, err := encodeNode(after[key])
+		if err != nil {
+			return err
+		}
+		content = append(content, &goyaml.Node{Kind: goyaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	}
+
+	node.Content = content
+	return nil
+}
+
+// mergeSequence matches items by name when every item has one, and by position otherwise.
+func mergeSequence(node *goyaml.Node, before, after []interface{}) error {
+	beforeNames, beforeNamed := itemNames(before)
+	afterNames, afterNamed := itemNames(after)
+	if !beforeNamed || !afterNamed || len(node.Content) != len(before) {
+		if len(before) != len(after) || len(node.Content) != len(before) {
+			return replaceNode(node, after)
+		}
+		for i := range after {
+			if err := mergeNode(node.Content[i], before[i], after[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	existing := map[string]int{}
+	for i, name := range beforeNames {
+		existing[name] = i
+	}
+
+	content := make([]*goyaml.Node, 0, len(after))
+	for i, name := range afterNames {
+		j, ok := existing[name]
+		if !ok {
+			item, err := encodeNode(after[i])
+			if err != nil {
+				return err
+			}
+			content = append(content, item)
+			continue
+		}
+		if err := mergeNode(node.Content[j], before[j], after[i]); err != nil {
+			return err
+		}
+		content = append(content, node.Content[j])
+	}
+
+	node.Content = content
+	return nil
+}
+
+// itemNames returns the "name" of each item, and whether every item is a map with a name.
+func itemNames(items []interface{}) ([]string, bool) {
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, ok := fields["name"].(string)
+		if !ok {
+			return nil, false
+		}
+		names = append(names, name)
+	}
+	return names, true
+}
+
+// replaceNode replaces the content of node with value, keeping the node's comments.
+func replaceNode(node *goyaml.Node, value interface{}) error {
+	replacement, err := encodeNode(value)
+	if err != nil {
+		return err
+	}
+
+	replacement.HeadComment = node.HeadComment
+	replacement.LineComment = node.LineComment
+	replacement.FootComment = node.FootComment
+	*node = *replacement
+	return nil
+}
+
+func encodeNode(value interface{}) (*goyaml.Node, error) {
+	var node goyaml.Node
+	if err := node.Encode(value); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
@@ -0,0 +1,78 @@
+package inject
+
+import (
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const minimalDiffPodYAML = `# team-a web pod
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web # pinned name
+  labels: {app: web}
+spec:
+  customField: keep-me
+  containers:
+    - name: app
+      image: "nginx:1.27"
+      resources:
+        requests:
+          cpu: 0.5
+      env:
+        - {name: FOO, value: bar}
+`
+
+func TestViaCLIMinimalDiff_KeepsUntouchedFields(t *testing.T) {
+	output, err := ViaCLIMinimalDiff([]byte(minimalDiffPodYAML))
+	require.NoError(t, err)
+
+	for _, untouched := range []string{
+		"# team-a web pod\napiVersion: v1\nkind: Pod\nmetadata:\n  name: web # pinned name\n  labels: {app: web}\n",
+		"  customField: keep-me\n",
+		"      image: \"nginx:1.27\"\n",
+		"          cpu: 0.5\n",
+		"        - {name: FOO, value: bar}\n",
+	} {
+		assert.Contains(t, string(output), untouched)
+	}
+
+	var pod corev1.Pod
+	require.NoError(t, yaml.Unmarshal(output, &pod))
+	require.Len(t, pod.Spec.InitContainers, 1)
+	assert.Equal(t, "mca-proxy", pod.Spec.InitContainers[0].Name)
+	assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "KUBERNETES_SERVICE_HOST", Value: "127.0.0.1"})
+	assert.Equal(t, "kube-api-access-mca-sa", pod.Spec.Volumes[0].Name)
+	assert.NotEmpty(t, pod.Annotations[conf.ConfigHashAnnotation])
+}
+
+func TestViaCLIMinimalDiff_MatchesViaCLI(t *testing.T) {
+	minimal, err := ViaCLIMinimalDiff([]byte(minimalDiffPodYAML))
+	require.NoError(t, err)
+	full, err := ViaCLI([]byte(minimalDiffPodYAML))
+	require.NoError(t, err)
+
+	var minimalPod, fullPod corev1.Pod
+	require.NoError(t, yaml.Unmarshal(minimal, &minimalPod))
+	require.NoError(t, yaml.Unmarshal(full, &fullPod))
+	assert.JSONEq(t, string(mustMarshal(t, &fullPod)), string(mustMarshal(t, &minimalPod)))
+}
+
+func TestViaCLIMinimalDiff_ReinjectionIsNoOp(t *testing.T) {
+	once, err := ViaCLIMinimalDiff([]byte(minimalDiffPodYAML))
+	require.NoError(t, err)
+	twice, err := ViaCLIMinimalDiff(once)
+	require.NoError(t, err)
+	assert.Equal(t, string(once), string(twice))
+}
+
+func TestViaCLIMinimalDiff_JSONInput(t *testing.T) {
+	output, err := ViaCLIMinimalDiff([]byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web"},"spec":{"containers":[{"name":"app","image":"nginx"}]}}`))
+	require.NoError(t, err)
+	assert.Equal(t, OutputJSON, detectFormat(output))
+}
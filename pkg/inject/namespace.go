@@ -0,0 +1,26 @@
+package inject
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/marxus/k8s-mca/conf"
+)
+
+// NamespaceSkipReason returns why pods in namespace are not injected under the namespace
+// policy, or "" when they are. conf.ExcludedNamespaces always wins; a non-empty
+// conf.IncludedNamespaces restricts injection to the listed namespaces.
+func NamespaceSkipReason(namespace string) string {
+	if NamespaceExcluded(namespace) {
+		return fmt.Sprintf("namespace %s is excluded", namespace)
+	}
+	if len(conf.IncludedNamespaces) > 0 && !slices.Contains(conf.IncludedNamespaces, namespace) {
+		return fmt.Sprintf("namespace %s is not included", namespace)
+	}
+	return ""
+}
+
+// NamespaceExcluded reports whether namespace is in conf.ExcludedNamespaces.
+func NamespaceExcluded(namespace string) bool {
+	return slices.Contains(conf.ExcludedNamespaces, namespace)
+}
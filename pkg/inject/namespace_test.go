@@ -0,0 +1,70 @@
+package inject
+
+import (
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaceSkipReason(t *testing.T) {
+	tests := []struct {
+		name      string
+		excluded  []string
+		included  []string
+		namespace string
+		want      string
+	}{
+		{name: "no policy", namespace: "team-a", want: ""},
+		{name: "excluded", excluded: []string{"kube-system"}, namespace: "kube-system", want: "namespace kube-system is excluded"},
+		{name: "included", included: []string{"team-a"}, namespace: "team-a", want: ""},
+		{name: "not included", included: []string{"team-a"}, namespace: "team-b", want: "namespace team-b is not included"},
+		{name: "excluded wins over included", excluded: []string{"team-a"}, included: []string{"team-a"}, namespace: "team-a", want: "namespace team-a is excluded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalExcluded, originalIncluded := conf.ExcludedNamespaces, conf.IncludedNamespaces
+			conf.ExcludedNamespaces, conf.IncludedNamespaces = tt.excluded, tt.included
+			defer func() { conf.ExcludedNamespaces, conf.IncludedNamespaces = originalExcluded, originalIncluded }()
+
+			assert.Equal(t, tt.want, NamespaceSkipReason(tt.namespace))
+		})
+	}
+}
+
+func TestViaCLI_NamespacePolicy(t *testing.T) {
+	podYAML := func(namespace string) []byte {
+		return []byte(`
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test-pod
+  namespace: ` + namespace + `
+spec:
+  containers:
+    - name: app
+      image: nginx
+`)
+	}
+
+	originalExcluded, originalIncluded := conf.ExcludedNamespaces, conf.IncludedNamespaces
+	conf.ExcludedNamespaces, conf.IncludedNamespaces = []string{"kube-system"}, []string{"team-a", "kube-system"}
+	defer func() { conf.ExcludedNamespaces, conf.IncludedNamespaces = originalExcluded, originalIncluded }()
+
+	for _, namespace := range []string{"kube-system", "team-b", `""`} {
+		t.Run("passes through "+namespace, func(t *testing.T) {
+			input := podYAML(namespace)
+			output, err := ViaCLI(input)
+			require.NoError(t, err)
+			assert.Equal(t, input, output)
+		})
+	}
+
+	t.Run("injects included namespace", func(t *testing.T) {
+		output, err := ViaCLI(podYAML("team-a"))
+		require.NoError(t, err)
+		assert.Contains(t, string(output), "mca-proxy")
+	})
+}
@@ -0,0 +1,42 @@
+package inject
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/marxus/k8s-mca/conf"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// JSONPatch returns the JSON patch that turns originalPod into mutatedPod, as sent by the
+// webhook in its admission response. It replaces the spec and, when transformers changed
+// them, the labels and annotations.
+//
+// When conf.PatchTestOps is set, each mutation op is preceded by a test op asserting the
+// original value, so the patch is rejected if another webhook changed the pod first.
+func JSONPatch(originalPod, mutatedPod corev1.Pod) ([]byte, error) {
+	var ops []map[string]interface{}
+	addOps := func(path string, original, mutated interface{}, originalSet, mutatedSet bool) {
+		if conf.PatchTestOps && originalSet {
+			ops = append(ops, map[string]interface{}{"op": "test", "path": path, "value": original})
+		}
+		switch {
+		case !mutatedSet:
+			ops = append(ops, map[string]interface{}{"op": "remove", "path": path})
+		case !originalSet:
+			ops = append(ops, map[string]interface{}{"op": "add", "path": path, "value": mutated})
+		default:
+			ops = append(ops, map[string]interface{}{"op": "replace", "path": path, "value": mutated})
+		}
+	}
+
+	addOps("/spec", originalPod.Spec, mutatedPod.Spec, true, true)
+	if !reflect.DeepEqual(originalPod.Labels, mutatedPod.Labels) {
+		addOps("/metadata/labels", originalPod.Labels, mutatedPod.Labels, originalPod.Labels != nil, mutatedPod.Labels != nil)
+	}
+	if !reflect.DeepEqual(originalPod.Annotations, mutatedPod.Annotations) {
+		addOps("/metadata/annotations", originalPod.Annotations, mutatedPod.Annotations, originalPod.Annotations != nil, mutatedPod.Annotations != nil)
+	}
+
+	return json.Marshal(ops)
+}
@@ -0,0 +1,99 @@
+package inject
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestJSONPatch(t *testing.T) {
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+	mutatedPod, err := injectProxy(pod)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		testOps bool
+		wantOps []string
+	}{
+		{
+			name:    "replace only by default",
+			wantOps: []string{"replace /spec", "add /metadata/annotations"},
+		},
+		{
+			name:    "test op precedes replace when enabled",
+			testOps: true,
+			wantOps: []string{"test /spec", "replace /spec", "add /metadata/annotations"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalTestOps := conf.PatchTestOps
+			conf.PatchTestOps = tt.testOps
+			defer func() { conf.PatchTestOps = originalTestOps }()
+
+			patchJSON, err := JSONPatch(pod, mutatedPod)
+			require.NoError(t, err)
+
+			var ops []map[string]interface{}
+			require.NoError(t, json.Unmarshal(patchJSON, &ops))
+			var gotOps []string
+			for _, op := range ops {
+				gotOps = append(gotOps, op["op"].(string)+" "+op["path"].(string))
+			}
+			assert.Equal(t, tt.wantOps, gotOps)
+
+			patch, err := jsonpatch.DecodePatch(patchJSON)
+			require.NoError(t, err)
+
+			originalJSON, err := json.Marshal(&pod)
+			require.NoError(t, err)
+			patchedJSON, err := patch.Apply(originalJSON)
+			require.NoError(t, err)
+			assertSamePod(t, mustMarshal(t, &mutatedPod), patchedJSON)
+		})
+	}
+}
+
+func TestJSONPatch_TestOpsRejectMismatchedBase(t *testing.T) {
+	originalTestOps := conf.PatchTestOps
+	conf.PatchTestOps = true
+	defer func() { conf.PatchTestOps = originalTestOps }()
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+	mutatedPod, err := injectProxy(pod)
+	require.NoError(t, err)
+
+	patchJSON, err := JSONPatch(pod, mutatedPod)
+	require.NoError(t, err)
+	patch, err := jsonpatch.DecodePatch(patchJSON)
+	require.NoError(t, err)
+
+	changedPod := *pod.DeepCopy()
+	changedPod.Spec.Containers = append(changedPod.Spec.Containers, corev1.Container{Name: "other-webhook", Image: "busybox"})
+
+	_, err = patch.Apply(mustMarshal(t, &changedPod))
+	assert.Error(t, err)
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return data
+}
@@ -0,0 +1,62 @@
+package inject
+
+import (
+	"github.com/marxus/k8s-mca/conf"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// podInfoVolume is the name of the downward-API volume exposing the pod's metadata to the proxy.
+const podInfoVolume = "mca-podinfo"
+
+// addPodInfoMount mounts the pod info volume into proxyContainer at conf.PodInfoPath and
+// passes the path on to the proxy, unless conf.PodInfoPath is empty.
+func addPodInfoMount(proxyContainer *corev1.Container) {
+	if conf.PodInfoPath == "" {
+		return
+	}
+
+	proxyContainer.VolumeMounts = append(proxyContainer.VolumeMounts, corev1.VolumeMount{
+		Name:      podInfoVolume,
+		MountPath: conf.PodInfoPath,
+		ReadOnly:  true,
+	})
+	proxyContainer.Env = append(proxyContainer.Env, corev1.EnvVar{
+		Name:  "MCA_POD_INFO_PATH",
+		Value: conf.PodInfoPath,
+	})
+}
+
+// addPodInfoVolume adds the downward-API volume with the pod's labels and annotations when the
+// proxy container mounts it.
+func addPodInfoVolume(pod *corev1.Pod) {
+	proxyContainer, _ := findProxyContainer(*pod)
+	if !mountsVolume(proxyContainer, podInfoVolume) {
+		return
+	}
+	for _, vol := range pod.Spec.Volumes {
+		if vol.Name == podInfoVolume {
+			return
+		}
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: podInfoVolume,
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{
+					{Path: "labels", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels"}},
+					{Path: "annotations", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations"}},
+				},
+			},
+		},
+	})
+}
+
+func mountsVolume(container corev1.Container, name string) bool {
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == name {
+			return true
+		}
+	}
+	return false
+}
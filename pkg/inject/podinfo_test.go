@@ -0,0 +1,62 @@
+package inject
+
+import (
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestInjectProxy_PodInfoVolume(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		enabled bool
+	}{
+		{name: "disabled by default"},
+		{name: "enabled with a mount path", path: "/etc/mca-podinfo", enabled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalPath := conf.PodInfoPath
+			conf.PodInfoPath = tt.path
+			defer func() { conf.PodInfoPath = originalPath }()
+
+			pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}}}
+			result, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			proxyContainer, _ := findProxyContainer(result)
+			var volume *corev1.Volume
+			for i := range result.Spec.Volumes {
+				if result.Spec.Volumes[i].Name == podInfoVolume {
+					volume = &result.Spec.Volumes[i]
+				}
+			}
+
+			if !tt.enabled {
+				assert.Nil(t, volume)
+				assert.False(t, mountsVolume(proxyContainer, podInfoVolume))
+				return
+			}
+
+			require.NotNil(t, volume)
+			require.NotNil(t, volume.DownwardAPI)
+			assert.Equal(t, []corev1.DownwardAPIVolumeFile{
+				{Path: "labels", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels"}},
+				{Path: "annotations", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations"}},
+			}, volume.DownwardAPI.Items)
+
+			assert.Contains(t, proxyContainer.VolumeMounts, corev1.VolumeMount{Name: podInfoVolume, MountPath: tt.path, ReadOnly: true})
+			assert.Contains(t, proxyContainer.Env, corev1.EnvVar{Name: "MCA_POD_INFO_PATH", Value: tt.path})
+			assert.False(t, mountsVolume(result.Spec.Containers[0], podInfoVolume), "only the proxy mounts the pod info")
+
+			again, err := injectProxy(result)
+			require.NoError(t, err)
+			assert.Equal(t, result.Spec.Volumes, again.Spec.Volumes, "the volume is not added twice")
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package inject
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/marxus/k8s-mca/conf"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/pod-security-admission/api"
+	"k8s.io/pod-security-admission/policy"
+)
+
+// Pod Security Standards levels understood by [CheckPodSecurity].
+const (
+	PodSecurityPrivileged = "privileged"
+	PodSecurityBaseline   = "baseline"
+	PodSecurityRestricted = "restricted"
+)
+
+var podSecurityEvaluator = sync.OnceValues(func() (policy.Evaluator, error) {
+	return policy.NewEvaluator(policy.DefaultChecks())
+})
+
+// ValidatePodSecurityLevel returns an error unless level is empty or a Pod Security Standards level.
+func ValidatePodSecurityLevel(level string) error {
+	if level == "" {
+		return nil
+	}
+	if _, err := api.ParseLevel(level); err != nil {
+		return fmt.Errorf("invalid PodSecurity level %q, must be %s, %s or %s",
+			level, PodSecurityPrivileged, PodSecurityBaseline, PodSecurityRestricted)
+	}
+	return nil
+}
+
+// CheckPodSecurity returns the Pod Security Standards violations of pod at the given level, as
+// evaluated by the latest version of the PodSecurity admission checks. An empty level disables
+// the check. Returns an error for an unknown level.
+func CheckPodSecurity(pod corev1.Pod, level string) ([]string, error) {
+	if level == "" {
+		return nil, nil
+	}
+	if err := ValidatePodSecurityLevel(level); err != nil {
+		return nil, err
+	}
+	evaluator, err := podSecurityEvaluator()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PodSecurity evaluator: %w", err)
+	}
+
+	var violations []string
+	levelVersion := api.LevelVersion{Level: api.Level(level), Version: api.LatestVersion()}
+	for _, result := range evaluator.EvaluatePod(levelVersion, &pod.ObjectMeta, &pod.Spec) {
+		if result.Allowed {
+			continue
+		}
+		violation := result.ForbiddenReason
+		if result.ForbiddenDetail != "" {
+			violation += " (" + result.ForbiddenDetail + ")"
+		}
+		violations = append(violations, violation)
+	}
+	return violations, nil
+}
+
+// checkPodSecurity compares the pod before and after injection against conf.PodSecurityLevel.
+// Violations introduced by injection are logged as warnings, or returned as an error when
+// conf.PodSecurityEnforce is set. Violations already present in the original pod are ignored.
+func checkPodSecurity(original, mutated corev1.Pod) error {
+	existing, err := CheckPodSecurity(original, conf.PodSecurityLevel)
+	if err != nil {
+		return err
+	}
+	violations, err := CheckPodSecurity(mutated, conf.PodSecurityLevel)
+	if err != nil {
+		return err
+	}
+
+	var introduced []string
+	for _, violation := range violations {
+		if !slices.Contains(existing, violation) {
+			introduced = append(introduced, violation)
+		}
+	}
+
+	if len(introduced) == 0 {
+		return nil
+	}
+
+	if conf.PodSecurityEnforce {
+		return fmt.Errorf("injection violates PodSecurity %q: %v", conf.PodSecurityLevel, introduced)
+	}
+
+	log.Printf("Warning: injection violates PodSecurity %q: %v", conf.PodSecurityLevel, introduced)
+	return nil
+}
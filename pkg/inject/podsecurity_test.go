@@ -0,0 +1,207 @@
+// PodSecurity evaluation tests for injected pods.
+package inject
+
+import (
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+// createRestrictedPod returns a pod that complies with the restricted Pod Security Standard.
+func createRestrictedPod() corev1.Pod {
+	return corev1.Pod{
+		Spec: corev1.PodSpec{
+			SecurityContext: &corev1.PodSecurityContext{
+				RunAsNonRoot:   ptr.To(true),
+				SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+			},
+			InitContainers: []corev1.Container{{
+				Name:  "init",
+				Image: "busybox",
+				SecurityContext: &corev1.SecurityContext{
+					AllowPrivilegeEscalation: ptr.To(false),
+					Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+				},
+			}},
+			Containers: []corev1.Container{{
+				Name:  "app",
+				Image: "nginx",
+				SecurityContext: &corev1.SecurityContext{
+					AllowPrivilegeEscalation: ptr.To(false),
+					Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+				},
+			}},
+		},
+	}
+}
+
+func TestInjectProxy_RestrictedPodStaysCompliant(t *testing.T) {
+	pod := createRestrictedPod()
+	violations, err := CheckPodSecurity(pod, PodSecurityRestricted)
+	require.NoError(t, err)
+	require.Empty(t, violations)
+
+	originalLevel, originalEnforce := conf.PodSecurityLevel, conf.PodSecurityEnforce
+	conf.PodSecurityLevel, conf.PodSecurityEnforce = PodSecurityRestricted, true
+	defer func() { conf.PodSecurityLevel, conf.PodSecurityEnforce = originalLevel, originalEnforce }()
+
+	result, err := injectProxy(pod)
+	require.NoError(t, err)
+
+	violations, err = CheckPodSecurity(result, PodSecurityRestricted)
+	require.NoError(t, err)
+	assert.Empty(t, violations)
+}
+
+func TestCheckPodSecurity(t *testing.T) {
+	tests := []struct {
+		name           string
+		level          string
+		modify         func(pod *corev1.Pod)
+		wantViolations []string
+	}{
+		{
+			name:   "restricted pod has no violations",
+			level:  PodSecurityRestricted,
+			modify: func(pod *corev1.Pod) {},
+		},
+		{
+			name:  "disabled level skips checks",
+			level: "",
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.HostNetwork = true
+			},
+		},
+		{
+			name:  "baseline rejects host namespaces and hostPath",
+			level: PodSecurityBaseline,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.HostNetwork = true
+				pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+					Name:         "host",
+					VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/"}},
+				})
+			},
+			wantViolations: []string{
+				"host namespaces (hostNetwork=true)",
+				`hostPath volumes (volume "host")`,
+			},
+		},
+		{
+			name:  "baseline allows missing restricted fields",
+			level: PodSecurityBaseline,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].SecurityContext = nil
+			},
+		},
+		{
+			name:  "restricted requires hardened container",
+			level: PodSecurityRestricted,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].SecurityContext = nil
+			},
+			wantViolations: []string{
+				`allowPrivilegeEscalation != false (container "app" must set securityContext.allowPrivilegeEscalation=false)`,
+				`unrestricted capabilities (container "app" must set securityContext.capabilities.drop=["ALL"])`,
+			},
+		},
+		{
+			name:  "restricted rejects root and extra capabilities",
+			level: PodSecurityRestricted,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].SecurityContext.RunAsUser = ptr.To(int64(0))
+				pod.Spec.Containers[0].SecurityContext.Capabilities.Add = []corev1.Capability{"NET_ADMIN"}
+			},
+			wantViolations: []string{
+				`unrestricted capabilities (container "app" must not include "NET_ADMIN" in securityContext.capabilities.add)`,
+				`runAsUser=0 (container "app" must not set runAsUser=0)`,
+			},
+		},
+		{
+			name:  "baseline rejects host ports and unsafe sysctls",
+			level: PodSecurityBaseline,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 80, HostPort: 80}}
+				pod.Spec.SecurityContext.Sysctls = []corev1.Sysctl{{Name: "kernel.msgmax", Value: "1"}}
+			},
+			wantViolations: []string{
+				`hostPort (container "app" uses hostPort 80)`,
+				`forbidden sysctls (kernel.msgmax)`,
+			},
+		},
+		{
+			name:  "privileged level allows everything",
+			level: PodSecurityPrivileged,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.HostNetwork = true
+				pod.Spec.Containers[0].SecurityContext.Privileged = ptr.To(true)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := createRestrictedPod()
+			tt.modify(&pod)
+
+			violations, err := CheckPodSecurity(pod, tt.level)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantViolations, violations)
+		})
+	}
+}
+
+func TestCheckPodSecurity_UnknownLevel(t *testing.T) {
+	_, err := CheckPodSecurity(createRestrictedPod(), "Restricted")
+	assert.EqualError(t, err, `invalid PodSecurity level "Restricted", must be privileged, baseline or restricted`)
+
+	originalLevel := conf.PodSecurityLevel
+	conf.PodSecurityLevel = "Restricted"
+	defer func() { conf.PodSecurityLevel = originalLevel }()
+
+	_, err = injectProxy(createRestrictedPod())
+	assert.ErrorContains(t, err, `invalid PodSecurity level "Restricted"`, "an unknown level never disables the check")
+}
+
+func TestCheckPodSecurity_IntroducedViolations(t *testing.T) {
+	tests := []struct {
+		name    string
+		enforce bool
+		wantErr bool
+	}{
+		{
+			name:    "warns when not enforced",
+			enforce: false,
+		},
+		{
+			name:    "denies when enforced",
+			enforce: true,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalLevel, originalEnforce := conf.PodSecurityLevel, conf.PodSecurityEnforce
+			conf.PodSecurityLevel, conf.PodSecurityEnforce = PodSecurityRestricted, tt.enforce
+			defer func() { conf.PodSecurityLevel, conf.PodSecurityEnforce = originalLevel, originalEnforce }()
+
+			original := createRestrictedPod()
+			mutated := *original.DeepCopy()
+			mutated.Spec.InitContainers[0].SecurityContext.AllowPrivilegeEscalation = ptr.To(true)
+
+			err := checkPodSecurity(original, mutated)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), `allowPrivilegeEscalation != false (container "init" must set securityContext.allowPrivilegeEscalation=false)`)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
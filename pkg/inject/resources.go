@@ -0,0 +1,96 @@
+package inject
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/marxus/k8s-mca/conf"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// scaledResources are the proxy requests scaled by conf.ProxyRequestFraction.
+var scaledResources = []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+
+// scaleProxyRequests sets the proxy's CPU and memory requests to conf.ProxyRequestFraction
+// of the summed requests of containers, clamped to conf.ProxyRequestMin and
+// conf.ProxyRequestMax and never above the proxy's limit. A resource no container requests
+// keeps its profile request.
+func scaleProxyRequests(resources *corev1.ResourceRequirements, containers []corev1.Container) {
+	if conf.ProxyRequestFraction <= 0 {
+		return
+	}
+
+	for _, name := range scaledResources {
+		var total resource.Quantity
+		for _, container := range containers {
+			if request, ok := container.Resources.Requests[name]; ok {
+				total.Add(request)
+			}
+		}
+		if total.IsZero() {
+			continue
+		}
+
+		scaled := scaleQuantity(name, total, conf.ProxyRequestFraction)
+		if minimum, ok := conf.ProxyRequestMin[name]; ok && scaled.Cmp(minimum) < 0 {
+			scaled = minimum.DeepCopy()
+		}
+		if maximum, ok := conf.ProxyRequestMax[name]; ok && scaled.Cmp(maximum) > 0 {
+			scaled = maximum.DeepCopy()
+		}
+		if limit, ok := resources.Limits[name]; ok && scaled.Cmp(limit) > 0 {
+			scaled = limit.DeepCopy()
+		}
+
+		if resources.Requests == nil {
+			resources.Requests = corev1.ResourceList{}
+		}
+		resources.Requests[name] = scaled
+	}
+}
+
+// scaleQuantity multiplies q by fraction, in millicores for CPU and whole bytes otherwise.
+func scaleQuantity(name corev1.ResourceName, q resource.Quantity, fraction float64) resource.Quantity {
+	if name == corev1.ResourceCPU {
+		return *resource.NewMilliQuantity(int64(float64(q.MilliValue())*fraction), q.Format)
+	}
+	return *resource.NewQuantity(int64(float64(q.Value())*fraction), q.Format)
+}
+
+// capacityWarnings returns a warning for each resource of conf.NodeCapacityHint that the
+// mutated pod requests more of than the hint while the original pod did not, i.e. where
+// injection pushed the pod over the hint.
+func capacityWarnings(original, mutated corev1.Pod) []string {
+	var warnings []string
+	for _, name := range slices.Sorted(maps.Keys(conf.NodeCapacityHint)) {
+		capacity := conf.NodeCapacityHint[name]
+		before, after := podRequest(original, name), podRequest(mutated, name)
+		if after.Cmp(capacity) > 0 && before.Cmp(capacity) <= 0 {
+			warnings = append(warnings, fmt.Sprintf("pod %s request of %s with the proxy exceeds the node capacity hint of %s",
+				name, after.String(), capacity.String()))
+		}
+	}
+	return warnings
+}
+
+// podRequest sums the name requests of the pod's containers and native sidecars, which run
+// alongside them. Regular init containers run before them and are not counted.
+func podRequest(pod corev1.Pod, name corev1.ResourceName) resource.Quantity {
+	var total resource.Quantity
+	for _, container := range pod.Spec.Containers {
+		if request, ok := container.Resources.Requests[name]; ok {
+			total.Add(request)
+		}
+	}
+	for _, container := range pod.Spec.InitContainers {
+		if container.RestartPolicy == nil || *container.RestartPolicy != corev1.ContainerRestartPolicyAlways {
+			continue
+		}
+		if request, ok := container.Resources.Requests[name]; ok {
+			total.Add(request)
+		}
+	}
+	return total
+}
@@ -0,0 +1,184 @@
+package inject
+
+import (
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestInjectProxy_ScaledProxyRequests(t *testing.T) {
+	requests := func(cpu, memory string) corev1.ResourceRequirements {
+		list := corev1.ResourceList{}
+		if cpu != "" {
+			list[corev1.ResourceCPU] = resource.MustParse(cpu)
+		}
+		if memory != "" {
+			list[corev1.ResourceMemory] = resource.MustParse(memory)
+		}
+		return corev1.ResourceRequirements{Requests: list}
+	}
+
+	tests := []struct {
+		name       string
+		fraction   float64
+		min, max   corev1.ResourceList
+		containers []corev1.Container
+		wantCPU    string
+		wantMemory string
+	}{
+		{
+			name:     "disabled keeps profile requests",
+			fraction: 0,
+			containers: []corev1.Container{
+				{Name: "app", Resources: requests("2", "1Gi")},
+			},
+			wantCPU:    "10m",
+			wantMemory: "32Mi",
+		},
+		{
+			name:     "fraction of summed requests",
+			fraction: 0.1,
+			containers: []corev1.Container{
+				{Name: "app", Resources: requests("1", "384Mi")},
+				{Name: "worker", Resources: requests("500m", "96Mi")},
+			},
+			wantCPU:    "150m",
+			wantMemory: "48Mi",
+		},
+		{
+			name:     "containers without requests keep profile requests",
+			fraction: 0.1,
+			containers: []corev1.Container{
+				{Name: "app"},
+				{Name: "worker", Resources: requests("500m", "")},
+			},
+			wantCPU:    "50m",
+			wantMemory: "32Mi",
+		},
+		{
+			name:     "clamped to min",
+			fraction: 0.01,
+			min:      corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("20m")},
+			containers: []corev1.Container{
+				{Name: "app", Resources: requests("1", "")},
+			},
+			wantCPU:    "20m",
+			wantMemory: "32Mi",
+		},
+		{
+			name:     "clamped to max",
+			fraction: 0.5,
+			max:      corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m")},
+			containers: []corev1.Container{
+				{Name: "app", Resources: requests("2", "")},
+			},
+			wantCPU:    "200m",
+			wantMemory: "32Mi",
+		},
+		{
+			name:     "never above the profile limit",
+			fraction: 0.5,
+			containers: []corev1.Container{
+				{Name: "app", Resources: requests("", "1Gi")},
+			},
+			wantCPU:    "10m",
+			wantMemory: "64Mi",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalFraction, originalMin, originalMax := conf.ProxyRequestFraction, conf.ProxyRequestMin, conf.ProxyRequestMax
+			conf.ProxyRequestFraction, conf.ProxyRequestMin, conf.ProxyRequestMax = tt.fraction, tt.min, tt.max
+			defer func() {
+				conf.ProxyRequestFraction, conf.ProxyRequestMin, conf.ProxyRequestMax = originalFraction, originalMin, originalMax
+			}()
+
+			mutated, err := injectProxy(corev1.Pod{Spec: corev1.PodSpec{Containers: tt.containers}})
+			require.NoError(t, err)
+
+			got := mutated.Spec.InitContainers[0].Resources.Requests
+			wantCPU, wantMemory := resource.MustParse(tt.wantCPU), resource.MustParse(tt.wantMemory)
+			assert.Zero(t, wantCPU.Cmp(*got.Cpu()), "cpu: got %s", got.Cpu())
+			assert.Zero(t, wantMemory.Cmp(*got.Memory()), "memory: got %s", got.Memory())
+		})
+	}
+}
+
+func TestCapacityWarnings(t *testing.T) {
+	pod := func(cpu string) corev1.Pod {
+		return corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name: "app",
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)},
+			},
+		}}}}
+	}
+
+	tests := []struct {
+		name         string
+		hint         corev1.ResourceList
+		cpu          string
+		wantWarnings []string
+	}{
+		{
+			name: "no hint",
+			cpu:  "2",
+		},
+		{
+			name: "within hint",
+			hint: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+			cpu:  "500m",
+		},
+		{
+			name:         "proxy pushes pod over hint",
+			hint:         corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+			cpu:          "995m",
+			wantWarnings: []string{"pod cpu request of 1005m with the proxy exceeds the node capacity hint of 1"},
+		},
+		{
+			name: "pod already over hint",
+			hint: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+			cpu:  "2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalHint := conf.NodeCapacityHint
+			conf.NodeCapacityHint = tt.hint
+			defer func() { conf.NodeCapacityHint = originalHint }()
+
+			original := pod(tt.cpu)
+			mutated, err := injectProxy(original)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.wantWarnings, capacityWarnings(original, mutated))
+		})
+	}
+}
+
+func TestInjectProxy_KeepsExistingProxyResources(t *testing.T) {
+	originalFraction := conf.ProxyRequestFraction
+	conf.ProxyRequestFraction = 0.5
+	defer func() { conf.ProxyRequestFraction = originalFraction }()
+
+	tight := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1m")},
+	}
+	pod := corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "mca-proxy", Image: "mca:v1", Resources: tight}},
+		Containers: []corev1.Container{{
+			Name:      "app",
+			Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}},
+		}},
+	}}
+
+	mutated, err := injectProxy(pod)
+	require.NoError(t, err)
+	assert.Equal(t, tight, mutated.Spec.InitContainers[0].Resources)
+}
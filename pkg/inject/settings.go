@@ -0,0 +1,147 @@
+package inject
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/marxus/k8s-mca/conf"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Namespace ConfigMap keys recognized as per-namespace injection overrides.
+const (
+	// NamespaceKeyProxyImage overrides the proxy image for pods in the namespace.
+	NamespaceKeyProxyImage = "proxyImage"
+	// NamespaceKeyProxyProfile overrides the default proxy resource profile for pods in the namespace.
+	NamespaceKeyProxyProfile = "proxyProfile"
+	// NamespaceKeyProxyAfter names the init container the proxy is inserted after for pods in the namespace.
+	NamespaceKeyProxyAfter = "proxyAfter"
+)
+
+// NamespaceOverrides returns the per-namespace injection overrides for a namespace,
+// or nil when the namespace has none.
+type NamespaceOverrides func(namespace string) map[string]string
+
+var namespaceOverrides atomic.Pointer[NamespaceOverrides]
+
+// SetNamespaceOverrides installs the lookup used to resolve per-namespace overrides.
+// Passing nil disables per-namespace overrides. It is safe for concurrent use.
+func SetNamespaceOverrides(lookup NamespaceOverrides) {
+	if lookup == nil {
+		namespaceOverrides.Store(nil)
+		return
+	}
+	namespaceOverrides.Store(&lookup)
+}
+
+// NamespaceAnnotations returns the annotations of a namespace, or nil when it has none
+// or cannot be read.
+type NamespaceAnnotations func(namespace string) map[string]string
+
+var namespaceAnnotations atomic.Pointer[NamespaceAnnotations]
+
+// SetNamespaceAnnotations installs the lookup used to copy the conf.NamespaceAnnotations
+// annotations from a pod's namespace onto the pod. Passing nil disables copying.
+// It is safe for concurrent use.
+func SetNamespaceAnnotations(lookup NamespaceAnnotations) {
+	if lookup == nil {
+		namespaceAnnotations.Store(nil)
+		return
+	}
+	namespaceAnnotations.Store(&lookup)
+}
+
+// copyNamespaceAnnotations copies the conf.NamespaceAnnotations annotations of the pod's
+// namespace onto the pod, leaving annotations the pod already sets untouched.
+func copyNamespaceAnnotations(pod *corev1.Pod) {
+	lookup := namespaceAnnotations.Load()
+	if lookup == nil || len(conf.NamespaceAnnotations) == 0 {
+		return
+	}
+
+	annotations := (*lookup)(pod.Namespace)
+	for _, key := range conf.NamespaceAnnotations {
+		value, ok := annotations[key]
+		if !ok {
+			continue
+		}
+		if _, exists := pod.Annotations[key]; exists {
+			continue
+		}
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[key] = value
+	}
+}
+
+// settings holds the injection settings resolved for a single pod.
+type settings struct {
+	proxyImage   string
+	proxyProfile string
+	proxyAfter   string
+	proxyArgs    []string
+}
+
+// resolveSettings layers the injection settings for a pod, highest precedence last:
+// global conf defaults, then the pod's namespace overrides, then pod annotations.
+func resolveSettings(namespace string, annotations map[string]string) settings {
+	resolved := settings{
+		proxyImage:   ProxyImage(),
+		proxyProfile: conf.ProxyDefaultProfile,
+		proxyAfter:   conf.ProxyInsertAfter,
+	}
+
+	if lookup := namespaceOverrides.Load(); lookup != nil {
+		overrides := (*lookup)(namespace)
+		if image := overrides[NamespaceKeyProxyImage]; image != "" {
+			resolved.proxyImage = image
+		}
+		if profile := overrides[NamespaceKeyProxyProfile]; profile != "" {
+			resolved.proxyProfile = profile
+		}
+		if after, ok := overrides[NamespaceKeyProxyAfter]; ok {
+			resolved.proxyAfter = after
+		}
+	}
+
+	if image := annotations[AnnotationProxyImage]; image != "" {
+		resolved.proxyImage = image
+	}
+	if profile, ok := annotations[AnnotationProxyProfile]; ok {
+		resolved.proxyProfile = profile
+	}
+	if after, ok := annotations[AnnotationProxyAfter]; ok {
+		resolved.proxyAfter = after
+	}
+	if args, ok := annotations[AnnotationProxyArgs]; ok {
+		resolved.proxyArgs = parseProxyArgs(args)
+	}
+
+	return resolved
+}
+
+// parseProxyArgs parses the comma-separated [AnnotationProxyArgs] value, prepending --proxy
+// when missing. Empty args and args containing whitespace are dropped with a warning.
+func parseProxyArgs(value string) []string {
+	args := []string{}
+	for _, arg := range strings.Split(value, ",") {
+		arg = strings.TrimSpace(arg)
+		switch {
+		case arg == "":
+			log.Printf("Warning: ignoring empty arg in %s annotation %q", AnnotationProxyArgs, value)
+		case strings.ContainsFunc(arg, unicode.IsSpace):
+			log.Printf("Warning: ignoring arg %q containing whitespace in %s annotation", arg, AnnotationProxyArgs)
+		default:
+			args = append(args, arg)
+		}
+	}
+
+	if !slices.Contains(args, "--proxy") {
+		args = append([]string{"--proxy"}, args...)
+	}
+	return args
+}
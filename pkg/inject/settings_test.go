@@ -0,0 +1,224 @@
+package inject
+
+import (
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestInjectProxy_SettingsPrecedence(t *testing.T) {
+	overrides := map[string]map[string]string{
+		"team-a": {NamespaceKeyProxyImage: "mca:team-a", NamespaceKeyProxyProfile: "medium"},
+		"team-b": {NamespaceKeyProxyProfile: "large"},
+	}
+	SetNamespaceOverrides(func(namespace string) map[string]string { return overrides[namespace] })
+	defer SetNamespaceOverrides(nil)
+
+	tests := []struct {
+		name        string
+		namespace   string
+		annotations map[string]string
+		wantImage   string
+		wantProfile string
+	}{
+		{
+			name:        "global defaults without namespace overrides",
+			namespace:   "other",
+			wantImage:   conf.ProxyImage,
+			wantProfile: conf.ProxyDefaultProfile,
+		},
+		{
+			name:        "namespace overrides global defaults",
+			namespace:   "team-a",
+			wantImage:   "mca:team-a",
+			wantProfile: "medium",
+		},
+		{
+			name:        "partial namespace override keeps global image",
+			namespace:   "team-b",
+			wantImage:   conf.ProxyImage,
+			wantProfile: "large",
+		},
+		{
+			name:      "annotations override namespace",
+			namespace: "team-a",
+			annotations: map[string]string{
+				AnnotationProxyImage:   "mca:pod",
+				AnnotationProxyProfile: "large",
+			},
+			wantImage:   "mca:pod",
+			wantProfile: "large",
+		},
+		{
+			name:        "annotations override global defaults",
+			namespace:   "other",
+			annotations: map[string]string{AnnotationProxyImage: "mca:pod"},
+			wantImage:   "mca:pod",
+			wantProfile: conf.ProxyDefaultProfile,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Annotations: tt.annotations},
+			}
+
+			result, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.wantImage, result.Spec.InitContainers[0].Image)
+			assert.Equal(t, conf.ProxyResourceProfiles[tt.wantProfile], result.Spec.InitContainers[0].Resources)
+		})
+	}
+}
+
+func TestResolveSettings_NamespaceOverridesGlobalOverride(t *testing.T) {
+	SetProxyImage("mca:global")
+	defer SetProxyImage("")
+	SetNamespaceOverrides(func(string) map[string]string {
+		return map[string]string{NamespaceKeyProxyImage: "mca:namespace"}
+	})
+	defer SetNamespaceOverrides(nil)
+
+	assert.Equal(t, "mca:namespace", resolveSettings("team-a", nil).proxyImage)
+
+	SetNamespaceOverrides(nil)
+	assert.Equal(t, "mca:global", resolveSettings("team-a", nil).proxyImage)
+}
+
+func TestInjectProxy_CopiesNamespaceAnnotations(t *testing.T) {
+	originalKeys := conf.NamespaceAnnotations
+	conf.NamespaceAnnotations = []string{"cost-center", "team"}
+	defer func() { conf.NamespaceAnnotations = originalKeys }()
+
+	namespaceAnnotations := map[string]map[string]string{
+		"team-a": {"cost-center": "1234", "team": "payments", "unrelated": "ignored"},
+	}
+	SetNamespaceAnnotations(func(namespace string) map[string]string { return namespaceAnnotations[namespace] })
+	defer SetNamespaceAnnotations(nil)
+
+	tests := []struct {
+		name            string
+		namespace       string
+		annotations     map[string]string
+		wantAnnotations map[string]string
+	}{
+		{
+			name:            "copies configured annotations",
+			namespace:       "team-a",
+			wantAnnotations: map[string]string{"cost-center": "1234", "team": "payments"},
+		},
+		{
+			name:            "keeps existing pod annotations",
+			namespace:       "team-a",
+			annotations:     map[string]string{"team": "checkout"},
+			wantAnnotations: map[string]string{"cost-center": "1234", "team": "checkout"},
+		},
+		{
+			name:      "namespace without annotations",
+			namespace: "team-b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Annotations: tt.annotations},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+			}
+
+			mutated, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			delete(mutated.Annotations, conf.ConfigHashAnnotation)
+			if tt.wantAnnotations == nil {
+				assert.Empty(t, mutated.Annotations)
+			} else {
+				assert.Equal(t, tt.wantAnnotations, mutated.Annotations)
+			}
+		})
+	}
+}
+
+func TestInjectProxy_UpstreamAnnotation(t *testing.T) {
+	defer SetUpstream("")
+
+	tests := []struct {
+		name         string
+		upstream     string
+		wantUpstream string
+	}{
+		{name: "records the upstream", upstream: "https://10.96.0.1:443", wantUpstream: "https://10.96.0.1:443"},
+		{name: "unknown upstream is not recorded", upstream: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetUpstream(tt.upstream)
+
+			pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}}}
+			mutated, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			upstream, ok := mutated.Annotations[AnnotationUpstream]
+			assert.Equal(t, tt.wantUpstream != "", ok)
+			assert.Equal(t, tt.wantUpstream, upstream)
+		})
+	}
+}
+
+func TestInjectProxy_ProxyArgsAnnotation(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation *string
+		wantArgs   []string
+	}{
+		{
+			name:     "default args without annotation",
+			wantArgs: []string{"--proxy"},
+		},
+		{
+			name:       "uses annotation args",
+			annotation: ptr.To("--proxy,--log-level=debug"),
+			wantArgs:   []string{"--proxy", "--log-level=debug"},
+		},
+		{
+			name:       "prepends missing --proxy",
+			annotation: ptr.To("--log-level=debug"),
+			wantArgs:   []string{"--proxy", "--log-level=debug"},
+		},
+		{
+			name:       "trims args and drops malformed ones",
+			annotation: ptr.To(" --proxy , ,--log-level=debug,--bad arg,"),
+			wantArgs:   []string{"--proxy", "--log-level=debug"},
+		},
+		{
+			name:       "empty annotation keeps only --proxy",
+			annotation: ptr.To(""),
+			wantArgs:   []string{"--proxy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := corev1.Pod{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+			}
+			if tt.annotation != nil {
+				pod.Annotations = map[string]string{AnnotationProxyArgs: *tt.annotation}
+			}
+
+			mutated, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			proxyContainer, _ := findProxyContainer(mutated)
+			assert.Equal(t, tt.wantArgs, proxyContainer.Args)
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package inject
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/marxus/k8s-mca/conf"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// maxSummaryImageLength bounds the image recorded in the summary, keeping the annotation small
+// even for images pinned by a long registry path and digest.
+const maxSummaryImageLength = 200
+
+// injectionSummary is the record of injection decisions stamped in conf.SummaryAnnotation.
+type injectionSummary struct {
+	Image   string `json:"image"`
+	Mode    string `json:"mode"`
+	Cluster string `json:"cluster"`
+	Profile string `json:"profile"`
+}
+
+// stampSummary sets the conf.SummaryAnnotation annotation to a JSON summary of the decisions
+// behind proxyContainer: its image, the sidecar mode, the cluster requests go to without a
+// cluster header and the resource profile. Like the config hash, it is only stamped when the
+// proxy is newly injected.
+func stampSummary(pod *corev1.Pod, proxyContainer corev1.Container, profile string) error {
+	if conf.SummaryAnnotation == "" {
+		return nil
+	}
+
+	image := proxyContainer.Image
+	if len(image) > maxSummaryImageLength {
+		image = image[:maxSummaryImageLength-3] + "..."
+	}
+	data, err := json.Marshal(injectionSummary{
+		Image:   image,
+		Mode:    conf.ProxySidecarMode,
+		Cluster: "in-cluster",
+		Profile: profile,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode injection summary: %w", err)
+	}
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[conf.SummaryAnnotation] = string(data)
+	return nil
+}
@@ -0,0 +1,79 @@
+package inject
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestInjectProxy_Summary(t *testing.T) {
+	longImage := "registry.example.com/" + strings.Repeat("a", 300) + "@sha256:abc"
+
+	tests := []struct {
+		name        string
+		annotation  string
+		annotations map[string]string
+		want        *injectionSummary
+	}{
+		{
+			name:       "disabled by default",
+			annotation: "",
+		},
+		{
+			name:       "records the injection decisions",
+			annotation: "mca.marxus.io/summary",
+			annotations: map[string]string{
+				AnnotationProxyImage:   "mca:v2",
+				AnnotationProxyProfile: "large",
+			},
+			want: &injectionSummary{Image: "mca:v2", Mode: conf.SidecarModeNative, Cluster: "in-cluster", Profile: "large"},
+		},
+		{
+			name:        "truncates long images",
+			annotation:  "mca.marxus.io/summary",
+			annotations: map[string]string{AnnotationProxyImage: longImage},
+			want: &injectionSummary{
+				Image:   longImage[:maxSummaryImageLength-3] + "...",
+				Mode:    conf.SidecarModeNative,
+				Cluster: "in-cluster",
+				Profile: conf.ProxyDefaultProfile,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalAnnotation := conf.SummaryAnnotation
+			conf.SummaryAnnotation = tt.annotation
+			defer func() { conf.SummaryAnnotation = originalAnnotation }()
+
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+				},
+			}
+
+			result, err := injectProxy(pod)
+			require.NoError(t, err)
+
+			if tt.want == nil {
+				assert.NotContains(t, result.Annotations, "mca.marxus.io/summary")
+				return
+			}
+			value := result.Annotations[tt.annotation]
+			require.NotEmpty(t, value)
+			assert.LessOrEqual(t, len(value), 512, "the summary stays size-bounded")
+
+			var summary injectionSummary
+			require.NoError(t, json.Unmarshal([]byte(value), &summary))
+			assert.Equal(t, *tt.want, summary)
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package inject
+
+import (
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Transformer customizes a pod after MCA's core mutation, e.g. adding labels or node selectors.
+type Transformer func(*corev1.Pod) error
+
+var (
+	transformersMu sync.RWMutex
+	transformers   []Transformer
+)
+
+// RegisterTransformer adds a transformer run by every subsequent injection, after the proxy
+// has been injected. Transformers run in registration order and the first error aborts the
+// injection. It is safe for concurrent use.
+func RegisterTransformer(transformer Transformer) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	transformers = append(transformers, transformer)
+}
+
+func applyTransformers(pod *corev1.Pod) error {
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+
+	for i, transformer := range transformers {
+		if err := transformer(pod); err != nil {
+			return fmt.Errorf("transformer %d failed: %w", i, err)
+		}
+	}
+	return nil
+}
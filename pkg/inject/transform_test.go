@@ -0,0 +1,74 @@
+package inject
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestRegisterTransformer(t *testing.T) {
+	defer func() { transformers = nil }()
+
+	var order []string
+	RegisterTransformer(func(pod *corev1.Pod) error {
+		order = append(order, "label")
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+		}
+		pod.Labels["team"] = "platform"
+		return nil
+	})
+	RegisterTransformer(func(pod *corev1.Pod) error {
+		order = append(order, "inspect")
+		require.NotEmpty(t, pod.Spec.InitContainers)
+		assert.Equal(t, "mca-proxy", pod.Spec.InitContainers[0].Name)
+		return nil
+	})
+
+	result, err := injectProxy(corev1.Pod{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "platform", result.Labels["team"])
+	assert.Equal(t, []string{"label", "inspect"}, order)
+}
+
+func TestRegisterTransformer_ErrorAbortsInjection(t *testing.T) {
+	defer func() { transformers = nil }()
+
+	ran := false
+	RegisterTransformer(func(*corev1.Pod) error { return errors.New("node selector conflict") })
+	RegisterTransformer(func(*corev1.Pod) error {
+		ran = true
+		return nil
+	})
+
+	_, err := injectProxy(corev1.Pod{})
+	assert.EqualError(t, err, "transformer 0 failed: node selector conflict")
+	assert.False(t, ran)
+}
+
+func TestRegisterTransformer_MetadataInJSONPatch(t *testing.T) {
+	defer func() { transformers = nil }()
+
+	RegisterTransformer(func(pod *corev1.Pod) error {
+		pod.Labels = map[string]string{"team": "platform"}
+		return nil
+	})
+
+	pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}}}
+	mutatedPod, err := injectProxy(pod)
+	require.NoError(t, err)
+
+	patchJSON, err := JSONPatch(pod, mutatedPod)
+	require.NoError(t, err)
+	patch, err := jsonpatch.DecodePatch(patchJSON)
+	require.NoError(t, err)
+	patchedJSON, err := patch.Apply(mustMarshal(t, &pod))
+	require.NoError(t, err)
+
+	assertSamePod(t, mustMarshal(t, &mutatedPod), patchedJSON)
+}
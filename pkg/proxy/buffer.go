@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"net/http/httputil"
+	"sync"
+)
+
+// bufferPool is an [httputil.BufferPool] of buffers of a fixed size, reused across responses.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool returns a pool of size byte buffers for copying response bodies, which bounds
+// the copy buffer of each in-flight response to size bytes.
+func NewBufferPool(size int) httputil.BufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() any {
+		buf := make([]byte, p.size)
+		return &buf
+	}
+	return p
+}
+
+func (p *bufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
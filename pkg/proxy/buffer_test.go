@@ -0,0 +1,116 @@
+// Response buffer pool and flush interval tests.
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingBufferPool records the buffers taken from a pool.
+type countingBufferPool struct {
+	httputil.BufferPool
+	gets  atomic.Int32
+	sizes chan int
+}
+
+func (p *countingBufferPool) Get() []byte {
+	p.gets.Add(1)
+	buf := p.BufferPool.Get()
+	select {
+	case p.sizes <- len(buf):
+	default:
+	}
+	return buf
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool(1024)
+
+	buf := pool.Get()
+	assert.Len(t, buf, 1024)
+	pool.Put(buf[:10])
+	assert.Len(t, pool.Get(), 1024)
+
+	pool.Put(make([]byte, 10))
+	assert.Len(t, pool.Get(), 1024)
+}
+
+func TestNewReverseProxy_Buffering(t *testing.T) {
+	tests := []struct {
+		name              string
+		bufferSize        int
+		flushInterval     time.Duration
+		wantBufferPool    bool
+		wantFlushInterval time.Duration
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name:              "bounded buffer and flush interval",
+			bufferSize:        4096,
+			flushInterval:     100 * time.Millisecond,
+			wantBufferPool:    true,
+			wantFlushInterval: 100 * time.Millisecond,
+		},
+		{
+			name:              "flush after every write",
+			flushInterval:     -1,
+			wantFlushInterval: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalSize, originalInterval := conf.ProxyBufferSize, conf.ProxyFlushInterval
+			conf.ProxyBufferSize, conf.ProxyFlushInterval = tt.bufferSize, tt.flushInterval
+			defer func() { conf.ProxyBufferSize, conf.ProxyFlushInterval = originalSize, originalInterval }()
+
+			reverseProxy := NewReverseProxy(testutil.NewUpstream(t, testutil.UpstreamOptions{}).URL(), http.DefaultTransport)
+
+			assert.Equal(t, tt.wantBufferPool, reverseProxy.BufferPool != nil)
+			assert.Equal(t, tt.wantFlushInterval, reverseProxy.FlushInterval)
+		})
+	}
+}
+
+func TestNewReverseProxy_BufferPoolLargeResponse(t *testing.T) {
+	originalSize := conf.ProxyBufferSize
+	conf.ProxyBufferSize = 1024
+	defer func() { conf.ProxyBufferSize = originalSize }()
+
+	raw := make([]byte, 2<<20)
+	_, err := rand.Read(raw)
+	require.NoError(t, err)
+	body := hex.EncodeToString(raw)
+
+	upstream := testutil.NewUpstream(t, testutil.UpstreamOptions{Body: body})
+	reverseProxy := NewReverseProxy(upstream.URL(), http.DefaultTransport)
+	pool := &countingBufferPool{BufferPool: reverseProxy.BufferPool, sizes: make(chan int, 1)}
+	reverseProxy.BufferPool = pool
+	frontend := httptest.NewServer(reverseProxy)
+	defer frontend.Close()
+
+	res, err := http.Get(frontend.URL + "/api/v1/pods")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	got, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, body, string(got))
+	assert.Positive(t, pool.gets.Load())
+	assert.Equal(t, 1024, <-pool.sizes)
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// SetClientCertClusters makes the proxy route API requests by the client certificate the
+// workload presents instead of by conf.ClusterHeader, tying the credential a request is sent
+// with to the identity of its sender. The certificate must verify against clientCAs, and its
+// subject common name is looked up in clusters to select the cluster. Local paths such as
+// /healthz stay reachable without a certificate, so probes keep working.
+// It must be called before [Server.Start].
+func (s *Server) SetClientCertClusters(clientCAs *x509.CertPool, clusters map[string]string) {
+	s.clientCertClusters = clusters
+	s.httpServer.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	s.httpServer.TLSConfig.ClientCAs = clientCAs
+}
+
+// clientCertCluster returns the cluster mapped to the client certificate of r. A requested
+// cluster, from the cluster header or path prefix, naming another cluster is rejected rather
+// than ignored.
+func (s *Server) clientCertCluster(r *http.Request, requested string) (string, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", errors.New("a client certificate is required")
+	}
+
+	subject := r.TLS.PeerCertificates[0].Subject.CommonName
+	cluster, ok := s.clientCertClusters[subject]
+	if !ok {
+		return "", fmt.Errorf("client certificate %q is not mapped to a cluster", subject)
+	}
+	if requested != "" && requested != cluster {
+		return "", fmt.Errorf("client certificate %q may not use cluster %q", subject, requested)
+	}
+	return cluster, nil
+}
@@ -0,0 +1,193 @@
+// Client certificate cluster routing tests.
+package proxy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+// newClientCert issues a client certificate for commonName signed by caCert.
+func newClientCert(t *testing.T, caCert *x509.Certificate, caKey crypto.Signer, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: key}
+}
+
+func TestServer_ClientCertClusters(t *testing.T) {
+	newBackend := func(body string) *httputil.ReverseProxy {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(backend.Close)
+
+		backendURL, err := url.Parse(backend.URL)
+		require.NoError(t, err)
+		return httputil.NewSingleHostReverseProxy(backendURL)
+	}
+
+	serverCert, serverCAPEM, err := certs.GenerateCAAndTLSCert([]string{"localhost"}, nil)
+	require.NoError(t, err)
+	clientCACert, clientCAKey, err := certs.GenerateCA(certs.DefaultCAOptions())
+	require.NoError(t, err)
+	otherCACert, otherCAKey, err := certs.GenerateCA(certs.DefaultCAOptions())
+	require.NoError(t, err)
+
+	originalLocalPaths := conf.ProxyLocalPaths
+	conf.ProxyLocalPaths = []string{"/healthz"}
+	defer func() { conf.ProxyLocalPaths = originalLocalPaths }()
+
+	server := NewServer(serverCert, map[string]*httputil.ReverseProxy{
+		"in-cluster": newBackend("in-cluster"),
+		"staging":    newBackend("staging"),
+	})
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCACert)
+	server.SetClientCertClusters(clientCAs, map[string]string{
+		"billing-worker": "staging",
+		"web":            "in-cluster",
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.serve(listener)
+	t.Cleanup(func() { server.httpServer.Close() })
+
+	serverCAs := x509.NewCertPool()
+	require.True(t, serverCAs.AppendCertsFromPEM(serverCAPEM))
+
+	tests := []struct {
+		name          string
+		clientCert    *tls.Certificate
+		path          string
+		clusterHeader string
+		wantCode      int
+		wantBody      string
+		wantMessage   string
+		wantTLSError  bool
+	}{
+		{
+			name:       "billing worker is routed to staging",
+			clientCert: ptr.To(newClientCert(t, clientCACert, clientCAKey, "billing-worker")),
+			path:       "/api/v1/pods",
+			wantCode:   http.StatusOK,
+			wantBody:   "staging",
+		},
+		{
+			name:       "web is routed to in-cluster",
+			clientCert: ptr.To(newClientCert(t, clientCACert, clientCAKey, "web")),
+			path:       "/api/v1/pods",
+			wantCode:   http.StatusOK,
+			wantBody:   "in-cluster",
+		},
+		{
+			name:          "matching cluster header is allowed",
+			clientCert:    ptr.To(newClientCert(t, clientCACert, clientCAKey, "billing-worker")),
+			path:          "/api/v1/pods",
+			clusterHeader: "staging",
+			wantCode:      http.StatusOK,
+			wantBody:      "staging",
+		},
+		{
+			name:          "cluster header cannot escape the certificate's cluster",
+			clientCert:    ptr.To(newClientCert(t, clientCACert, clientCAKey, "web")),
+			path:          "/api/v1/pods",
+			clusterHeader: "staging",
+			wantCode:      http.StatusForbidden,
+			wantMessage:   `client certificate "web" may not use cluster "staging"`,
+		},
+		{
+			name:        "unmapped subject is rejected",
+			clientCert:  ptr.To(newClientCert(t, clientCACert, clientCAKey, "intruder")),
+			path:        "/api/v1/pods",
+			wantCode:    http.StatusForbidden,
+			wantMessage: `client certificate "intruder" is not mapped to a cluster`,
+		},
+		{
+			name:        "missing certificate is rejected",
+			path:        "/api/v1/pods",
+			wantCode:    http.StatusForbidden,
+			wantMessage: "a client certificate is required",
+		},
+		{
+			name:     "local paths need no certificate",
+			path:     "/healthz",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:         "certificate from another CA fails the handshake",
+			clientCert:   ptr.To(newClientCert(t, otherCACert, otherCAKey, "billing-worker")),
+			path:         "/api/v1/pods",
+			wantTLSError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig := &tls.Config{RootCAs: serverCAs, ServerName: "localhost"}
+			if tt.clientCert != nil {
+				tlsConfig.Certificates = []tls.Certificate{*tt.clientCert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+			req, err := http.NewRequest(http.MethodGet, "https://"+listener.Addr().String()+tt.path, nil)
+			require.NoError(t, err)
+			if tt.clusterHeader != "" {
+				req.Header.Set(conf.ClusterHeader, tt.clusterHeader)
+			}
+
+			resp, err := client.Do(req)
+			if tt.wantTLSError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, string(body))
+			}
+			if tt.wantMessage != "" {
+				var status metav1.Status
+				require.NoError(t, json.Unmarshal(body, &status))
+				assert.Equal(t, metav1.StatusReasonForbidden, status.Reason)
+				assert.Equal(t, tt.wantMessage, status.Message)
+			}
+		})
+	}
+}
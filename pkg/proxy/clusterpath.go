@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// clusterPathPrefix selects the target cluster by path, as in /clusters/<name>/api/v1/pods,
+// for clients that cannot set conf.ClusterHeader.
+const clusterPathPrefix = "/clusters/"
+
+// splitClusterPath splits a /clusters/<name>/... path into the cluster name and the API path
+// that follows it. ok is false when path has no cluster prefix or names no cluster.
+func splitClusterPath(path string) (cluster, rest string, ok bool) {
+	after, found := strings.CutPrefix(path, clusterPathPrefix)
+	if !found {
+		return "", "", false
+	}
+	cluster, rest, _ = strings.Cut(after, "/")
+	if cluster == "" {
+		return "", "", false
+	}
+	return cluster, "/" + rest, true
+}
+
+// stripClusterPath returns the cluster named by the path prefix of r and a shallow copy of r
+// with the prefix removed. When r has no cluster prefix, it is returned unchanged with an
+// empty cluster.
+func stripClusterPath(r *http.Request) (string, *http.Request) {
+	cluster, path, ok := splitClusterPath(r.URL.Path)
+	if !ok {
+		return "", r
+	}
+
+	stripped := new(http.Request)
+	*stripped = *r
+	stripped.URL = new(url.URL)
+	*stripped.URL = *r.URL
+	stripped.URL.Path = path
+	if _, rawPath, ok := splitClusterPath(r.URL.RawPath); ok {
+		stripped.URL.RawPath = rawPath
+	} else {
+		stripped.URL.RawPath = ""
+	}
+	stripped.RequestURI = stripped.URL.RequestURI()
+	return cluster, stripped
+}
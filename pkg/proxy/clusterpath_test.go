@@ -0,0 +1,137 @@
+// Cluster path prefix routing tests.
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSplitClusterPath(t *testing.T) {
+	tests := []struct {
+		path        string
+		wantCluster string
+		wantRest    string
+		wantOK      bool
+	}{
+		{"/clusters/prod/api/v1/pods", "prod", "/api/v1/pods", true},
+		{"/clusters/prod/", "prod", "/", true},
+		{"/clusters/prod", "prod", "/", true},
+		{"/clusters/in-cluster/apis", "in-cluster", "/apis", true},
+		{"/clusters/", "", "", false},
+		{"/clusters//api", "", "", false},
+		{"/clusters", "", "", false},
+		{"/api/v1/pods", "", "", false},
+		{"/api/v1/namespaces/clusters/pods", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			cluster, rest, ok := splitClusterPath(tt.path)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantCluster, cluster)
+			assert.Equal(t, tt.wantRest, rest)
+		})
+	}
+}
+
+func TestServer_Handler_RoutesByClusterPath(t *testing.T) {
+	newBackend := func(name string) *httputil.ReverseProxy {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.RequestURI()))
+		}))
+		t.Cleanup(backend.Close)
+
+		backendURL, err := url.Parse(backend.URL)
+		require.NoError(t, err)
+		return httputil.NewSingleHostReverseProxy(backendURL)
+	}
+
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": newBackend("in-cluster"),
+		"prod":       newBackend("prod"),
+	})
+
+	tests := []struct {
+		name     string
+		target   string
+		header   string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "strips the prefix and routes to the named cluster",
+			target:   "/clusters/prod/api/v1/pods",
+			wantCode: http.StatusOK,
+			wantBody: "prod /api/v1/pods",
+		},
+		{
+			name:     "keeps the query",
+			target:   "/clusters/prod/api/v1/pods?watch=false&limit=5",
+			wantCode: http.StatusOK,
+			wantBody: "prod /api/v1/pods?watch=false&limit=5",
+		},
+		{
+			name:     "keeps escaped path segments",
+			target:   "/clusters/prod/api/v1/namespaces/default/configmaps/a%2Fb",
+			wantCode: http.StatusOK,
+			wantBody: "prod /api/v1/namespaces/default/configmaps/a%2Fb",
+		},
+		{
+			name:     "routes to in-cluster without a prefix",
+			target:   "/api/v1/pods",
+			wantCode: http.StatusOK,
+			wantBody: "in-cluster /api/v1/pods",
+		},
+		{
+			name:     "prefix takes precedence over the cluster header",
+			target:   "/clusters/prod/api/v1/pods",
+			header:   "in-cluster",
+			wantCode: http.StatusOK,
+			wantBody: "prod /api/v1/pods",
+		},
+		{
+			name:     "rejects an unknown cluster",
+			target:   "/clusters/staging/api/v1/pods",
+			wantCode: http.StatusNotFound,
+			wantBody: `cluster "staging" not found`,
+		},
+		{
+			name:     "rejects a non-API path after the prefix",
+			target:   "/clusters/prod/dashboard",
+			wantCode: http.StatusNotFound,
+			wantBody: "path /dashboard is not a Kubernetes API path",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set(conf.ClusterHeader, tt.header)
+			}
+			recorder := httptest.NewRecorder()
+			server.handler(recorder, req)
+
+			assert.Equal(t, tt.wantCode, recorder.Code)
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, tt.wantBody, recorder.Body.String())
+				return
+			}
+			var status metav1.Status
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+			assert.Equal(t, metav1.StatusReasonNotFound, status.Reason)
+			assert.Equal(t, int32(http.StatusNotFound), status.Code)
+			assert.Contains(t, status.Message, tt.wantBody)
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDiscoveryBodySize bounds the responses kept by the discovery cache. OpenAPI documents of
+// large clusters can exceed it and are then proxied every time.
+const maxDiscoveryBodySize = 16 << 20
+
+// discoveryCache keeps successful discovery and OpenAPI responses for a TTL, keyed by cluster,
+// path and the headers that select the representation. Responses do not depend on the client,
+// since the proxy sends every request with its own credentials. It is safe for concurrent use.
+type discoveryCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*discoveryEntry
+}
+
+type discoveryEntry struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// discoveryCachedHeaders are the response headers describing the cached representation. Others,
+// such as Audit-Id and Warning, belong to the request that filled the cache and are not replayed.
+var discoveryCachedHeaders = []string{"Content-Type", "Content-Encoding", "ETag", "Last-Modified", "Cache-Control", "Vary"}
+
+func newDiscoveryCache(ttl time.Duration) *discoveryCache {
+	return &discoveryCache{ttl: ttl, now: time.Now, entries: map[string]*discoveryEntry{}}
+}
+
+// isDiscoveryPath reports whether path is a discovery or OpenAPI endpoint: /api, /api/<version>,
+// /apis, /apis/<group>, /apis/<group>/<version>, /version and everything under /openapi/.
+func isDiscoveryPath(path string) bool {
+	switch {
+	case path == "/api" || path == "/apis" || path == "/version":
+		return true
+	case strings.HasPrefix(path, "/openapi/"):
+		return true
+	case strings.HasPrefix(path, "/api/"):
+		return !strings.Contains(strings.TrimPrefix(path, "/api/"), "/")
+	case strings.HasPrefix(path, "/apis/"):
+		return strings.Count(strings.TrimPrefix(path, "/apis/"), "/") <= 1
+	}
+	return false
+}
+
+func discoveryKey(r *http.Request, cluster string) string {
+	return strings.Join([]string{cluster, r.URL.RequestURI(), r.Header.Get("Accept"), r.Header.Get("Accept-Encoding")}, "\x00")
+}
+
+// serve answers r from the cache when it holds a fresh response, with the warnings recorded for
+// r, and otherwise forwards it to next, keeping a 200 response for the TTL.
+func (c *discoveryCache) serve(w http.ResponseWriter, r *http.Request, cluster string, next http.Handler) {
+	key := discoveryKey(r, cluster)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if ok {
+		for name, values := range entry.header {
+			w.Header()[name] = values
+		}
+		appendWarnings(w.Header(), r)
+		w.WriteHeader(http.StatusOK)
+		w.Write(entry.body)
+		return
+	}
+
+	recorder := &discoveryRecorder{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(recorder, r)
+	if recorder.status != http.StatusOK || recorder.overflow {
+		return
+	}
+
+	header := http.Header{}
+	for _, name := range discoveryCachedHeaders {
+		if values := w.Header().Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = slices.Clone(values)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &discoveryEntry{
+		header:  header,
+		body:    recorder.body.Bytes(),
+		expires: c.now().Add(c.ttl),
+	}
+}
+
+func (c *discoveryCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
+
+// discoveryRecorder passes a response through while keeping a copy of it for the cache.
+type discoveryRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *discoveryRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *discoveryRecorder) Write(p []byte) (int, error) {
+	if !r.overflow {
+		if r.body.Len()+len(p) > maxDiscoveryBodySize {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *discoveryRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,170 @@
+// Discovery and OpenAPI response cache tests.
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsDiscoveryPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/api", true},
+		{"/api/v1", true},
+		{"/apis", true},
+		{"/apis/apps", true},
+		{"/apis/apps/v1", true},
+		{"/version", true},
+		{"/openapi/v2", true},
+		{"/openapi/v3/apis/apps/v1", true},
+		{"/api/v1/pods", false},
+		{"/api/v1/namespaces/default/pods", false},
+		{"/apis/apps/v1/deployments", false},
+		{"/healthz", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, isDiscoveryPath(tt.path))
+		})
+	}
+}
+
+func TestServer_DiscoveryCache(t *testing.T) {
+	var upstreamCalls atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		if r.URL.Path == "/apis/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kind":"APIGroupList","path":"` + r.URL.Path + `","accept":"` + r.Header.Get("Accept") + `"}`))
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	originalTTL := conf.ProxyDiscoveryCacheTTL
+	conf.ProxyDiscoveryCacheTTL = time.Minute
+	defer func() { conf.ProxyDiscoveryCacheTTL = originalTTL }()
+
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": httputil.NewSingleHostReverseProxy(backendURL),
+		"prod":       httputil.NewSingleHostReverseProxy(backendURL),
+	})
+	now := time.Now()
+	server.discovery.now = func() time.Time { return now }
+
+	get := func(path, cluster, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if cluster != "" {
+			req.Header.Set(conf.ClusterHeader, cluster)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		recorder := httptest.NewRecorder()
+		server.handler(recorder, req)
+		return recorder
+	}
+
+	first := get("/apis", "", "")
+	require.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, int64(1), upstreamCalls.Load())
+
+	cached := get("/apis", "", "")
+	assert.Equal(t, http.StatusOK, cached.Code)
+	assert.Equal(t, first.Body.String(), cached.Body.String())
+	assert.Equal(t, "application/json", cached.Header().Get("Content-Type"))
+	assert.Equal(t, int64(1), upstreamCalls.Load(), "served from the cache within the TTL")
+
+	get("/apis", "prod", "")
+	assert.Equal(t, int64(2), upstreamCalls.Load(), "clusters are cached separately")
+	get("/apis", "", "application/json;g=apidiscovery.k8s.io;v=v2;as=APIGroupDiscoveryList")
+	assert.Equal(t, int64(3), upstreamCalls.Load(), "representations are cached separately")
+
+	get("/api/v1/pods", "", "")
+	get("/api/v1/pods", "", "")
+	assert.Equal(t, int64(5), upstreamCalls.Load(), "resource requests are never cached")
+
+	get("/apis/missing", "", "")
+	get("/apis/missing", "", "")
+	assert.Equal(t, int64(7), upstreamCalls.Load(), "errors are never cached")
+
+	now = now.Add(time.Minute)
+	get("/apis", "", "")
+	assert.Equal(t, int64(8), upstreamCalls.Load(), "expired entries are refetched")
+
+	server.SetReverseProxies(map[string]*httputil.ReverseProxy{"in-cluster": httputil.NewSingleHostReverseProxy(backendURL)})
+	get("/apis", "", "")
+	assert.Equal(t, int64(9), upstreamCalls.Load(), "a new cluster map drops the cache")
+}
+
+func TestServer_DiscoveryCache_PerRequestHeaders(t *testing.T) {
+	var upstreamCalls atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls := upstreamCalls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"discovery"`)
+		w.Header().Set("Audit-Id", fmt.Sprintf("audit-%d", calls))
+		w.Header().Add("Warning", `299 - "upstream warning"`)
+		w.Write([]byte(`{"kind":"APIGroupList"}`))
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	originalTTL := conf.ProxyDiscoveryCacheTTL
+	conf.ProxyDiscoveryCacheTTL = time.Minute
+	defer func() { conf.ProxyDiscoveryCacheTTL = originalTTL }()
+	originalPolicy := conf.UnknownClusterPolicy
+	conf.UnknownClusterPolicy = conf.UnknownClusterFallback
+	defer func() { conf.UnknownClusterPolicy = originalPolicy }()
+
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": NewReverseProxy(backendURL, http.DefaultTransport),
+	})
+
+	get := func(cluster string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/apis", nil)
+		if cluster != "" {
+			req.Header.Set(conf.ClusterHeader, cluster)
+		}
+		recorder := httptest.NewRecorder()
+		server.handler(recorder, req)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		return recorder
+	}
+
+	// The unknown clusters fall back to in-cluster, so all three requests share one cache key.
+	first := get("x")
+	assert.Equal(t, "audit-1", first.Header().Get("Audit-Id"))
+	assert.Len(t, first.Header().Values("Warning"), 2)
+	assert.Contains(t, first.Header().Values("Warning")[1], `unknown cluster \"x\"`)
+
+	direct := get("")
+	assert.Equal(t, int64(1), upstreamCalls.Load(), "served from the cache")
+	assert.Equal(t, "application/json", direct.Header().Get("Content-Type"))
+	assert.Equal(t, `"discovery"`, direct.Header().Get("ETag"))
+	assert.Empty(t, direct.Header().Get("Audit-Id"), "the first request's Audit-Id is not replayed")
+	assert.Empty(t, direct.Header().Values("Warning"), "the first request's warnings are not replayed")
+
+	other := get("y")
+	assert.Equal(t, int64(1), upstreamCalls.Load(), "served from the cache")
+	require.Len(t, other.Header().Values("Warning"), 1)
+	assert.Contains(t, other.Header().Values("Warning")[0], `unknown cluster \"y\"`)
+}
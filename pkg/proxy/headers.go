@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/marxus/k8s-mca/conf"
+)
+
+// protectedHeaders are the API server audit and request tracing headers the proxy never strips
+// or rewrites, so a request can be correlated across the client, the proxy and the API server.
+var protectedHeaders = map[string]bool{
+	"Audit-Id":      true,
+	"Traceparent":   true,
+	"Tracestate":    true,
+	"Baggage":       true,
+	"X-Request-Id":  true,
+	"Uber-Trace-Id": true,
+	"B3":            true,
+}
+
+// protectedHeaderPrefixes extend protectedHeaders to header families such as B3 multi-header.
+var protectedHeaderPrefixes = []string{"X-B3-"}
+
+func isProtectedHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if protectedHeaders[name] {
+		return true
+	}
+	for _, prefix := range protectedHeaderPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hopByHopHeaders are the hop-by-hop headers of RFC 7230 section 6.1, with the obsolete
+// Keep-Alive and Proxy-Connection that clients still send.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func isHopByHopHeader(name string) bool {
+	return slices.Contains(hopByHopHeaders, http.CanonicalHeaderKey(name))
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, the headers named in Connection and
+// the headers listed in conf.ProxyHopByHopHeaders, as RFC 7230 section 6.1 requires of a
+// proxy. The Connection and Upgrade headers of a protocol upgrade, and a "Te: trailers", are
+// kept, since they are negotiated end to end through the proxy. Protected headers are never
+// removed, even when named in Connection or conf.ProxyHopByHopHeaders.
+func removeHopByHopHeaders(header http.Header) {
+	upgrade := upgradeType(header)
+	trailers := headerHasToken(header, "Te", "trailers")
+
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" && !isProtectedHeader(name) {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	for _, name := range conf.ProxyHopByHopHeaders {
+		if !isProtectedHeader(name) {
+			header.Del(name)
+		}
+	}
+
+	if upgrade != "" {
+		header.Set("Connection", "Upgrade")
+		header.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		header.Set("Te", "trailers")
+	}
+}
+
+// upgradeType returns the protocol a request asks to upgrade to, or "" when it does not.
+func upgradeType(header http.Header) string {
+	if !headerHasToken(header, "Connection", "upgrade") {
+		return ""
+	}
+	return header.Get("Upgrade")
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(textproto.TrimString(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setUserAgent rewrites the forwarded User-Agent according to conf.ProxyUserAgent.
+func setUserAgent(header http.Header) {
+	identifier := fmt.Sprintf("mca/%s", conf.Version)
+
+	switch conf.ProxyUserAgent {
+	case conf.UserAgentSet:
+		header.Set("User-Agent", identifier)
+	case conf.UserAgentAppend:
+		if original := header.Get("User-Agent"); original != "" {
+			header.Set("User-Agent", fmt.Sprintf("%s (%s)", identifier, original))
+		} else {
+			header.Set("User-Agent", identifier)
+		}
+	}
+}
+
+// stripResponseHeaders removes the response headers listed in conf.ProxyStripResponseHeaders.
+// An entry ending in "*" removes every header with that prefix. Protected headers are kept, and
+// so are hop-by-hop headers, which only remain on upgrade responses that need them.
+func stripResponseHeaders(header http.Header) {
+	for _, name := range conf.ProxyStripResponseHeaders {
+		prefix, isPrefix := strings.CutSuffix(name, "*")
+		if !isPrefix {
+			if !isProtectedHeader(name) && !isHopByHopHeader(name) {
+				header.Del(name)
+			}
+			continue
+		}
+		prefix = http.CanonicalHeaderKey(prefix)
+		for key := range header {
+			if strings.HasPrefix(key, prefix) && !isProtectedHeader(key) && !isHopByHopHeader(key) {
+				header.Del(key)
+			}
+		}
+	}
+}
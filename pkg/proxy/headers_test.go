@@ -0,0 +1,377 @@
+// Request and response header manipulation tests.
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Handler_UserAgent(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		userAgent     string
+		wantUserAgent string
+	}{
+		{
+			name:          "appends original user agent",
+			mode:          conf.UserAgentAppend,
+			userAgent:     "kubectl/v1.34.0",
+			wantUserAgent: "mca/" + conf.Version + " (kubectl/v1.34.0)",
+		},
+		{
+			name:          "uses identifier without original user agent",
+			mode:          conf.UserAgentAppend,
+			wantUserAgent: "mca/" + conf.Version,
+		},
+		{
+			name:          "replaces original user agent",
+			mode:          conf.UserAgentSet,
+			userAgent:     "kubectl/v1.34.0",
+			wantUserAgent: "mca/" + conf.Version,
+		},
+		{
+			name:          "leaves user agent untouched when disabled",
+			mode:          conf.UserAgentOff,
+			userAgent:     "kubectl/v1.34.0",
+			wantUserAgent: "kubectl/v1.34.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalMode := conf.ProxyUserAgent
+			conf.ProxyUserAgent = tt.mode
+			defer func() { conf.ProxyUserAgent = originalMode }()
+
+			var receivedUserAgent string
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				receivedUserAgent = r.Header.Get("User-Agent")
+			}))
+			defer backend.Close()
+
+			backendURL, err := url.Parse(backend.URL)
+			require.NoError(t, err)
+			server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+				"in-cluster": httputil.NewSingleHostReverseProxy(backendURL),
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			server.handler(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tt.wantUserAgent, receivedUserAgent)
+		})
+	}
+}
+
+func TestNewReverseProxy_StripsResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		strip       []string
+		wantRemoved []string
+		wantKept    []string
+	}{
+		{
+			name:     "strips nothing by default",
+			wantKept: []string{"Set-Cookie", "X-Internal-Node", "X-Internal-Zone", "Audit-Id"},
+		},
+		{
+			name:        "strips listed headers",
+			strip:       []string{"set-cookie"},
+			wantRemoved: []string{"Set-Cookie"},
+			wantKept:    []string{"X-Internal-Node", "X-Internal-Zone", "Audit-Id"},
+		},
+		{
+			name:        "strips headers by prefix",
+			strip:       []string{"Set-Cookie", "X-Internal-*"},
+			wantRemoved: []string{"Set-Cookie", "X-Internal-Node", "X-Internal-Zone"},
+			wantKept:    []string{"Audit-Id"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalStrip := conf.ProxyStripResponseHeaders
+			conf.ProxyStripResponseHeaders = tt.strip
+			defer func() { conf.ProxyStripResponseHeaders = originalStrip }()
+
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Set-Cookie", "session=1")
+				w.Header().Set("X-Internal-Node", "node-1")
+				w.Header().Set("X-Internal-Zone", "zone-a")
+				w.Header().Set("Audit-Id", "abc")
+			}))
+			defer backend.Close()
+			backendURL, err := url.Parse(backend.URL)
+			require.NoError(t, err)
+
+			server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+				"in-cluster": NewReverseProxy(backendURL, http.DefaultTransport),
+			})
+
+			recorder := httptest.NewRecorder()
+			server.handler(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+
+			require.Equal(t, http.StatusOK, recorder.Code)
+			for _, header := range tt.wantRemoved {
+				assert.Empty(t, recorder.Header().Get(header), header)
+			}
+			for _, header := range tt.wantKept {
+				assert.NotEmpty(t, recorder.Header().Get(header), header)
+			}
+		})
+	}
+}
+
+func TestServer_Handler_Warnings(t *testing.T) {
+	upstreamWarning := `299 - "batch/v1beta1 CronJob is deprecated"`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Warning", upstreamWarning)
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": NewReverseProxy(backendURL, http.DefaultTransport),
+	})
+
+	tests := []struct {
+		name         string
+		cluster      string
+		wantWarnings []string
+	}{
+		{
+			name:         "passes upstream warnings through",
+			wantWarnings: []string{upstreamWarning},
+		},
+		{
+			name:    "appends mca warnings",
+			cluster: "staging",
+			wantWarnings: []string{
+				upstreamWarning,
+				`299 mca "unknown cluster \"staging\", request was sent to in-cluster"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalPolicy := conf.UnknownClusterPolicy
+			conf.UnknownClusterPolicy = conf.UnknownClusterFallback
+			defer func() { conf.UnknownClusterPolicy = originalPolicy }()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			if tt.cluster != "" {
+				req.Header.Set(conf.ClusterHeader, tt.cluster)
+			}
+			recorder := httptest.NewRecorder()
+			server.handler(recorder, req)
+
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, tt.wantWarnings, recorder.Header().Values("Warning"))
+		})
+	}
+}
+
+func TestAddWarning_IgnoresRequestsNotRouted(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+	AddWarning(req, "ignored")
+
+	header := http.Header{}
+	appendWarnings(header, req)
+	assert.Empty(t, header.Values("Warning"))
+}
+
+func TestServer_Handler_ProtectedHeaders(t *testing.T) {
+	originalStrip, originalMode := conf.ProxyStripResponseHeaders, conf.ProxyUserAgent
+	conf.ProxyStripResponseHeaders = []string{"*", "Audit-Id", "traceparent"}
+	conf.ProxyUserAgent = conf.UserAgentSet
+	defer func() { conf.ProxyStripResponseHeaders, conf.ProxyUserAgent = originalStrip, originalMode }()
+
+	requestHeaders := map[string]string{
+		"Traceparent":  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"Tracestate":   "vendor=opaque",
+		"X-Request-Id": "req-1",
+		"X-B3-Traceid": "80f198ee56343ba864fe8b2a57d3eff7",
+	}
+	responseHeaders := map[string]string{
+		"Audit-Id":    "4a3f0c4e-1f9e-4f8a-9d8e-0e6f6a1b2c3d",
+		"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-b7ad6b7169203331-01",
+	}
+
+	received := http.Header{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		for name, value := range responseHeaders {
+			w.Header().Set(name, value)
+		}
+		w.Header().Set("X-Internal-Node", "node-1")
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": NewReverseProxy(backendURL, http.DefaultTransport),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+	for name, value := range requestHeaders {
+		req.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	server.handler(recorder, req)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	for name, value := range requestHeaders {
+		assert.Equal(t, value, received.Get(name), name)
+	}
+	for name, value := range responseHeaders {
+		assert.Equal(t, value, recorder.Header().Get(name), name)
+	}
+	assert.Empty(t, recorder.Header().Get("X-Internal-Node"), "unprotected headers are still stripped")
+}
+
+func TestServer_Handler_RemovesHopByHopHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		extra       []string
+		header      http.Header
+		wantRemoved []string
+		wantHeader  http.Header
+	}{
+		{
+			name: "standard hop-by-hop headers",
+			header: http.Header{
+				"Keep-Alive":          {"timeout=5"},
+				"Proxy-Connection":    {"keep-alive"},
+				"Proxy-Authorization": {"Basic Zm9vOmJhcg=="},
+				"Accept":              {"application/json"},
+			},
+			wantRemoved: []string{"Keep-Alive", "Proxy-Connection", "Proxy-Authorization"},
+			wantHeader:  http.Header{"Accept": {"application/json"}},
+		},
+		{
+			name: "headers named in Connection",
+			header: http.Header{
+				"Connection":    {"X-Hop, keep-alive", "x-other-hop"},
+				"X-Hop":         {"1"},
+				"X-Other-Hop":   {"2"},
+				"X-End-To-End":  {"3"},
+				"Audit-Id":      {"abc"},
+				"Authorization": {"Bearer client-token"},
+			},
+			wantRemoved: []string{"Connection", "X-Hop", "X-Other-Hop", "Authorization"},
+			wantHeader:  http.Header{"X-End-To-End": {"3"}, "Audit-Id": {"abc"}},
+		},
+		{
+			name:        "Connection cannot remove the headers the proxy sets",
+			header:      http.Header{"Connection": {"User-Agent"}, "User-Agent": {"kubectl/v1.34.0"}},
+			wantRemoved: []string{"Connection"},
+			wantHeader:  http.Header{"User-Agent": {"mca/" + conf.Version}},
+		},
+		{
+			name:        "configured hop-by-hop headers",
+			extra:       []string{"X-Node-Local"},
+			header:      http.Header{"X-Node-Local": {"1"}, "X-End-To-End": {"2"}},
+			wantRemoved: []string{"X-Node-Local"},
+			wantHeader:  http.Header{"X-End-To-End": {"2"}},
+		},
+		{
+			name:       "Te trailers is kept",
+			header:     http.Header{"Te": {"trailers, deflate"}},
+			wantHeader: http.Header{"Te": {"trailers"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalExtra, originalMode := conf.ProxyHopByHopHeaders, conf.ProxyUserAgent
+			conf.ProxyHopByHopHeaders, conf.ProxyUserAgent = tt.extra, conf.UserAgentSet
+			defer func() { conf.ProxyHopByHopHeaders, conf.ProxyUserAgent = originalExtra, originalMode }()
+
+			upstream := testutil.NewUpstream(t, testutil.UpstreamOptions{})
+			server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+				"in-cluster": NewReverseProxy(upstream.URL(), http.DefaultTransport),
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			req.Header = tt.header
+			recorder := httptest.NewRecorder()
+			server.handler(recorder, req)
+
+			require.Equal(t, http.StatusOK, recorder.Code)
+			received := upstream.LastRequest().Header
+			for _, header := range tt.wantRemoved {
+				assert.Empty(t, received.Values(header), header)
+			}
+			for header, values := range tt.wantHeader {
+				assert.Equal(t, values, received.Values(header), header)
+			}
+		})
+	}
+}
+
+func TestRemoveHopByHopHeaders_KeepsUpgrade(t *testing.T) {
+	header := http.Header{
+		"Connection": {"Upgrade, X-Hop"},
+		"Upgrade":    {"SPDY/3.1"},
+		"X-Hop":      {"1"},
+		"Keep-Alive": {"timeout=5"},
+	}
+
+	removeHopByHopHeaders(header)
+
+	assert.Equal(t, http.Header{"Connection": {"Upgrade"}, "Upgrade": {"SPDY/3.1"}}, header)
+}
+
+func TestRemoveHopByHopHeaders_KeepsProtectedHeaders(t *testing.T) {
+	originalHopByHop := conf.ProxyHopByHopHeaders
+	conf.ProxyHopByHopHeaders = []string{"Traceparent", "X-Hop"}
+	defer func() { conf.ProxyHopByHopHeaders = originalHopByHop }()
+
+	header := http.Header{
+		"Connection":   {"Audit-Id, X-B3-Traceid"},
+		"Audit-Id":     {"a1"},
+		"X-B3-Traceid": {"b2"},
+		"Traceparent":  {"00-c3-01"},
+		"X-Hop":        {"1"},
+	}
+
+	removeHopByHopHeaders(header)
+
+	assert.Equal(t, http.Header{"Audit-Id": {"a1"}, "X-B3-Traceid": {"b2"}, "Traceparent": {"00-c3-01"}}, header)
+}
+
+func TestNewReverseProxy_StripKeepsUpgradeHeaders(t *testing.T) {
+	originalStrip := conf.ProxyStripResponseHeaders
+	conf.ProxyStripResponseHeaders = []string{"Upgrade", "Conn*"}
+	defer func() { conf.ProxyStripResponseHeaders = originalStrip }()
+
+	upstream := testutil.NewUpstream(t, testutil.UpstreamOptions{Upgrade: "SPDY/3.1"})
+	frontend := httptest.NewServer(NewReverseProxy(upstream.URL(), http.DefaultTransport))
+	defer frontend.Close()
+
+	req, err := http.NewRequest(http.MethodPost, frontend.URL+"/api/v1/namespaces/default/pods/web/exec", nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "SPDY/3.1")
+	res, err := http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, "SPDY/3.1", res.Header.Get("Upgrade"))
+	assert.Equal(t, "Upgrade", res.Header.Get("Connection"))
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/marxus/k8s-mca/pkg/health"
+)
+
+// serveHealth answers plain HTTP on listener, giving kubelet a tcpSocket or httpGet probe
+// target without TLS. /healthz reports the proxy process only, so probes do not depend on
+// the API server. It returns once listener is closed.
+func serveHealth(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", health.Handler(func() map[string]health.Check { return nil }))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Warning: health listener stopped: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+// Health listener tests.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Start_HealthListener(t *testing.T) {
+	originalListen, originalHealth := conf.ProxyListenAddress, conf.ProxyHealthAddress
+	conf.ProxyListenAddress, conf.ProxyHealthAddress = "127.0.0.1:0", "127.0.0.1:0"
+	defer func() { conf.ProxyListenAddress, conf.ProxyHealthAddress = originalListen, originalHealth }()
+
+	server := NewServer(tls.Certificate{}, nil)
+	startErr := make(chan error, 1)
+	go func() { startErr <- server.Start() }()
+
+	require.Eventually(t, func() bool { return server.healthListener.Load() != nil }, 5*time.Second, 10*time.Millisecond)
+	healthAddr := (*server.healthListener.Load()).Addr().String()
+
+	conn, err := net.Dial("tcp", healthAddr)
+	require.NoError(t, err)
+	conn.Close()
+
+	resp, err := http.Get("http://" + healthAddr + "/healthz")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"status":"ok","subsystems":{}}`, string(body))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx))
+	assert.ErrorIs(t, <-startErr, http.ErrServerClosed)
+
+	_, err = net.Dial("tcp", healthAddr)
+	assert.Error(t, err, "health listener should be closed on shutdown")
+}
+
+func TestServer_Start_HealthListenerDisabled(t *testing.T) {
+	originalListen := conf.ProxyListenAddress
+	conf.ProxyListenAddress = "127.0.0.1:0"
+	defer func() { conf.ProxyListenAddress = originalListen }()
+
+	server := NewServer(tls.Certificate{}, nil)
+	startErr := make(chan error, 1)
+	go func() { startErr <- server.Start() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, server.Shutdown(ctx))
+	<-startErr
+
+	assert.Nil(t, server.healthListener.Load())
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/marxus/k8s-mca/pkg/health"
+)
+
+// apiPathPrefixes lists the top-level paths served by the Kubernetes API server.
+var apiPathPrefixes = []string{
+	"/api", "/apis", "/openapi", "/version", "/healthz", "/livez", "/readyz", "/metrics", "/logs", "/.well-known",
+}
+
+func (s *Server) buildLocalHandlers(paths []string) map[string]http.Handler {
+	available := map[string]http.Handler{
+		"/healthz": health.Handler(s.healthChecks),
+		"/stats":   s.stats.handler(),
+	}
+
+	localHandlers := make(map[string]http.Handler)
+	for _, path := range paths {
+		handler, ok := available[path]
+		if !ok {
+			log.Printf("Warning: unsupported local path %q, requests will be forwarded", path)
+			continue
+		}
+		localHandlers[path] = handler
+	}
+	return localHandlers
+}
+
+func (s *Server) healthChecks() map[string]health.Check {
+	checks := map[string]health.Check{
+		"cert":   health.CertCheck(s.tlsCert),
+		"config": s.checkConfig,
+	}
+	if s.upstreamCheck != nil {
+		checks["upstream"] = s.upstreamCheck
+	}
+	return checks
+}
+
+func (s *Server) checkConfig() error {
+	if reverseProxies := s.reverseProxies.Load(); reverseProxies == nil || len(*reverseProxies) == 0 {
+		return errors.New("no clusters loaded")
+	}
+	return nil
+}
+
+func isAPIPath(path string) bool {
+	if path == "/" {
+		return true
+	}
+	for _, prefix := range apiPathPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+// Local endpoint and non-API path handling tests.
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
+	"github.com/marxus/k8s-mca/pkg/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Handler_LocalPaths(t *testing.T) {
+	tests := []struct {
+		name            string
+		localPaths      []string
+		path            string
+		wantCode        int
+		wantBody        string
+		wantUpstreamHit bool
+	}{
+		{
+			name:       "answers enabled local path without forwarding",
+			localPaths: []string{"/healthz"},
+			path:       "/healthz",
+			wantCode:   http.StatusServiceUnavailable,
+			wantBody:   `"cert":{"status":"failing","error":"no certificate loaded"}`,
+		},
+		{
+			name:            "forwards API health path when not enabled locally",
+			path:            "/healthz",
+			wantCode:        http.StatusOK,
+			wantBody:        "upstream",
+			wantUpstreamHit: true,
+		},
+		{
+			name:            "forwards API path",
+			localPaths:      []string{"/healthz"},
+			path:            "/api/v1/pods",
+			wantCode:        http.StatusOK,
+			wantBody:        "upstream",
+			wantUpstreamHit: true,
+		},
+		{
+			name:       "rejects non-API path without forwarding",
+			localPaths: []string{"/healthz"},
+			path:       "/index.html",
+			wantCode:   http.StatusNotFound,
+			wantBody:   "path /index.html is not a Kubernetes API path",
+		},
+		{
+			name:       "ignores unsupported local path",
+			localPaths: []string{"/custom"},
+			path:       "/custom",
+			wantCode:   http.StatusNotFound,
+			wantBody:   "path /custom is not a Kubernetes API path",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamHit := false
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamHit = true
+				w.Write([]byte("upstream"))
+			}))
+			defer backend.Close()
+
+			backendURL, err := url.Parse(backend.URL)
+			require.NoError(t, err)
+
+			originalPaths := conf.ProxyLocalPaths
+			conf.ProxyLocalPaths = tt.localPaths
+			defer func() { conf.ProxyLocalPaths = originalPaths }()
+
+			server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+				"in-cluster": httputil.NewSingleHostReverseProxy(backendURL),
+			})
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			recorder := httptest.NewRecorder()
+			server.handler(recorder, req)
+
+			assert.Equal(t, tt.wantCode, recorder.Code)
+			assert.Contains(t, recorder.Body.String(), tt.wantBody)
+			assert.Equal(t, tt.wantUpstreamHit, upstreamHit)
+		})
+	}
+}
+
+func TestIsAPIPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/", want: true},
+		{path: "/api", want: true},
+		{path: "/api/v1/namespaces/default/pods", want: true},
+		{path: "/apis/apps/v1/deployments", want: true},
+		{path: "/openapi/v2", want: true},
+		{path: "/version", want: true},
+		{path: "/readyz", want: true},
+		{path: "/apiextras", want: false},
+		{path: "/favicon.ico", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, isAPIPath(tt.path))
+		})
+	}
+}
+
+func TestServer_Healthz_Subsystems(t *testing.T) {
+	validCert, _, err := certs.GenerateCAAndTLSCert([]string{"localhost"}, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		cert           tls.Certificate
+		reverseProxies map[string]*httputil.ReverseProxy
+		upstreamCheck  health.Check
+		wantCode       int
+		wantReport     health.Report
+	}{
+		{
+			name:           "all subsystems healthy",
+			cert:           validCert,
+			reverseProxies: map[string]*httputil.ReverseProxy{"in-cluster": {}},
+			upstreamCheck:  func() error { return nil },
+			wantCode:       http.StatusOK,
+			wantReport: health.Report{
+				Status: health.StatusOK,
+				Subsystems: map[string]health.SubsystemStatus{
+					"cert":     {Status: health.StatusOK},
+					"config":   {Status: health.StatusOK},
+					"upstream": {Status: health.StatusOK},
+				},
+			},
+		},
+		{
+			name:           "cert missing",
+			reverseProxies: map[string]*httputil.ReverseProxy{"in-cluster": {}},
+			upstreamCheck:  func() error { return nil },
+			wantCode:       http.StatusServiceUnavailable,
+			wantReport: health.Report{
+				Status: health.StatusFailing,
+				Subsystems: map[string]health.SubsystemStatus{
+					"cert":     {Status: health.StatusFailing, Error: "no certificate loaded"},
+					"config":   {Status: health.StatusOK},
+					"upstream": {Status: health.StatusOK},
+				},
+			},
+		},
+		{
+			name:          "cluster map empty",
+			cert:          validCert,
+			upstreamCheck: func() error { return nil },
+			wantCode:      http.StatusServiceUnavailable,
+			wantReport: health.Report{
+				Status: health.StatusFailing,
+				Subsystems: map[string]health.SubsystemStatus{
+					"cert":     {Status: health.StatusOK},
+					"config":   {Status: health.StatusFailing, Error: "no clusters loaded"},
+					"upstream": {Status: health.StatusOK},
+				},
+			},
+		},
+		{
+			name:           "upstream unreachable",
+			cert:           validCert,
+			reverseProxies: map[string]*httputil.ReverseProxy{"in-cluster": {}},
+			upstreamCheck:  func() error { return errors.New("connection refused") },
+			wantCode:       http.StatusServiceUnavailable,
+			wantReport: health.Report{
+				Status: health.StatusFailing,
+				Subsystems: map[string]health.SubsystemStatus{
+					"cert":     {Status: health.StatusOK},
+					"config":   {Status: health.StatusOK},
+					"upstream": {Status: health.StatusFailing, Error: "connection refused"},
+				},
+			},
+		},
+		{
+			name:           "upstream check not configured",
+			cert:           validCert,
+			reverseProxies: map[string]*httputil.ReverseProxy{"in-cluster": {}},
+			wantCode:       http.StatusOK,
+			wantReport: health.Report{
+				Status: health.StatusOK,
+				Subsystems: map[string]health.SubsystemStatus{
+					"cert":   {Status: health.StatusOK},
+					"config": {Status: health.StatusOK},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalPaths := conf.ProxyLocalPaths
+			conf.ProxyLocalPaths = []string{"/healthz"}
+			defer func() { conf.ProxyLocalPaths = originalPaths }()
+
+			server := NewServer(tt.cert, tt.reverseProxies)
+			server.SetUpstreamCheck(tt.upstreamCheck)
+
+			recorder := httptest.NewRecorder()
+			server.handler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			assert.Equal(t, tt.wantCode, recorder.Code)
+
+			var report health.Report
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+			assert.Equal(t, tt.wantReport, report)
+		})
+	}
+}
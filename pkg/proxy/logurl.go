@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/marxus/k8s-mca/conf"
+)
+
+// redactedName replaces resource names in sanitized URLs.
+const redactedName = "{name}"
+
+// logURL returns u as logged according to conf.ProxyLogURLs.
+func logURL(u *url.URL) string {
+	switch conf.ProxyLogURLs {
+	case conf.LogURLsFull:
+		return u.RequestURI()
+	case conf.LogURLsSanitized:
+		return sanitizePath(u.Path)
+	default:
+		return u.Path
+	}
+}
+
+// sanitizePath redacts the resource name of a Kubernetes API path, e.g.
+// /api/v1/namespaces/default/secrets/db-password/status becomes
+// /api/v1/namespaces/default/secrets/{name}/status. Namespaces, the legacy watch segment and a
+// /clusters/<name> prefix are kept, and paths outside /api and /apis are returned unchanged.
+func sanitizePath(path string) string {
+	if cluster, rest, ok := splitClusterPath(path); ok {
+		return clusterPathPrefix + cluster + sanitizePath(rest)
+	}
+
+	segments := strings.Split(path, "/")
+
+	// segments[0] is empty, as path starts with a slash.
+	var resource int
+	switch {
+	case len(segments) > 2 && segments[1] == "api":
+		resource = 3
+	case len(segments) > 3 && segments[1] == "apis":
+		resource = 4
+	default:
+		return path
+	}
+	if len(segments) > resource && segments[resource] == "watch" {
+		resource++
+	}
+	if len(segments) > resource+2 && segments[resource] == "namespaces" {
+		resource += 2
+	}
+	if len(segments) <= resource || segments[resource] == "namespaces" {
+		return path
+	}
+
+	if name := resource + 1; len(segments) > name && segments[name] != "" {
+		segments[name] = redactedName
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,135 @@
+// Request URL logging tests.
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogURL(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		url  string
+		want string
+	}{
+		{
+			name: "path drops the query",
+			mode: conf.LogURLsPath,
+			url:  "/api/v1/namespaces/default/secrets/db-password?fieldSelector=data.password%3Dhunter2",
+			want: "/api/v1/namespaces/default/secrets/db-password",
+		},
+		{
+			name: "full keeps the query",
+			mode: conf.LogURLsFull,
+			url:  "/api/v1/namespaces/default/pods?labelSelector=app%3Dweb",
+			want: "/api/v1/namespaces/default/pods?labelSelector=app%3Dweb",
+		},
+		{
+			name: "sanitized namespaced core resource",
+			mode: conf.LogURLsSanitized,
+			url:  "/api/v1/namespaces/default/secrets/db-password?fieldSelector=data.password%3Dhunter2",
+			want: "/api/v1/namespaces/default/secrets/{name}",
+		},
+		{
+			name: "sanitized subresource",
+			mode: conf.LogURLsSanitized,
+			url:  "/api/v1/namespaces/default/pods/web-0/log?follow=true",
+			want: "/api/v1/namespaces/default/pods/{name}/log",
+		},
+		{
+			name: "sanitized cluster-scoped group resource",
+			mode: conf.LogURLsSanitized,
+			url:  "/apis/rbac.authorization.k8s.io/v1/clusterroles/tenant-admin",
+			want: "/apis/rbac.authorization.k8s.io/v1/clusterroles/{name}",
+		},
+		{
+			name: "sanitized namespaced group resource",
+			mode: conf.LogURLsSanitized,
+			url:  "/apis/apps/v1/namespaces/prod/deployments/billing/scale",
+			want: "/apis/apps/v1/namespaces/prod/deployments/{name}/scale",
+		},
+		{
+			name: "sanitized legacy watch",
+			mode: conf.LogURLsSanitized,
+			url:  "/api/v1/watch/namespaces/default/secrets/db-password",
+			want: "/api/v1/watch/namespaces/default/secrets/{name}",
+		},
+		{
+			name: "sanitized legacy watch of a group resource",
+			mode: conf.LogURLsSanitized,
+			url:  "/apis/apps/v1/watch/namespaces/prod/deployments/billing",
+			want: "/apis/apps/v1/watch/namespaces/prod/deployments/{name}",
+		},
+		{
+			name: "sanitized collection keeps the path",
+			mode: conf.LogURLsSanitized,
+			url:  "/api/v1/namespaces/default/secrets?fieldSelector=metadata.name%3Ddb-password",
+			want: "/api/v1/namespaces/default/secrets",
+		},
+		{
+			name: "sanitized namespace keeps its name",
+			mode: conf.LogURLsSanitized,
+			url:  "/api/v1/namespaces/default",
+			want: "/api/v1/namespaces/default",
+		},
+		{
+			name: "sanitized group version",
+			mode: conf.LogURLsSanitized,
+			url:  "/apis/apps/v1",
+			want: "/apis/apps/v1",
+		},
+		{
+			name: "sanitized cluster path prefix",
+			mode: conf.LogURLsSanitized,
+			url:  "/clusters/staging/api/v1/namespaces/default/secrets/db-password",
+			want: "/clusters/staging/api/v1/namespaces/default/secrets/{name}",
+		},
+		{
+			name: "sanitized non-resource path",
+			mode: conf.LogURLsSanitized,
+			url:  "/version?timeout=32s",
+			want: "/version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalMode := conf.ProxyLogURLs
+			conf.ProxyLogURLs = tt.mode
+			defer func() { conf.ProxyLogURLs = originalMode }()
+
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, logURL(u))
+		})
+	}
+}
+
+func TestServer_LogsSanitizedURL(t *testing.T) {
+	originalMode := conf.ProxyLogURLs
+	conf.ProxyLogURLs = conf.LogURLsSanitized
+	defer func() { conf.ProxyLogURLs = originalMode }()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	server := NewServer(tls.Certificate{}, nil)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/secrets/db-password?fieldSelector=data.password%3Dhunter2", nil)
+	server.handler(httptest.NewRecorder(), req)
+
+	assert.Contains(t, logs.String(), "GET /api/v1/namespaces/default/secrets/{name}")
+	assert.NotContains(t, logs.String(), "db-password")
+	assert.NotContains(t, logs.String(), "hunter2")
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/marxus/k8s-mca/conf"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// plainHTTPPrefixes are the first bytes of plain HTTP requests, which never start a TLS record.
+var plainHTTPPrefixes = [][]byte{
+	[]byte("GET /"), []byte("HEAD "), []byte("POST "), []byte("PUT /"),
+	[]byte("PATCH"), []byte("DELET"), []byte("OPTIO"),
+}
+
+// plainHTTPListener accepts connections that answer plain HTTP requests on the HTTPS port
+// according to conf.ProxyPlainHTTP instead of failing the TLS handshake.
+type plainHTTPListener struct {
+	net.Listener
+}
+
+func (l plainHTTPListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &plainHTTPConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// plainHTTPConn inspects the first bytes read from its connection, which are read during the
+// TLS handshake, so a plain HTTP client is detected without blocking the accept loop.
+type plainHTTPConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	checked bool
+}
+
+func (c *plainHTTPConn) Read(p []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		if prefix, err := c.reader.Peek(5); err == nil && isPlainHTTP(prefix) {
+			return 0, c.answerPlainHTTP()
+		}
+	}
+	return c.reader.Read(p)
+}
+
+func isPlainHTTP(prefix []byte) bool {
+	for _, plainPrefix := range plainHTTPPrefixes {
+		if bytes.Equal(prefix, plainPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerPlainHTTP answers the plain HTTP request on the connection and closes it. The returned
+// error fails the TLS handshake, and is logged by the HTTP server as its reason.
+func (c *plainHTTPConn) answerPlainHTTP() error {
+	defer c.Conn.Close()
+
+	req, err := http.ReadRequest(c.reader)
+	if err != nil {
+		return fmt.Errorf("client sent a malformed plain HTTP request to the HTTPS port: %w", err)
+	}
+	httpsURL := "https://" + req.Host + req.URL.RequestURI()
+
+	res := &http.Response{
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Close:      true,
+	}
+	if conf.ProxyPlainHTTP == conf.PlainHTTPRedirect {
+		res.StatusCode = http.StatusPermanentRedirect
+		res.Header.Set("Location", httpsURL)
+	} else {
+		status := newStatus(http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf(
+			"the MCA proxy only serves HTTPS, use %s; clients configured via KUBERNETES_SERVICE_HOST "+
+				"and KUBERNETES_SERVICE_PORT must connect with HTTPS", httpsURL))
+		body, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		res.StatusCode = http.StatusBadRequest
+		res.Header.Set("Content-Type", "application/json")
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		res.ContentLength = int64(len(body))
+	}
+	res.Write(c.Conn)
+
+	return fmt.Errorf("client sent a plain HTTP request %s %s to the HTTPS port, it must use HTTPS (answered %d)",
+		req.Method, logURL(req.URL), res.StatusCode)
+}
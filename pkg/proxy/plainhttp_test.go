@@ -0,0 +1,132 @@
+// Plain HTTP requests on the HTTPS port tests.
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// lockedBuffer is a log output safe to read while the server logs to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startTLSServer serves a proxy server without reverse proxies on a loopback port and returns
+// its address.
+func startTLSServer(t *testing.T) string {
+	t.Helper()
+	tlsCert, _, err := certs.GenerateCAAndTLSCert([]string{"localhost"}, nil)
+	require.NoError(t, err)
+
+	server := NewServer(tlsCert, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.serve(listener)
+	t.Cleanup(func() { server.httpServer.Close() })
+	return listener.Addr().String()
+}
+
+func TestServer_PlainHTTP(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         string
+		wantCode     int
+		wantLocation string
+		wantHint     bool
+	}{
+		{
+			name:     "hint",
+			mode:     conf.PlainHTTPHint,
+			wantCode: http.StatusBadRequest,
+			wantHint: true,
+		},
+		{
+			name:         "redirect",
+			mode:         conf.PlainHTTPRedirect,
+			wantCode:     http.StatusPermanentRedirect,
+			wantLocation: "https://%s/api/v1/pods?limit=1",
+		},
+		{
+			name:     "off",
+			mode:     conf.PlainHTTPOff,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalMode := conf.ProxyPlainHTTP
+			conf.ProxyPlainHTTP = tt.mode
+			defer func() { conf.ProxyPlainHTTP = originalMode }()
+
+			var logs lockedBuffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			addr := startTLSServer(t)
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}}
+			res, err := client.Get(fmt.Sprintf("http://%s/api/v1/pods?limit=1", addr))
+			require.NoError(t, err, "the client gets an answer rather than a reset connection")
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.wantCode, res.StatusCode)
+			if tt.wantLocation != "" {
+				assert.Equal(t, fmt.Sprintf(tt.wantLocation, addr), res.Header.Get("Location"))
+			}
+			if tt.wantHint {
+				var status metav1.Status
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+				assert.Equal(t, metav1.StatusReasonBadRequest, status.Reason)
+				assert.Contains(t, status.Message, fmt.Sprintf("use https://%s/api/v1/pods?limit=1", addr))
+				assert.Contains(t, status.Message, "KUBERNETES_SERVICE_HOST")
+				assert.Eventually(t, func() bool {
+					return strings.Contains(logs.String(), "client sent a plain HTTP request GET /api/v1/pods to the HTTPS port, it must use HTTPS")
+				}, 5*time.Second, 10*time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestServer_PlainHTTPDetectionKeepsTLS(t *testing.T) {
+	addr := startTLSServer(t)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	res, err := client.Get(fmt.Sprintf("https://%s/api/v1/pods", addr))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "the cluster map is not loaded")
+}
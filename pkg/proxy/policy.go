@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/marxus/k8s-mca/conf"
+)
+
+// methodAllowed reports whether method may be used on path under conf.ProxyMethodPolicy.
+// The longest configured path prefix matching path decides; unmatched paths allow every method.
+func methodAllowed(path, method string) bool {
+	var matchedPrefix string
+	var allowedMethods []string
+	matched := false
+
+	for prefix, methods := range conf.ProxyMethodPolicy {
+		if hasPathPrefix(path, prefix) && (!matched || len(prefix) > len(matchedPrefix)) {
+			matchedPrefix, allowedMethods, matched = prefix, methods, true
+		}
+	}
+
+	return !matched || slices.Contains(allowedMethods, method)
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// isLoopback reports whether remoteAddr, in host:port form, is a loopback address.
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
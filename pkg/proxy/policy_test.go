@@ -0,0 +1,173 @@
+// Method policy tests.
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMethodAllowed(t *testing.T) {
+	policy := map[string][]string{
+		"/api/v1/namespaces/default/configmaps":     {http.MethodGet},
+		"/api/v1/namespaces/default/configmaps/app": {http.MethodGet, http.MethodPut},
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		method string
+		want   bool
+	}{
+		{
+			name:   "allows configured method",
+			path:   "/api/v1/namespaces/default/configmaps",
+			method: http.MethodGet,
+			want:   true,
+		},
+		{
+			name:   "rejects unconfigured method",
+			path:   "/api/v1/namespaces/default/configmaps/other",
+			method: http.MethodPost,
+			want:   false,
+		},
+		{
+			name:   "longest prefix wins",
+			path:   "/api/v1/namespaces/default/configmaps/app",
+			method: http.MethodPut,
+			want:   true,
+		},
+		{
+			name:   "allows unmatched path",
+			path:   "/api/v1/namespaces/default/pods",
+			method: http.MethodDelete,
+			want:   true,
+		},
+		{
+			name:   "does not match partial segment",
+			path:   "/api/v1/namespaces/default/configmapsx",
+			method: http.MethodPost,
+			want:   true,
+		},
+	}
+
+	originalPolicy := conf.ProxyMethodPolicy
+	conf.ProxyMethodPolicy = policy
+	defer func() { conf.ProxyMethodPolicy = originalPolicy }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, methodAllowed(tt.path, tt.method))
+		})
+	}
+}
+
+func TestServer_Handler_MethodPolicy(t *testing.T) {
+	originalPolicy := conf.ProxyMethodPolicy
+	conf.ProxyMethodPolicy = map[string][]string{
+		"/api/v1/namespaces/default/configmaps": {http.MethodGet},
+	}
+	defer func() { conf.ProxyMethodPolicy = originalPolicy }()
+
+	backendCalled := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalled = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": httputil.NewSingleHostReverseProxy(backendURL),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/configmaps", nil)
+	recorder := httptest.NewRecorder()
+	server.handler(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, backendCalled)
+
+	backendCalled = false
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/namespaces/default/configmaps", nil)
+	recorder = httptest.NewRecorder()
+	server.handler(recorder, req)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.False(t, backendCalled)
+
+	var status metav1.Status
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.Equal(t, metav1.StatusReasonMethodNotAllowed, status.Reason)
+	assert.Equal(t, int32(http.StatusMethodNotAllowed), status.Code)
+}
+
+func TestServer_Handler_RequireLoopback(t *testing.T) {
+	tests := []struct {
+		name            string
+		requireLoopback bool
+		remoteAddr      string
+		wantCode        int
+	}{
+		{
+			name:            "allows IPv4 loopback",
+			requireLoopback: true,
+			remoteAddr:      "127.0.0.1:51234",
+			wantCode:        http.StatusOK,
+		},
+		{
+			name:            "allows IPv6 loopback",
+			requireLoopback: true,
+			remoteAddr:      "[::1]:51234",
+			wantCode:        http.StatusOK,
+		},
+		{
+			name:            "rejects non-loopback when enabled",
+			requireLoopback: true,
+			remoteAddr:      "10.0.0.12:51234",
+			wantCode:        http.StatusForbidden,
+		},
+		{
+			name:            "allows non-loopback when disabled",
+			requireLoopback: false,
+			remoteAddr:      "10.0.0.12:51234",
+			wantCode:        http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalRequire := conf.ProxyRequireLoopback
+			conf.ProxyRequireLoopback = tt.requireLoopback
+			defer func() { conf.ProxyRequireLoopback = originalRequire }()
+
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer backend.Close()
+
+			backendURL, err := url.Parse(backend.URL)
+			require.NoError(t, err)
+			server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+				"in-cluster": httputil.NewSingleHostReverseProxy(backendURL),
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			req.RemoteAddr = tt.remoteAddr
+			recorder := httptest.NewRecorder()
+			server.handler(recorder, req)
+
+			assert.Equal(t, tt.wantCode, recorder.Code)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+type reconnectTransport struct {
+	base        http.RoundTripper
+	maxAttempts int
+	wait        time.Duration
+}
+
+// NewReconnectTransport wraps base so that a request whose connection to the upstream could
+// not be established is dialed again, up to maxAttempts more times, waiting wait in between.
+// Requests are never replayed once sent: only dial failures are retried, which lets the proxy
+// follow an upstream that moved to a new address without a restart. A request with a body is
+// redialed only when the body can be rewound through GetBody.
+//
+// Whenever a dial fails or an established connection is reset, the idle connections of base
+// are closed so that later requests dial afresh instead of reusing connections to the old
+// address. A maxAttempts of zero disables redialing.
+func NewReconnectTransport(base http.RoundTripper, maxAttempts int, wait time.Duration) http.RoundTripper {
+	return &reconnectTransport{
+		base:        base,
+		maxAttempts: maxAttempts,
+		wait:        wait,
+	}
+}
+
+func (t *reconnectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+
+	for attempt := 1; err != nil && isDialError(err); attempt++ {
+		t.closeIdleConnections()
+		if attempt > t.maxAttempts || !rewindBody(req) {
+			return nil, err
+		}
+
+		log.Printf("Failed to connect to upstream for %s %s, reconnecting in %s (%d/%d): %v", req.Method, logURL(req.URL), t.wait, attempt, t.maxAttempts, err)
+
+		timer := time.NewTimer(t.wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		res, err = t.base.RoundTrip(req)
+	}
+
+	if err != nil && isConnectionReset(err) {
+		t.closeIdleConnections()
+	}
+	return res, err
+}
+
+func (t *reconnectTransport) closeIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// rewindBody resets the request body for another attempt, reporting false when it cannot.
+func rewindBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
+
+// isDialError reports whether err happened while establishing the connection, before any of
+// the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isConnectionReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,108 @@
+// Upstream reconnect transport tests.
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marxus/k8s-mca/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// movingUpstream serves as "upstream.test" at whatever address it currently resolves to.
+type movingUpstream struct {
+	address atomic.Value
+}
+
+func (m *movingUpstream) dial(ctx context.Context, network, _ string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, m.address.Load().(string))
+}
+
+func TestReconnectTransport_UpstreamMoves(t *testing.T) {
+	oldBackend := testutil.NewUpstream(t, testutil.UpstreamOptions{Body: "old"})
+	newBackend := testutil.NewUpstream(t, testutil.UpstreamOptions{Body: "new"})
+
+	upstream := &movingUpstream{}
+	upstream.address.Store(oldBackend.URL().Host)
+
+	base := &http.Transport{DialContext: upstream.dial}
+	transport := NewReconnectTransport(base, 3, 50*time.Millisecond)
+	upstreamURL, _ := url.Parse("http://upstream.test")
+	reverseProxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	reverseProxy.Transport = transport
+
+	get := func() (int, string) {
+		recorder := httptest.NewRecorder()
+		reverseProxy.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	code, body := get()
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "old", body)
+
+	// The old upstream goes away, and its address resolves to the new one only a moment later.
+	oldBackend.Close()
+	time.AfterFunc(20*time.Millisecond, func() { upstream.address.Store(newBackend.URL().Host) })
+
+	code, body = get()
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "new", body)
+}
+
+func TestReconnectTransport(t *testing.T) {
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddress := closedListener.Addr().String()
+	closedListener.Close()
+
+	tests := []struct {
+		name        string
+		maxAttempts int
+		body        string
+		getBody     bool
+		wantDials   int32
+	}{
+		{name: "redials up to max attempts", maxAttempts: 2, wantDials: 3},
+		{name: "zero attempts disables redialing", maxAttempts: 0, wantDials: 1},
+		{name: "redials rewindable body", maxAttempts: 2, body: "{}", getBody: true, wantDials: 3},
+		{name: "does not redial unrewindable body", maxAttempts: 2, body: "{}", wantDials: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dials atomic.Int32
+			base := &http.Transport{DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				dials.Add(1)
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, closedAddress)
+			}}
+			transport := NewReconnectTransport(base, tt.maxAttempts, time.Millisecond)
+
+			req := httptest.NewRequest(http.MethodPost, "http://upstream.test/api/v1/namespaces", nil)
+			req.RequestURI = ""
+			if tt.body != "" {
+				req.Body = io.NopCloser(strings.NewReader(tt.body))
+				if tt.getBody {
+					req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(tt.body)), nil }
+				}
+			}
+
+			_, err := transport.RoundTrip(req)
+			require.Error(t, err)
+			assert.True(t, isDialError(err))
+			assert.Equal(t, tt.wantDials, dials.Load())
+		})
+	}
+}
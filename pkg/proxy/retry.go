@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultRetryWait is used when a retryable response carries no usable Retry-After header.
+const defaultRetryWait = time.Second
+
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	maxWait    time.Duration
+}
+
+// NewRetryTransport wraps base with a bounded retry for transient upstream responses.
+// Only safe methods (GET, HEAD, OPTIONS) are retried, and only on 429 and 503 responses.
+// The wait between attempts honors the Retry-After header, capped at maxWait.
+//
+// Non-idempotent methods are never retried. A maxRetries of zero disables retries.
+func NewRetryTransport(base http.RoundTripper, maxRetries int, maxWait time.Duration) http.RoundTripper {
+	return &retryTransport{
+		base:       base,
+		maxRetries: maxRetries,
+		maxWait:    maxWait,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if !isSafeMethod(req.Method) {
+		return res, err
+	}
+
+	for attempt := 1; attempt <= t.maxRetries && err == nil && isRetryableStatus(res.StatusCode); attempt++ {
+		wait := t.retryWait(res)
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+
+		log.Printf("Upstream returned %d for %s %s, retrying in %s (%d/%d)", res.StatusCode, req.Method, logURL(req.URL), wait, attempt, t.maxRetries)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		res, err = t.base.RoundTrip(req)
+	}
+
+	return res, err
+}
+
+func (t *retryTransport) retryWait(res *http.Response) time.Duration {
+	wait := defaultRetryWait
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(res.Header.Get("Retry-After")); err == nil {
+		wait = max(time.Until(date), 0)
+	}
+	return min(wait, t.maxWait)
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+}
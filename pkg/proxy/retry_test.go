@@ -0,0 +1,136 @@
+// Upstream retry transport tests.
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		failureStatus int
+		wantCode      int
+		wantCalls     int32
+	}{
+		{
+			name:          "retries GET after 503",
+			method:        http.MethodGet,
+			failureStatus: http.StatusServiceUnavailable,
+			wantCode:      http.StatusOK,
+			wantCalls:     2,
+		},
+		{
+			name:          "retries GET after 429",
+			method:        http.MethodGet,
+			failureStatus: http.StatusTooManyRequests,
+			wantCode:      http.StatusOK,
+			wantCalls:     2,
+		},
+		{
+			name:          "does not retry POST",
+			method:        http.MethodPost,
+			failureStatus: http.StatusServiceUnavailable,
+			wantCode:      http.StatusServiceUnavailable,
+			wantCalls:     1,
+		},
+		{
+			name:          "does not retry GET on 500",
+			method:        http.MethodGet,
+			failureStatus: http.StatusInternalServerError,
+			wantCode:      http.StatusInternalServerError,
+			wantCalls:     1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(tt.failureStatus)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer backend.Close()
+
+			backendURL, err := url.Parse(backend.URL)
+			require.NoError(t, err)
+			reverseProxy := httputil.NewSingleHostReverseProxy(backendURL)
+			reverseProxy.Transport = NewRetryTransport(http.DefaultTransport, 2, time.Second)
+
+			req := httptest.NewRequest(tt.method, "/api/v1/pods", nil)
+			recorder := httptest.NewRecorder()
+			reverseProxy.ServeHTTP(recorder, req)
+
+			assert.Equal(t, tt.wantCode, recorder.Code)
+			assert.Equal(t, tt.wantCalls, calls.Load())
+		})
+	}
+}
+
+func TestRetryTransport_StopsAfterMaxRetries(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	req, err := http.NewRequest(http.MethodGet, backend.URL, nil)
+	require.NoError(t, err)
+
+	res, err := NewRetryTransport(http.DefaultTransport, 2, time.Second).RoundTrip(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestRetryTransport_RetryWait(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		wantWait   time.Duration
+	}{
+		{
+			name:       "uses Retry-After seconds",
+			retryAfter: "2",
+			wantWait:   2 * time.Second,
+		},
+		{
+			name:       "caps Retry-After at max wait",
+			retryAfter: "120",
+			wantWait:   5 * time.Second,
+		},
+		{
+			name:     "uses default wait without Retry-After",
+			wantWait: defaultRetryWait,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &retryTransport{maxWait: 5 * time.Second}
+			res := &http.Response{Header: http.Header{}}
+			if tt.retryAfter != "" {
+				res.Header.Set("Retry-After", tt.retryAfter)
+			}
+
+			assert.Equal(t, tt.wantWait, transport.retryWait(res))
+		})
+	}
+}
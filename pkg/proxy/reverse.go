@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/marxus/k8s-mca/conf"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// StatusReasonUpstreamCertificateInvalid is the Status reason of the 502 response sent when
+// the upstream API server presents a certificate that fails verification.
+const StatusReasonUpstreamCertificateInvalid metav1.StatusReason = "UpstreamCertificateInvalid"
+
+// drainKey is the request context key carrying the drain context of a watch request.
+type drainKey struct{}
+
+// ResponseHook modifies a discrete upstream response, and may read or replace its body.
+type ResponseHook func(res *http.Response) error
+
+// NewReverseProxy creates a reverse proxy forwarding requests to target through transport.
+// Its responses pass through the proxy's response hooks, which strip the headers listed in
+// conf.ProxyStripResponseHeaders, append the warnings recorded with [AddWarning] and allow
+// [Server.Shutdown] to end watch responses cleanly. An upstream certificate that fails
+// verification is answered with 502 and [StatusReasonUpstreamCertificateInvalid]; the
+// request is never retried without verification. Response bodies are copied with buffers of
+// conf.ProxyBufferSize bytes when it is positive, and flushed every conf.ProxyFlushInterval.
+//
+// The given hooks then run in order on discrete responses only. Streamed and upgraded
+// responses, see [isStreamingResponse], skip them, so a hook never buffers a watch, a log
+// follow or an exec session.
+func NewReverseProxy(target *url.URL, transport http.RoundTripper, hooks ...ResponseHook) *httputil.ReverseProxy {
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	reverseProxy.Transport = transport
+	reverseProxy.ModifyResponse = func(res *http.Response) error {
+		return modifyResponse(res, hooks)
+	}
+	reverseProxy.ErrorHandler = handleUpstreamError
+	if conf.ProxyBufferSize > 0 {
+		reverseProxy.BufferPool = NewBufferPool(conf.ProxyBufferSize)
+	}
+	reverseProxy.FlushInterval = conf.ProxyFlushInterval
+	return reverseProxy
+}
+
+func handleUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	if isCertificateVerificationError(err) {
+		log.Printf("Upstream certificate verification failed for %s %s: %v", r.Method, logURL(r.URL), err)
+		writeStatus(w, http.StatusBadGateway, StatusReasonUpstreamCertificateInvalid,
+			fmt.Sprintf("upstream certificate verification failed: %v", err))
+		return
+	}
+
+	log.Printf("Upstream request failed for %s %s: %v", r.Method, logURL(r.URL), err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func isCertificateVerificationError(err error) bool {
+	var (
+		verificationErr *tls.CertificateVerificationError
+		unknownAuthErr  x509.UnknownAuthorityError
+		hostnameErr     x509.HostnameError
+		invalidErr      x509.CertificateInvalidError
+	)
+	return errors.As(err, &verificationErr) || errors.As(err, &unknownAuthErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+func modifyResponse(res *http.Response, hooks []ResponseHook) error {
+	// Header changes never touch the body, so they are safe for every response.
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		removeHopByHopHeaders(res.Header)
+	}
+	stripResponseHeaders(res.Header)
+	appendWarnings(res.Header, res.Request)
+
+	if isStreamingResponse(res) {
+		// An upgraded response body is the connection itself and must not be wrapped.
+		drain, ok := res.Request.Context().Value(drainKey{}).(context.Context)
+		if ok && res.StatusCode != http.StatusSwitchingProtocols {
+			res.Body = newDrainingBody(drain, res.Body)
+		}
+		return nil
+	}
+
+	for _, hook := range hooks {
+		if err := hook(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isStreamingResponse reports whether res is streamed to the client as it arrives: an upgraded
+// connection, a watch or log follow request, or a streaming content type.
+func isStreamingResponse(res *http.Response) bool {
+	if res.StatusCode == http.StatusSwitchingProtocols || isWatchRequest(res.Request) || res.Request.URL.Query().Get("follow") == "true" {
+		return true
+	}
+
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/event-stream" || params["stream"] == "watch"
+}
+
+// drainingBody ends a streamed response body with io.EOF once its drain context is done,
+// so the response completes cleanly instead of being aborted.
+type drainingBody struct {
+	io.ReadCloser
+	draining atomic.Bool
+	stop     func() bool
+}
+
+func newDrainingBody(drain context.Context, body io.ReadCloser) *drainingBody {
+	b := &drainingBody{ReadCloser: body}
+	b.stop = context.AfterFunc(drain, func() {
+		b.draining.Store(true)
+		body.Close()
+	})
+	return b
+}
+
+func (b *drainingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && b.draining.Load() {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (b *drainingBody) Close() error {
+	b.stop()
+	return b.ReadCloser.Close()
+}
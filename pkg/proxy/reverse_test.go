@@ -0,0 +1,235 @@
+// Reverse proxy response hook and watch draining tests.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marxus/k8s-mca/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServer_Shutdown_DrainsWatchCleanly(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for i := 0; ; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			fmt.Fprintf(w, "{\"type\":\"ADDED\",\"index\":%d}\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": NewReverseProxy(backendURL, http.DefaultTransport),
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.httpServer.Serve(listener) }()
+
+	res, err := http.Get(fmt.Sprintf("http://%s/api/v1/pods?watch=true", listener.Addr()))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	reader := bufio.NewReader(res.Body)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), server.activeWatches.Load())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx))
+
+	_, err = io.ReadAll(reader)
+	assert.NoError(t, err, "watch should end with a clean EOF, not a reset")
+	assert.ErrorIs(t, <-serveErr, http.ErrServerClosed)
+	assert.Equal(t, int64(0), server.activeWatches.Load())
+}
+
+func TestIsWatchRequest(t *testing.T) {
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{target: "/api/v1/pods?watch=true", want: true},
+		{target: "/api/v1/pods?watch=1", want: true},
+		{target: "/api/v1/watch/pods", want: true},
+		{target: "/api/v1/pods", want: false},
+		{target: "/api/v1/pods?watch=false", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			assert.Equal(t, tt.want, isWatchRequest(req))
+		})
+	}
+}
+
+func TestReverseProxy_UntrustedUpstreamCertificate(t *testing.T) {
+	backendHits := 0
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendHits++
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	// The backend's certificate is signed by a CA this transport does not trust.
+	transport := &http.Transport{TLSClientConfig: &tls.Config{}}
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": NewReverseProxy(backendURL, NewRetryTransport(transport, 2, time.Second)),
+	})
+
+	recorder := httptest.NewRecorder()
+	server.handler(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	var status metav1.Status
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.Equal(t, StatusReasonUpstreamCertificateInvalid, status.Reason)
+	assert.Equal(t, int32(http.StatusBadGateway), status.Code)
+	assert.Contains(t, status.Message, "upstream certificate verification failed")
+	assert.Zero(t, backendHits, "request must not reach an unverified upstream")
+}
+
+func TestReverseProxy_UpstreamTransportError(t *testing.T) {
+	backendURL, err := url.Parse("http://127.0.0.1:1")
+	require.NoError(t, err)
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": NewReverseProxy(backendURL, http.DefaultTransport),
+	})
+
+	recorder := httptest.NewRecorder()
+	server.handler(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	assert.Empty(t, recorder.Body.String())
+}
+
+func TestReverseProxy_ResponseHooksSkipStreams(t *testing.T) {
+	var hookCalls atomic.Int32
+	hook := func(res *http.Response) error {
+		hookCalls.Add(1)
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		body = bytes.Replace(body, []byte(`}`), []byte(`,"hooked":true}`), 1)
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		res.ContentLength = int64(len(body))
+		res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+	newFrontend := func(upstream *testutil.Upstream) *httptest.Server {
+		server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+			"in-cluster": NewReverseProxy(upstream.URL(), http.DefaultTransport, hook),
+		})
+		frontend := httptest.NewServer(http.HandlerFunc(server.handler))
+		t.Cleanup(frontend.Close)
+		return frontend
+	}
+
+	t.Run("discrete JSON response is modified", func(t *testing.T) {
+		hookCalls.Store(0)
+		frontend := newFrontend(testutil.NewUpstream(t, testutil.UpstreamOptions{
+			Header: http.Header{"Content-Type": {"application/json"}},
+			Body:   `{"kind":"PodList"}`,
+		}))
+
+		res, err := http.Get(frontend.URL + "/api/v1/pods")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, `{"kind":"PodList","hooked":true}`, string(body))
+		assert.Equal(t, int32(1), hookCalls.Load())
+	})
+
+	t.Run("watch response is streamed without buffering", func(t *testing.T) {
+		hookCalls.Store(0)
+		frontend := newFrontend(testutil.NewUpstream(t, testutil.UpstreamOptions{
+			Header:   http.Header{"Content-Type": {"application/json"}},
+			Stream:   []string{"{\"type\":\"ADDED\"}\n", "{\"type\":\"MODIFIED\"}\n"},
+			Interval: time.Second,
+			Hold:     true,
+		}))
+
+		start := time.Now()
+		res, err := http.Get(frontend.URL + "/api/v1/pods?watch=true")
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		line, err := bufio.NewReader(res.Body).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "{\"type\":\"ADDED\"}\n", line)
+		assert.Less(t, time.Since(start), time.Second, "first event must arrive before the stream ends")
+		assert.Zero(t, hookCalls.Load())
+	})
+
+	t.Run("streaming content type is not modified", func(t *testing.T) {
+		hookCalls.Store(0)
+		frontend := newFrontend(testutil.NewUpstream(t, testutil.UpstreamOptions{
+			Header: http.Header{"Content-Type": {"application/json;stream=watch"}},
+			Body:   `{"type":"ADDED"}`,
+		}))
+
+		res, err := http.Get(frontend.URL + "/apis/example.io/v1/things")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, `{"type":"ADDED"}`, string(body))
+		assert.Zero(t, hookCalls.Load())
+	})
+
+	t.Run("upgraded connection is passed through", func(t *testing.T) {
+		hookCalls.Store(0)
+		frontend := newFrontend(testutil.NewUpstream(t, testutil.UpstreamOptions{Upgrade: "SPDY/3.1"}))
+
+		conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, "POST /api/v1/namespaces/default/pods/web/exec HTTP/1.1\r\nHost: mca\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\n\r\n")
+		require.NoError(t, err)
+
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+		_, err = io.WriteString(conn, "ping")
+		require.NoError(t, err)
+		echoed := make([]byte, 4)
+		_, err = io.ReadFull(reader, echoed)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(echoed))
+		assert.Zero(t, hookCalls.Load())
+	})
+}
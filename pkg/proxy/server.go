@@ -6,48 +6,282 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
+	"github.com/marxus/k8s-mca/pkg/health"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// notReadyRetryAfter is the Retry-After, in seconds, sent while the cluster map is not loaded.
+const notReadyRetryAfter = "1"
+
 // Server represents an HTTPS proxy server that intercepts Kubernetes API calls.
 // It removes Authorization headers and forwards requests to configured cluster endpoints.
-// The server is safe for concurrent use by multiple goroutines.
+// The server is safe for concurrent use by multiple goroutines, including concurrent
+// calls to [Server.SetReverseProxies] while requests are in flight.
 type Server struct {
 	tlsCert        tls.Certificate
-	reverseProxies map[string]*httputil.ReverseProxy
+	reverseProxies atomic.Pointer[map[string]*httputil.ReverseProxy]
+	localHandlers  map[string]http.Handler
+	httpServer     *http.Server
+	drainCtx       context.Context
+	drainWatches   context.CancelFunc
+	activeWatches  atomic.Int64
+	upstreamCheck  health.Check
+	discovery      *discoveryCache
+	healthListener atomic.Pointer[net.Listener]
+	stats          *Stats
+
+	clientCertClusters map[string]string
 }
 
 // NewServer creates a new proxy server with the given TLS certificate and reverse proxies.
 // The reverseProxies map must contain at least an "in-cluster" key for the default cluster.
+// It may be nil when the cluster map is loaded later with [Server.SetReverseProxies]; until
+// then API requests get 503 with a Retry-After header.
+// Paths listed in conf.ProxyLocalPaths are answered by the proxy itself and never forwarded.
+// API requests go to the cluster named by a /clusters/<name>/ path prefix, which is stripped,
+// or else by conf.ClusterHeader, and to "in-cluster" when neither is set.
+// When conf.ProxyDiscoveryCacheTTL is positive, discovery and OpenAPI responses are cached
+// per cluster for that long.
 func NewServer(tlsCert tls.Certificate, reverseProxies map[string]*httputil.ReverseProxy) *Server {
-	return &Server{
-		tlsCert:        tlsCert,
-		reverseProxies: reverseProxies,
+	s := &Server{
+		tlsCert: tlsCert,
+		stats:   newStats(),
+	}
+	s.localHandlers = s.buildLocalHandlers(conf.ProxyLocalPaths)
+	if conf.ProxyDiscoveryCacheTTL > 0 {
+		s.discovery = newDiscoveryCache(conf.ProxyDiscoveryCacheTTL)
+	}
+	if reverseProxies != nil {
+		s.reverseProxies.Store(&reverseProxies)
+	}
+	s.drainCtx, s.drainWatches = context.WithCancel(context.Background())
+	s.httpServer = &http.Server{
+		Addr:      conf.ProxyListenAddress,
+		Handler:   http.HandlerFunc(s.handler),
+		TLSConfig: certs.ServerTLSConfig(tlsCert),
+	}
+	return s
+}
+
+// SetReverseProxies atomically replaces the reverse proxies used for routing.
+// Requests already in flight complete against the map they started with, and cached
+// discovery responses are dropped. The map must not be modified after it is passed in.
+func (s *Server) SetReverseProxies(reverseProxies map[string]*httputil.ReverseProxy) {
+	s.reverseProxies.Store(&reverseProxies)
+	if s.discovery != nil {
+		s.discovery.purge()
 	}
 }
 
+// SetUpstreamCheck sets the check reporting upstream reachability in the /healthz local path.
+// It must be called before [Server.Start].
+func (s *Server) SetUpstreamCheck(check health.Check) {
+	s.upstreamCheck = check
+}
+
+// Stats returns the request counts of the server, also served on the /stats local path.
+func (s *Server) Stats() StatsSnapshot {
+	return s.stats.Snapshot()
+}
+
 func (s *Server) handler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s %s", r.Method, r.URL.Path)
+	log.Printf("%s %s", r.Method, logURL(r.URL))
+	w = s.stats.track(w)
+
+	if conf.ProxyRequireLoopback && !isLoopback(r.RemoteAddr) {
+		log.Printf("Rejected request from non-loopback address %s", r.RemoteAddr)
+		writeStatus(w, http.StatusForbidden, metav1.StatusReasonForbidden,
+			fmt.Sprintf("requests from %s are not allowed", r.RemoteAddr))
+		return
+	}
+
+	if localHandler, ok := s.localHandlers[r.URL.Path]; ok {
+		localHandler.ServeHTTP(w, r)
+		return
+	}
+
+	pathCluster, r := stripClusterPath(r)
+
+	if r.URL.Path == "/" || r.URL.Path == "" {
+		log.Printf("Warning: request %s to the API root from %s, usually a misconfigured client", r.Method, r.RemoteAddr)
+		if conf.ProxyRootPath == conf.RootPathInfo {
+			writeRootInfo(w)
+			return
+		}
+	}
+
+	if !isAPIPath(r.URL.Path) {
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound,
+			fmt.Sprintf("path %s is not a Kubernetes API path", r.URL.Path))
+		return
+	}
+
+	if !methodAllowed(r.URL.Path, r.Method) {
+		writeStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed,
+			fmt.Sprintf("method %s is not allowed on %s", r.Method, r.URL.Path))
+		return
+	}
+
+	reverseProxies := s.reverseProxies.Load()
+	if reverseProxies == nil || len(*reverseProxies) == 0 {
+		w.Header().Set("Retry-After", notReadyRetryAfter)
+		writeStatus(w, http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable,
+			"cluster map is not loaded yet")
+		return
+	}
+
+	r = withWarnings(r)
+	cluster := r.Header.Get(conf.ClusterHeader)
+	if pathCluster != "" {
+		cluster = pathCluster
+	}
+	if s.clientCertClusters != nil {
+		var err error
+		if cluster, err = s.clientCertCluster(r, cluster); err != nil {
+			log.Printf("Rejected request from %s: %v", r.RemoteAddr, err)
+			writeStatus(w, http.StatusForbidden, metav1.StatusReasonForbidden, err.Error())
+			return
+		}
+	}
+	reverseProxy, err := s.selectReverseProxy(r, *reverseProxies, cluster)
+	if err != nil {
+		log.Printf("Failed to route request: %v", err)
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, err.Error())
+		return
+	}
+	if _, ok := (*reverseProxies)[cluster]; !ok {
+		// No cluster, or an unknown one that fell back to in-cluster.
+		cluster = "in-cluster"
+	}
+	s.stats.addCluster(cluster)
+
+	// Hop-by-hop headers go first, so a Connection header cannot remove the headers set below.
+	removeHopByHopHeaders(r.Header)
 	r.Header.Del("Authorization")
-	s.reverseProxies["in-cluster"].ServeHTTP(w, r)
+	r.Header.Del(conf.ClusterHeader)
+	setUserAgent(r.Header)
+
+	if isWatchRequest(r) {
+		s.activeWatches.Add(1)
+		defer s.activeWatches.Add(-1)
+		r = r.WithContext(context.WithValue(r.Context(), drainKey{}, s.drainCtx))
+	}
+
+	if s.discovery != nil && r.Method == http.MethodGet && isDiscoveryPath(r.URL.Path) {
+		s.discovery.serve(w, r, cluster, reverseProxy)
+		return
+	}
+
+	reverseProxy.ServeHTTP(w, r)
+}
+
+func isWatchRequest(r *http.Request) bool {
+	watch := r.URL.Query().Get("watch")
+	return watch == "true" || watch == "1" || strings.Contains(r.URL.Path, "/watch/")
 }
 
-// Start starts the proxy server on 127.0.0.1:6443 and blocks until it exits.
-// The server listens for HTTPS connections using the configured TLS certificate.
+func (s *Server) selectReverseProxy(r *http.Request, reverseProxies map[string]*httputil.ReverseProxy, cluster string) (*httputil.ReverseProxy, error) {
+	if cluster == "" {
+		cluster = "in-cluster"
+	}
+
+	if reverseProxy, ok := reverseProxies[cluster]; ok {
+		return reverseProxy, nil
+	}
+
+	if inCluster, ok := reverseProxies["in-cluster"]; ok && conf.UnknownClusterPolicy == conf.UnknownClusterFallback {
+		log.Printf("Warning: unknown cluster %q, falling back to in-cluster", cluster)
+		AddWarning(r, fmt.Sprintf("unknown cluster %q, request was sent to in-cluster", cluster))
+		return inCluster, nil
+	}
+
+	return nil, fmt.Errorf("cluster %q not found", cluster)
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason metav1.StatusReason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(newStatus(code, reason, message))
+}
+
+// writeRootInfo answers a request to the API root with a Status explaining it is not forwarded.
+func writeRootInfo(w http.ResponseWriter) {
+	status := newStatus(http.StatusOK, "", "this is the MCA proxy, requests to / are not forwarded to the API server; "+
+		"use Kubernetes API paths such as /api and /apis")
+	status.Status = metav1.StatusSuccess
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func newStatus(code int, reason metav1.StatusReason, message string) metav1.Status {
+	return metav1.Status{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Status",
+		},
+		Status:  metav1.StatusFailure,
+		Message: message,
+		Reason:  reason,
+		Code:    int32(code),
+	}
+}
+
+// Start starts the proxy server on conf.ProxyListenAddress (127.0.0.1:6443 by default) and blocks until it exits.
+// The server listens for HTTPS connections using the configured TLS certificate. Plain HTTP
+// requests are answered according to conf.ProxyPlainHTTP.
+// When conf.ProxyHealthAddress is set, a plain HTTP health listener is started on it too.
 // Returns an error if the server fails to start or encounters a fatal error.
 func (s *Server) Start() error {
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{s.tlsCert},
+	if conf.ProxyHealthAddress != "" {
+		listener, err := net.Listen("tcp", conf.ProxyHealthAddress)
+		if err != nil {
+			return fmt.Errorf("failed to listen for health checks: %w", err)
+		}
+		s.healthListener.Store(&listener)
+		defer listener.Close()
+		log.Printf("Health listener started on %s", listener.Addr())
+		go serveHealth(listener)
 	}
 
-	server := &http.Server{
-		Addr:      "127.0.0.1:6443",
-		Handler:   http.HandlerFunc(s.handler),
-		TLSConfig: tlsConfig,
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return err
 	}
+	return s.serve(listener)
+}
 
-	return server.ListenAndServeTLS("", "")
+// serve serves HTTPS on listener, answering plain HTTP requests according to
+// conf.ProxyPlainHTTP.
+func (s *Server) serve(listener net.Listener) error {
+	if conf.ProxyPlainHTTP != conf.PlainHTTPOff {
+		listener = plainHTTPListener{listener}
+	}
+	return s.httpServer.ServeTLS(listener, "", "")
+}
+
+// Shutdown gracefully stops the server. Watch responses proxied through [NewReverseProxy]
+// are ended cleanly so clients resume their watches instead of seeing a reset connection,
+// then Shutdown waits for in-flight requests to complete until ctx is done.
+// After Shutdown, [Server.Start] returns [http.ErrServerClosed].
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Printf("Draining %d watch connections...", s.activeWatches.Load())
+	s.drainWatches()
+	if listener := s.healthListener.Load(); listener != nil {
+		(*listener).Close()
+	}
+	return s.httpServer.Shutdown(ctx)
 }
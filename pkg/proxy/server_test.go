@@ -3,14 +3,21 @@ package proxy
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"sync"
 	"testing"
 
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/internal/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestNewServer(t *testing.T) {
@@ -25,29 +32,14 @@ func TestNewServer(t *testing.T) {
 
 	require.NotNil(t, server)
 	assert.Equal(t, cert, server.tlsCert)
-	assert.Equal(t, reverseProxies, server.reverseProxies)
+	assert.Equal(t, reverseProxies, *server.reverseProxies.Load())
 }
 
 func TestServer_Handler_RemovesAuthorizationHeader(t *testing.T) {
-	// Create a mock backend server
-	var receivedHeaders http.Header
-	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		receivedHeaders = r.Header.Clone()
-		w.WriteHeader(http.StatusOK)
-	}))
-	defer backend.Close()
-
-	// Create reverse proxy pointing to backend
-	backendURL, err := url.Parse(backend.URL)
-	require.NoError(t, err)
-	reverseProxy := httputil.NewSingleHostReverseProxy(backendURL)
-
-	// Create server with the reverse proxy
-	cert := tls.Certificate{}
-	reverseProxies := map[string]*httputil.ReverseProxy{
-		"in-cluster": reverseProxy,
-	}
-	server := NewServer(cert, reverseProxies)
+	upstream := testutil.NewUpstream(t, testutil.UpstreamOptions{})
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": httputil.NewSingleHostReverseProxy(upstream.URL()),
+	})
 
 	// Create test request with Authorization header
 	req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
@@ -59,6 +51,7 @@ func TestServer_Handler_RemovesAuthorizationHeader(t *testing.T) {
 	server.handler(recorder, req)
 
 	// Verify Authorization header was removed
+	receivedHeaders := upstream.LastRequest().Header
 	assert.Empty(t, receivedHeaders.Get("Authorization"))
 
 	// Verify other headers are preserved
@@ -66,62 +59,255 @@ func TestServer_Handler_RemovesAuthorizationHeader(t *testing.T) {
 }
 
 func TestServer_Handler_ForwardsRequestToBackend(t *testing.T) {
-	backendCalled := false
-	var receivedMethod, receivedPath string
-
-	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		backendCalled = true
-		receivedMethod = r.Method
-		receivedPath = r.URL.Path
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("backend response"))
-	}))
-	defer backend.Close()
-
-	backendURL, err := url.Parse(backend.URL)
-	require.NoError(t, err)
-	reverseProxy := httputil.NewSingleHostReverseProxy(backendURL)
-
-	cert := tls.Certificate{}
-	reverseProxies := map[string]*httputil.ReverseProxy{
-		"in-cluster": reverseProxy,
-	}
-	server := NewServer(cert, reverseProxies)
+	upstream := testutil.NewUpstream(t, testutil.UpstreamOptions{Body: "backend response"})
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": httputil.NewSingleHostReverseProxy(upstream.URL()),
+	})
 
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/namespaces/default/pods", nil)
 	recorder := httptest.NewRecorder()
 	server.handler(recorder, req)
 
-	assert.True(t, backendCalled)
-	assert.Equal(t, http.MethodPost, receivedMethod)
-	assert.Equal(t, "/api/v1/namespaces/default/pods", receivedPath)
+	require.Len(t, upstream.Requests(), 1)
+	assert.Equal(t, http.MethodPost, upstream.LastRequest().Method)
+	assert.Equal(t, "/api/v1/namespaces/default/pods", upstream.LastRequest().Path)
 	assert.Equal(t, "backend response", recorder.Body.String())
 }
 
 func TestServer_Handler_ForwardsResponseStatusAndBody(t *testing.T) {
 	responseBody := `{"items":[]}`
+	upstream := testutil.NewUpstream(t, testutil.UpstreamOptions{
+		Status: http.StatusCreated,
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   responseBody,
+	})
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": httputil.NewSingleHostReverseProxy(upstream.URL()),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+	recorder := httptest.NewRecorder()
+	server.handler(recorder, req)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, responseBody, recorder.Body.String())
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+}
+
+func TestServer_Handler_ConcurrentRequestsAndSwap(t *testing.T) {
+	newBackend := func(body string) *httputil.ReverseProxy {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(backend.Close)
+
+		backendURL, err := url.Parse(backend.URL)
+		require.NoError(t, err)
+		return httputil.NewSingleHostReverseProxy(backendURL)
+	}
+
+	first := map[string]*httputil.ReverseProxy{"in-cluster": newBackend("first")}
+	second := map[string]*httputil.ReverseProxy{"in-cluster": newBackend("second")}
+	server := NewServer(tls.Certificate{}, first)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			req.Header.Set("Authorization", "Bearer secret-token")
+			recorder := httptest.NewRecorder()
+			server.handler(recorder, req)
+
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Contains(t, []string{"first", "second"}, recorder.Body.String())
+		}()
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				server.SetReverseProxies(second)
+			} else {
+				server.SetReverseProxies(first)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestServer_Handler_RoutesByClusterHeader(t *testing.T) {
+	newBackend := func(body string) *httputil.ReverseProxy {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get(conf.ClusterHeader))
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(backend.Close)
+
+		backendURL, err := url.Parse(backend.URL)
+		require.NoError(t, err)
+		return httputil.NewSingleHostReverseProxy(backendURL)
+	}
+
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": newBackend("in-cluster"),
+		"prod":       newBackend("prod"),
+	})
+
+	tests := []struct {
+		name     string
+		policy   string
+		cluster  string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "routes to in-cluster without header",
+			policy:   conf.UnknownClusterStrict,
+			wantCode: http.StatusOK,
+			wantBody: "in-cluster",
+		},
+		{
+			name:     "routes to named cluster",
+			policy:   conf.UnknownClusterStrict,
+			cluster:  "prod",
+			wantCode: http.StatusOK,
+			wantBody: "prod",
+		},
+		{
+			name:     "strict policy rejects unknown cluster",
+			policy:   conf.UnknownClusterStrict,
+			cluster:  "staging",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "fallback policy routes unknown cluster to in-cluster",
+			policy:   conf.UnknownClusterFallback,
+			cluster:  "staging",
+			wantCode: http.StatusOK,
+			wantBody: "in-cluster",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalPolicy := conf.UnknownClusterPolicy
+			conf.UnknownClusterPolicy = tt.policy
+			defer func() { conf.UnknownClusterPolicy = originalPolicy }()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			if tt.cluster != "" {
+				req.Header.Set(conf.ClusterHeader, tt.cluster)
+			}
+			recorder := httptest.NewRecorder()
+			server.handler(recorder, req)
+
+			assert.Equal(t, tt.wantCode, recorder.Code)
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, tt.wantBody, recorder.Body.String())
+			} else {
+				var status metav1.Status
+				require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+				assert.Equal(t, metav1.StatusReasonNotFound, status.Reason)
+				assert.Contains(t, status.Message, `cluster "staging" not found`)
+			}
+		})
+	}
+}
+
+func TestServer_Handler_ClusterMapNotLoaded(t *testing.T) {
+	backendHit := false
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte(responseBody))
+		backendHit = true
 	}))
 	defer backend.Close()
-
 	backendURL, err := url.Parse(backend.URL)
 	require.NoError(t, err)
-	reverseProxy := httputil.NewSingleHostReverseProxy(backendURL)
 
-	cert := tls.Certificate{}
-	reverseProxies := map[string]*httputil.ReverseProxy{
-		"in-cluster": reverseProxy,
-	}
-	server := NewServer(cert, reverseProxies)
+	server := NewServer(tls.Certificate{}, nil)
 
-	req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
 	recorder := httptest.NewRecorder()
-	server.handler(recorder, req)
+	server.handler(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
 
-	assert.Equal(t, http.StatusCreated, recorder.Code)
-	assert.Equal(t, responseBody, recorder.Body.String())
-	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	var status metav1.Status
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.Equal(t, metav1.StatusReasonServiceUnavailable, status.Reason)
+	assert.Equal(t, "cluster map is not loaded yet", status.Message)
+
+	server.SetReverseProxies(map[string]*httputil.ReverseProxy{
+		"in-cluster": httputil.NewSingleHostReverseProxy(backendURL),
+	})
+
+	recorder = httptest.NewRecorder()
+	server.handler(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, backendHit)
+}
+
+func TestServer_Handler_RootPath(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		wantForwarded bool
+	}{
+		{name: "forwards by default", mode: conf.RootPathForward, wantForwarded: true},
+		{name: "answers with info", mode: conf.RootPathInfo},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalMode := conf.ProxyRootPath
+			conf.ProxyRootPath = tt.mode
+			defer func() { conf.ProxyRootPath = originalMode }()
+
+			var logs lockedBuffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			upstream := testutil.NewUpstream(t, testutil.UpstreamOptions{Body: `{"paths":["/api","/apis"]}`})
+			server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+				"in-cluster": NewReverseProxy(upstream.URL(), http.DefaultTransport),
+			})
+
+			recorder := httptest.NewRecorder()
+			server.handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Contains(t, logs.String(), "Warning: request GET to the API root from")
+			if tt.wantForwarded {
+				assert.Len(t, upstream.Requests(), 1)
+				assert.JSONEq(t, `{"paths":["/api","/apis"]}`, recorder.Body.String())
+				return
+			}
+
+			assert.Empty(t, upstream.Requests())
+			var status metav1.Status
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+			assert.Equal(t, metav1.StatusSuccess, status.Status)
+			assert.Contains(t, status.Message, "requests to / are not forwarded")
+		})
+	}
+}
+
+func TestServer_Handler_APIPathNotLoggedAsRoot(t *testing.T) {
+	var logs lockedBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := testutil.NewUpstream(t, testutil.UpstreamOptions{})
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": NewReverseProxy(upstream.URL(), http.DefaultTransport),
+	})
+	server.handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+
+	assert.NotContains(t, logs.String(), "API root")
+}
+
+func TestNewServer_TLSConfig(t *testing.T) {
+	config := NewServer(tls.Certificate{}, nil).httpServer.TLSConfig
+
+	assert.True(t, config.SessionTicketsDisabled)
+	assert.Equal(t, tls.RenegotiateNever, config.Renegotiation)
 }
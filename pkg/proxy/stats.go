@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Stats counts the requests handled by a [Server]. It is safe for concurrent use.
+type Stats struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+
+	mu       sync.Mutex
+	clusters map[string]int64
+}
+
+// StatsSnapshot is a point-in-time copy of [Stats], as served by the /stats local path.
+type StatsSnapshot struct {
+	// Requests is the number of requests received.
+	Requests int64 `json:"requests"`
+	// Errors is the number of requests answered with a 5xx status, by the proxy or upstream.
+	Errors int64 `json:"errors"`
+	// Clusters is the number of requests forwarded to each cluster.
+	Clusters map[string]int64 `json:"clusters"`
+}
+
+func newStats() *Stats {
+	return &Stats{clusters: map[string]int64{}}
+}
+
+// track counts a request and returns w wrapped to count it as an error on a 5xx status.
+func (s *Stats) track(w http.ResponseWriter) http.ResponseWriter {
+	s.requests.Add(1)
+	return &statsWriter{ResponseWriter: w, stats: s}
+}
+
+func (s *Stats) addCluster(cluster string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clusters[cluster]++
+}
+
+// Snapshot returns the current counts.
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clusters := make(map[string]int64, len(s.clusters))
+	for cluster, count := range s.clusters {
+		clusters[cluster] = count
+	}
+	return StatsSnapshot{
+		Requests: s.requests.Load(),
+		Errors:   s.errors.Load(),
+		Clusters: clusters,
+	}
+}
+
+func (s *Stats) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Snapshot())
+	})
+}
+
+// statsWriter counts a 5xx response as an error. It unwraps to the original writer, so
+// flushing and hijacking through [http.ResponseController] keep working.
+type statsWriter struct {
+	http.ResponseWriter
+	stats       *Stats
+	wroteHeader bool
+}
+
+func (w *statsWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= http.StatusOK {
+		w.wroteHeader = true
+		if code >= http.StatusInternalServerError {
+			w.stats.errors.Add(1)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
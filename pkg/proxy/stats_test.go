@@ -0,0 +1,82 @@
+// Request stats tests.
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Stats(t *testing.T) {
+	originalPaths, originalPolicy := conf.ProxyLocalPaths, conf.UnknownClusterPolicy
+	conf.ProxyLocalPaths, conf.UnknownClusterPolicy = []string{"/stats"}, conf.UnknownClusterFallback
+	defer func() { conf.ProxyLocalPaths, conf.UnknownClusterPolicy = originalPaths, originalPolicy }()
+
+	inCluster := testutil.NewUpstream(t, testutil.UpstreamOptions{})
+	staging := testutil.NewUpstream(t, testutil.UpstreamOptions{Status: http.StatusServiceUnavailable})
+	server := NewServer(tls.Certificate{}, map[string]*httputil.ReverseProxy{
+		"in-cluster": NewReverseProxy(inCluster.URL(), http.DefaultTransport),
+		"staging":    NewReverseProxy(staging.URL(), http.DefaultTransport),
+	})
+
+	send := func(cluster string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+		if cluster != "" {
+			req.Header.Set(conf.ClusterHeader, cluster)
+		}
+		recorder := httptest.NewRecorder()
+		server.handler(recorder, req)
+		return recorder.Code
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(3)
+		go func() { defer wg.Done(); send("") }()
+		go func() { defer wg.Done(); send("staging") }()
+		go func() { defer wg.Done(); send("unknown") }()
+	}
+	wg.Wait()
+
+	assert.Equal(t, StatsSnapshot{
+		Requests: 30,
+		Errors:   10,
+		Clusters: map[string]int64{"in-cluster": 20, "staging": 10},
+	}, server.Stats())
+
+	recorder := httptest.NewRecorder()
+	server.handler(recorder, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var served StatsSnapshot
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &served))
+	assert.Equal(t, StatsSnapshot{
+		Requests: 31,
+		Errors:   10,
+		Clusters: map[string]int64{"in-cluster": 20, "staging": 10},
+	}, served, "the stats request itself is counted")
+}
+
+func TestServer_Stats_CountsProxyErrors(t *testing.T) {
+	server := NewServer(tls.Certificate{}, nil)
+
+	recorder := httptest.NewRecorder()
+	server.handler(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	server.handler(recorder, httptest.NewRequest(http.MethodGet, "/not-the-api", nil))
+	require.Equal(t, http.StatusNotFound, recorder.Code)
+
+	assert.Equal(t, StatsSnapshot{Requests: 2, Errors: 1, Clusters: map[string]int64{}}, server.Stats())
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+)
+
+// warningAgent is the warn-agent of the Warning headers added by the proxy.
+const warningAgent = "mca"
+
+// warningsKey is the request context key carrying the warnings recorded for a request.
+type warningsKey struct{}
+
+type warnings struct {
+	messages []string
+}
+
+func withWarnings(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), warningsKey{}, &warnings{}))
+}
+
+// AddWarning records a warning to be returned to the client in a Warning response header,
+// alongside any Warning headers sent by the API server. Clients such as kubectl print these
+// warnings to the user. It has no effect on requests not routed by [Server].
+func AddWarning(r *http.Request, message string) {
+	if w, ok := r.Context().Value(warningsKey{}).(*warnings); ok {
+		w.messages = append(w.messages, message)
+	}
+}
+
+// appendWarnings adds the warnings recorded for req to header, keeping upstream warnings.
+func appendWarnings(header http.Header, req *http.Request) {
+	w, ok := req.Context().Value(warningsKey{}).(*warnings)
+	if !ok {
+		return
+	}
+	for _, message := range w.messages {
+		value, err := utilnet.NewWarningHeader(299, warningAgent, message)
+		if err != nil {
+			log.Printf("Warning: failed to encode warning %q: %v", message, err)
+			continue
+		}
+		header.Add("Warning", value)
+	}
+}
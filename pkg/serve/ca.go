@@ -0,0 +1,135 @@
+package serve
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// caKeyUsages maps the key usage names accepted in conf.CAKeyUsage to x509 key usages.
+var caKeyUsages = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"certSign":          x509.KeyUsageCertSign,
+	"crlSign":           x509.KeyUsageCRLSign,
+}
+
+func caOptions() (certs.CAOptions, error) {
+	opts := certs.DefaultCAOptions()
+	opts.MaxPathLenZero = conf.CAMaxPathLenZero
+
+	if err := certs.ValidateKeySize(conf.CertKeySize); err != nil {
+		return certs.CAOptions{}, err
+	}
+	opts.KeySize = conf.CertKeySize
+
+	if len(conf.CAKeyUsage) > 0 {
+		opts.KeyUsage = 0
+		for _, name := range conf.CAKeyUsage {
+			usage, ok := caKeyUsages[name]
+			if !ok {
+				return certs.CAOptions{}, fmt.Errorf("unknown CA key usage %q", name)
+			}
+			opts.KeyUsage |= usage
+		}
+	}
+
+	return opts, nil
+}
+
+func generateCAAndTLSCert(dnsNames []string, ipAddresses []net.IP) (tls.Certificate, []byte, error) {
+	opts, err := caOptions()
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	return certs.GenerateCAAndTLSCertWithOptions(dnsNames, ipAddresses, opts)
+}
+
+// verifyCertChain checks that tlsCert chains to the CA in caCertPEM, unless
+// conf.VerifyCertChain is unset.
+func verifyCertChain(tlsCert tls.Certificate, caCertPEM []byte) error {
+	if !conf.VerifyCertChain {
+		return nil
+	}
+	if err := certs.VerifyChain(tlsCert, caCertPEM); err != nil {
+		return fmt.Errorf("failed to verify certificate chain: %w", err)
+	}
+	return nil
+}
+
+// PrintCA writes the webhook's CA certificate to w as PEM. When the CA is managed externally,
+// either shared through the webhook certificate Secret under conf.WebhookLeaderElection or set
+// in the caBundle when conf.WebhookPatchCABundle is unset, it is loaded from the cluster.
+// Otherwise a new CA is generated from the conf CA options, as each webhook start does.
+//
+// Returns an error if the CA cannot be loaded or generated, or writing fails.
+func PrintCA(w io.Writer) error {
+	var caCertPEM []byte
+	var err error
+	if caManagedExternally() {
+		clientset, clientErr := buildKubernetesClient()
+		if clientErr != nil {
+			return fmt.Errorf("failed to build Kubernetes client: %w", clientErr)
+		}
+		caCertPEM, err = loadCACert(context.Background(), clientset)
+	} else {
+		caCertPEM, err = generateCACert()
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(caCertPEM)
+	return err
+}
+
+func caManagedExternally() bool {
+	return conf.WebhookLeaderElection || !conf.WebhookPatchCABundle
+}
+
+// loadCACert returns the CA certificate from the webhook certificate Secret under
+// conf.WebhookLeaderElection, and from the caBundle of the mutating webhook otherwise.
+func loadCACert(ctx context.Context, clientset kubernetes.Interface) ([]byte, error) {
+	if conf.WebhookLeaderElection {
+		_, caCertPEM, err := loadWebhookCertSecret(ctx, clientset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load webhook certificate Secret %s/%s: %w", conf.PodNamespace, conf.WebhookCertSecret, err)
+		}
+		return caCertPEM, nil
+	}
+
+	config, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, conf.WebhookName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mutating webhook %s: %w", conf.WebhookName, err)
+	}
+	if len(config.Webhooks) == 0 || len(config.Webhooks[0].ClientConfig.CABundle) == 0 {
+		return nil, fmt.Errorf("mutating webhook %s has no caBundle", conf.WebhookName)
+	}
+	return config.Webhooks[0].ClientConfig.CABundle, nil
+}
+
+func generateCACert() ([]byte, error) {
+	opts, err := caOptions()
+	if err != nil {
+		return nil, err
+	}
+	caCert, _, err := certs.GenerateCA(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CA: %w", err)
+	}
+	log.Println("Warning: printing a newly generated CA, the running webhook generates its own on each start")
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), nil
+}
@@ -0,0 +1,153 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCAOptions(t *testing.T) {
+	tests := []struct {
+		name               string
+		maxPathLenZero     bool
+		keyUsage           []string
+		keySize            int
+		wantMaxPathLenZero bool
+		wantKeyUsage       x509.KeyUsage
+		wantErr            string
+	}{
+		{
+			name:               "defaults",
+			maxPathLenZero:     true,
+			wantMaxPathLenZero: true,
+			wantKeyUsage:       x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		},
+		{
+			name:               "custom key usage without path length constraint",
+			keyUsage:           []string{"certSign", "crlSign"},
+			wantMaxPathLenZero: false,
+			wantKeyUsage:       x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		},
+		{
+			name:     "unknown key usage",
+			keyUsage: []string{"certSign", "everything"},
+			wantErr:  `unknown CA key usage "everything"`,
+		},
+		{
+			name:               "larger key size",
+			maxPathLenZero:     true,
+			keySize:            4096,
+			wantMaxPathLenZero: true,
+			wantKeyUsage:       x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		},
+		{
+			name:    "unsupported key size",
+			keySize: 8192,
+			wantErr: "unsupported key size 8192, must be one of [2048 3072 4096]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.keySize == 0 {
+				tt.keySize = certs.DefaultKeySize
+			}
+			originalMaxPathLenZero, originalKeyUsage, originalKeySize := conf.CAMaxPathLenZero, conf.CAKeyUsage, conf.CertKeySize
+			conf.CAMaxPathLenZero, conf.CAKeyUsage, conf.CertKeySize = tt.maxPathLenZero, tt.keyUsage, tt.keySize
+			defer func() {
+				conf.CAMaxPathLenZero, conf.CAKeyUsage, conf.CertKeySize = originalMaxPathLenZero, originalKeyUsage, originalKeySize
+			}()
+
+			opts, err := caOptions()
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantMaxPathLenZero, opts.MaxPathLenZero)
+			assert.Equal(t, tt.wantKeyUsage, opts.KeyUsage)
+			assert.Equal(t, tt.keySize, opts.KeySize)
+		})
+	}
+}
+
+// parseCACert asserts that data is a single PEM certificate of a CA and returns it.
+func parseCACert(t *testing.T, data []byte) *x509.Certificate {
+	t.Helper()
+	block, rest := pem.Decode(data)
+	require.NotNil(t, block)
+	assert.Equal(t, "CERTIFICATE", block.Type)
+	assert.Empty(t, bytes.TrimSpace(rest))
+
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	assert.True(t, caCert.IsCA)
+	assert.NotZero(t, caCert.KeyUsage&x509.KeyUsageCertSign)
+	return caCert
+}
+
+func TestPrintCA_Generated(t *testing.T) {
+	originalLeader, originalPatch := conf.WebhookLeaderElection, conf.WebhookPatchCABundle
+	conf.WebhookLeaderElection, conf.WebhookPatchCABundle = false, true
+	defer func() { conf.WebhookLeaderElection, conf.WebhookPatchCABundle = originalLeader, originalPatch }()
+
+	var out bytes.Buffer
+	require.NoError(t, PrintCA(&out))
+	parseCACert(t, out.Bytes())
+}
+
+func TestLoadCACert(t *testing.T) {
+	originalLeader, originalPatch := conf.WebhookLeaderElection, conf.WebhookPatchCABundle
+	defer func() { conf.WebhookLeaderElection, conf.WebhookPatchCABundle = originalLeader, originalPatch }()
+	ctx := context.Background()
+
+	t.Run("webhook certificate Secret", func(t *testing.T) {
+		conf.WebhookLeaderElection, conf.WebhookPatchCABundle = true, true
+		fakeClient := fake.NewSimpleClientset()
+		caCertPEM, err := createWebhookCertSecret(ctx, fakeClient)
+		require.NoError(t, err)
+
+		loaded, err := loadCACert(ctx, fakeClient)
+		require.NoError(t, err)
+		assert.Equal(t, caCertPEM, loaded)
+		parseCACert(t, loaded)
+	})
+
+	t.Run("external caBundle", func(t *testing.T) {
+		conf.WebhookLeaderElection, conf.WebhookPatchCABundle = false, false
+		caCertPEM, err := generateCACert()
+		require.NoError(t, err)
+		fakeClient := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: conf.WebhookName},
+			Webhooks: []admissionregistrationv1.MutatingWebhook{
+				{ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: caCertPEM}},
+			},
+		})
+
+		loaded, err := loadCACert(ctx, fakeClient)
+		require.NoError(t, err)
+		assert.Equal(t, caCertPEM, loaded)
+		parseCACert(t, loaded)
+	})
+
+	t.Run("missing caBundle", func(t *testing.T) {
+		conf.WebhookLeaderElection, conf.WebhookPatchCABundle = false, false
+		fakeClient := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: conf.WebhookName},
+			Webhooks:   []admissionregistrationv1.MutatingWebhook{{}},
+		})
+
+		_, err := loadCACert(ctx, fakeClient)
+		assert.ErrorContains(t, err, "has no caBundle")
+	})
+}
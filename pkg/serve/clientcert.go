@@ -0,0 +1,39 @@
+package serve
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/spf13/afero"
+	"k8s.io/client-go/rest"
+)
+
+// clientCertRouting loads the CAs of conf.ProxyClientCAPath and checks that every subject in
+// conf.ClientCertClusters maps to one of the clusters in configs.
+func clientCertRouting(configs map[string]*rest.Config) (*x509.CertPool, map[string]string, error) {
+	if conf.ClientCertClustersErr != nil {
+		return nil, nil, conf.ClientCertClustersErr
+	}
+	if len(conf.ClientCertClusters) == 0 {
+		return nil, nil, errors.New("no client certificate subjects are mapped to clusters")
+	}
+	for _, subject := range slices.Sorted(maps.Keys(conf.ClientCertClusters)) {
+		if cluster := conf.ClientCertClusters[subject]; configs[cluster] == nil {
+			return nil, nil, fmt.Errorf("client certificate %q is mapped to unknown cluster %q", subject, cluster)
+		}
+	}
+
+	caPEM, err := afero.ReadFile(conf.FS, conf.ProxyClientCAPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, nil, fmt.Errorf("no certificates found in client CA %s", conf.ProxyClientCAPath)
+	}
+	return clientCAs, conf.ClientCertClusters, nil
+}
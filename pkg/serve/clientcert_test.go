@@ -0,0 +1,86 @@
+// Client certificate routing configuration tests.
+package serve
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
+)
+
+func TestClientCertRouting(t *testing.T) {
+	_, caCertPEM, err := certs.GenerateCAAndTLSCert([]string{"localhost"}, nil)
+	require.NoError(t, err)
+	configs := map[string]*rest.Config{"in-cluster": {}, "staging": {}}
+
+	tests := []struct {
+		name        string
+		clusters    map[string]string
+		clustersErr error
+		caPEM       []byte
+		wantErr     string
+	}{
+		{
+			name:     "valid",
+			clusters: map[string]string{"billing-worker": "staging", "web": "in-cluster"},
+			caPEM:    caCertPEM,
+		},
+		{
+			name:        "invalid subject map",
+			clustersErr: errors.New(`invalid MCA_CLIENT_CERT_CLUSTERS "{": unexpected end of JSON input`),
+			caPEM:       caCertPEM,
+			wantErr:     `invalid MCA_CLIENT_CERT_CLUSTERS "{"`,
+		},
+		{
+			name:    "no subjects",
+			caPEM:   caCertPEM,
+			wantErr: "no client certificate subjects are mapped to clusters",
+		},
+		{
+			name:     "unknown cluster",
+			clusters: map[string]string{"web": "prod"},
+			caPEM:    caCertPEM,
+			wantErr:  `client certificate "web" is mapped to unknown cluster "prod"`,
+		},
+		{
+			name:     "missing CA",
+			clusters: map[string]string{"web": "in-cluster"},
+			wantErr:  "failed to read client CA",
+		},
+		{
+			name:     "CA without certificates",
+			clusters: map[string]string{"web": "in-cluster"},
+			caPEM:    []byte("not a certificate"),
+			wantErr:  "no certificates found in client CA /etc/mca/client-ca.crt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalPath, originalClusters, originalErr := conf.ProxyClientCAPath, conf.ClientCertClusters, conf.ClientCertClustersErr
+			defer func() {
+				conf.ProxyClientCAPath, conf.ClientCertClusters, conf.ClientCertClustersErr = originalPath, originalClusters, originalErr
+			}()
+
+			conf.ProxyClientCAPath, conf.ClientCertClusters, conf.ClientCertClustersErr = "/etc/mca/client-ca.crt", tt.clusters, tt.clustersErr
+			if tt.caPEM != nil {
+				defer conf.FS.Remove(conf.ProxyClientCAPath)
+				require.NoError(t, afero.WriteFile(conf.FS, conf.ProxyClientCAPath, tt.caPEM, 0644))
+			}
+
+			clientCAs, clusters, err := clientCertRouting(configs)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.NotNil(t, clientCAs)
+			assert.Equal(t, tt.clusters, clusters)
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// StartCombined starts the MCA webhook and proxy servers in a single process, each on its own
+// address. A SIGINT/SIGTERM, or either server failing, shuts both down.
+//
+// Returns an error if either server fails to prepare or start, joining the errors of both.
+func StartCombined() error {
+	log.SetPrefix(logPrefix())
+	log.Println("Starting MCA Webhook and Proxy...")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientset, err := buildKubernetesClient()
+	if err != nil {
+		return fmt.Errorf("failed to build Kubernetes client: %w", err)
+	}
+
+	webhookServer, err := newWebhookServer(ctx, clientset)
+	if err != nil {
+		return fmt.Errorf("failed to prepare webhook: %w", err)
+	}
+
+	proxyServer, err := newProxyServer()
+	if err != nil {
+		return fmt.Errorf("failed to prepare proxy: %w", err)
+	}
+
+	log.Println("Starting webhook and proxy servers...")
+	return serveAllUntilSignal([]service{webhookService(webhookServer), proxyService(proxyServer)})
+}
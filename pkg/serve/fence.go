@@ -0,0 +1,51 @@
+package serve
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/marxus/k8s-mca/conf"
+)
+
+const (
+	// proxyFenceTimeout bounds how long [WaitForProxy] waits for the proxy to listen.
+	proxyFenceTimeout = 60 * time.Second
+	// proxyFenceInterval is the delay between [WaitForProxy] connection attempts.
+	proxyFenceInterval = 100 * time.Millisecond
+)
+
+// WaitForProxy blocks until the proxy in the same pod accepts connections on the port of
+// conf.ProxyListenAddress. It runs as the postStart hook of a legacy sidecar proxy, holding
+// the app containers until the proxy is ready.
+//
+// Returns an error if the proxy listen address is invalid or the proxy does not listen in time.
+func WaitForProxy() error {
+	_, port, err := net.SplitHostPort(conf.ProxyListenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to parse proxy listen address: %w", err)
+	}
+
+	address := net.JoinHostPort("127.0.0.1", port)
+	if err := waitForListener(address, proxyFenceTimeout, proxyFenceInterval); err != nil {
+		return err
+	}
+
+	log.Printf("Proxy is listening on %s", address)
+	return nil
+}
+
+func waitForListener(address string, timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", address, interval)
+		if err == nil {
+			return conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("failed to connect to proxy on %s within %s: %w", address, timeout, err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,48 @@
+// Proxy startup fence tests.
+package serve
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForListener(t *testing.T) {
+	t.Run("returns once the address listens", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		assert.NoError(t, waitForListener(listener.Addr().String(), time.Second, 10*time.Millisecond))
+	})
+
+	t.Run("waits for a late listener", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		address := listener.Addr().String()
+		listener.Close()
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			late, err := net.Listen("tcp", address)
+			if err == nil {
+				time.AfterFunc(time.Second, func() { late.Close() })
+			}
+		}()
+
+		assert.NoError(t, waitForListener(address, 2*time.Second, 10*time.Millisecond))
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		address := listener.Addr().String()
+		listener.Close()
+
+		err = waitForListener(address, 50*time.Millisecond, 10*time.Millisecond)
+		assert.ErrorContains(t, err, "failed to connect to proxy")
+	})
+}
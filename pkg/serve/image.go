@@ -0,0 +1,224 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/marxus/k8s-mca/conf"
+)
+
+// dockerHubRegistry is the registry serving images whose name has no registry host, or names
+// one of dockerHubAliases, which do not serve the registry API themselves.
+const dockerHubRegistry = "registry-1.docker.io"
+
+var dockerHubAliases = []string{"docker.io", "index.docker.io"}
+
+// digestLookupTimeout bounds the registry lookup pinning the proxy image at startup.
+const digestLookupTimeout = 10 * time.Second
+
+// manifestMediaTypes are the manifest types accepted when resolving a tag, multi-arch indexes
+// first so the digest pins every platform.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// imageReference is a container image name split into the parts a registry lookup needs.
+type imageReference struct {
+	name       string // the image as written, without tag and digest
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+func parseImageReference(image string) imageReference {
+	var ref imageReference
+	ref.name, ref.digest, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(ref.name, ":"); i > strings.LastIndex(ref.name, "/") {
+		ref.name, ref.tag = ref.name[:i], ref.name[i+1:]
+	}
+
+	ref.registry, ref.repository = dockerHubRegistry, ref.name
+	if first, rest, ok := strings.Cut(ref.name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		ref.registry, ref.repository = first, rest
+	}
+	if slices.Contains(dockerHubAliases, ref.registry) {
+		ref.registry = dockerHubRegistry
+	}
+	if ref.registry == dockerHubRegistry && !strings.Contains(ref.repository, "/") {
+		ref.repository = "library/" + ref.repository
+	}
+	return ref
+}
+
+// floating reports whether the image may change under the same reference: it has no digest
+// and its tag is "latest" or missing, which means "latest".
+func (ref imageReference) floating() bool {
+	return ref.digest == "" && (ref.tag == "" || ref.tag == "latest")
+}
+
+// checkProxyImage pins conf.ProxyImage to a digest when conf.ProxyImagePinDigest is set, so
+// every injected pod runs the same image, then applies conf.ProxyImageFloatingTag to it.
+// A failed lookup leaves the image unpinned with a warning rather than blocking startup.
+// It runs before anything reads conf.ProxyImage.
+func checkProxyImage(ctx context.Context, client *http.Client) error {
+	ref := parseImageReference(conf.ProxyImage)
+	if conf.ProxyImagePinDigest && ref.digest == "" {
+		ctx, cancel := context.WithTimeout(ctx, digestLookupTimeout)
+		defer cancel()
+		digest, err := resolveImageDigest(ctx, client, ref)
+		if err != nil {
+			log.Printf("Warning: failed to pin proxy image %s to a digest: %v", conf.ProxyImage, err)
+		} else {
+			pinned := conf.ProxyImage + "@" + digest
+			log.Printf("Pinned proxy image %s to %s", conf.ProxyImage, pinned)
+			conf.ProxyImage = pinned
+			return nil
+		}
+	}
+
+	if !ref.floating() {
+		return nil
+	}
+	switch conf.ProxyImageFloatingTag {
+	case conf.FloatingTagReject:
+		return fmt.Errorf("proxy image %s uses a floating tag, pin a version or digest", conf.ProxyImage)
+	case conf.FloatingTagWarn:
+		log.Printf("Warning: proxy image %s uses a floating tag, injected pods may run different images", conf.ProxyImage)
+	}
+	return nil
+}
+
+// resolveImageDigest returns the digest ref's tag currently points to, from a manifest HEAD
+// request to its registry. A registry answering 401 is retried with an anonymous bearer
+// token, as public registries such as Docker Hub require.
+func resolveImageDigest(ctx context.Context, client *http.Client, ref imageReference) (string, error) {
+	tag := ref.tag
+	if tag == "" {
+		tag = "latest"
+	}
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.registry, ref.repository, tag)
+
+	res, err := headManifest(ctx, client, manifestURL, "")
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		token, err := registryToken(ctx, client, res.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", err
+		}
+		if res, err = headManifest(ctx, client, manifestURL, token); err != nil {
+			return "", err
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry answered %s for %s", res.Status, manifestURL)
+	}
+
+	digest := res.Header.Get("Docker-Content-Digest")
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("registry returned no sha256 digest for %s", manifestURL)
+	}
+	return digest, nil
+}
+
+func headManifest(ctx context.Context, client *http.Client, manifestURL, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up manifest: %w", err)
+	}
+	res.Body.Close()
+	return res, nil
+}
+
+// registryToken fetches an anonymous token from the realm of a Bearer challenge.
+func registryToken(ctx context.Context, client *http.Client, challenge string) (string, error) {
+	params, ok := parseBearerChallenge(challenge)
+	if !ok || params["realm"] == "" {
+		return "", fmt.Errorf("registry requires unsupported authentication %q", challenge)
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q: %w", params["realm"], err)
+	}
+	query := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get registry token: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token endpoint answered %s", res.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode registry token: %w", err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", errors.New("registry token endpoint returned no token")
+}
+
+// parseBearerChallenge parses a `Bearer realm="...",service="...",scope="..."` challenge.
+func parseBearerChallenge(challenge string) (map[string]string, bool) {
+	scheme, rest, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[strings.ToLower(key)] = value
+		}
+	}
+	return params, true
+}
@@ -0,0 +1,201 @@
+// Proxy image floating tag and digest pinning tests.
+package serve
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		image        string
+		want         imageReference
+		wantFloating bool
+	}{
+		{
+			image:        "mca",
+			want:         imageReference{name: "mca", registry: dockerHubRegistry, repository: "library/mca"},
+			wantFloating: true,
+		},
+		{
+			image:        "mca:latest",
+			want:         imageReference{name: "mca", registry: dockerHubRegistry, repository: "library/mca", tag: "latest"},
+			wantFloating: true,
+		},
+		{
+			image: "marxus/mca:v1.2.0",
+			want:  imageReference{name: "marxus/mca", registry: dockerHubRegistry, repository: "marxus/mca", tag: "v1.2.0"},
+		},
+		{
+			image: "docker.io/nginx:1.27",
+			want:  imageReference{name: "docker.io/nginx", registry: dockerHubRegistry, repository: "library/nginx", tag: "1.27"},
+		},
+		{
+			image: "index.docker.io/marxus/mca:v1.2.0",
+			want:  imageReference{name: "index.docker.io/marxus/mca", registry: dockerHubRegistry, repository: "marxus/mca", tag: "v1.2.0"},
+		},
+		{
+			image:        "localhost:5000/mca",
+			want:         imageReference{name: "localhost:5000/mca", registry: "localhost:5000", repository: "mca"},
+			wantFloating: true,
+		},
+		{
+			image: "ghcr.io/marxus/mca:latest@sha256:abc",
+			want: imageReference{
+				name: "ghcr.io/marxus/mca", registry: "ghcr.io", repository: "marxus/mca", tag: "latest", digest: "sha256:abc",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref := parseImageReference(tt.image)
+			assert.Equal(t, tt.want, ref)
+			assert.Equal(t, tt.wantFloating, ref.floating())
+		})
+	}
+}
+
+func TestCheckProxyImage_FloatingTag(t *testing.T) {
+	tests := []struct {
+		name        string
+		image       string
+		policy      string
+		wantErr     string
+		wantWarning bool
+	}{
+		{name: "warns about latest", image: "mca:latest", policy: conf.FloatingTagWarn, wantWarning: true},
+		{name: "warns about a missing tag", image: "ghcr.io/marxus/mca", policy: conf.FloatingTagWarn, wantWarning: true},
+		{name: "accepts a pinned tag", image: "mca:v1.2.0", policy: conf.FloatingTagWarn},
+		{name: "accepts a digest", image: "mca@sha256:abc", policy: conf.FloatingTagReject},
+		{name: "ignores latest when told to", image: "mca:latest", policy: conf.FloatingTagIgnore},
+		{
+			name:    "rejects latest",
+			image:   "mca:latest",
+			policy:  conf.FloatingTagReject,
+			wantErr: "proxy image mca:latest uses a floating tag, pin a version or digest",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalImage, originalPolicy := conf.ProxyImage, conf.ProxyImageFloatingTag
+			conf.ProxyImage, conf.ProxyImageFloatingTag = tt.image, tt.policy
+			defer func() { conf.ProxyImage, conf.ProxyImageFloatingTag = originalImage, originalPolicy }()
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			err := checkProxyImage(context.Background(), http.DefaultClient)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.image, conf.ProxyImage)
+			assert.Equal(t, tt.wantWarning, strings.Contains(logs.String(), "Warning: proxy image "+tt.image+" uses a floating tag"))
+		})
+	}
+}
+
+func TestCheckProxyImage_PinDigest(t *testing.T) {
+	const digest = "sha256:4bcff63911fcb4448bd4fdacec207030997caf25e9bea4045fa6c8c44de311d1"
+
+	registry := httptest.NewTLSServer(nil)
+	defer registry.Close()
+	registry.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			assert.Equal(t, "repository:marxus/mca:pull", r.URL.Query().Get("scope"))
+			w.Write([]byte(`{"token": "anonymous"}`))
+		case "/v2/marxus/mca/manifests/latest":
+			assert.Equal(t, http.MethodHead, r.Method)
+			assert.Contains(t, r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json")
+			if r.Header.Get("Authorization") != "Bearer anonymous" {
+				w.Header().Set("WWW-Authenticate",
+					`Bearer realm="`+registry.URL+`/token",service="registry",scope="repository:marxus/mca:pull"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", digest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	host := strings.TrimPrefix(registry.URL, "https://")
+
+	tests := []struct {
+		name        string
+		image       string
+		pin         bool
+		wantImage   string
+		wantWarning string
+	}{
+		{
+			name:      "pins the floating tag",
+			image:     host + "/marxus/mca:latest",
+			pin:       true,
+			wantImage: host + "/marxus/mca:latest@" + digest,
+		},
+		{
+			name:      "pins a missing tag",
+			image:     host + "/marxus/mca",
+			pin:       true,
+			wantImage: host + "/marxus/mca@" + digest,
+		},
+		{
+			name:      "leaves the image alone without the flag",
+			image:     host + "/marxus/mca:latest",
+			wantImage: host + "/marxus/mca:latest",
+		},
+		{
+			name:        "keeps the tag when the lookup fails",
+			image:       host + "/marxus/other:latest",
+			pin:         true,
+			wantImage:   host + "/marxus/other:latest",
+			wantWarning: "Warning: failed to pin proxy image",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalImage, originalPin := conf.ProxyImage, conf.ProxyImagePinDigest
+			conf.ProxyImage, conf.ProxyImagePinDigest = tt.image, tt.pin
+			defer func() { conf.ProxyImage, conf.ProxyImagePinDigest = originalImage, originalPin }()
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			require.NoError(t, checkProxyImage(context.Background(), registry.Client()))
+			assert.Equal(t, tt.wantImage, conf.ProxyImage)
+			if tt.wantWarning != "" {
+				assert.Contains(t, logs.String(), tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestParseBearerChallenge(t *testing.T) {
+	params, ok := parseBearerChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/mca:pull"`)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/mca:pull",
+	}, params)
+
+	_, ok = parseBearerChallenge(`Basic realm="registry"`)
+	assert.False(t, ok)
+}
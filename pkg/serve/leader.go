@@ -0,0 +1,328 @@
+package serve
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var (
+	leaseDuration     = 15 * time.Second
+	renewDeadline     = 10 * time.Second
+	retryPeriod       = 2 * time.Second
+	certPollDelay     = time.Second
+	publishRetryDelay = time.Second
+	publishAttempts   = 5
+)
+
+// startLeaderElectedWebhookCert runs leader election among webhook replicas and returns the shared
+// serving certificate. Only the leader generates the certificate Secret and patches the caBundle;
+// every replica, the leader included, serves the certificate loaded from the Secret.
+// A leader that cannot publish the certificate gives up leadership, so another replica tries.
+func startLeaderElectedWebhookCert(ctx context.Context, clientset kubernetes.Interface) (tls.Certificate, error) {
+	runLeaderElection, err := newLeaderElection(clientset, leaderIdentity(), func(ctx context.Context) error {
+		return publishWebhookCertWithRetry(ctx, clientset)
+	})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	go runLeaderElection(ctx)
+
+	var tlsCert tls.Certificate
+	err = wait.PollUntilContextCancel(ctx, certPollDelay, true, func(ctx context.Context) (bool, error) {
+		var err error
+		tlsCert, _, err = loadWebhookCertSecret(ctx, clientset)
+		if apierrors.IsNotFound(err) {
+			log.Printf("Waiting for webhook certificate Secret %s/%s...", conf.PodNamespace, conf.WebhookCertSecret)
+			return false, nil
+		}
+		if errors.Is(err, errStaleWebhookCert) {
+			log.Printf("Waiting for webhook certificate Secret %s/%s to be reissued: %v", conf.PodNamespace, conf.WebhookCertSecret, err)
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load webhook certificate Secret: %w", err)
+	}
+
+	return tlsCert, nil
+}
+
+func leaderIdentity() string {
+	if conf.PodName != "" {
+		return conf.PodName
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// newLeaderElection creates the webhook leader elector and returns a function running it until
+// ctx is done. When onStartedLeading fails, the lease is released and the election rerun.
+func newLeaderElection(clientset kubernetes.Interface, identity string, onStartedLeading func(ctx context.Context) error) (func(ctx context.Context), error) {
+	var release atomic.Pointer[context.CancelFunc]
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      conf.WebhookName,
+				Namespace: conf.PodNamespace,
+			},
+			Client:     clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            conf.WebhookName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Printf("Acquired webhook leadership as %s", identity)
+				if err := onStartedLeading(ctx); err != nil {
+					log.Printf("Releasing webhook leadership as %s: %v", identity, err)
+					(*release.Load())()
+				}
+			},
+			OnStoppedLeading: func() {
+				log.Printf("Lost webhook leadership as %s", identity)
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create leader elector: %w", err)
+	}
+
+	return func(ctx context.Context) {
+		for ctx.Err() == nil {
+			termCtx, cancel := context.WithCancel(ctx)
+			release.Store(&cancel)
+			elector.Run(termCtx)
+			cancel()
+		}
+	}, nil
+}
+
+// publishWebhookCertWithRetry publishes the webhook certificate, retrying with exponential
+// backoff up to publishAttempts times while ctx is not done.
+func publishWebhookCertWithRetry(ctx context.Context, clientset kubernetes.Interface) error {
+	backoff := wait.Backoff{Duration: publishRetryDelay, Factor: 2, Steps: publishAttempts}
+	var publishErr error
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (bool, error) {
+		if publishErr = publishWebhookCert(ctx, clientset); publishErr != nil {
+			log.Printf("Failed to publish webhook certificate: %v", publishErr)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil && publishErr != nil {
+		return fmt.Errorf("failed to publish webhook certificate: %w", publishErr)
+	}
+	return err
+}
+
+// webhookCertSANsAnnotation records on the webhook certificate Secret the SANs its certificate
+// was issued for.
+const webhookCertSANsAnnotation = "mca.marxus.io/sans"
+
+// errStaleWebhookCert is returned for a webhook certificate Secret issued for other SANs than
+// the configured ones, e.g. after conf.WebhookName changed.
+var errStaleWebhookCert = errors.New("webhook certificate was issued for other SANs")
+
+func publishWebhookCert(ctx context.Context, clientset kubernetes.Interface) error {
+	_, caCertPEM, err := loadWebhookCertSecret(ctx, clientset)
+	switch {
+	case apierrors.IsNotFound(err):
+		caCertPEM, err = createWebhookCertSecret(ctx, clientset)
+	case errors.Is(err, errStaleWebhookCert):
+		log.Printf("Reissuing webhook certificate: %v", err)
+		caCertPEM, err = reissueWebhookCertSecret(ctx, clientset)
+	}
+	if err != nil {
+		return err
+	}
+
+	return patchMutatingConfig(caCertPEM, clientset)
+}
+
+// loadWebhookCertSecret returns the certificate and CA of the webhook certificate Secret.
+// It returns an error wrapping errStaleWebhookCert when the certificate was issued for other
+// SANs than webhookDNSNames.
+func loadWebhookCertSecret(ctx context.Context, clientset kubernetes.Interface) (tls.Certificate, []byte, error) {
+	secret, err := clientset.CoreV1().Secrets(conf.PodNamespace).Get(ctx, conf.WebhookCertSecret, metav1.GetOptions{})
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	tlsCert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to parse webhook certificate Secret: %w", err)
+	}
+
+	caCertPEM := secret.Data[corev1.ServiceAccountRootCAKey]
+	if err := verifyCertChain(tlsCert, caCertPEM); err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("webhook certificate Secret %s/%s is invalid: %w", conf.PodNamespace, conf.WebhookCertSecret, err)
+	}
+
+	sans, err := storedWebhookCertSANs(secret, tlsCert)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to read webhook certificate SANs: %w", err)
+	}
+	if want := slices.Sorted(slices.Values(webhookDNSNames())); !slices.Equal(sans, want) {
+		return tls.Certificate{}, nil, fmt.Errorf("%w: Secret %s/%s has %v, configured %v",
+			errStaleWebhookCert, conf.PodNamespace, conf.WebhookCertSecret, sans, want)
+	}
+
+	return tlsCert, caCertPEM, nil
+}
+
+// storedWebhookCertSANs returns the sorted SANs recorded on secret, or read from its
+// certificate for Secrets created before they were recorded.
+func storedWebhookCertSANs(secret *corev1.Secret, tlsCert tls.Certificate) ([]string, error) {
+	if sans, ok := secret.Annotations[webhookCertSANsAnnotation]; ok {
+		return slices.Sorted(slices.Values(strings.Split(sans, ","))), nil
+	}
+
+	dnsNames, _, err := certs.SANs(tlsCert)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Sorted(slices.Values(dnsNames)), nil
+}
+
+func createWebhookCertSecret(ctx context.Context, clientset kubernetes.Interface) ([]byte, error) {
+	caCert, caKey, err := generateWebhookCA()
+	if err != nil {
+		return nil, err
+	}
+	secret, caCertPEM, err := newWebhookCertSecret(caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := clientset.CoreV1().Secrets(conf.PodNamespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to create webhook certificate Secret: %w", err)
+	}
+
+	log.Printf("Created webhook certificate Secret: %s/%s", conf.PodNamespace, conf.WebhookCertSecret)
+	return caCertPEM, nil
+}
+
+// reissueWebhookCertSecret replaces the certificate in the webhook certificate Secret with one
+// for the configured SANs, issued by the CA already in the Secret, so the caBundle is unchanged
+// and replicas still serving the old certificate keep being trusted. Secrets created without
+// the CA key get a new CA, and those replicas are only trusted again once restarted.
+func reissueWebhookCertSecret(ctx context.Context, clientset kubernetes.Interface) ([]byte, error) {
+	current, err := clientset.CoreV1().Secrets(conf.PodNamespace).Get(ctx, conf.WebhookCertSecret, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook certificate Secret: %w", err)
+	}
+
+	caCert, caKey, err := webhookCAFromSecret(current)
+	if err != nil {
+		log.Printf("Warning: generating a new webhook CA, replicas serving the old certificate must be restarted: %v", err)
+		if caCert, caKey, err = generateWebhookCA(); err != nil {
+			return nil, err
+		}
+	}
+
+	secret, caCertPEM, err := newWebhookCertSecret(caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+	secret.ResourceVersion = current.ResourceVersion
+
+	if _, err := clientset.CoreV1().Secrets(conf.PodNamespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to update webhook certificate Secret: %w", err)
+	}
+
+	log.Printf("Reissued webhook certificate Secret %s/%s for %v", conf.PodNamespace, conf.WebhookCertSecret, webhookDNSNames())
+	return caCertPEM, nil
+}
+
+// webhookCAKeyKey is the webhook certificate Secret key holding the PEM-encoded CA private key,
+// kept so the serving certificate can be reissued by the same CA.
+const webhookCAKeyKey = "ca.key"
+
+func generateWebhookCA() (*x509.Certificate, crypto.Signer, error) {
+	opts, err := caOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	caCert, caKey, err := certs.GenerateCA(opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate webhook CA: %w", err)
+	}
+	return caCert, caKey, nil
+}
+
+// webhookCAFromSecret returns the CA certificate and key stored in secret.
+func webhookCAFromSecret(secret *corev1.Secret) (*x509.Certificate, crypto.Signer, error) {
+	caKeyPEM, ok := secret.Data[webhookCAKeyKey]
+	if !ok {
+		return nil, nil, fmt.Errorf("Secret %s/%s has no %s", secret.Namespace, secret.Name, webhookCAKeyKey)
+	}
+
+	ca, err := tls.X509KeyPair(secret.Data[corev1.ServiceAccountRootCAKey], caKeyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse webhook CA: %w", err)
+	}
+	caKey, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("webhook CA key cannot sign")
+	}
+	return ca.Leaf, caKey, nil
+}
+
+// newWebhookCertSecret issues a serving certificate for webhookDNSNames from the CA and returns
+// the Secret holding them, with the SANs recorded, and the CA certificate.
+func newWebhookCertSecret(caCert *x509.Certificate, caKey crypto.Signer) (*corev1.Secret, []byte, error) {
+	dnsNames := webhookDNSNames()
+	tlsCert, err := certs.GenerateTLSCert(caCert, caKey, dnsNames, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate webhook certificates: %w", err)
+	}
+
+	certPEM, keyPEM, err := certs.EncodeTLSCertPEM(tlsCert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode webhook certificate: %w", err)
+	}
+	caCertPEM, caKeyPEM, err := certs.EncodeTLSCertPEM(tls.Certificate{Certificate: [][]byte{caCert.Raw}, PrivateKey: caKey})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode webhook CA: %w", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        conf.WebhookCertSecret,
+			Namespace:   conf.PodNamespace,
+			Annotations: map[string]string{webhookCertSANsAnnotation: strings.Join(dnsNames, ",")},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:              certPEM,
+			corev1.TLSPrivateKeyKey:        keyPEM,
+			corev1.ServiceAccountRootCAKey: caCertPEM,
+			webhookCAKeyKey:                caKeyPEM,
+		},
+	}
+	return secret, caCertPEM, nil
+}
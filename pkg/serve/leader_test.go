@@ -0,0 +1,300 @@
+// Leader election and shared webhook certificate tests.
+package serve
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// shortenLeaderElection speeds up leader election timings for the duration of a test.
+func shortenLeaderElection(t *testing.T) {
+	originalLease, originalRenew, originalRetry, originalPoll := leaseDuration, renewDeadline, retryPeriod, certPollDelay
+	leaseDuration, renewDeadline, retryPeriod, certPollDelay = 2*time.Second, time.Second, 100*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() {
+		leaseDuration, renewDeadline, retryPeriod, certPollDelay = originalLease, originalRenew, originalRetry, originalPoll
+	})
+}
+
+func TestStartLeaderElectedWebhookCert_OnlyLeaderPatches(t *testing.T) {
+	shortenLeaderElection(t)
+
+	fakeClient := fake.NewSimpleClientset()
+	var patchCount atomic.Int32
+	fakeClient.PrependReactor("patch", "mutatingwebhookconfigurations", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patchCount.Add(1)
+		return true, nil, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, identity := range []string{"replica-a", "replica-b", "replica-c"} {
+		wg.Add(1)
+		go func(identity string) {
+			defer wg.Done()
+			runLeaderElection, err := newLeaderElection(fakeClient, identity, func(ctx context.Context) error {
+				assert.NoError(t, publishWebhookCert(ctx, fakeClient))
+				return nil
+			})
+			require.NoError(t, err)
+			runLeaderElection(ctx)
+		}(identity)
+	}
+
+	tlsCert, err := startLeaderElectedWebhookCert(ctx, fakeClient)
+	require.NoError(t, err)
+	assert.NotEmpty(t, tlsCert.Certificate)
+
+	// Allow followers several retry periods to (wrongly) acquire leadership.
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, int32(1), patchCount.Load())
+
+	cancel()
+	wg.Wait()
+}
+
+func TestStartLeaderElectedWebhookCert_InvalidElectorConfig(t *testing.T) {
+	shortenLeaderElection(t)
+	renewDeadline = leaseDuration
+
+	_, err := startLeaderElectedWebhookCert(context.Background(), fake.NewSimpleClientset())
+	assert.ErrorContains(t, err, "failed to create leader elector: ")
+}
+
+func TestNewLeaderElection_ReleasesLeadershipOnFailure(t *testing.T) {
+	shortenLeaderElection(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var terms atomic.Int32
+	runLeaderElection, err := newLeaderElection(fake.NewSimpleClientset(), "replica-a", func(ctx context.Context) error {
+		if terms.Add(1) == 1 {
+			return assert.AnError
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runLeaderElection(ctx)
+	}()
+
+	assert.Eventually(t, func() bool { return terms.Load() == 2 }, 5*time.Second, 10*time.Millisecond,
+		"leadership is given up and acquired again after a failure")
+
+	cancel()
+	<-done
+}
+
+func TestPublishWebhookCertWithRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int32
+		wantPatches  int32
+		wantErrorMsg string
+	}{
+		{
+			name:        "succeeds after transient failures",
+			failures:    2,
+			wantPatches: 3,
+		},
+		{
+			name:         "gives up after the last attempt",
+			failures:     10,
+			wantPatches:  3,
+			wantErrorMsg: "failed to publish webhook certificate: ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalDelay, originalAttempts := publishRetryDelay, publishAttempts
+			defer func() { publishRetryDelay, publishAttempts = originalDelay, originalAttempts }()
+			publishRetryDelay, publishAttempts = time.Millisecond, 3
+
+			fakeClient := fake.NewSimpleClientset()
+			var patches atomic.Int32
+			fakeClient.PrependReactor("patch", "mutatingwebhookconfigurations", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if patches.Add(1) <= tt.failures {
+					return true, nil, assert.AnError
+				}
+				return true, nil, nil
+			})
+
+			err := publishWebhookCertWithRetry(context.Background(), fakeClient)
+			if tt.wantErrorMsg != "" {
+				assert.ErrorContains(t, err, tt.wantErrorMsg)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantPatches, patches.Load())
+		})
+	}
+}
+
+func TestPublishWebhookCert_ReusesExistingSecret(t *testing.T) {
+	fakeClient := fake.NewSimpleClientset()
+	fakeClient.PrependReactor("patch", "mutatingwebhookconfigurations", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+	ctx := context.Background()
+
+	require.NoError(t, publishWebhookCert(ctx, fakeClient))
+	firstCert, firstCA, err := loadWebhookCertSecret(ctx, fakeClient)
+	require.NoError(t, err)
+
+	require.NoError(t, publishWebhookCert(ctx, fakeClient))
+	secondCert, secondCA, err := loadWebhookCertSecret(ctx, fakeClient)
+	require.NoError(t, err)
+
+	assert.Equal(t, firstCert.Certificate, secondCert.Certificate)
+	assert.Equal(t, firstCA, secondCA)
+}
+
+func TestPublishWebhookCert_ReissuesOnSANChange(t *testing.T) {
+	fakeClient := fake.NewSimpleClientset()
+	fakeClient.PrependReactor("patch", "mutatingwebhookconfigurations", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+	ctx := context.Background()
+
+	originalName := conf.WebhookName
+	defer func() { conf.WebhookName = originalName }()
+
+	conf.WebhookName = "mca-webhook"
+	require.NoError(t, publishWebhookCert(ctx, fakeClient))
+	firstCert, firstCA, err := loadWebhookCertSecret(ctx, fakeClient)
+	require.NoError(t, err)
+
+	conf.WebhookName = "mca-webhook-renamed"
+	_, _, err = loadWebhookCertSecret(ctx, fakeClient)
+	require.ErrorIs(t, err, errStaleWebhookCert)
+	assert.ErrorContains(t, err, "has [mca-webhook.")
+
+	require.NoError(t, publishWebhookCert(ctx, fakeClient))
+	tlsCert, secondCA, err := loadWebhookCertSecret(ctx, fakeClient)
+	require.NoError(t, err)
+	assert.Equal(t, firstCA, secondCA, "the CA is kept, so the caBundle still trusts the old certificate")
+	assert.NoError(t, certs.VerifyChain(firstCert, secondCA))
+	assert.NotEqual(t, firstCert.Certificate, tlsCert.Certificate)
+
+	dnsNames, _, err := certs.SANs(tlsCert)
+	require.NoError(t, err)
+	assert.Equal(t, webhookDNSNames(), dnsNames)
+
+	secret, err := fakeClient.CoreV1().Secrets(conf.PodNamespace).Get(ctx, conf.WebhookCertSecret, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, webhookDNSNames()[0], secret.Annotations[webhookCertSANsAnnotation])
+}
+
+func TestPublishWebhookCert_ReissuesWithNewCAWithoutCAKey(t *testing.T) {
+	originalName := conf.WebhookName
+	defer func() { conf.WebhookName = originalName }()
+	conf.WebhookName = "mca-webhook"
+
+	tlsCert, caCertPEM, err := certs.GenerateCAAndTLSCert([]string{"old-name.default.svc"}, nil)
+	require.NoError(t, err)
+	certPEM, keyPEM, err := certs.EncodeTLSCertPEM(tlsCert)
+	require.NoError(t, err)
+	fakeClient := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: conf.WebhookCertSecret, Namespace: conf.PodNamespace},
+		Data: map[string][]byte{
+			corev1.TLSCertKey:              certPEM,
+			corev1.TLSPrivateKeyKey:        keyPEM,
+			corev1.ServiceAccountRootCAKey: caCertPEM,
+		},
+	})
+	fakeClient.PrependReactor("patch", "mutatingwebhookconfigurations", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+	ctx := context.Background()
+
+	require.NoError(t, publishWebhookCert(ctx, fakeClient))
+	_, newCACertPEM, err := loadWebhookCertSecret(ctx, fakeClient)
+	require.NoError(t, err)
+	assert.NotEqual(t, caCertPEM, newCACertPEM)
+
+	secret, err := fakeClient.CoreV1().Secrets(conf.PodNamespace).Get(ctx, conf.WebhookCertSecret, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, secret.Data[webhookCAKeyKey], "later reissues keep the new CA")
+}
+
+func TestLoadWebhookCertSecret_SANsWithoutAnnotation(t *testing.T) {
+	originalName := conf.WebhookName
+	defer func() { conf.WebhookName = originalName }()
+	conf.WebhookName = "mca-webhook"
+
+	tlsCert, caCertPEM, err := certs.GenerateCAAndTLSCert(webhookDNSNames(), nil)
+	require.NoError(t, err)
+	certPEM, keyPEM, err := certs.EncodeTLSCertPEM(tlsCert)
+	require.NoError(t, err)
+	fakeClient := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: conf.WebhookCertSecret, Namespace: conf.PodNamespace},
+		Data: map[string][]byte{
+			corev1.TLSCertKey:              certPEM,
+			corev1.TLSPrivateKeyKey:        keyPEM,
+			corev1.ServiceAccountRootCAKey: caCertPEM,
+		},
+	})
+	ctx := context.Background()
+
+	_, _, err = loadWebhookCertSecret(ctx, fakeClient)
+	require.NoError(t, err, "the SANs are read from the certificate")
+
+	conf.WebhookName = "mca-webhook-renamed"
+	_, _, err = loadWebhookCertSecret(ctx, fakeClient)
+	assert.ErrorIs(t, err, errStaleWebhookCert)
+}
+
+func TestLoadWebhookCertSecret_NotFound(t *testing.T) {
+	fakeClient := fake.NewSimpleClientset()
+
+	_, _, err := loadWebhookCertSecret(context.Background(), fakeClient)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), conf.WebhookCertSecret)
+}
+
+func TestLoadWebhookCertSecret_VerifiesChain(t *testing.T) {
+	tlsCert, _, err := certs.GenerateCAAndTLSCert(webhookDNSNames(), nil)
+	require.NoError(t, err)
+	_, otherCACertPEM, err := certs.GenerateCAAndTLSCert(webhookDNSNames(), nil)
+	require.NoError(t, err)
+	certPEM, keyPEM, err := certs.EncodeTLSCertPEM(tlsCert)
+	require.NoError(t, err)
+
+	fakeClient := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: conf.WebhookCertSecret, Namespace: conf.PodNamespace},
+		Data: map[string][]byte{
+			corev1.TLSCertKey:              certPEM,
+			corev1.TLSPrivateKeyKey:        keyPEM,
+			corev1.ServiceAccountRootCAKey: otherCACertPEM,
+		},
+	})
+
+	_, _, err = loadWebhookCertSecret(context.Background(), fakeClient)
+	assert.ErrorContains(t, err, "is invalid: failed to verify certificate chain: ")
+	assert.ErrorContains(t, err, "does not chain to the CA")
+
+	originalVerify := conf.VerifyCertChain
+	conf.VerifyCertChain = false
+	defer func() { conf.VerifyCertChain = originalVerify }()
+
+	_, _, err = loadWebhookCertSecret(context.Background(), fakeClient)
+	assert.NoError(t, err)
+}
@@ -3,11 +3,20 @@
 package serve
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net"
+	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"path"
+	"slices"
+	"time"
 
 	"github.com/marxus/k8s-mca/conf"
 	"github.com/marxus/k8s-mca/pkg/certs"
@@ -23,86 +32,324 @@ import (
 // Returns an error if certificate generation fails, file writing fails,
 // reverse proxy creation fails, or server startup fails.
 func StartProxy() error {
+	log.SetPrefix(logPrefix())
 	log.Println("Starting MCA Proxy...")
 
-	tlsCert, caCertPEM, err := certs.GenerateCAAndTLSCert([]string{"localhost"}, []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback})
+	server, err := newProxyServer()
 	if err != nil {
-		return fmt.Errorf("failed to generate certificates: %w", err)
+		return err
 	}
+	log.Println("Starting proxy server...")
 
-	if err := writeCACertificate(caCertPEM); err != nil {
-		return err
+	svc := proxyService(server)
+	if err := serveUntilSignal(svc.start, svc.shutdown, svc.timeout); err != nil {
+		return serveError("proxy", conf.ProxyListenAddress, err)
 	}
+	return nil
+}
 
-	if err := writeNamespaceFile(); err != nil {
-		return err
+// newProxyServer prepares everything the proxy needs and returns the server ready to start.
+// Each step's error names the step, so a startup failure identifies what went wrong.
+func newProxyServer() (*proxy.Server, error) {
+	// The method policy restricts what workloads may do, so an invalid one must not be dropped.
+	if conf.ProxyMethodPolicyErr != nil {
+		return nil, fmt.Errorf("failed to load proxy method policy: %w", conf.ProxyMethodPolicyErr)
+	}
+	if conf.UnknownClusterPolicy != conf.UnknownClusterStrict && conf.UnknownClusterPolicy != conf.UnknownClusterFallback {
+		return nil, fmt.Errorf("invalid unknown cluster policy %q, must be %s or %s",
+			conf.UnknownClusterPolicy, conf.UnknownClusterStrict, conf.UnknownClusterFallback)
 	}
 
-	if err := writeTokenFile(); err != nil {
-		return err
+	dnsNames, ipAddresses := proxySANs()
+	tlsCert, caCertPEM, err := generateCAAndTLSCert(dnsNames, ipAddresses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate proxy certificates: %w", err)
+	}
+	if err := verifyCertChain(tlsCert, caCertPEM); err != nil {
+		return nil, err
 	}
+	logCertSANs(tlsCert)
 
-	reverseProxies, err := buildReverseProxies()
+	if err := writeServiceAccountFiles(caCertPEM); err != nil {
+		return nil, fmt.Errorf("failed to write service account files: %w", err)
+	}
+
+	configs, err := clusterConfigs()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to build reverse proxies: %w", err)
+	}
+	reverseProxies, err := reverseProxiesFor(configs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build reverse proxies: %w", err)
+	}
+
+	clientset, err := buildKubernetesClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build Kubernetes client: %w", err)
+	}
+	if conf.ProxyRBACPreflight {
+		if err := logRBACSummary(context.Background(), clientset); err != nil {
+			log.Printf("Warning: %v", err)
+		}
 	}
 
 	server := proxy.NewServer(tlsCert, reverseProxies)
-	log.Println("Starting proxy server...")
+	server.SetUpstreamCheck(upstreamCheck(clientset))
+	if conf.ProxyClientCAPath != "" {
+		clientCAs, clusters, err := clientCertRouting(configs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up client certificate routing: %w", err)
+		}
+		server.SetClientCertClusters(clientCAs, clusters)
+	}
+	return server, nil
+}
+
+func logCertSANs(tlsCert tls.Certificate) {
+	dnsNames, ipAddresses, err := certs.SANs(tlsCert)
+	if err != nil {
+		log.Printf("Warning: failed to read certificate SANs: %v", err)
+		return
+	}
+	log.Printf("Serving certificate SANs: DNS=%v IP=%v", dnsNames, ipAddresses)
+}
 
-	return server.Start()
+func logPrefix() string {
+	if conf.PodName == "" {
+		return ""
+	}
+	return fmt.Sprintf("[%s/%s] ", conf.PodNamespace, conf.PodName)
 }
 
+func proxySANs() ([]string, []net.IP) {
+	dnsNames := []string{"localhost"}
+	ipAddresses := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+	for _, san := range conf.ProxyExtraSANs {
+		if ip := net.ParseIP(san); ip != nil {
+			ipAddresses = append(ipAddresses, ip)
+		} else {
+			dnsNames = append(dnsNames, san)
+		}
+	}
+
+	return dnsNames, ipAddresses
+}
+
+// buildReverseProxies returns the reverse proxies of the in-cluster API server and of each
+// cluster in conf.Clusters, keyed by cluster name.
 func buildReverseProxies() (map[string]*httputil.ReverseProxy, error) {
+	configs, err := clusterConfigs()
+	if err != nil {
+		return nil, err
+	}
+	return reverseProxiesFor(configs)
+}
+
+func reverseProxiesFor(configs map[string]*rest.Config) (map[string]*httputil.ReverseProxy, error) {
+	reverseProxies := map[string]*httputil.ReverseProxy{}
+	for _, name := range slices.Sorted(maps.Keys(configs)) {
+		config := configs[name]
+		reverseProxy, err := newReverseProxy(config)
+		if err != nil {
+			if name == "in-cluster" {
+				return nil, err
+			}
+			return nil, fmt.Errorf("invalid cluster %q: %w", name, err)
+		}
+		reverseProxies[name] = reverseProxy
+		if name != "in-cluster" {
+			log.Printf("Routing cluster %s to %s", name, config.Host)
+		}
+	}
+
+	return reverseProxies, nil
+}
+
+// clusterConfigs returns the client configs of the in-cluster API server and of each cluster
+// in conf.Clusters, keyed by cluster name. An invalid MCA_CLUSTERS is an error rather than
+// dropping the clusters. Each cluster gets its own transport, so more than conf.MaxClusters
+// clusters are refused when it is positive.
+func clusterConfigs() (map[string]*rest.Config, error) {
+	if conf.ClustersErr != nil {
+		return nil, conf.ClustersErr
+	}
+	if conf.MaxClusters > 0 && len(conf.Clusters) > conf.MaxClusters {
+		return nil, fmt.Errorf("%d clusters are configured, more than the maximum of %d", len(conf.Clusters), conf.MaxClusters)
+	}
+
 	config, err := conf.InClusterConfig()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get in-cluster config: %w", err)
 	}
 
+	configs := map[string]*rest.Config{"in-cluster": config}
+	for _, name := range slices.Sorted(maps.Keys(conf.Clusters)) {
+		configs[name], err = clusterConfig(name, conf.Clusters[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return configs, nil
+}
+
+// clusterConfig validates a conf.Clusters entry and returns its client config.
+func clusterConfig(name string, cluster conf.Cluster) (*rest.Config, error) {
+	if name == "" || name == "in-cluster" {
+		return nil, fmt.Errorf("invalid cluster name %q", name)
+	}
+	if cluster.Host == "" {
+		return nil, fmt.Errorf("invalid cluster %q: host is required", name)
+	}
+	hostURL, err := url.Parse(cluster.Host)
+	if err != nil || hostURL.Host == "" || (hostURL.Scheme != "https" && hostURL.Scheme != "http") {
+		return nil, fmt.Errorf("invalid cluster %q: host %q is not an http(s) URL", name, cluster.Host)
+	}
+
+	return &rest.Config{
+		Host:            cluster.Host,
+		BearerTokenFile: cluster.TokenPath,
+		TLSClientConfig: rest.TLSClientConfig{CAFile: cluster.CAPath},
+	}, nil
+}
+
+func newReverseProxy(config *rest.Config) (*httputil.ReverseProxy, error) {
 	apiURL, err := url.Parse(config.Host)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse API URL: %w", err)
 	}
 
-	transport, err := rest.TransportFor(config)
+	baseTransport, err := newUpstreamTransport(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create transport: %w", err)
 	}
+	reconnectTransport := proxy.NewReconnectTransport(baseTransport, conf.UpstreamReconnectAttempts, conf.UpstreamReconnectWait)
+
+	transport, err := rest.HTTPWrappersForConfig(config, reconnectTransport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transport: %w", err)
+	}
+
+	return proxy.NewReverseProxy(apiURL, proxy.NewRetryTransport(transport, conf.UpstreamMaxRetries, conf.UpstreamRetryMaxWait)), nil
+}
 
-	reverseProxy := httputil.NewSingleHostReverseProxy(apiURL)
-	reverseProxy.Transport = transport
+// newUpstreamTransport returns the transport to the API server with the dial and TLS
+// handshake timeouts from conf, in place of the client-go defaults.
+func newUpstreamTransport(config *rest.Config) (*http.Transport, error) {
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
 
-	return map[string]*httputil.ReverseProxy{
-		"in-cluster": reverseProxy,
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         upstreamDialer().DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: conf.UpstreamTLSHandshakeTimeout,
+		MaxIdleConnsPerHost: 25,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   true,
 	}, nil
 }
 
-func writeCACertificate(caCertPEM []byte) error {
-	mcaCACertPath := "/var/run/secrets/kubernetes.io/mca-serviceaccount/ca.crt"
-	if err := afero.WriteFile(conf.FS, mcaCACertPath, caCertPEM, 0644); err != nil {
-		return fmt.Errorf("failed to write CA certificate: %w", err)
+func upstreamDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   conf.UpstreamDialTimeout,
+		KeepAlive: 30 * time.Second,
 	}
+}
 
-	log.Printf("CA certificate saved to: %s", mcaCACertPath)
-	return nil
+// writeFileWithMode writes data to path and sets its mode, since afero.WriteFile only applies
+// the mode when creating the file and is subject to the process umask.
+func writeFileWithMode(path string, data []byte, mode os.FileMode) error {
+	if err := afero.WriteFile(conf.FS, path, data, mode); err != nil {
+		return err
+	}
+	return conf.FS.Chmod(path, mode)
 }
 
-func writeNamespaceFile() error {
-	mcaNamespacePath := "/var/run/secrets/kubernetes.io/mca-serviceaccount/namespace"
-	if err := afero.WriteFile(conf.FS, mcaNamespacePath, []byte(conf.PodNamespace), 0644); err != nil {
-		return fmt.Errorf("failed to write namespace file: %w", err)
+// writeFileWithRetry calls writeFileWithMode up to conf.SAFileWriteAttempts times, doubling
+// conf.SAFileWriteBackoff between attempts, to ride out a freshly mounted emptyDir that is
+// not writable yet.
+func writeFileWithRetry(path string, data []byte, mode os.FileMode) error {
+	attempts := max(conf.SAFileWriteAttempts, 1)
+	wait := conf.SAFileWriteBackoff
+	for attempt := 1; ; attempt++ {
+		err := writeFileWithMode(path, data, mode)
+		if err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			return fmt.Errorf("gave up after %d attempts: %w", attempts, err)
+		}
+		log.Printf("Warning: failed to write %s, retrying in %s: %v", path, wait, err)
+		time.Sleep(wait)
+		wait *= 2
 	}
+}
 
-	log.Printf("Namespace file copied to: %s", mcaNamespacePath)
-	return nil
+// mcaServiceAccountDir is where the proxy writes the service account files mounted into
+// injected containers.
+const mcaServiceAccountDir = "/var/run/secrets/kubernetes.io/mca-serviceaccount"
+
+// serviceAccountFile is a file of the service account directory served by the proxy.
+type serviceAccountFile struct {
+	name        string
+	description string
+	data        []byte
+	mode        os.FileMode
 }
 
-func writeTokenFile() error {
-	mcaTokenPath := "/var/run/secrets/kubernetes.io/mca-serviceaccount/token"
-	if err := afero.WriteFile(conf.FS, mcaTokenPath, []byte("-"), 0644); err != nil {
-		return fmt.Errorf("failed to write token file: %w", err)
+func serviceAccountFiles(caCertPEM []byte) []serviceAccountFile {
+	return []serviceAccountFile{
+		{name: "ca.crt", description: "CA certificate", data: caCertPEM, mode: conf.CACertFileMode},
+		{name: "namespace", description: "namespace file", data: []byte(conf.PodNamespace), mode: conf.NamespaceFileMode},
+		{name: "token", description: "placeholder token file", data: []byte("-"), mode: conf.TokenFileMode},
+	}
+}
+
+func writeServiceAccountFiles(caCertPEM []byte) error {
+	return writeFilesAllOrNothing(mcaServiceAccountDir, serviceAccountFiles(caCertPEM))
+}
+
+// writeFilesAllOrNothing writes files into dir, staging each next to its target first and only
+// replacing the targets once every file was staged, so a failure to write any file leaves the
+// existing files in place. The errors of all files are joined. Replacing is one rename per
+// file and not atomic as a whole: when a rename fails, the files before it are already
+// replaced, the rest are left as they were, and the error names the replaced ones.
+func writeFilesAllOrNothing(dir string, files []serviceAccountFile) error {
+	var errs []error
+	staged := make([]string, len(files))
+	for i, file := range files {
+		stagingPath := path.Join(dir, "."+file.name+".tmp")
+		if err := writeFileWithRetry(stagingPath, file.data, file.mode); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write %s: %w", file.description, err))
+			continue
+		}
+		staged[i] = stagingPath
+	}
+
+	if len(errs) > 0 {
+		for _, stagingPath := range staged {
+			if stagingPath != "" {
+				conf.FS.Remove(stagingPath)
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	var replaced []string
+	for i, file := range files {
+		filePath := path.Join(dir, file.name)
+		if err := conf.FS.Rename(staged[i], filePath); err != nil {
+			for _, stagingPath := range staged[i:] {
+				conf.FS.Remove(stagingPath)
+			}
+			return fmt.Errorf("failed to replace %s, after replacing %v: %w", file.description, replaced, err)
+		}
+		replaced = append(replaced, file.name)
+		log.Printf("Wrote %s to: %s", file.description, filePath)
 	}
 
-	log.Printf("Placeholder token file created at: %s", mcaTokenPath)
 	return nil
 }
@@ -2,44 +2,411 @@
 package serve
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
 )
 
-func TestWriteCACertificate(t *testing.T) {
-	defer conf.FS.Remove("/var/run/secrets/kubernetes.io/mca-serviceaccount/ca.crt")
+func TestWriteServiceAccountFiles(t *testing.T) {
+	dir := "/var/run/secrets/kubernetes.io/mca-serviceaccount"
+	defer conf.FS.Remove(dir + "/ca.crt")
+	defer conf.FS.Remove(dir + "/namespace")
+	defer conf.FS.Remove(dir + "/token")
 
 	caCertPEM := []byte("-----BEGIN CERTIFICATE-----\ntest\n-----END CERTIFICATE-----")
-	err := writeCACertificate(caCertPEM)
-	require.NoError(t, err)
+	require.NoError(t, writeServiceAccountFiles(caCertPEM))
+
+	for file, want := range map[string][]byte{"ca.crt": caCertPEM, "namespace": []byte("default"), "token": []byte("-")} {
+		content, err := afero.ReadFile(conf.FS, dir+"/"+file)
+		require.NoError(t, err)
+		assert.Equal(t, want, content, file)
+	}
 
-	content, err := afero.ReadFile(conf.FS, "/var/run/secrets/kubernetes.io/mca-serviceaccount/ca.crt")
+	entries, err := afero.ReadDir(conf.FS, dir)
 	require.NoError(t, err)
-	assert.Equal(t, caCertPEM, content)
+	assert.Len(t, entries, 3, "no staging files are left behind")
 }
 
-func TestWriteNamespaceFile(t *testing.T) {
+func TestProxySANs(t *testing.T) {
+	tests := []struct {
+		name            string
+		extraSANs       []string
+		wantDNSNames    []string
+		wantIPAddresses []net.IP
+	}{
+		{
+			name:            "defaults to loopback",
+			wantDNSNames:    []string{"localhost"},
+			wantIPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		},
+		{
+			name:            "adds extra DNS names and IPs",
+			extraSANs:       []string{"kubernetes.default.svc", "10.0.0.1"},
+			wantDNSNames:    []string{"localhost", "kubernetes.default.svc"},
+			wantIPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback, net.ParseIP("10.0.0.1")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalSANs := conf.ProxyExtraSANs
+			conf.ProxyExtraSANs = tt.extraSANs
+			defer func() { conf.ProxyExtraSANs = originalSANs }()
+
+			dnsNames, ipAddresses := proxySANs()
+			tlsCert, _, err := certs.GenerateCAAndTLSCert(dnsNames, ipAddresses)
+			require.NoError(t, err)
+
+			serverCert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.wantDNSNames, serverCert.DNSNames)
+			require.Len(t, serverCert.IPAddresses, len(tt.wantIPAddresses))
+			for i, want := range tt.wantIPAddresses {
+				assert.True(t, serverCert.IPAddresses[i].Equal(want), "got %s, want %s", serverCert.IPAddresses[i], want)
+			}
+		})
+	}
+}
+
+func TestLogPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		podName    string
+		wantPrefix string
+	}{
+		{
+			name:       "includes pod namespace and name",
+			podName:    "app-7d9f",
+			wantPrefix: "[default/app-7d9f] ",
+		},
+		{
+			name:       "empty without pod name",
+			wantPrefix: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalPodName := conf.PodName
+			conf.PodName = tt.podName
+			defer func() { conf.PodName = originalPodName }()
+
+			assert.Equal(t, tt.wantPrefix, logPrefix())
+		})
+	}
+}
+
+func TestWriteServiceAccountFiles_FileModes(t *testing.T) {
+	tests := []struct {
+		name string
+		mode os.FileMode
+	}{
+		{name: "default mode", mode: 0644},
+		{name: "read-only for all", mode: 0444},
+		{name: "read-only for owner", mode: 0400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalCAMode, originalNamespaceMode, originalTokenMode := conf.CACertFileMode, conf.NamespaceFileMode, conf.TokenFileMode
+			conf.CACertFileMode, conf.NamespaceFileMode, conf.TokenFileMode = tt.mode, tt.mode, tt.mode
+			defer func() {
+				conf.CACertFileMode, conf.NamespaceFileMode, conf.TokenFileMode = originalCAMode, originalNamespaceMode, originalTokenMode
+			}()
+
+			dir := "/var/run/secrets/kubernetes.io/mca-serviceaccount"
+			defer conf.FS.Remove(dir + "/ca.crt")
+			defer conf.FS.Remove(dir + "/namespace")
+			defer conf.FS.Remove(dir + "/token")
+
+			require.NoError(t, writeServiceAccountFiles([]byte("ca")))
+
+			for _, file := range []string{"ca.crt", "namespace", "token"} {
+				info, err := conf.FS.Stat(dir + "/" + file)
+				require.NoError(t, err)
+				assert.Equal(t, tt.mode, info.Mode().Perm(), file)
+			}
+		})
+	}
+}
+
+func TestWriteServiceAccountFiles_AppliesModeToExistingFile(t *testing.T) {
+	originalMode := conf.CACertFileMode
+	conf.CACertFileMode = 0444
+	defer func() { conf.CACertFileMode = originalMode }()
+
+	path := "/var/run/secrets/kubernetes.io/mca-serviceaccount/ca.crt"
+	defer conf.FS.Remove(path)
 	defer conf.FS.Remove("/var/run/secrets/kubernetes.io/mca-serviceaccount/namespace")
+	defer conf.FS.Remove("/var/run/secrets/kubernetes.io/mca-serviceaccount/token")
+	require.NoError(t, afero.WriteFile(conf.FS, path, []byte("old"), 0644))
+
+	require.NoError(t, writeServiceAccountFiles([]byte("new")))
+
+	info, err := conf.FS.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0444), info.Mode().Perm())
+}
+
+func TestNewUpstreamTransport_Timeouts(t *testing.T) {
+	originalDial, originalHandshake := conf.UpstreamDialTimeout, conf.UpstreamTLSHandshakeTimeout
+	conf.UpstreamDialTimeout, conf.UpstreamTLSHandshakeTimeout = 3*time.Second, 200*time.Millisecond
+	defer func() { conf.UpstreamDialTimeout, conf.UpstreamTLSHandshakeTimeout = originalDial, originalHandshake }()
 
-	err := writeNamespaceFile()
+	assert.Equal(t, 3*time.Second, upstreamDialer().Timeout)
+
+	transport, err := newUpstreamTransport(&rest.Config{Host: "https://127.0.0.1"})
+	require.NoError(t, err)
+	assert.Equal(t, 200*time.Millisecond, transport.TLSHandshakeTimeout)
+
+	// The upstream accepts connections but never completes a TLS handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
 
-	content, err := afero.ReadFile(conf.FS, "/var/run/secrets/kubernetes.io/mca-serviceaccount/namespace")
+	req, err := http.NewRequest(http.MethodGet, "https://"+listener.Addr().String()+"/version", nil)
 	require.NoError(t, err)
-	assert.Equal(t, []byte("default"), content)
+
+	start := time.Now()
+	_, err = transport.RoundTrip(req)
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
 }
 
-func TestWriteTokenFile(t *testing.T) {
-	defer conf.FS.Remove("/var/run/secrets/kubernetes.io/mca-serviceaccount/token")
+func TestNewProxyServer_StepErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		policyErr     error
+		clusterPolicy string
+		keyUsage      []string
+		clustersErr   error
+		configErr     error
+		wantPrefix    string
+	}{
+		{
+			name:       "method policy",
+			policyErr:  assert.AnError,
+			wantPrefix: "failed to load proxy method policy: ",
+		},
+		{
+			name:          "unknown cluster policy",
+			clusterPolicy: "warnn",
+			wantPrefix:    `invalid unknown cluster policy "warnn", must be strict or fallback`,
+		},
+		{
+			name:       "certificate generation",
+			keyUsage:   []string{"bogus"},
+			wantPrefix: "failed to generate proxy certificates: ",
+		},
+		{
+			name:        "clusters",
+			clustersErr: errors.New(`invalid MCA_CLUSTERS "{": unexpected end of JSON input`),
+			wantPrefix:  `failed to build reverse proxies: invalid MCA_CLUSTERS "{"`,
+		},
+		{
+			name:       "reverse proxies",
+			configErr:  assert.AnError,
+			wantPrefix: "failed to build reverse proxies: failed to get in-cluster config: ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalPolicyErr, originalKeyUsage, originalConfig := conf.ProxyMethodPolicyErr, conf.CAKeyUsage, conf.InClusterConfig
+			originalClustersErr, originalClusterPolicy := conf.ClustersErr, conf.UnknownClusterPolicy
+			defer func() {
+				conf.ProxyMethodPolicyErr, conf.CAKeyUsage, conf.InClusterConfig = originalPolicyErr, originalKeyUsage, originalConfig
+				conf.ClustersErr, conf.UnknownClusterPolicy = originalClustersErr, originalClusterPolicy
+			}()
+
+			conf.ProxyMethodPolicyErr = tt.policyErr
+			if tt.clusterPolicy != "" {
+				conf.UnknownClusterPolicy = tt.clusterPolicy
+			}
+			conf.ClustersErr = tt.clustersErr
+			conf.CAKeyUsage = tt.keyUsage
+			conf.InClusterConfig = func() (*rest.Config, error) {
+				return &rest.Config{Host: "https://127.0.0.1:1"}, tt.configErr
+			}
 
-	err := writeTokenFile()
+			_, err := newProxyServer()
+			require.Error(t, err)
+			assert.True(t, strings.HasPrefix(err.Error(), tt.wantPrefix), err.Error())
+		})
+	}
+}
+
+func TestStartProxy_ServeError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
+	defer listener.Close()
+
+	originalAddress, originalConfig := conf.ProxyListenAddress, conf.InClusterConfig
+	defer func() { conf.ProxyListenAddress, conf.InClusterConfig = originalAddress, originalConfig }()
+	conf.ProxyListenAddress = listener.Addr().String()
+	conf.InClusterConfig = func() (*rest.Config, error) {
+		return &rest.Config{Host: "https://127.0.0.1:1"}, nil
+	}
+
+	err = StartProxy()
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "failed to serve proxy: "), err.Error())
+	assert.Contains(t, err.Error(), "is another process listening on "+listener.Addr().String())
+}
+
+func TestBuildReverseProxies_Clusters(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", name)
+			w.Header().Set("X-Authorization", r.Header.Get("Authorization"))
+		}))
+		t.Cleanup(backend.Close)
+		return backend
+	}
+	inCluster, staging, production := newBackend("in-cluster"), newBackend("staging"), newBackend("production")
 
-	content, err := afero.ReadFile(conf.FS, "/var/run/secrets/kubernetes.io/mca-serviceaccount/token")
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("staging-token"), 0600))
+
+	originalClusters, originalConfig := conf.Clusters, conf.InClusterConfig
+	defer func() { conf.Clusters, conf.InClusterConfig = originalClusters, originalConfig }()
+	conf.InClusterConfig = func() (*rest.Config, error) { return &rest.Config{Host: inCluster.URL}, nil }
+	clustersJSON := fmt.Sprintf(`{"staging": {"host": %q, "tokenPath": %q}, "production": {"host": %q}}`,
+		staging.URL, tokenPath, production.URL)
+	require.NoError(t, json.Unmarshal([]byte(clustersJSON), &conf.Clusters))
+
+	reverseProxies, err := buildReverseProxies()
 	require.NoError(t, err)
-	assert.Equal(t, []byte("-"), content)
+	require.Len(t, reverseProxies, 3)
+
+	for name, wantAuthorization := range map[string]string{"in-cluster": "", "staging": "Bearer staging-token", "production": ""} {
+		recorder := httptest.NewRecorder()
+		reverseProxies[name].ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+		assert.Equal(t, name, recorder.Header().Get("X-Backend"), name)
+		assert.Equal(t, wantAuthorization, recorder.Header().Get("X-Authorization"), name)
+	}
+}
+
+func TestBuildReverseProxies_InvalidClusters(t *testing.T) {
+	tests := []struct {
+		name     string
+		clusters map[string]conf.Cluster
+		wantErr  string
+	}{
+		{
+			name:     "missing host",
+			clusters: map[string]conf.Cluster{"staging": {TokenPath: "/token"}},
+			wantErr:  `invalid cluster "staging": host is required`,
+		},
+		{
+			name:     "host without scheme",
+			clusters: map[string]conf.Cluster{"staging": {Host: "10.0.0.1:6443"}},
+			wantErr:  `invalid cluster "staging": host "10.0.0.1:6443" is not an http(s) URL`,
+		},
+		{
+			name:     "reserved name",
+			clusters: map[string]conf.Cluster{"in-cluster": {Host: "https://10.0.0.1"}},
+			wantErr:  `invalid cluster name "in-cluster"`,
+		},
+		{
+			name:     "missing CA file",
+			clusters: map[string]conf.Cluster{"staging": {Host: "https://10.0.0.1", CAPath: "/does/not/exist"}},
+			wantErr:  `invalid cluster "staging": failed to create transport: `,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalClusters, originalConfig := conf.Clusters, conf.InClusterConfig
+			defer func() { conf.Clusters, conf.InClusterConfig = originalClusters, originalConfig }()
+			conf.InClusterConfig = func() (*rest.Config, error) { return &rest.Config{Host: "https://127.0.0.1"}, nil }
+			conf.Clusters = tt.clusters
+
+			_, err := buildReverseProxies()
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestClusterConfigs_MaxClusters(t *testing.T) {
+	clusters := func(n int) map[string]conf.Cluster {
+		clusters := map[string]conf.Cluster{}
+		for i := range n {
+			clusters[fmt.Sprintf("cluster-%d", i)] = conf.Cluster{Host: fmt.Sprintf("https://10.0.0.%d", i+1)}
+		}
+		return clusters
+	}
+
+	tests := []struct {
+		name        string
+		maxClusters int
+		clusters    map[string]conf.Cluster
+		wantErr     string
+	}{
+		{
+			name:        "under the limit",
+			maxClusters: 3,
+			clusters:    clusters(2),
+		},
+		{
+			name:        "at the limit",
+			maxClusters: 3,
+			clusters:    clusters(3),
+		},
+		{
+			name:        "over the limit",
+			maxClusters: 3,
+			clusters:    clusters(4),
+			wantErr:     "4 clusters are configured, more than the maximum of 3",
+		},
+		{
+			name:     "unlimited",
+			clusters: clusters(150),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalClusters, originalConfig, originalMax := conf.Clusters, conf.InClusterConfig, conf.MaxClusters
+			defer func() {
+				conf.Clusters, conf.InClusterConfig, conf.MaxClusters = originalClusters, originalConfig, originalMax
+			}()
+			conf.InClusterConfig = func() (*rest.Config, error) { return &rest.Config{Host: "https://127.0.0.1"}, nil }
+			conf.Clusters, conf.MaxClusters = tt.clusters, tt.maxClusters
+
+			configs, err := clusterConfigs()
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, configs, len(tt.clusters)+1, "the in-cluster API server is not counted")
+		})
+	}
 }
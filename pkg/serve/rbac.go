@@ -0,0 +1,63 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/marxus/k8s-mca/conf"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// logRBACSummary logs the permissions the proxy's service account has in its namespace, as
+// reported by a SelfSubjectRulesReview, and warns when they look empty. Requests through the
+// proxy are authorized as this service account, so missing permissions surface as 403s.
+func logRBACSummary(ctx context.Context, clientset kubernetes.Interface) error {
+	review, err := clientset.AuthorizationV1().SelfSubjectRulesReviews().Create(ctx, &authorizationv1.SelfSubjectRulesReview{
+		Spec: authorizationv1.SelfSubjectRulesReviewSpec{Namespace: conf.PodNamespace},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to review proxy service account permissions: %w", err)
+	}
+
+	status := review.Status
+	log.Printf("Proxy service account permissions in namespace %s:", conf.PodNamespace)
+	for _, rule := range status.ResourceRules {
+		log.Printf("  %s", describeResourceRule(rule))
+	}
+	for _, rule := range status.NonResourceRules {
+		log.Printf("  %s %s", strings.Join(rule.Verbs, ","), strings.Join(rule.NonResourceURLs, ","))
+	}
+
+	if status.Incomplete {
+		log.Printf("Warning: proxy service account permissions may be incomplete: %s", status.EvaluationError)
+	}
+	if len(status.ResourceRules) == 0 {
+		log.Printf("Warning: proxy service account has no permissions on resources in namespace %s, "+
+			"requests through the proxy will be forbidden", conf.PodNamespace)
+	}
+	return nil
+}
+
+// describeResourceRule returns a rule as its verbs and resources, e.g.
+// "get,list pods,deployments.apps [web]".
+func describeResourceRule(rule authorizationv1.ResourceRule) string {
+	var resources []string
+	for _, group := range rule.APIGroups {
+		for _, resource := range rule.Resources {
+			if group != "" {
+				resource += "." + group
+			}
+			resources = append(resources, resource)
+		}
+	}
+
+	description := fmt.Sprintf("%s %s", strings.Join(rule.Verbs, ","), strings.Join(resources, ","))
+	if len(rule.ResourceNames) > 0 {
+		description += fmt.Sprintf(" [%s]", strings.Join(rule.ResourceNames, ","))
+	}
+	return description
+}
@@ -0,0 +1,100 @@
+// Proxy service account RBAC preflight tests.
+package serve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestLogRBACSummary(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      authorizationv1.SubjectRulesReviewStatus
+		reviewErr   error
+		wantErr     string
+		wantLogs    []string
+		notWantLogs []string
+	}{
+		{
+			name: "logs the rules",
+			status: authorizationv1.SubjectRulesReviewStatus{
+				ResourceRules: []authorizationv1.ResourceRule{
+					{Verbs: []string{"get", "list"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+					{Verbs: []string{"get"}, APIGroups: []string{"apps"}, Resources: []string{"deployments"}, ResourceNames: []string{"web"}},
+				},
+				NonResourceRules: []authorizationv1.NonResourceRule{
+					{Verbs: []string{"get"}, NonResourceURLs: []string{"/healthz"}},
+				},
+			},
+			wantLogs:    []string{"  get,list pods\n", "  get deployments.apps [web]\n", "  get /healthz\n"},
+			notWantLogs: []string{"Warning"},
+		},
+		{
+			name: "warns about empty permissions",
+			status: authorizationv1.SubjectRulesReviewStatus{
+				NonResourceRules: []authorizationv1.NonResourceRule{
+					{Verbs: []string{"get"}, NonResourceURLs: []string{"/api", "/version"}},
+				},
+			},
+			wantLogs: []string{"Warning: proxy service account has no permissions on resources in namespace"},
+		},
+		{
+			name: "warns about incomplete rules",
+			status: authorizationv1.SubjectRulesReviewStatus{
+				ResourceRules:   []authorizationv1.ResourceRule{{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}}},
+				Incomplete:      true,
+				EvaluationError: "webhook authorizer does not support rules",
+			},
+			wantLogs: []string{"  * *.*\n", "Warning: proxy service account permissions may be incomplete: webhook authorizer does not support rules"},
+		},
+		{
+			name:      "review fails",
+			reviewErr: errors.New("forbidden"),
+			wantErr:   "failed to review proxy service account permissions: forbidden",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeClient := fake.NewSimpleClientset()
+			fakeClient.PrependReactor("create", "selfsubjectrulesreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if tt.reviewErr != nil {
+					return true, nil, tt.reviewErr
+				}
+				review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectRulesReview)
+				review.Status = tt.status
+				return true, review, nil
+			})
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			err := logRBACSummary(context.Background(), fakeClient)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Contains(t, logs.String(), "Proxy service account permissions in namespace")
+			for _, want := range tt.wantLogs {
+				assert.Contains(t, logs.String(), want)
+			}
+			for _, notWant := range tt.notWantLogs {
+				assert.NotContains(t, logs.String(), notWant)
+			}
+		})
+	}
+}
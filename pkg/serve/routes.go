@@ -0,0 +1,73 @@
+package serve
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"text/tabwriter"
+
+	"k8s.io/client-go/rest"
+)
+
+// PrintRoutes writes the proxy's routing table to w: each cluster name with its upstream
+// host, how requests to it are authenticated and the CA it is verified with. Credentials are
+// never printed, only the files they are read from.
+//
+// Returns an error if the cluster configs are invalid or writing fails.
+func PrintRoutes(w io.Writer) error {
+	configs, err := clusterConfigs()
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "CLUSTER\tHOST\tAUTH\tCA")
+	for _, name := range slices.Sorted(maps.Keys(configs)) {
+		config := configs[name]
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", name, redactHost(config.Host), describeAuth(config), describeCA(config))
+	}
+	return table.Flush()
+}
+
+// redactHost hides any password in a host URL.
+func redactHost(host string) string {
+	hostURL, err := url.Parse(host)
+	if err != nil {
+		return "<invalid>"
+	}
+	return hostURL.Redacted()
+}
+
+func describeAuth(config *rest.Config) string {
+	switch {
+	case config.BearerTokenFile != "":
+		return "token file " + config.BearerTokenFile
+	case config.BearerToken != "":
+		return "token <redacted>"
+	case config.CertFile != "":
+		return "client certificate " + config.CertFile
+	case len(config.CertData) > 0:
+		return "client certificate <redacted>"
+	case config.ExecProvider != nil:
+		return "exec " + config.ExecProvider.Command
+	case config.AuthProvider != nil:
+		return "auth provider " + config.AuthProvider.Name
+	case config.Username != "":
+		return "basic " + config.Username + " <redacted>"
+	}
+	return "none"
+}
+
+func describeCA(config *rest.Config) string {
+	switch {
+	case config.Insecure:
+		return "insecure"
+	case config.CAFile != "":
+		return config.CAFile
+	case len(config.CAData) > 0:
+		return "inline"
+	}
+	return "system roots"
+}
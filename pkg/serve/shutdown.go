@@ -0,0 +1,146 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/proxy"
+	"github.com/marxus/k8s-mca/pkg/webhook"
+)
+
+// service is a server run by [serveAllUntilSignal]. timeout bounds how long its shutdown
+// waits for in-flight requests to drain.
+type service struct {
+	name     string
+	start    func() error
+	shutdown func(context.Context) error
+	timeout  time.Duration
+}
+
+// proxyService returns the service of the proxy server, draining for conf.ProxyDrainTimeout.
+func proxyService(server *proxy.Server) service {
+	return service{name: "proxy", start: server.Start, shutdown: server.Shutdown, timeout: conf.ProxyDrainTimeout}
+}
+
+// webhookService returns the service of the webhook server, draining for
+// conf.WebhookDrainTimeout.
+func webhookService(server *webhook.Server) service {
+	return service{name: "webhook", start: server.Start, shutdown: server.Shutdown, timeout: conf.WebhookDrainTimeout}
+}
+
+// serveUntilSignal runs start until it fails or a SIGINT/SIGTERM arrives, in which case
+// shutdown is called with the given timeout. A clean shutdown returns nil.
+func serveUntilSignal(start func() error, shutdown func(context.Context) error, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- start() }()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serveAllUntilSignal runs every service until one fails or a SIGINT/SIGTERM arrives, then
+// shuts down the services still running, each with its own timeout, and waits for them to
+// exit. Returns the errors of all services joined, each prefixed with its name; a clean
+// shutdown returns nil.
+func serveAllUntilSignal(services []service) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	type result struct {
+		index int
+		err   error
+	}
+	results := make(chan result, len(services))
+	for i, svc := range services {
+		go func() { results <- result{i, svc.start()} }()
+	}
+
+	errs := make([]error, len(services))
+	running := make([]bool, len(services))
+	for i := range running {
+		running[i] = true
+	}
+
+	select {
+	case res := <-results:
+		running[res.index] = false
+		errs[res.index] = res.err
+		log.Printf("%s server stopped, shutting down the others...", services[res.index].name)
+	case <-ctx.Done():
+		log.Println("Shutting down...")
+	}
+
+	// The services drain concurrently, so a short timeout is not held up by a long one.
+	var wg sync.WaitGroup
+	shutdownErrs := make([]error, len(services))
+	remaining := 0
+	for i, svc := range services {
+		if !running[i] {
+			continue
+		}
+		remaining++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), svc.timeout)
+			defer cancel()
+			shutdownErrs[i] = svc.shutdown(shutdownCtx)
+		}()
+	}
+	wg.Wait()
+	for i, err := range shutdownErrs {
+		if err != nil {
+			errs[i] = err
+		}
+	}
+	for ; remaining > 0; remaining-- {
+		res := <-results
+		if errs[res.index] == nil {
+			errs[res.index] = res.err
+		}
+	}
+
+	var joined []error
+	for i, err := range errs {
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			joined = append(joined, fmt.Errorf("%s: %w", services[i].name, err))
+		}
+	}
+	return errors.Join(joined...)
+}
+
+// serveError wraps an error from serving name on address, with a hint when the address is
+// already in use.
+func serveError(name, address string, err error) error {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("failed to serve %s: %w; is another process listening on %s?", name, err, address)
+	}
+	return fmt.Errorf("failed to serve %s: %w", name, err)
+}
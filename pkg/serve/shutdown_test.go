@@ -0,0 +1,183 @@
+// Signal-driven shutdown tests.
+package serve
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/proxy"
+	"github.com/marxus/k8s-mca/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeUntilSignal(t *testing.T) {
+	tests := []struct {
+		name    string
+		signal  bool
+		startFn func(stopped chan struct{}) func() error
+		wantErr error
+	}{
+		{
+			name:   "shuts down on SIGTERM",
+			signal: true,
+			startFn: func(stopped chan struct{}) func() error {
+				return func() error {
+					<-stopped
+					return http.ErrServerClosed
+				}
+			},
+		},
+		{
+			name: "returns start error",
+			startFn: func(stopped chan struct{}) func() error {
+				return func() error { return assert.AnError }
+			},
+			wantErr: assert.AnError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stopped := make(chan struct{})
+			shutdownCalled := false
+			shutdown := func(ctx context.Context) error {
+				shutdownCalled = true
+				close(stopped)
+				return nil
+			}
+
+			if tt.signal {
+				go func() {
+					time.Sleep(100 * time.Millisecond)
+					syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+				}()
+			}
+
+			err := serveUntilSignal(tt.startFn(stopped), shutdown, time.Second)
+
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.signal, shutdownCalled)
+		})
+	}
+}
+
+// fakeService blocks in start until shutdown is called, or returns startErr right away.
+type fakeService struct {
+	startErr       error
+	stopped        chan struct{}
+	shutdownCalled bool
+}
+
+func newFakeService(startErr error) *fakeService {
+	return &fakeService{startErr: startErr, stopped: make(chan struct{})}
+}
+
+func (f *fakeService) service(name string) service {
+	return service{
+		name: name,
+		start: func() error {
+			if f.startErr != nil {
+				return f.startErr
+			}
+			<-f.stopped
+			return http.ErrServerClosed
+		},
+		shutdown: func(ctx context.Context) error {
+			f.shutdownCalled = true
+			close(f.stopped)
+			return nil
+		},
+		timeout: time.Second,
+	}
+}
+
+func TestServeAllUntilSignal(t *testing.T) {
+	t.Run("shuts down all services on SIGTERM", func(t *testing.T) {
+		webhook, proxy := newFakeService(nil), newFakeService(nil)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+		}()
+
+		err := serveAllUntilSignal([]service{webhook.service("webhook"), proxy.service("proxy")})
+
+		assert.NoError(t, err)
+		assert.True(t, webhook.shutdownCalled)
+		assert.True(t, proxy.shutdownCalled)
+	})
+
+	t.Run("shuts down the others when one fails", func(t *testing.T) {
+		webhook, proxy := newFakeService(assert.AnError), newFakeService(nil)
+
+		err := serveAllUntilSignal([]service{webhook.service("webhook"), proxy.service("proxy")})
+
+		assert.ErrorIs(t, err, assert.AnError)
+		assert.ErrorContains(t, err, "webhook: ")
+		assert.False(t, webhook.shutdownCalled)
+		assert.True(t, proxy.shutdownCalled)
+	})
+
+	t.Run("joins the errors of all services", func(t *testing.T) {
+		webhook, proxy := newFakeService(assert.AnError), newFakeService(context.Canceled)
+
+		err := serveAllUntilSignal([]service{webhook.service("webhook"), proxy.service("proxy")})
+
+		assert.ErrorIs(t, err, assert.AnError)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestServeAllUntilSignal_DrainTimeouts(t *testing.T) {
+	deadlines := make(chan time.Duration, 2)
+	newService := func(name string, timeout time.Duration) service {
+		stopped := make(chan struct{})
+		return service{
+			name: name,
+			start: func() error {
+				<-stopped
+				return http.ErrServerClosed
+			},
+			shutdown: func(ctx context.Context) error {
+				deadline, ok := ctx.Deadline()
+				assert.True(t, ok)
+				deadlines <- time.Until(deadline).Round(time.Second)
+				close(stopped)
+				return nil
+			},
+			timeout: timeout,
+		}
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	}()
+
+	err := serveAllUntilSignal([]service{newService("webhook", 5*time.Second), newService("proxy", 30*time.Second)})
+
+	assert.NoError(t, err)
+	close(deadlines)
+	var got []time.Duration
+	for deadline := range deadlines {
+		got = append(got, deadline)
+	}
+	assert.ElementsMatch(t, []time.Duration{5 * time.Second, 30 * time.Second}, got)
+}
+
+func TestServices_DrainTimeouts(t *testing.T) {
+	originalProxy, originalWebhook := conf.ProxyDrainTimeout, conf.WebhookDrainTimeout
+	conf.ProxyDrainTimeout, conf.WebhookDrainTimeout = 2*time.Minute, 3*time.Second
+	defer func() { conf.ProxyDrainTimeout, conf.WebhookDrainTimeout = originalProxy, originalWebhook }()
+
+	proxySvc := proxyService(proxy.NewServer(tls.Certificate{}, nil))
+	assert.Equal(t, "proxy", proxySvc.name)
+	assert.Equal(t, 2*time.Minute, proxySvc.timeout)
+
+	webhookSvc := webhookService(webhook.NewServer(tls.Certificate{}))
+	assert.Equal(t, "webhook", webhookSvc.name)
+	assert.Equal(t, 3*time.Second, webhookSvc.timeout)
+}
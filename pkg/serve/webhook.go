@@ -4,45 +4,159 @@ package serve
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"log"
+	"net/http"
 
 	"github.com/marxus/k8s-mca/conf"
-	"github.com/marxus/k8s-mca/pkg/certs"
+	"github.com/marxus/k8s-mca/pkg/health"
+	"github.com/marxus/k8s-mca/pkg/inject"
 	"github.com/marxus/k8s-mca/pkg/webhook"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
+// proxyImageKey is the ConfigMap data key holding the proxy image override.
+const proxyImageKey = "proxyImage"
+
 // StartWebhook starts the MCA webhook server and patches the mutating webhook configuration.
 // It generates TLS certificates, creates a Kubernetes client, patches the webhook configuration
-// with the CA certificate, and starts the webhook server.
+// with the CA certificate, and starts the webhook server. The patch is skipped when
+// conf.WebhookPatchCABundle is unset.
+//
+// When conf.NamespaceConfigMap is set, ConfigMaps with that name in each namespace provide
+// per-namespace injection overrides layered between conf defaults and pod annotations.
+//
+// When conf.NamespaceSelector is set, pods in namespaces whose labels do not match it are
+// skipped. When conf.NamespaceAnnotations is set, those namespace annotations are copied onto
+// injected pods. Both read namespaces from an informer cache.
+//
+// When conf.WebhookLeaderElection is set, replicas elect a leader that alone manages the shared
+// certificate Secret and patches the caBundle, while every replica serves the shared certificate.
+//
+// A SIGINT/SIGTERM shuts the server down, draining admission requests for
+// conf.WebhookDrainTimeout.
 //
 // Returns an error if namespace file cannot be read, certificate generation fails,
 // Kubernetes client creation fails, webhook patching fails, or server startup fails.
 func StartWebhook() error {
 	log.Println("Starting MCA Webhook...")
-	
-	tlsCert, caCertPEM, err := certs.GenerateCAAndTLSCert([]string{fmt.Sprintf("%s.%s.svc", conf.WebhookName, conf.PodNamespace)}, nil)
+
+	clientset, err := buildKubernetesClient()
 	if err != nil {
-		return fmt.Errorf("failed to generate webhook certificates: %w", err)
+		return fmt.Errorf("failed to build Kubernetes client: %w", err)
 	}
 
-	clientset, err := buildKubernetesClient()
+	server, err := newWebhookServer(context.Background(), clientset)
 	if err != nil {
 		return err
 	}
+	log.Println("Starting webhook server...")
 
-	if err := patchMutatingConfig(caCertPEM, clientset); err != nil {
-		return err
+	svc := webhookService(server)
+	if err := serveUntilSignal(svc.start, svc.shutdown, svc.timeout); err != nil {
+		return serveError("webhook", conf.WebhookListenAddress, err)
+	}
+	return nil
+}
+
+// newWebhookServer prepares everything the webhook needs, including the caBundle patch and
+// the watches that run until ctx is done, and returns the server ready to start.
+// Each step's error names the step, so a startup failure identifies what went wrong.
+func newWebhookServer(ctx context.Context, clientset kubernetes.Interface) (*webhook.Server, error) {
+	if err := inject.ValidatePodSecurityLevel(conf.PodSecurityLevel); err != nil {
+		return nil, err
+	}
+
+	var (
+		tlsCert tls.Certificate
+		err     error
+	)
+	if conf.WebhookLeaderElection {
+		tlsCert, err = startLeaderElectedWebhookCert(ctx, clientset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up shared webhook certificate: %w", err)
+		}
+	} else {
+		var caCertPEM []byte
+		tlsCert, caCertPEM, err = generateCAAndTLSCert(webhookDNSNames(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate webhook certificates: %w", err)
+		}
+		if err := verifyCertChain(tlsCert, caCertPEM); err != nil {
+			return nil, err
+		}
+
+		if err := patchMutatingConfig(caCertPEM, clientset); err != nil {
+			return nil, err
+		}
+	}
+
+	logCertSANs(tlsCert)
+
+	if err := checkProxyImage(ctx, http.DefaultClient); err != nil {
+		return nil, err
+	}
+	if err := watchProxyImage(ctx, clientset); err != nil {
+		return nil, err
+	}
+
+	if err := watchNamespaceOverrides(ctx, clientset); err != nil {
+		return nil, err
+	}
+
+	if err := recordUpstream(); err != nil {
+		return nil, err
 	}
 
 	server := webhook.NewServer(tlsCert)
-	log.Println("Starting webhook server...")
+	server.SetUpstreamCheck(upstreamCheck(clientset))
+
+	if conf.NamespaceSelector != "" || len(conf.NamespaceAnnotations) > 0 {
+		getNamespace := watchNamespaces(ctx, clientset)
+		if conf.NamespaceSelector != "" {
+			selector, err := labels.Parse(conf.NamespaceSelector)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse namespace selector: %w", err)
+			}
+			server.SetNamespaceSelector(selector, namespaceLabels(getNamespace))
+		}
+		if len(conf.NamespaceAnnotations) > 0 {
+			inject.SetNamespaceAnnotations(namespaceAnnotations(getNamespace))
+		}
+	}
+
+	return server, nil
+}
+
+// recordUpstream has injected pods annotated with the API server their proxy targets when
+// conf.UpstreamAnnotation is set. It is the one the webhook itself talks to, since the proxy
+// runs in the same cluster.
+func recordUpstream() error {
+	if !conf.UpstreamAnnotation {
+		return nil
+	}
 
-	return server.Start()
+	config, err := conf.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get upstream for annotation: %w", err)
+	}
+	inject.SetUpstream(redactHost(config.Host))
+	log.Printf("Annotating injected pods with upstream: %s", redactHost(config.Host))
+	return nil
+}
+
+func webhookDNSNames() []string {
+	return []string{fmt.Sprintf("%s.%s.svc", conf.WebhookName, conf.PodNamespace)}
 }
 
 func buildKubernetesClient() (kubernetes.Interface, error) {
@@ -59,6 +173,17 @@ func buildKubernetesClient() (kubernetes.Interface, error) {
 	return clientset, nil
 }
 
+// upstreamCheck returns a health check that fails when the API server does not answer a
+// version request.
+func upstreamCheck(clientset kubernetes.Interface) health.Check {
+	return func() error {
+		if _, err := clientset.Discovery().ServerVersion(); err != nil {
+			return fmt.Errorf("API server unreachable: %w", err)
+		}
+		return nil
+	}
+}
+
 func buildWebhookPatch(caCertPEM []byte) []byte {
 	return []byte(fmt.Sprintf(
 		`[{ "op": "replace", "path": "/webhooks/0/clientConfig/caBundle", "value": "%s" }]`,
@@ -66,7 +191,14 @@ func buildWebhookPatch(caCertPEM []byte) []byte {
 	))
 }
 
+// patchMutatingConfig patches the caBundle of the mutating webhook configuration, unless
+// conf.WebhookPatchCABundle is unset because the caBundle is managed externally.
 func patchMutatingConfig(caCertPEM []byte, clientset kubernetes.Interface) error {
+	if !conf.WebhookPatchCABundle {
+		log.Printf("Skipped patching mutating webhook %s: caBundle is managed externally", conf.WebhookName)
+		return nil
+	}
+
 	log.Println("Applying mutating webhook configuration...")
 
 	ctx := context.Background()
@@ -80,9 +212,156 @@ func patchMutatingConfig(caCertPEM []byte, clientset kubernetes.Interface) error
 		metav1.PatchOptions{},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to patch mutating webhook: %w", err)
+		return fmt.Errorf("failed to patch mutating webhook %s: %w%s", conf.WebhookName, err, patchHint(err))
 	}
 
 	log.Printf("Patched mutating webhook: %s", conf.WebhookName)
 	return nil
 }
+
+// patchHint returns a remediation hint for common caBundle patch failures.
+func patchHint(err error) string {
+	switch {
+	case apierrors.IsForbidden(err):
+		return "; grant the webhook's service account patch on mutatingwebhookconfigurations, or set MCA_WEBHOOK_PATCH_CA_BUNDLE=false"
+	case apierrors.IsNotFound(err):
+		return fmt.Sprintf("; create the MutatingWebhookConfiguration %s first, e.g. by installing the chart", conf.WebhookName)
+	}
+	return ""
+}
+
+func watchProxyImage(ctx context.Context, clientset kubernetes.Interface) error {
+	if conf.ProxyImageConfigMap == "" {
+		return nil
+	}
+
+	log.Printf("Watching ConfigMap %s/%s for proxy image overrides...", conf.PodNamespace, conf.ProxyImageConfigMap)
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(conf.PodNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", conf.ProxyImageConfigMap).String()
+		}),
+	)
+	informer := factory.Core().V1().ConfigMaps().Informer()
+
+	setProxyImage := func(obj interface{}, deleted bool) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		configMap, ok := obj.(*corev1.ConfigMap)
+		if !ok || configMap.Name != conf.ProxyImageConfigMap {
+			return
+		}
+
+		image := configMap.Data[proxyImageKey]
+		if deleted {
+			image = ""
+		}
+		inject.SetProxyImage(image)
+		log.Printf("Proxy image set to: %s", inject.ProxyImage())
+	}
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { setProxyImage(obj, false) },
+		UpdateFunc: func(_, obj interface{}) { setProxyImage(obj, false) },
+		DeleteFunc: func(obj interface{}) { setProxyImage(obj, true) },
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch proxy image ConfigMap: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to sync proxy image ConfigMap")
+	}
+
+	return nil
+}
+
+func watchNamespaceOverrides(ctx context.Context, clientset kubernetes.Interface) error {
+	if conf.NamespaceConfigMap == "" {
+		return nil
+	}
+
+	log.Printf("Watching ConfigMaps named %s for per-namespace injection overrides...", conf.NamespaceConfigMap)
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", conf.NamespaceConfigMap).String()
+		}),
+	)
+	configMaps := factory.Core().V1().ConfigMaps()
+	informer := configMaps.Informer()
+	lister := configMaps.Lister()
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to sync namespace override ConfigMaps")
+	}
+
+	inject.SetNamespaceOverrides(func(namespace string) map[string]string {
+		configMap, err := lister.ConfigMaps(namespace).Get(conf.NamespaceConfigMap)
+		if err != nil {
+			return nil
+		}
+		return configMap.Data
+	})
+
+	return nil
+}
+
+// watchNamespaces starts a namespace informer and returns a lookup reading namespaces from
+// its cache. Until the cache has synced, and for namespaces created since the last sync, the
+// lookup falls back to a live GET so admission never waits on the informer.
+func watchNamespaces(ctx context.Context, clientset kubernetes.Interface) func(name string) (*corev1.Namespace, error) {
+	log.Println("Watching namespaces...")
+
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	namespaces := factory.Core().V1().Namespaces()
+	informer := namespaces.Informer()
+	lister := namespaces.Lister()
+
+	factory.Start(ctx.Done())
+
+	return func(name string) (*corev1.Namespace, error) {
+		if informer.HasSynced() {
+			namespace, err := lister.Get(name)
+			if err == nil {
+				return namespace, nil
+			}
+			if !apierrors.IsNotFound(err) {
+				return nil, fmt.Errorf("failed to get namespace %s from cache: %w", name, err)
+			}
+		}
+
+		namespace, err := clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get namespace %s: %w", name, err)
+		}
+		return namespace, nil
+	}
+}
+
+func namespaceLabels(getNamespace func(string) (*corev1.Namespace, error)) webhook.NamespaceLabels {
+	return func(name string) (map[string]string, error) {
+		namespace, err := getNamespace(name)
+		if err != nil {
+			return nil, err
+		}
+		return namespace.Labels, nil
+	}
+}
+
+// namespaceAnnotations returns a lookup of namespace annotations for injection. A namespace
+// that cannot be read is logged and treated as having no annotations, so injection proceeds.
+func namespaceAnnotations(getNamespace func(string) (*corev1.Namespace, error)) inject.NamespaceAnnotations {
+	return func(name string) map[string]string {
+		namespace, err := getNamespace(name)
+		if err != nil {
+			log.Printf("Warning: not copying namespace annotations: %v", err)
+			return nil
+		}
+		return namespace.Annotations
+	}
+}
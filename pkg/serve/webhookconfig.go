@@ -0,0 +1,144 @@
+package serve
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/marxus/k8s-mca/conf"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// webhookObjectSelector is the pod label the webhook configuration selects pods by.
+const webhookObjectSelector = "mca.k8s.io/inject"
+
+// PrintWebhookConfig writes the MutatingWebhookConfiguration matching the webhook's conf to w
+// as YAML: its name, service, path and port, failure policy, namespace selector and rules.
+// The caBundle is left empty for the webhook to patch.
+//
+// Returns an error if the conf is invalid or writing fails.
+func PrintWebhookConfig(w io.Writer) error {
+	config, err := webhookConfiguration()
+	if err != nil {
+		return err
+	}
+
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(config)
+	if err != nil {
+		return fmt.Errorf("failed to convert webhook configuration: %w", err)
+	}
+	// An explicit empty caBundle gives the webhook's caBundle patch a field to replace.
+	webhooks := object["webhooks"].([]any)
+	webhooks[0].(map[string]any)["clientConfig"].(map[string]any)["caBundle"] = ""
+
+	data, err := yaml.Marshal(object)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook configuration: %w", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func webhookConfiguration() (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+	failurePolicy := admissionregistrationv1.FailurePolicyType(conf.WebhookFailurePolicy)
+	if failurePolicy != admissionregistrationv1.Fail && failurePolicy != admissionregistrationv1.Ignore {
+		return nil, fmt.Errorf("invalid webhook failure policy %q, must be Fail or Ignore", conf.WebhookFailurePolicy)
+	}
+
+	namespaceSelector, err := webhookNamespaceSelector()
+	if err != nil {
+		return nil, err
+	}
+
+	path := conf.WebhookMutatePath
+	port := int32(conf.WebhookServicePort)
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	reinvocationPolicy := admissionregistrationv1.IfNeededReinvocationPolicy
+
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationv1.SchemeGroupVersion.String(),
+			Kind:       "MutatingWebhookConfiguration",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: conf.WebhookName},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name: "webhook.mca.k8s.io",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Name:      conf.WebhookName,
+					Namespace: conf.PodNamespace,
+					Path:      &path,
+					Port:      &port,
+				},
+			},
+			Rules:                   webhookRules(),
+			NamespaceSelector:       namespaceSelector,
+			ObjectSelector:          &metav1.LabelSelector{MatchLabels: map[string]string{webhookObjectSelector: "true"}},
+			AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			SideEffects:             &sideEffects,
+			FailurePolicy:           &failurePolicy,
+			ReinvocationPolicy:      &reinvocationPolicy,
+		}},
+	}, nil
+}
+
+// webhookRules returns the requests the webhook handles: pod CREATEs, pod UPDATEs under
+// conf.WebhookUpdateOptOut and ephemeral container updates under
+// conf.WebhookEphemeralContainers.
+func webhookRules() []admissionregistrationv1.RuleWithOperations {
+	podRule := func(resource string, operations ...admissionregistrationv1.OperationType) admissionregistrationv1.RuleWithOperations {
+		return admissionregistrationv1.RuleWithOperations{
+			Operations: operations,
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{""},
+				APIVersions: []string{"v1"},
+				Resources:   []string{resource},
+			},
+		}
+	}
+
+	operations := []admissionregistrationv1.OperationType{admissionregistrationv1.Create}
+	if conf.WebhookUpdateOptOut {
+		operations = append(operations, admissionregistrationv1.Update)
+	}
+	rules := []admissionregistrationv1.RuleWithOperations{podRule("pods", operations...)}
+	if conf.WebhookEphemeralContainers {
+		rules = append(rules, podRule("pods/ephemeralcontainers", admissionregistrationv1.Update))
+	}
+	return rules
+}
+
+// webhookNamespaceSelector returns conf.NamespaceSelector, narrowed to conf.IncludedNamespaces
+// and away from conf.ExcludedNamespaces, so the API server does not call the webhook for pods
+// it would skip anyway. Under conf.PodOptInOverridesNamespace a pod opting in is injected
+// regardless of the selector and included namespaces, so only excluded namespaces are left out.
+func webhookNamespaceSelector() (*metav1.LabelSelector, error) {
+	selector := &metav1.LabelSelector{}
+	if conf.NamespaceSelector != "" && !conf.PodOptInOverridesNamespace {
+		var err error
+		selector, err = metav1.ParseToLabelSelector(conf.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace selector %q: %w", conf.NamespaceSelector, err)
+		}
+	}
+
+	if len(conf.IncludedNamespaces) > 0 && !conf.PodOptInOverridesNamespace {
+		selector.MatchExpressions = append(selector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      corev1.LabelMetadataName,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   slices.Sorted(slices.Values(conf.IncludedNamespaces)),
+		})
+	}
+	if len(conf.ExcludedNamespaces) > 0 {
+		selector.MatchExpressions = append(selector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      corev1.LabelMetadataName,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   slices.Sorted(slices.Values(conf.ExcludedNamespaces)),
+		})
+	}
+	return selector, nil
+}
@@ -0,0 +1,197 @@
+// MutatingWebhookConfiguration generation tests.
+package serve
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// withWebhookConf sets the webhook settings PrintWebhookConfig reads for the duration of a test.
+func withWebhookConf(t *testing.T, set func()) {
+	original := struct {
+		name, namespace, path, failurePolicy, selector string
+		port                                           int
+		updateOptOut, optInOverrides                   bool
+		included, excluded                             []string
+	}{
+		conf.WebhookName, conf.PodNamespace, conf.WebhookMutatePath, conf.WebhookFailurePolicy, conf.NamespaceSelector,
+		conf.WebhookServicePort, conf.WebhookUpdateOptOut, conf.PodOptInOverridesNamespace,
+		conf.IncludedNamespaces, conf.ExcludedNamespaces,
+	}
+	t.Cleanup(func() {
+		conf.WebhookName, conf.PodNamespace, conf.WebhookMutatePath = original.name, original.namespace, original.path
+		conf.WebhookFailurePolicy, conf.NamespaceSelector = original.failurePolicy, original.selector
+		conf.WebhookServicePort, conf.WebhookUpdateOptOut = original.port, original.updateOptOut
+		conf.PodOptInOverridesNamespace = original.optInOverrides
+		conf.IncludedNamespaces, conf.ExcludedNamespaces = original.included, original.excluded
+	})
+	set()
+}
+
+func TestPrintWebhookConfig(t *testing.T) {
+	withWebhookConf(t, func() {
+		conf.WebhookName, conf.PodNamespace, conf.WebhookMutatePath = "tenant-mca", "mca-system", "/admit/pods"
+		conf.WebhookServicePort, conf.WebhookFailurePolicy = 8443, "Ignore"
+		conf.WebhookUpdateOptOut = true
+		conf.NamespaceSelector = "team=payments"
+		conf.ExcludedNamespaces = []string{"kube-system", "kube-public"}
+	})
+
+	var out bytes.Buffer
+	require.NoError(t, PrintWebhookConfig(&out))
+
+	var config admissionregistrationv1.MutatingWebhookConfiguration
+	require.NoError(t, yaml.UnmarshalStrict(out.Bytes(), &config))
+	assert.Equal(t, "MutatingWebhookConfiguration", config.Kind)
+	assert.Equal(t, "admissionregistration.k8s.io/v1", config.APIVersion)
+	assert.Equal(t, "tenant-mca", config.Name)
+	require.Len(t, config.Webhooks, 1)
+
+	webhook := config.Webhooks[0]
+	service := webhook.ClientConfig.Service
+	require.NotNil(t, service)
+	assert.Equal(t, "tenant-mca", service.Name)
+	assert.Equal(t, "mca-system", service.Namespace)
+	assert.Equal(t, "/admit/pods", *service.Path)
+	assert.Equal(t, int32(8443), *service.Port)
+	assert.Empty(t, webhook.ClientConfig.CABundle)
+	assert.Contains(t, out.String(), `caBundle: ""`, "the caBundle patch has a field to replace")
+
+	assert.Equal(t, admissionregistrationv1.Ignore, *webhook.FailurePolicy)
+	assert.Equal(t, []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		webhook.Rules[0].Operations)
+	assert.Equal(t, []string{"pods"}, webhook.Rules[0].Resources)
+	assert.Equal(t, &metav1.LabelSelector{
+		MatchLabels: map[string]string{"team": "payments"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "kubernetes.io/metadata.name", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"kube-public", "kube-system"}},
+		},
+	}, webhook.NamespaceSelector)
+}
+
+func TestWebhookNamespaceSelector(t *testing.T) {
+	tests := []struct {
+		name           string
+		selector       string
+		included       []string
+		excluded       []string
+		optInOverrides bool
+		want           *metav1.LabelSelector
+		wantErr        string
+	}{
+		{
+			name: "every namespace by default",
+			want: &metav1.LabelSelector{},
+		},
+		{
+			name:     "included namespaces",
+			included: []string{"b", "a"},
+			want: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "kubernetes.io/metadata.name", Operator: metav1.LabelSelectorOpIn, Values: []string{"a", "b"}},
+			}},
+		},
+		{
+			name:           "opt-in overrides keep only the excluded namespaces",
+			selector:       "team=payments",
+			included:       []string{"a"},
+			excluded:       []string{"kube-system"},
+			optInOverrides: true,
+			want: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "kubernetes.io/metadata.name", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"kube-system"}},
+			}},
+		},
+		{
+			name:     "invalid selector",
+			selector: "team in (",
+			wantErr:  `invalid namespace selector "team in ("`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withWebhookConf(t, func() {
+				conf.NamespaceSelector, conf.PodOptInOverridesNamespace = tt.selector, tt.optInOverrides
+				conf.IncludedNamespaces, conf.ExcludedNamespaces = tt.included, tt.excluded
+			})
+
+			selector, err := webhookNamespaceSelector()
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, selector)
+		})
+	}
+}
+
+func TestPrintWebhookConfig_InvalidFailurePolicy(t *testing.T) {
+	withWebhookConf(t, func() { conf.WebhookFailurePolicy = "Retry" })
+
+	err := PrintWebhookConfig(&bytes.Buffer{})
+	assert.EqualError(t, err, `invalid webhook failure policy "Retry", must be Fail or Ignore`)
+}
+
+func TestWebhookRules(t *testing.T) {
+	podsRule := func(resource string, operations ...admissionregistrationv1.OperationType) admissionregistrationv1.RuleWithOperations {
+		return admissionregistrationv1.RuleWithOperations{
+			Operations: operations,
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{""},
+				APIVersions: []string{"v1"},
+				Resources:   []string{resource},
+			},
+		}
+	}
+
+	tests := []struct {
+		name                string
+		updateOptOut        bool
+		ephemeralContainers bool
+		want                []admissionregistrationv1.RuleWithOperations
+	}{
+		{
+			name: "pod creation only",
+			want: []admissionregistrationv1.RuleWithOperations{podsRule("pods", admissionregistrationv1.Create)},
+		},
+		{
+			name:         "pod updates for opt-out",
+			updateOptOut: true,
+			want: []admissionregistrationv1.RuleWithOperations{
+				podsRule("pods", admissionregistrationv1.Create, admissionregistrationv1.Update),
+			},
+		},
+		{
+			name:                "ephemeral containers",
+			ephemeralContainers: true,
+			want: []admissionregistrationv1.RuleWithOperations{
+				podsRule("pods", admissionregistrationv1.Create),
+				podsRule("pods/ephemeralcontainers", admissionregistrationv1.Update),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalUpdateOptOut, originalEphemeral := conf.WebhookUpdateOptOut, conf.WebhookEphemeralContainers
+			conf.WebhookUpdateOptOut, conf.WebhookEphemeralContainers = tt.updateOptOut, tt.ephemeralContainers
+			defer func() {
+				conf.WebhookUpdateOptOut, conf.WebhookEphemeralContainers = originalUpdateOptOut, originalEphemeral
+			}()
+
+			var out bytes.Buffer
+			require.NoError(t, PrintWebhookConfig(&out))
+
+			var config admissionregistrationv1.MutatingWebhookConfiguration
+			require.NoError(t, yaml.UnmarshalStrict(out.Bytes(), &config))
+			assert.Equal(t, tt.want, config.Webhooks[0].Rules)
+		})
+	}
+}
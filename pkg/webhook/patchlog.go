@@ -0,0 +1,92 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+
+	"github.com/marxus/k8s-mca/conf"
+)
+
+// redacted replaces values that may hold secrets in logged patches.
+const redacted = "<redacted>"
+
+// unredactedEnv are the env vars MCA sets itself, which hold no secrets and matter when
+// diagnosing a patch.
+var unredactedEnv = map[string]bool{
+	"KUBERNETES_SERVICE_HOST": true,
+	"KUBERNETES_SERVICE_PORT": true,
+}
+
+// lastAppliedAnnotation holds a copy of the whole manifest, env values included.
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// logPatch logs the JSON patch returned for pod at conf.LogLevelDebug, with env values and
+// the last-applied manifest redacted, for diagnosing patches the API server fails to apply.
+func logPatch(pod string, patch []byte) {
+	if conf.LogLevel != conf.LogLevelDebug {
+		return
+	}
+
+	redactedPatch, err := redactPatch(patch)
+	if err != nil {
+		log.Printf("Warning: failed to redact JSON patch for pod %s: %v", pod, err)
+		return
+	}
+	log.Printf("JSON patch for pod %s: %s", pod, redactedPatch)
+}
+
+// redactPatch returns patch with the literal value of every env var but MCA's own, and the
+// last-applied annotation, replaced by a placeholder. References such as valueFrom are kept.
+func redactPatch(patch []byte) ([]byte, error) {
+	var ops interface{}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, err
+	}
+	redactValue(ops)
+
+	var redactedPatch bytes.Buffer
+	encoder := json.NewEncoder(&redactedPatch)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(ops); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(redactedPatch.Bytes(), []byte("\n")), nil
+}
+
+func redactValue(value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			switch {
+			case key == "env":
+				redactEnv(field)
+			case key == lastAppliedAnnotation:
+				value[key] = redacted
+			default:
+				redactValue(field)
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			redactValue(item)
+		}
+	}
+}
+
+func redactEnv(env interface{}) {
+	vars, ok := env.([]interface{})
+	if !ok {
+		return
+	}
+	for _, envVar := range vars {
+		if envVar, ok := envVar.(map[string]interface{}); ok {
+			if name, _ := envVar["name"].(string); unredactedEnv[name] {
+				continue
+			}
+			if _, ok := envVar["value"]; ok {
+				envVar["value"] = redacted
+			}
+		}
+	}
+}
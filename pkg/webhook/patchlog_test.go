@@ -0,0 +1,98 @@
+// JSON patch debug logging tests.
+package webhook
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestServer_Mutate_LogsPatchAtDebug(t *testing.T) {
+	podJSON, err := json.Marshal(corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Annotations: map[string]string{lastAppliedAnnotation: `{"env":"DB_PASSWORD=hunter2"}`},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "app",
+			Image: "nginx",
+			Env: []corev1.EnvVar{
+				{Name: "DB_PASSWORD", Value: "hunter2"},
+				{Name: "API_KEY", ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "api"}, Key: "key"},
+				}},
+			},
+		}}},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		level     string
+		testOps   bool
+		wantPatch bool
+	}{
+		{name: "not logged at info", level: conf.LogLevelInfo},
+		{name: "logged at debug", level: conf.LogLevelDebug, wantPatch: true},
+		{name: "test ops are redacted too", level: conf.LogLevelDebug, testOps: true, wantPatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalLevel, originalTestOps := conf.LogLevel, conf.PatchTestOps
+			conf.LogLevel, conf.PatchTestOps = tt.level, tt.testOps
+			defer func() { conf.LogLevel, conf.PatchTestOps = originalLevel, originalTestOps }()
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			response := NewServer(tls.Certificate{}).mutate(&admissionv1.AdmissionReview{
+				Request: &admissionv1.AdmissionRequest{
+					UID:       types.UID("test-uid"),
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Operation: admissionv1.Create,
+					Namespace: "default",
+					Object:    runtime.RawExtension{Raw: podJSON},
+				},
+			})
+			require.True(t, response.Response.Allowed)
+			require.NotEmpty(t, response.Response.Patch)
+
+			assert.Equal(t, tt.wantPatch, bytes.Contains(logs.Bytes(), []byte("JSON patch for pod default/web: ")))
+			assert.NotContains(t, logs.String(), "hunter2")
+			if tt.wantPatch {
+				assert.Contains(t, logs.String(), `{"name":"DB_PASSWORD","value":"<redacted>"}`)
+				assert.Contains(t, logs.String(), `"secretKeyRef":{"key":"key","name":"api"}`, "references are kept")
+				assert.Contains(t, logs.String(), `{"name":"KUBERNETES_SERVICE_HOST","value":"127.0.0.1"}`, "MCA's own env is kept")
+			}
+		})
+	}
+}
+
+func TestRedactPatch(t *testing.T) {
+	patch := []byte(`[{"op":"replace","path":"/spec","value":{"containers":[{"name":"app",` +
+		`"env":[{"name":"TOKEN","value":"s3cret"},{"name":"EMPTY","value":""},{"name":"KUBERNETES_SERVICE_PORT","value":"6443"}]}]}},` +
+		`{"op":"add","path":"/metadata/annotations","value":{"team":"a","` + lastAppliedAnnotation + `":"{}"}}]`)
+
+	got, err := redactPatch(patch)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"op":"replace","path":"/spec","value":{"containers":[{"name":"app",`+
+		`"env":[{"name":"TOKEN","value":"<redacted>"},{"name":"EMPTY","value":"<redacted>"},{"name":"KUBERNETES_SERVICE_PORT","value":"6443"}]}]}},`+
+		`{"op":"add","path":"/metadata/annotations","value":{"team":"a","`+lastAppliedAnnotation+`":"<redacted>"}}]`, string(got))
+
+	_, err = redactPatch([]byte("not json"))
+	assert.Error(t, err)
+}
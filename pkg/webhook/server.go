@@ -4,53 +4,102 @@
 package webhook
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
+	"github.com/marxus/k8s-mca/pkg/health"
 	"github.com/marxus/k8s-mca/pkg/inject"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 )
 
+// NamespaceLabels returns the labels of a namespace.
+type NamespaceLabels func(namespace string) (map[string]string, error)
+
 // Server represents a Kubernetes mutating admission webhook server.
 // It intercepts pod creation requests and injects the MCA sidecar container.
 // The server is safe for concurrent use by multiple goroutines.
 type Server struct {
-	tlsCert tls.Certificate
+	tlsCert       tls.Certificate
+	upstreamCheck health.Check
+	inFlight      chan struct{}
+
+	namespaceSelector labels.Selector
+	namespaceLabels   NamespaceLabels
+
+	httpServer *http.Server
 }
 
 // NewServer creates a new webhook server with the given TLS certificate.
+// At most conf.WebhookMaxInFlight admission requests are handled concurrently when it is positive.
 func NewServer(tlsCert tls.Certificate) *Server {
-	return &Server{
+	s := &Server{
 		tlsCert: tlsCert,
 	}
+	if conf.WebhookMaxInFlight > 0 {
+		s.inFlight = make(chan struct{}, conf.WebhookMaxInFlight)
+	}
+	s.httpServer = &http.Server{
+		Addr:      conf.WebhookListenAddress,
+		Handler:   s.routes(),
+		TLSConfig: certs.ServerTLSConfig(tlsCert),
+	}
+	return s
+}
+
+// SetUpstreamCheck sets the check reporting API server reachability in /healthz.
+// It must be called before [Server.Start].
+func (s *Server) SetUpstreamCheck(check health.Check) {
+	s.upstreamCheck = check
+}
+
+// SetNamespaceSelector skips injection for pods in namespaces whose labels, as returned by
+// lookup, do not match selector. It must be called before [Server.Start].
+func (s *Server) SetNamespaceSelector(selector labels.Selector, lookup NamespaceLabels) {
+	s.namespaceSelector = selector
+	s.namespaceLabels = lookup
 }
 
-// Start starts the webhook server on port 8443 and blocks until it exits.
-// The server exposes /mutate for pod admission requests and /health for health checks.
+// Start starts the webhook server on conf.WebhookListenAddress (:8443 by default) and blocks
+// until it exits. The server exposes conf.WebhookMutatePath (/mutate by default) for pod
+// admission requests, /health for liveness checks and /healthz for a JSON report of the cert,
+// upstream and config subsystems.
 // Returns an error if the server fails to start or encounters a fatal error.
 func (s *Server) Start() error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", s.handleMutate)
-	mux.HandleFunc("/health", s.handleHealth)
+	return s.httpServer.ListenAndServeTLS("", "")
+}
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{s.tlsCert},
-	}
+// Shutdown gracefully stops the server, waiting for in-flight admission requests to complete
+// until ctx is done. After Shutdown, [Server.Start] returns [http.ErrServerClosed].
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
 
-	server := &http.Server{
-		Addr:      ":8443",
-		Handler:   mux,
-		TLSConfig: tlsConfig,
-	}
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(conf.WebhookMutatePath, s.MutateHandler())
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.Handle("/healthz", health.Handler(s.healthChecks))
+	return mux
+}
 
-	return server.ListenAndServeTLS("", "")
+// MutateHandler returns the admission handler for pod mutation requests.
+// It allows embedding MCA admission into another HTTP server or webhook framework
+// without using [Server.Start].
+func (s *Server) MutateHandler() http.Handler {
+	return http.HandlerFunc(s.handleMutate)
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -58,12 +107,42 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+func (s *Server) healthChecks() map[string]health.Check {
+	checks := map[string]health.Check{
+		"cert":   health.CertCheck(s.tlsCert),
+		"config": checkConfig,
+	}
+	if s.upstreamCheck != nil {
+		checks["upstream"] = s.upstreamCheck
+	}
+	return checks
+}
+
+func checkConfig() error {
+	if inject.ProxyImage() == "" {
+		return errors.New("no proxy image configured")
+	}
+	return nil
+}
+
 func (s *Server) handleErr(w http.ResponseWriter, err error, message string, statusCode int) {
 	log.Printf("%s: %v", message, err)
 	http.Error(w, message, statusCode)
 }
 
 func (s *Server) handleMutate(w http.ResponseWriter, r *http.Request) {
+	if s.inFlight != nil {
+		select {
+		case s.inFlight <- struct{}{}:
+			defer func() { <-s.inFlight }()
+		default:
+			log.Printf("Rejected admission request: %d requests already in flight", cap(s.inFlight))
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many admission requests in flight", http.StatusTooManyRequests)
+			return
+		}
+	}
+
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		s.handleErr(w, err, "Failed to read request body", http.StatusBadRequest)
@@ -103,25 +182,142 @@ func (s *Server) mutateErr(uid types.UID, err error, message string) *admissionv
 	}
 }
 
+// mutateAllow allows a request without changes. The response carries no patch and no patch
+// type, rather than an empty patch, which the API server treats as no mutation.
+func (s *Server) mutateAllow(uid types.UID, warnings []string) *admissionv1.AdmissionReview {
+	return &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Response: &admissionv1.AdmissionResponse{
+			UID:      uid,
+			Allowed:  true,
+			Warnings: warnings,
+		},
+	}
+}
+
+func (s *Server) mutateSkip(uid types.UID, reason string) *admissionv1.AdmissionReview {
+	log.Printf("Skipped MCA injection: %s", reason)
+	return &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Response: &admissionv1.AdmissionResponse{
+			UID:     uid,
+			Allowed: true,
+			Result: &metav1.Status{
+				Status:  metav1.StatusSuccess,
+				Message: reason,
+			},
+			Warnings: []string{fmt.Sprintf("MCA injection skipped: %s", reason)},
+		},
+	}
+}
+
+func optedOut(pod *corev1.Pod) bool {
+	return pod.Annotations[inject.AnnotationInject] == "false"
+}
+
+func (s *Server) skipReason(req *admissionv1.AdmissionRequest, pod *corev1.Pod) (string, error) {
+	return skipDecision(pod, req.Namespace, s.namespaceSelectorSkipReason)
+}
+
+// skipDecision returns why pod, admitted in namespace, is not injected, or "" when it is.
+// Conflicting signals resolve in this order, the first that applies deciding:
+//
+//  1. a pod opted out with the mca.marxus.io/inject "false" annotation is skipped;
+//  2. a pod in conf.ExcludedNamespaces is skipped, even when it opts in;
+//  3. a pod opted in with the mca.marxus.io/inject "true" annotation is injected when
+//     conf.PodOptInOverridesNamespace is set;
+//  4. a pod outside a non-empty conf.IncludedNamespaces is skipped;
+//  5. a pod whose namespace does not match the namespace selector is skipped.
+func skipDecision(pod *corev1.Pod, namespace string, selectorSkipReason func(string) (string, error)) (string, error) {
+	if optedOut(pod) {
+		return fmt.Sprintf("pod opted out via %s annotation", inject.AnnotationInject), nil
+	}
+	if inject.NamespaceExcluded(namespace) {
+		return inject.NamespaceSkipReason(namespace), nil
+	}
+	if pod.Annotations[inject.AnnotationInject] == "true" && conf.PodOptInOverridesNamespace {
+		return "", nil
+	}
+	if reason := inject.NamespaceSkipReason(namespace); reason != "" {
+		return reason, nil
+	}
+	return selectorSkipReason(namespace)
+}
+
+func (s *Server) namespaceSelectorSkipReason(namespace string) (string, error) {
+	if s.namespaceSelector == nil || s.namespaceLabels == nil {
+		return "", nil
+	}
+
+	namespaceLabels, err := s.namespaceLabels(namespace)
+	if err != nil {
+		return "", err
+	}
+	if !s.namespaceSelector.Matches(labels.Set(namespaceLabels)) {
+		return fmt.Sprintf("namespace %s does not match selector %q", namespace, s.namespaceSelector), nil
+	}
+	return "", nil
+}
+
 func (s *Server) mutate(admissionReview *admissionv1.AdmissionReview) *admissionv1.AdmissionReview {
 	req := admissionReview.Request
 
+	if req.Kind.Kind != "Pod" {
+		return s.mutateSkip(req.UID, fmt.Sprintf("kind %s is not a Pod", req.Kind.Kind))
+	}
+	if req.SubResource == "ephemeralcontainers" && conf.WebhookEphemeralContainers {
+		return s.mutateEphemeralContainers(req)
+	}
+	if req.Operation == admissionv1.Update && conf.WebhookUpdateOptOut {
+		return s.mutateUpdate(req)
+	}
+	if req.Operation != admissionv1.Create {
+		return s.mutateSkip(req.UID, fmt.Sprintf("operation %s is not CREATE", req.Operation))
+	}
+
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 		return s.mutateErr(req.UID, err, "Failed to unmarshal pod")
 	}
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+
+	reason, err := s.skipReason(req, &pod)
+	if err != nil {
+		return s.mutateErr(req.UID, err, "Failed to get namespace labels")
+	}
+	if reason != "" {
+		return s.mutateSkip(req.UID, reason)
+	}
 
-	mutatedPod, err := inject.ViaWebhook(pod)
+	result, err := inject.ViaWebhookResult(pod)
 	if err != nil {
 		return s.mutateErr(req.UID, err, "Failed to inject MCA")
 	}
 
-	patches, err := s.generateJSONPatch(mutatedPod)
+	var warnings []string
+	for _, warning := range result.Warnings {
+		warnings = append(warnings, fmt.Sprintf("MCA: %s", warning))
+	}
+	if result.Decision == inject.DecisionSkipped {
+		log.Printf("MCA injection left pod %s/%s unchanged: %s", pod.Namespace, podName(&pod), result.Reason)
+		return s.mutateAllow(req.UID, warnings)
+	}
+
+	patches, err := s.generateJSONPatch(pod, result.Pod)
 	if err != nil {
 		return s.mutateErr(req.UID, err, "Failed to generate JSON patch")
 	}
 
-	log.Printf("Applied MCA injection to pod %s/%s", pod.Namespace, pod.Name)
+	log.Printf("Applied MCA injection to pod %s/%s", pod.Namespace, podName(&pod))
+	logPatch(pod.Namespace+"/"+podName(&pod), patches)
 
 	patchType := admissionv1.PatchTypeJSONPatch
 	return &admissionv1.AdmissionReview{
@@ -134,16 +330,95 @@ func (s *Server) mutate(admissionReview *admissionv1.AdmissionReview) *admission
 			Allowed:   true,
 			PatchType: &patchType,
 			Patch:     patches,
+			Warnings:  warnings,
 		},
 	}
 }
 
-func (s *Server) generateJSONPatch(mutatedPod corev1.Pod) ([]byte, error) {
-	return json.Marshal([]map[string]interface{}{
-		{
-			"op":    "replace",
-			"path":  "/spec",
-			"value": mutatedPod.Spec,
-		},
+// podName returns the pod's name for logging. Pods created from a template usually have only
+// generateName at admission time, so it is used with a trailing "*" when the name is empty.
+func podName(pod *corev1.Pod) string {
+	if pod.Name == "" && pod.GenerateName != "" {
+		return pod.GenerateName + "*"
+	}
+	return pod.Name
+}
+
+func (s *Server) generateJSONPatch(pod, mutatedPod corev1.Pod) ([]byte, error) {
+	return inject.JSONPatch(pod, mutatedPod)
+}
+
+// mutateEphemeralContainers handles an update of the ephemeralcontainers subresource under
+// conf.WebhookEphemeralContainers, redirecting the ephemeral containers of an injected pod to
+// the proxy. The patch only replaces the ephemeral containers, the one field the subresource
+// may change.
+func (s *Server) mutateEphemeralContainers(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionReview {
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return s.mutateErr(req.UID, err, "Failed to unmarshal pod")
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+	if !inject.Injected(pod) {
+		return s.mutateSkip(req.UID, fmt.Sprintf("pod %s/%s has no MCA proxy", pod.Namespace, podName(&pod)))
+	}
+
+	mutatedPod, err := inject.RedirectEphemeralContainers(pod)
+	if err != nil {
+		return s.mutateErr(req.UID, err, "Failed to redirect ephemeral containers")
+	}
+	if equality.Semantic.DeepEqual(pod.Spec.EphemeralContainers, mutatedPod.Spec.EphemeralContainers) {
+		return s.mutateAllow(req.UID, nil)
+	}
+
+	patches, err := json.Marshal([]map[string]interface{}{
+		{"op": "replace", "path": "/spec/ephemeralContainers", "value": mutatedPod.Spec.EphemeralContainers},
 	})
+	if err != nil {
+		return s.mutateErr(req.UID, err, "Failed to generate JSON patch")
+	}
+
+	log.Printf("Redirected ephemeral containers of pod %s/%s to MCA", pod.Namespace, podName(&pod))
+	logPatch(pod.Namespace+"/"+podName(&pod), patches)
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Response: &admissionv1.AdmissionResponse{
+			UID:       req.UID,
+			Allowed:   true,
+			PatchType: &patchType,
+			Patch:     patches,
+		},
+	}
+}
+
+// mutateUpdate handles a pod UPDATE under conf.WebhookUpdateOptOut. Kubernetes rejects pod
+// updates that remove containers or volumes, so an injected pod that opts out cannot be
+// ejected in place: the update is allowed unchanged with a warning that the proxy stays until
+// the pod is recreated, when the opt-out skips injection. Other updates are allowed silently.
+func (s *Server) mutateUpdate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionReview {
+	var pod, oldPod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return s.mutateErr(req.UID, err, "Failed to unmarshal pod")
+	}
+	if err := json.Unmarshal(req.OldObject.Raw, &oldPod); err != nil {
+		return s.mutateErr(req.UID, err, "Failed to unmarshal old pod")
+	}
+
+	var warnings []string
+	if optedOut(&pod) && !optedOut(&oldPod) && inject.Injected(pod) {
+		if pod.Namespace == "" {
+			pod.Namespace = req.Namespace
+		}
+		log.Printf("Pod %s/%s opted out of MCA after injection, its proxy stays until it is recreated", pod.Namespace, podName(&pod))
+		warnings = []string{fmt.Sprintf("MCA: pod opted out via %s annotation, but Kubernetes does not allow removing "+
+			"containers from an existing pod; the MCA proxy stays until the pod is recreated", inject.AnnotationInject)}
+	}
+
+	return s.mutateAllow(req.UID, warnings)
 }
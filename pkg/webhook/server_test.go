@@ -3,17 +3,30 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/marxus/k8s-mca/conf"
+	"github.com/marxus/k8s-mca/pkg/certs"
+	"github.com/marxus/k8s-mca/pkg/health"
+	"github.com/marxus/k8s-mca/pkg/inject"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -80,7 +93,9 @@ func TestServer_HandleMutate(t *testing.T) {
 						Kind:       "AdmissionReview",
 					},
 					Request: &admissionv1.AdmissionRequest{
-						UID: types.UID("test-uid"),
+						UID:       types.UID("test-uid"),
+						Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+						Operation: admissionv1.Create,
 						Object: runtime.RawExtension{
 							Raw: podJSON,
 						},
@@ -178,7 +193,9 @@ func TestServer_Mutate(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			admissionReview := &admissionv1.AdmissionReview{
 				Request: &admissionv1.AdmissionRequest{
-					UID: types.UID("test-uid"),
+					UID:       types.UID("test-uid"),
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Operation: admissionv1.Create,
 					Object: runtime.RawExtension{
 						Raw: tt.podRaw,
 					},
@@ -223,7 +240,7 @@ func TestServer_GenerateJSONPatch(t *testing.T) {
 	cert := tls.Certificate{}
 	server := NewServer(cert)
 
-	patch, err := server.generateJSONPatch(pod)
+	patch, err := server.generateJSONPatch(corev1.Pod{}, pod)
 	require.NoError(t, err)
 	assert.NotEmpty(t, patch)
 
@@ -236,3 +253,742 @@ func TestServer_GenerateJSONPatch(t *testing.T) {
 	assert.Equal(t, "/spec", patchOps[0]["path"])
 	assert.NotNil(t, patchOps[0]["value"])
 }
+
+func TestServer_MutateHandler_MountedOnCustomMux(t *testing.T) {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+	podJSON, err := json.Marshal(pod)
+	require.NoError(t, err)
+
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("test-uid"),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: podJSON},
+		},
+	})
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.Handle("/custom/mca-mutate", NewServer(tls.Certificate{}).MutateHandler())
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	res, err := http.Post(httpServer.URL+"/custom/mca-mutate", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var responseReview admissionv1.AdmissionReview
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&responseReview))
+	require.NotNil(t, responseReview.Response)
+	assert.True(t, responseReview.Response.Allowed)
+	assert.Equal(t, types.UID("test-uid"), responseReview.Response.UID)
+	assert.NotEmpty(t, responseReview.Response.Patch)
+}
+
+func TestServer_Routes_MutatePath(t *testing.T) {
+	originalPath := conf.WebhookMutatePath
+	conf.WebhookMutatePath = "/custom/mca-mutate"
+	defer func() { conf.WebhookMutatePath = originalPath }()
+
+	httpServer := httptest.NewServer(NewServer(tls.Certificate{}).routes())
+	defer httpServer.Close()
+
+	admissionReview := admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("test-uid"),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Deployment"},
+			Operation: admissionv1.Create,
+		},
+	}
+	body, err := json.Marshal(admissionReview)
+	require.NoError(t, err)
+
+	res, err := http.Post(httpServer.URL+"/custom/mca-mutate", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var response admissionv1.AdmissionReview
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+	assert.Equal(t, types.UID("test-uid"), response.Response.UID)
+
+	res, err = http.Post(httpServer.URL+"/mutate", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestServer_Mutate_SkipReasons(t *testing.T) {
+	podJSON := func(annotations map[string]string) []byte {
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "test-pod",
+				Annotations: annotations,
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+			},
+		}
+		raw, _ := json.Marshal(pod)
+		return raw
+	}
+
+	tests := []struct {
+		name       string
+		kind       string
+		operation  admissionv1.Operation
+		namespace  string
+		podRaw     []byte
+		wantReason string
+	}{
+		{
+			name:       "non-Pod kind",
+			kind:       "Deployment",
+			operation:  admissionv1.Create,
+			podRaw:     podJSON(nil),
+			wantReason: "kind Deployment is not a Pod",
+		},
+		{
+			name:       "non-CREATE operation",
+			kind:       "Pod",
+			operation:  admissionv1.Update,
+			podRaw:     podJSON(nil),
+			wantReason: "operation UPDATE is not CREATE",
+		},
+		{
+			name:       "opt-out annotation",
+			kind:       "Pod",
+			operation:  admissionv1.Create,
+			podRaw:     podJSON(map[string]string{inject.AnnotationInject: "false"}),
+			wantReason: "pod opted out via mca.marxus.io/inject annotation",
+		},
+		{
+			name:       "excluded namespace",
+			kind:       "Pod",
+			operation:  admissionv1.Create,
+			namespace:  "kube-system",
+			podRaw:     podJSON(nil),
+			wantReason: "namespace kube-system is excluded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalExcluded := conf.ExcludedNamespaces
+			conf.ExcludedNamespaces = []string{"kube-system"}
+			defer func() { conf.ExcludedNamespaces = originalExcluded }()
+
+			admissionReview := &admissionv1.AdmissionReview{
+				Request: &admissionv1.AdmissionRequest{
+					UID:       types.UID("test-uid"),
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: tt.kind},
+					Operation: tt.operation,
+					Namespace: tt.namespace,
+					Object:    runtime.RawExtension{Raw: tt.podRaw},
+				},
+			}
+
+			response := NewServer(tls.Certificate{}).mutate(admissionReview)
+
+			require.NotNil(t, response.Response)
+			assert.True(t, response.Response.Allowed)
+			assert.Nil(t, response.Response.PatchType)
+			assert.Empty(t, response.Response.Patch)
+			require.NotNil(t, response.Response.Result)
+			assert.Equal(t, metav1.StatusSuccess, response.Response.Result.Status)
+			assert.Equal(t, tt.wantReason, response.Response.Result.Message)
+			assert.Equal(t, []string{"MCA injection skipped: " + tt.wantReason}, response.Response.Warnings)
+		})
+	}
+}
+
+func TestServer_Mutate_NamespaceSelector(t *testing.T) {
+	namespaceLabels := map[string]map[string]string{
+		"team-a": {"mca": "enabled"},
+		"team-b": {"mca": "disabled"},
+	}
+	lookup := func(namespace string) (map[string]string, error) {
+		if l, ok := namespaceLabels[namespace]; ok {
+			return l, nil
+		}
+		return nil, errors.New("namespace not found")
+	}
+	selector, err := labels.Parse("mca!=disabled")
+	require.NoError(t, err)
+
+	server := NewServer(tls.Certificate{})
+	server.SetNamespaceSelector(selector, lookup)
+
+	podRaw, err := json.Marshal(corev1.Pod{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		namespace   string
+		wantAllowed bool
+		wantPatch   bool
+		wantMessage string
+	}{
+		{
+			name:        "matching namespace is injected",
+			namespace:   "team-a",
+			wantAllowed: true,
+			wantPatch:   true,
+		},
+		{
+			name:        "non-matching namespace is skipped",
+			namespace:   "team-b",
+			wantAllowed: true,
+			wantMessage: `namespace team-b does not match selector "mca!=disabled"`,
+		},
+		{
+			name:        "lookup failure denies",
+			namespace:   "missing",
+			wantMessage: "Failed to get namespace labels: namespace not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := server.mutate(&admissionv1.AdmissionReview{
+				Request: &admissionv1.AdmissionRequest{
+					UID:       types.UID("test-uid"),
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Operation: admissionv1.Create,
+					Namespace: tt.namespace,
+					Object:    runtime.RawExtension{Raw: podRaw},
+				},
+			})
+
+			require.NotNil(t, response.Response)
+			assert.Equal(t, tt.wantAllowed, response.Response.Allowed)
+			assert.Equal(t, tt.wantPatch, len(response.Response.Patch) > 0)
+			if tt.wantMessage != "" {
+				require.NotNil(t, response.Response.Result)
+				assert.Equal(t, tt.wantMessage, response.Response.Result.Message)
+			}
+		})
+	}
+}
+
+func TestSkipDecision(t *testing.T) {
+	selectorSkipReason := func(namespace string) (string, error) {
+		if namespace == "unlabeled" {
+			return "namespace unlabeled does not match selector", nil
+		}
+		return "", nil
+	}
+
+	tests := []struct {
+		name       string
+		annotation string
+		namespace  string
+		override   bool
+		wantReason string
+	}{
+		{name: "no signals injects", namespace: "team-a"},
+		{name: "opt-out wins over everything", annotation: "false", namespace: "team-a", override: true, wantReason: "pod opted out via mca.marxus.io/inject annotation"},
+		{name: "opt-out wins over exclude", annotation: "false", namespace: "kube-system", wantReason: "pod opted out via mca.marxus.io/inject annotation"},
+		{name: "exclude wins over opt-in", annotation: "true", namespace: "kube-system", override: true, wantReason: "namespace kube-system is excluded"},
+		{name: "opt-in overrides include", annotation: "true", namespace: "team-b", override: true},
+		{name: "opt-in overrides selector", annotation: "true", namespace: "unlabeled", override: true},
+		{name: "opt-in without override keeps include", annotation: "true", namespace: "team-b", wantReason: "namespace team-b is not included"},
+		{name: "include wins over selector", namespace: "team-b", wantReason: "namespace team-b is not included"},
+		{name: "selector applies last", namespace: "unlabeled", wantReason: "namespace unlabeled does not match selector"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalExcluded, originalIncluded, originalOverride := conf.ExcludedNamespaces, conf.IncludedNamespaces, conf.PodOptInOverridesNamespace
+			defer func() {
+				conf.ExcludedNamespaces, conf.IncludedNamespaces, conf.PodOptInOverridesNamespace = originalExcluded, originalIncluded, originalOverride
+			}()
+			conf.ExcludedNamespaces = []string{"kube-system"}
+			conf.IncludedNamespaces = []string{"team-a", "unlabeled", "kube-system"}
+			conf.PodOptInOverridesNamespace = tt.override
+
+			pod := &corev1.Pod{}
+			if tt.annotation != "" {
+				pod.Annotations = map[string]string{inject.AnnotationInject: tt.annotation}
+			}
+
+			reason, err := skipDecision(pod, tt.namespace, selectorSkipReason)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantReason, reason)
+		})
+	}
+}
+
+func TestServer_Healthz_Subsystems(t *testing.T) {
+	validCert, _, err := certs.GenerateCAAndTLSCert([]string{"localhost"}, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		cert          tls.Certificate
+		proxyImage    string
+		upstreamCheck health.Check
+		wantCode      int
+		wantReport    health.Report
+	}{
+		{
+			name:          "all subsystems healthy",
+			cert:          validCert,
+			proxyImage:    "mca:latest",
+			upstreamCheck: func() error { return nil },
+			wantCode:      http.StatusOK,
+			wantReport: health.Report{
+				Status: health.StatusOK,
+				Subsystems: map[string]health.SubsystemStatus{
+					"cert":     {Status: health.StatusOK},
+					"config":   {Status: health.StatusOK},
+					"upstream": {Status: health.StatusOK},
+				},
+			},
+		},
+		{
+			name:          "cert missing",
+			proxyImage:    "mca:latest",
+			upstreamCheck: func() error { return nil },
+			wantCode:      http.StatusServiceUnavailable,
+			wantReport: health.Report{
+				Status: health.StatusFailing,
+				Subsystems: map[string]health.SubsystemStatus{
+					"cert":     {Status: health.StatusFailing, Error: "no certificate loaded"},
+					"config":   {Status: health.StatusOK},
+					"upstream": {Status: health.StatusOK},
+				},
+			},
+		},
+		{
+			name:          "proxy image missing",
+			cert:          validCert,
+			upstreamCheck: func() error { return nil },
+			wantCode:      http.StatusServiceUnavailable,
+			wantReport: health.Report{
+				Status: health.StatusFailing,
+				Subsystems: map[string]health.SubsystemStatus{
+					"cert":     {Status: health.StatusOK},
+					"config":   {Status: health.StatusFailing, Error: "no proxy image configured"},
+					"upstream": {Status: health.StatusOK},
+				},
+			},
+		},
+		{
+			name:          "upstream unreachable",
+			cert:          validCert,
+			proxyImage:    "mca:latest",
+			upstreamCheck: func() error { return errors.New("connection refused") },
+			wantCode:      http.StatusServiceUnavailable,
+			wantReport: health.Report{
+				Status: health.StatusFailing,
+				Subsystems: map[string]health.SubsystemStatus{
+					"cert":     {Status: health.StatusOK},
+					"config":   {Status: health.StatusOK},
+					"upstream": {Status: health.StatusFailing, Error: "connection refused"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalImage := conf.ProxyImage
+			conf.ProxyImage = tt.proxyImage
+			defer func() { conf.ProxyImage = originalImage }()
+
+			server := NewServer(tt.cert)
+			server.SetUpstreamCheck(tt.upstreamCheck)
+
+			recorder := httptest.NewRecorder()
+			health.Handler(server.healthChecks).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			assert.Equal(t, tt.wantCode, recorder.Code)
+
+			var report health.Report
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+			assert.Equal(t, tt.wantReport, report)
+		})
+	}
+}
+
+func TestServer_HandleMutate_MaxInFlight(t *testing.T) {
+	originalMaxInFlight := conf.WebhookMaxInFlight
+	conf.WebhookMaxInFlight = 2
+	defer func() { conf.WebhookMaxInFlight = originalMaxInFlight }()
+
+	podJSON, err := json.Marshal(corev1.Pod{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+	})
+	require.NoError(t, err)
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("test-uid"),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: podJSON},
+		},
+	})
+	require.NoError(t, err)
+
+	server := NewServer(tls.Certificate{})
+
+	var (
+		wg        sync.WaitGroup
+		writers   []*io.PipeWriter
+		recorders = make([]*httptest.ResponseRecorder, conf.WebhookMaxInFlight)
+	)
+	for i := range conf.WebhookMaxInFlight {
+		reader, writer := io.Pipe()
+		writers = append(writers, writer)
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.handleMutate(recorders[i], httptest.NewRequest(http.MethodPost, "/mutate", reader))
+		}()
+	}
+	require.Eventually(t, func() bool { return len(server.inFlight) == conf.WebhookMaxInFlight }, 5*time.Second, 10*time.Millisecond)
+
+	shed := httptest.NewRecorder()
+	server.handleMutate(shed, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusTooManyRequests, shed.Code)
+	assert.Equal(t, "1", shed.Header().Get("Retry-After"))
+
+	for _, writer := range writers {
+		writer.Write(body)
+		writer.Close()
+	}
+	wg.Wait()
+	for _, r := range recorders {
+		assert.Equal(t, http.StatusOK, r.Code)
+	}
+
+	admitted := httptest.NewRecorder()
+	server.handleMutate(admitted, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusOK, admitted.Code)
+}
+
+func TestPodName(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  corev1.Pod
+		want string
+	}{
+		{
+			name: "uses name",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0"}},
+			want: "web-0",
+		},
+		{
+			name: "falls back to generateName",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "web-7d4b9c-"}},
+			want: "web-7d4b9c-*",
+		},
+		{
+			name: "prefers name over generateName",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-7d4b9c-x2k", GenerateName: "web-7d4b9c-"}},
+			want: "web-7d4b9c-x2k",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, podName(&tt.pod))
+		})
+	}
+}
+
+func TestServer_Mutate_LogsGenerateName(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	podJSON, err := json.Marshal(corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "web-7d4b9c-"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+	})
+	require.NoError(t, err)
+
+	response := NewServer(tls.Certificate{}).mutate(&admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("test-uid"),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Operation: admissionv1.Create,
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: podJSON},
+		},
+	})
+	require.True(t, response.Response.Allowed)
+
+	assert.Contains(t, logs.String(), "Applied MCA injection to pod default/web-7d4b9c-*")
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	originalAddress := conf.WebhookListenAddress
+	conf.WebhookListenAddress = "127.0.0.1:0"
+	defer func() { conf.WebhookListenAddress = originalAddress }()
+
+	cert, _, err := certs.GenerateCAAndTLSCert([]string{"localhost"}, nil)
+	require.NoError(t, err)
+	server := NewServer(cert)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- server.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, server.Shutdown(context.Background()))
+	select {
+	case err := <-errCh:
+		assert.ErrorIs(t, err, http.ErrServerClosed)
+	case <-time.After(time.Second):
+		t.Fatal("server did not stop after shutdown")
+	}
+}
+
+func TestServer_Mutate_EnvSizeWarning(t *testing.T) {
+	originalThreshold := conf.EnvSizeWarnBytes
+	conf.EnvSizeWarnBytes = 1010
+	defer func() { conf.EnvSizeWarnBytes = originalThreshold }()
+
+	podRaw, err := json.Marshal(corev1.Pod{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "app",
+			Image: "nginx",
+			Env:   []corev1.EnvVar{{Name: "BLOB", Value: strings.Repeat("x", 1000)}},
+		}}},
+	})
+	require.NoError(t, err)
+
+	response := NewServer(tls.Certificate{}).mutate(&admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("test-uid"),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Operation: admissionv1.Create,
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: podRaw},
+		},
+	})
+
+	require.NotNil(t, response.Response)
+	assert.True(t, response.Response.Allowed)
+	assert.NotEmpty(t, response.Response.Patch)
+	require.Len(t, response.Response.Warnings, 1)
+	assert.Contains(t, response.Response.Warnings[0], `MCA: container "app" env is`)
+}
+
+func TestServer_Mutate_UpdateOptOut(t *testing.T) {
+	injectedPod := func(annotations map[string]string) []byte {
+		raw, err := json.Marshal(corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: annotations},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "mca-proxy", Image: "mca:v1"}},
+				Containers:     []corev1.Container{{Name: "app", Image: "nginx"}},
+			},
+		})
+		require.NoError(t, err)
+		return raw
+	}
+	optOut := map[string]string{inject.AnnotationInject: "false"}
+
+	tests := []struct {
+		name        string
+		enabled     bool
+		oldPod      []byte
+		pod         []byte
+		wantWarning bool
+		wantReason  string
+	}{
+		{
+			name:        "warns when an injected pod opts out",
+			enabled:     true,
+			oldPod:      injectedPod(nil),
+			pod:         injectedPod(optOut),
+			wantWarning: true,
+		},
+		{
+			name:    "silent when already opted out",
+			enabled: true,
+			oldPod:  injectedPod(optOut),
+			pod:     injectedPod(optOut),
+		},
+		{
+			name:    "silent for other updates",
+			enabled: true,
+			oldPod:  injectedPod(nil),
+			pod:     injectedPod(map[string]string{"team": "a"}),
+		},
+		{
+			name:       "skipped when disabled",
+			oldPod:     injectedPod(nil),
+			pod:        injectedPod(optOut),
+			wantReason: "operation UPDATE is not CREATE",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalEnabled := conf.WebhookUpdateOptOut
+			conf.WebhookUpdateOptOut = tt.enabled
+			defer func() { conf.WebhookUpdateOptOut = originalEnabled }()
+
+			response := NewServer(tls.Certificate{}).mutate(&admissionv1.AdmissionReview{
+				Request: &admissionv1.AdmissionRequest{
+					UID:       types.UID("test-uid"),
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Operation: admissionv1.Update,
+					Namespace: "default",
+					Object:    runtime.RawExtension{Raw: tt.pod},
+					OldObject: runtime.RawExtension{Raw: tt.oldPod},
+				},
+			})
+
+			require.NotNil(t, response.Response)
+			assert.True(t, response.Response.Allowed)
+			assert.Empty(t, response.Response.Patch, "containers of an existing pod cannot be removed")
+			if tt.wantReason != "" {
+				require.NotNil(t, response.Response.Result)
+				assert.Equal(t, tt.wantReason, response.Response.Result.Message)
+				return
+			}
+			if tt.wantWarning {
+				require.Len(t, response.Response.Warnings, 1)
+				assert.Contains(t, response.Response.Warnings[0], "the MCA proxy stays until the pod is recreated")
+			} else {
+				assert.Empty(t, response.Response.Warnings)
+			}
+		})
+	}
+}
+
+func TestServer_Mutate_NoOpOmitsPatch(t *testing.T) {
+	injected, err := inject.ViaWebhook(corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+	})
+	require.NoError(t, err)
+	injectedRaw, err := json.Marshal(injected)
+	require.NoError(t, err)
+	optedOutRaw, err := json.Marshal(corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{inject.AnnotationInject: "false"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		podRaw []byte
+	}{
+		{name: "already injected pod", podRaw: injectedRaw},
+		{name: "skipped pod", podRaw: optedOutRaw},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := NewServer(tls.Certificate{}).mutate(&admissionv1.AdmissionReview{
+				Request: &admissionv1.AdmissionRequest{
+					UID:       types.UID("test-uid"),
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Operation: admissionv1.Create,
+					Namespace: "default",
+					Object:    runtime.RawExtension{Raw: tt.podRaw},
+				},
+			})
+
+			require.NotNil(t, response.Response)
+			assert.True(t, response.Response.Allowed)
+			assert.Nil(t, response.Response.PatchType)
+			assert.Nil(t, response.Response.Patch)
+
+			responseJSON, err := json.Marshal(response.Response)
+			require.NoError(t, err)
+			assert.NotContains(t, string(responseJSON), `"patch"`)
+			assert.NotContains(t, string(responseJSON), `"patchType"`)
+		})
+	}
+}
+
+func TestNewServer_TLSConfig(t *testing.T) {
+	originalTickets, originalRenegotiation := conf.TLSSessionTicketsDisabled, conf.TLSRenegotiation
+	conf.TLSSessionTicketsDisabled, conf.TLSRenegotiation = false, conf.TLSRenegotiationOnce
+	defer func() { conf.TLSSessionTicketsDisabled, conf.TLSRenegotiation = originalTickets, originalRenegotiation }()
+
+	config := NewServer(tls.Certificate{}).httpServer.TLSConfig
+
+	assert.False(t, config.SessionTicketsDisabled)
+	assert.Equal(t, tls.RenegotiateOnceAsClient, config.Renegotiation)
+}
+
+func TestServer_Mutate_EphemeralContainers(t *testing.T) {
+	injected, err := inject.ViaWebhook(corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+	})
+	require.NoError(t, err)
+	injected.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "busybox"},
+	}}
+	podJSON, err := json.Marshal(injected)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		enabled   bool
+		wantPatch bool
+	}{
+		{name: "redirects ephemeral containers when enabled", enabled: true, wantPatch: true},
+		{name: "skipped when disabled", enabled: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalEphemeral := conf.WebhookEphemeralContainers
+			conf.WebhookEphemeralContainers = tt.enabled
+			defer func() { conf.WebhookEphemeralContainers = originalEphemeral }()
+
+			response := NewServer(tls.Certificate{}).mutate(&admissionv1.AdmissionReview{
+				Request: &admissionv1.AdmissionRequest{
+					UID:         types.UID("test-uid"),
+					Kind:        metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					SubResource: "ephemeralcontainers",
+					Operation:   admissionv1.Update,
+					Namespace:   "default",
+					Object:      runtime.RawExtension{Raw: podJSON},
+				},
+			})
+			require.True(t, response.Response.Allowed)
+
+			if !tt.wantPatch {
+				assert.Nil(t, response.Response.Patch)
+				return
+			}
+			var patch []struct {
+				Op    string                      `json:"op"`
+				Path  string                      `json:"path"`
+				Value []corev1.EphemeralContainer `json:"value"`
+			}
+			require.NoError(t, json.Unmarshal(response.Response.Patch, &patch))
+			require.Len(t, patch, 1)
+			assert.Equal(t, "replace", patch[0].Op)
+			assert.Equal(t, "/spec/ephemeralContainers", patch[0].Path)
+			require.Len(t, patch[0].Value, 1)
+			assert.Contains(t, patch[0].Value[0].Env, corev1.EnvVar{Name: "KUBERNETES_SERVICE_HOST", Value: "127.0.0.1"})
+		})
+	}
+}